@@ -0,0 +1,110 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/Loopring/relay/cache"
+	"github.com/Loopring/relay/cmd/utils"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/extractor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/ordermanager"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func extractorCommands() cli.Command {
+	extractorCommand := cli.Command{
+		Name:     "extractor",
+		Usage:    "extractor ",
+		Category: "extractor commands",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:   "reindex",
+				Usage:  "roll back the fills, cancels, cutoffs and rings of blocks from..to and extract them again, a live node can keep running on the same database",
+				Action: reindexBlocks,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "config,c",
+						Usage: "config file",
+					},
+					cli.Int64Flag{
+						Name:  "from",
+						Usage: "the first block to reindex",
+					},
+					cli.Int64Flag{
+						Name:  "to",
+						Usage: "the last block to reindex, it shouldn't be after the checkpoint of live node",
+					},
+				},
+			},
+		},
+	}
+	return extractorCommand
+}
+
+func reindexBlocks(ctx *cli.Context) {
+	from, to := ctx.Int64("from"), ctx.Int64("to")
+	if from <= 0 || to < from {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("from should be positive and to shouldn't be less than from"))
+	}
+
+	globalConfig := utils.SetGlobalConfig(ctx)
+	logger := log.Initialize(globalConfig.Log)
+	defer func() {
+		if nil != logger {
+			logger.Sync()
+		}
+	}()
+
+	// the event bus isn't initialized, events are only handled in this process and never published to the live node,
+	// which reloads its order book by the mark set in redis after orders recomputed.
+	// the gas price window file belongs to the live node too
+	globalConfig.Accessor.GasPriceFile = ""
+	rdsService := dao.NewRdsService(globalConfig.Mysql)
+	cache.NewCache(globalConfig.Redis)
+	util.Initialize(globalConfig.Market, globalConfig.Common.ProtocolImpl.Address)
+	marketCapProvider := marketcap.NewMarketCapProvider(globalConfig.MarketCap)
+	if err := ethaccessor.Initialize(globalConfig.Accessor, globalConfig.Common, util.WethTokenAddress()); nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+
+	reindexer := ordermanager.NewReindexer(rdsService, marketCapProvider)
+	reindexer.Start()
+	defer reindexer.Stop()
+
+	extractorService := extractor.NewExtractorService(globalConfig.Extractor, rdsService)
+	err := extractorService.Reindex(big.NewInt(from), big.NewInt(to), func(from, to *big.Int, emit func()) error {
+		if err := reindexer.RollBack(from.Int64()-1, to.Int64()); nil != err {
+			return err
+		}
+		emit()
+		return reindexer.Recompute()
+	})
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	fmt.Fprintf(ctx.App.Writer, "reindexed block:%d->%d \n", from, to)
+}
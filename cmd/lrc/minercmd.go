@@ -18,14 +18,58 @@
 
 package main
 
-import "gopkg.in/urfave/cli.v1"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Loopring/relay/cmd/utils"
+	"github.com/Loopring/relay/miner"
+	"gopkg.in/urfave/cli.v1"
+)
 
 func minerCommands() cli.Command {
 	minerCommand := cli.Command{
 		Name:     "miner",
 		Usage:    "miner ",
 		Category: "miner commands",
-		Action:   nil,
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:   "dryrun-summary",
+				Usage:  "summarize the hypothetical profit of rings recorded in dry-run mode by market and by hour",
+				Action: summarizeDryRun,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "file,f",
+						Usage: "the dry-run file written by miner",
+						Value: miner.DefaultDryRunFile,
+					},
+					cli.Int64Flag{
+						Name:  "from",
+						Usage: "unix seconds, only rings recorded after it are summarized",
+					},
+					cli.Int64Flag{
+						Name:  "to",
+						Usage: "unix seconds, only rings recorded before it are summarized",
+					},
+				},
+			},
+		},
 	}
 	return minerCommand
 }
+
+func summarizeDryRun(ctx *cli.Context) {
+	file, err := os.Open(ctx.String("file"))
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	defer file.Close()
+
+	summary, err := miner.SummarizeDryRun(file, ctx.Int64("from"), ctx.Int64("to"))
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	bs, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Fprintf(ctx.App.Writer, "%s \n", string(bs))
+}
@@ -70,6 +70,14 @@ func MinerFlags() []cli.Flag {
 			Name:  "ifRegistryRingHash,reg",
 			Usage: "the submitter will registry ringhash first if it set ture",
 		},
+		cli.BoolFlag{
+			Name:  "miner-dryrun",
+			Usage: "the rings will be written to the dry-run file instead of being submitted",
+		},
+		cli.StringFlag{
+			Name:  "miner-dryrun-file",
+			Usage: "the NDJSON file that dry-run rings will be written to",
+		},
 	}
 }
 
@@ -86,6 +94,12 @@ func mergeMinerConfig(ctx *cli.Context, minerOpts *config.MinerOptions) {
 	if ctx.IsSet("ifRegistryRingHash") {
 		minerOpts.IfRegistryRingHash = ctx.Bool("ifRegistryRingHash")
 	}
+	if ctx.IsSet("miner-dryrun") {
+		minerOpts.DryRun = ctx.Bool("miner-dryrun")
+	}
+	if ctx.IsSet("miner-dryrun-file") {
+		minerOpts.DryRunFile = ctx.String("miner-dryrun-file")
+	}
 }
 
 func mergeModeConfig(ctx *cli.Context, globalConfig *config.GlobalConfig) {
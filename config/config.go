@@ -84,14 +84,33 @@ type GlobalConfig struct {
 	Market         MarketOptions
 	MarketCap      MarketCapOptions
 	UserManager    UserManagerOptions
+	EventBus       EventBusOptions
 }
 
 type JsonrpcOptions struct {
-	Port int
+	Host               string //bind address, empty means all interfaces
+	Port               int
+	WsPort             int      //0 means websocket is disabled
+	CorsDomains        []string //allowed origins, cors is disabled when it's empty
+	TlsCertFile        string
+	TlsKeyFile         string
+	MaxRequestBodySize int64                       //bytes, it can't be larger than the limit of rpc package(128KB)
+	ReadTimeout        int64                       //seconds
+	WriteTimeout       int64                       //seconds
+	ShutdownTimeout    int64                       //seconds to wait for the in-flight requests when stopping
+	RateLimits         map[string]RateLimitOptions //keyed by method name, such as loopring_submitOrder
 }
 
-func (c *GlobalConfig) defaultConfig() {
+type RateLimitOptions struct {
+	IpRate     float64 //requests per second of each remote ip, 0 means no limit. each order of loopring_submitOrders is a request
+	IpBurst    int
+	OwnerRate  float64 //requests per second of each order owner, 0 means no limit
+	OwnerBurst int
+}
 
+func (c *GlobalConfig) defaultConfig() {
+	c.Jsonrpc.Port = 8083
+	c.Jsonrpc.ShutdownTimeout = 5
 }
 
 type OrderManagerOptions struct {
@@ -116,7 +135,12 @@ func (opts IpfsOptions) Url() string {
 }
 
 type AccessorOptions struct {
-	RawUrls []string `required:"true"`
+	RawUrls                    []string `required:"true"`
+	GasPriceBlocks             int      //gas prices of txs in the recent blocks are evaluated, default 20
+	SafeGasPricePercentile     int      //default 30
+	StandardGasPricePercentile int      //default 60, it's the gas price estimated for txs
+	FastGasPricePercentile     int      //default 90
+	GasPriceFile               string   //the gas prices of the recent blocks are saved in it to be used after restart, empty means not saved
 }
 
 type ExtractorOptions struct {
@@ -126,6 +150,13 @@ type ExtractorOptions struct {
 	ConfirmBlockNumber      uint64
 	StartBlockNumber        *big.Int
 	EndBlockNumber          *big.Int
+	Mode                    string //"block"(default) gets all transactions and receipts, "logs" gets logs of known contracts by eth_getLogs
+	LogsRange               uint64 //blocks of each eth_getLogs query in logs mode, default 100
+	Workers                 int    //blocks(ranges in logs mode) fetched and decoded concurrently, they are still applied in order, default 1
+	MetricsInterval         int64  //seconds, the throughput is logged every interval, 0 means not logged
+	MaxRetries              int    //times to retry the rpc and db errors before node halts
+	RetryInterval           int64  //milliseconds before the first retry, doubled after each retry, default 1000
+	MaxReorgDepth           int64  //node halts if more blocks than it are rolled back by chain fork, 0 means no limit
 }
 
 type KeyStoreOptions struct {
@@ -158,17 +189,25 @@ type TimingMatcher struct {
 	Duration             int64
 	DelayedNumber        int64
 	MaxCacheRoundsLength int
+	SelectTimeBudget     int64 //milliseconds, rings of a round are chosen to get max total received in it, 0 means greedy
+}
+
+// EventMatcher matches orders as soon as they are received, instead of waiting for the timing rounds
+type EventMatcher struct {
+	BookOrdersCount      int   //orders of each token pair loaded into the book
+	RefreshDuration      int64 //blocks, the book is reloaded from db to remove orders finished or cancelled
+	MaxCacheRoundsLength int   //blocks, amounts of rings matched in these blocks are reduced before matching
 }
 
 type PercentMinerAddress struct {
 	Address    string
 	FeePercent float64 //the gasprice will be calculated by (FeePercent/100)*(legalFee/eth-price)/gaslimit
-	StartFee   float64 //If received reaches StartReceived, it will use feepercent to ensure eth confirm this tx quickly.
+	StartFee   float64 //If legal fee of ring reaches StartFee, it will use feepercent to ensure eth confirm this tx quickly.
 }
 
 type NormalMinerAddress struct {
 	Address         string
-	MaxPendingTtl   int   //if a tx is still pending after MaxPendingTtl blocks, the nonce used by it will be used again.
+	MaxPendingTtl   int   //if a tx is still pending after MaxPendingTtl blocks, the nonce used by it will be used again by a tx with higher gasPrice.
 	MaxPendingCount int64 //this addr will be used to send tx again until the count of pending txs belows MaxPendingCount.
 	GasPriceLimit   int64 //the max gas price
 }
@@ -181,8 +220,14 @@ type MinerOptions struct {
 	IfRegistryRingHash    bool
 	NormalMiners          []NormalMinerAddress  //
 	PercentMiners         []PercentMinerAddress //
+	Matcher               string                //"timing"(default) or "event"
 	TimingMatcher         *TimingMatcher
+	EventMatcher          *EventMatcher
 	RateRatioCVSThreshold int64
+	RatePrecision         uint   //mantissa bits of big.Float to compute the rate of ring, default 256
+	DryRun                bool   //rings are written to DryRunFile and never be submitted
+	DryRunFile            string //NDJSON file of dry-run rings
+	RingExpireTime        int64  //seconds, rings matched but not sent before restart are submitted again if not expired
 	MinGasLimit           int64
 	MaxGasLimit           int64
 }
@@ -198,15 +243,26 @@ type MarketCapOptions struct {
 }
 
 type GatewayFiltersOptions struct {
+	Enabled    []string //names of the filters in the order they run, base,sign,token and cutoff are used if it's empty
 	BaseFilter struct {
 		MinLrcFee int64
 		MaxPrice  int64
 	}
+	MinValueFilter struct {
+		MinValue float64 //legal currency value of amountS
+	}
+	BalanceFilter struct {
+		RequireFullAmount bool //available balance must cover amountS, otherwise it only needs to be positive
+	}
+	MaxOpenOrdersFilter struct {
+		MaxCount int //must be positive, remove the filter from the list to not limit open orders
+	}
 }
 
 type GateWayOptions struct {
 	IsBroadcast      bool
 	MaxBroadcastTime int
+	MaxBatchSize     int //max count of orders in loopring_submitOrders
 }
 
 type MysqlOptions struct {
@@ -228,6 +284,15 @@ type RedisOptions struct {
 	MaxActive   int
 }
 
+type EventBusOptions struct {
+	Backend           string   //"memory" or "file", empty means events of all topics are only emitted in process
+	Dir               string   //directory of the append-only logs when backend is file
+	DurableTopics     []string //topics published through the bus
+	RedeliverInterval int64    //milliseconds to wait before redelivering an event whose handler returned error
+	MaxRedelivery     int      //the event is parked in the dead letter topic after MaxRedelivery failed deliveries, default 10, negative means never
+	CompactThreshold  int64    //the file log is compacted once this many events are handled by all consumers, default 10000
+}
+
 type UserManagerOptions struct {
 	WhiteListOpen            bool
 	WhiteListCacheExpireTime int64
@@ -56,6 +56,19 @@ func (s *RdsServiceImpl) FindCancelEvent(orderhash, txhash common.Hash) (*Cancel
 	return &model, err
 }
 
+func (s *RdsServiceImpl) GetCancelsByOrderHash(orderhash common.Hash) ([]CancelEvent, error) {
+	var cancels []CancelEvent
+	err := s.db.Where("order_hash = ?", orderhash.Hex()).Order("block_number asc").Find(&cancels).Error
+	return cancels, err
+}
+
+// GetCancelsWithBlockNumberRange returns the cancel events of blocks in (from, to], which RollBackCancel deletes
+func (s *RdsServiceImpl) GetCancelsWithBlockNumberRange(from, to int64) ([]CancelEvent, error) {
+	var cancels []CancelEvent
+	err := s.db.Where("block_number > ? and block_number <= ?", from, to).Find(&cancels).Error
+	return cancels, err
+}
+
 func (s *RdsServiceImpl) RollBackCancel(from, to int64) error {
 	return s.db.Where("block_number > ? and block_number <= ?", from, to).Delete(&CancelEvent{}).Error
 }
@@ -0,0 +1,88 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package dao
+
+import (
+	"time"
+
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// there is only one checkpoint of extractor
+const extractorCheckpointId = 1
+
+// ExtractorCheckpoint is the last block fully processed by extractor
+type ExtractorCheckpoint struct {
+	ID          int    `gorm:"column:id;primary_key"`
+	BlockNumber int64  `gorm:"column:block_number;type:bigint"`
+	BlockHash   string `gorm:"column:block_hash;type:varchar(82)"`
+	UpdateTime  int64  `gorm:"column:update_time;type:bigint"`
+}
+
+// ConvertUp returns the block of checkpoint, parent hash is unknown
+func (c *ExtractorCheckpoint) ConvertUp(dst *types.Block) error {
+	var block Block
+	block.BlockNumber = c.BlockNumber
+	block.BlockHash = c.BlockHash
+	return block.ConvertUp(dst)
+}
+
+func (s *RdsServiceImpl) GetExtractorCheckpoint() (*ExtractorCheckpoint, error) {
+	var checkpoint ExtractorCheckpoint
+	err := s.db.Where("id = ?", extractorCheckpointId).First(&checkpoint).Error
+	return &checkpoint, err
+}
+
+// SaveExtractorCheckpoint moves the checkpoint to block, it's used to rewind the checkpoint when chain forked
+func (s *RdsServiceImpl) SaveExtractorCheckpoint(blockNumber int64, blockHash common.Hash) error {
+	checkpoint := &ExtractorCheckpoint{ID: extractorCheckpointId, BlockNumber: blockNumber, BlockHash: blockHash.Hex(), UpdateTime: time.Now().Unix()}
+	return s.db.Save(checkpoint).Error
+}
+
+// CommitExtractedBlock saves the block and its event logs, and moves the checkpoint to it in a transaction
+func (s *RdsServiceImpl) CommitExtractedBlock(block *Block, eventLogs []*EventLog) error {
+	tx := s.db.Begin()
+
+	// the block is saved already if it's processed again after restart
+	var count int
+	if err := tx.Model(&Block{}).Where("block_hash = ?", block.BlockHash).Count(&count).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count == 0 {
+		if err := tx.Create(block).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, eventLog := range eventLogs {
+		if err := tx.Create(eventLog).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	checkpoint := &ExtractorCheckpoint{ID: extractorCheckpointId, BlockNumber: block.BlockNumber, BlockHash: block.BlockHash, UpdateTime: time.Now().Unix()}
+	if err := tx.Save(checkpoint).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
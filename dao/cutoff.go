@@ -73,6 +73,13 @@ func (s *RdsServiceImpl) DelCutoffEvent(protocol, owner common.Address) error {
 	return s.db.Delete(CutOffEvent{}, "contract_address = ? and owner = ?", protocol.Hex(), owner.Hex()).Error
 }
 
+// GetCutoffsWithBlockNumberRange returns the cutoff events of blocks in (from, to], which RollBackCutoff deletes
+func (s *RdsServiceImpl) GetCutoffsWithBlockNumberRange(from, to int64) ([]CutOffEvent, error) {
+	var cutoffs []CutOffEvent
+	err := s.db.Where("block_number > ? and block_number <= ?", from, to).Find(&cutoffs).Error
+	return cutoffs, err
+}
+
 func (s *RdsServiceImpl) RollBackCutoff(from, to int64) error {
 	return s.db.Where("block_number > ? and block_number <= ?", from, to).Delete(&CutOffEvent{}).Error
 }
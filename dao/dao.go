@@ -71,9 +71,12 @@ func (s *RdsServiceImpl) Prepare() {
 	tables = append(tables, &Trend{})
 	tables = append(tables, &WhiteList{})
 	tables = append(tables, &RingSubmitInfo{})
+	tables = append(tables, &RingSubmitTransition{})
 	tables = append(tables, &Token{})
 	tables = append(tables, &EventLog{})
 	tables = append(tables, &FilledOrder{})
+	tables = append(tables, &MinerTransaction{})
+	tables = append(tables, &ExtractorCheckpoint{})
 
 	for _, t := range tables {
 		if ok := s.db.HasTable(t); !ok {
@@ -136,6 +136,19 @@ func buildTimeQueryString(start, end int64) string {
 	return rst
 }
 
+func (s *RdsServiceImpl) GetFillsByOrderHash(orderhash common.Hash) ([]FillEvent, error) {
+	var fills []FillEvent
+	err := s.db.Where("order_hash = ?", orderhash.Hex()).Order("block_number asc").Find(&fills).Error
+	return fills, err
+}
+
+// GetFillsWithBlockNumberRange returns the fills of blocks in (from, to], which RollBackFill deletes
+func (s *RdsServiceImpl) GetFillsWithBlockNumberRange(from, to int64) ([]FillEvent, error) {
+	var fills []FillEvent
+	err := s.db.Where("block_number > ? and block_number <= ?", from, to).Find(&fills).Error
+	return fills, err
+}
+
 func (s *RdsServiceImpl) RollBackFill(from, to int64) error {
 	return s.db.Where("block_number > ? and block_number <= ?", from, to).Delete(&FillEvent{}).Error
 }
@@ -42,20 +42,29 @@ type RdsService interface {
 
 	// order table
 	GetOrderByHash(orderhash common.Hash) (*Order, error)
+	LockOrder(orderhash common.Hash, fn func(rds RdsService, order *Order) error) error
+	AddOrders(orders []*Order) error
 	GetOrdersByHash(orderhashs []string) (map[string]Order, error)
 	MarkMinerOrders(filterOrderhashs []string, blockNumber int64) error
 	GetOrdersForMiner(protocol, tokenS, tokenB string, length int, filterStatus []types.OrderStatus, startBlockNumber, endBlockNumber int64) ([]*Order, error)
 	GetOrdersWithBlockNumberRange(from, to int64) ([]Order, error)
+	GetOrdersByOwnerAndStatus(owner common.Address, statusSet []types.OrderStatus) ([]Order, error)
 	GetCutoffOrders(cutoffTime int64) ([]Order, error)
 	SetCutOff(owner common.Address, cutoffTime *big.Int) error
 	CheckOrderCutoff(orderhash string, cutoff int64) bool
 	GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]Order, error)
+	GetOpenOrders(fromId, limit int) ([]Order, error)
+	GetOrdersToExpire(blockTime int64, limit int) ([]Order, error)
+	ExpireOrders(orderhashs []string, blockNumber int64) error
+	GetExpiredOrdersWithBlockNumberRange(from, to int64) ([]Order, error)
 	OrderPageQuery(query map[string]interface{}, pageIndex, pageSize int) (PageResult, error)
 	UpdateBroadcastTimeByHash(hash string, bt int) error
+	UpdateOrderStatusByHash(hash common.Hash, status types.OrderStatus, fromStatusSet []types.OrderStatus) (int64, error)
 	UpdateOrderWhileFill(hash common.Hash, status types.OrderStatus, dealtAmountS, dealtAmountB, splitAmountS, splitAmountB, blockNumber *big.Int) error
 	UpdateOrderWhileCancel(hash common.Hash, status types.OrderStatus, cancelledAmountS, cancelledAmountB, blockNumber *big.Int) error
 	GetFrozenAmount(owner common.Address, token common.Address, statusSet []types.OrderStatus) ([]Order, error)
 	GetFrozenLrcFee(owner common.Address, statusSet []types.OrderStatus) ([]Order, error)
+	GetOrderCountByOwner(owner common.Address, statusSet []types.OrderStatus) (int, error)
 
 	// block table
 	FindBlockByHash(blockhash common.Hash) (*Block, error)
@@ -64,21 +73,31 @@ type RdsService interface {
 	FindForkBlock() (*Block, error)
 	SetForkBlock(blockhash common.Hash) error
 
+	// extractor checkpoint table
+	GetExtractorCheckpoint() (*ExtractorCheckpoint, error)
+	SaveExtractorCheckpoint(blockNumber int64, blockHash common.Hash) error
+	CommitExtractedBlock(block *Block, eventLogs []*EventLog) error
+
 	// fill event table
 	FindFillEventByRinghashAndOrderhash(ringhash, orderhash common.Hash) (*FillEvent, error)
 	QueryRecentFills(mkt, owner string, start int64, end int64) (fills []FillEvent, err error)
 	RollBackFill(from, to int64) error
+	GetFillsWithBlockNumberRange(from, to int64) ([]FillEvent, error)
+	GetFillsByOrderHash(orderhash common.Hash) ([]FillEvent, error)
 	FillsPageQuery(query map[string]interface{}, pageIndex, pageSize int) (res PageResult, err error)
 
 	// cancel event table
 	FindCancelEvent(orderhash, txhash common.Hash) (*CancelEvent, error)
 	RollBackCancel(from, to int64) error
+	GetCancelsWithBlockNumberRange(from, to int64) ([]CancelEvent, error)
+	GetCancelsByOrderHash(orderhash common.Hash) ([]CancelEvent, error)
 
 	// cutoff event table
 	GetCutoffEvent(protocol, owner common.Address) (*CutOffEvent, error)
 	DelCutoffEvent(protocol, owner common.Address) error
 	UpdateCutoffByProtocolAndOwner(protocol, owner common.Address, txhash common.Hash, blockNumber, cutoff, createTime *big.Int) error
 	RollBackCutoff(from, to int64) error
+	GetCutoffsWithBlockNumberRange(from, to int64) ([]CutOffEvent, error)
 
 	// trend table
 	TrendPageQuery(query Trend, pageIndex, pageSize int) (pageResult PageResult, err error)
@@ -96,8 +115,19 @@ type RdsService interface {
 	UpdateRingSubmitInfoFailed(ringhashs []common.Hash, err string) error
 	GetRingForSubmitByHash(ringhash common.Hash) (RingSubmitInfo, error)
 	GetRingHashesByTxHash(txHash common.Hash) ([]common.Hash, error)
+	UpdateRingSubmitInfoStatus(ringhashs []common.Hash, status types.RingSubmitStatus, txHash string, errMsg string) error
+	GetRingSubmitTransitions(ringhash common.Hash) ([]RingSubmitTransition, error)
+	GetUnfinishedRingSubmitInfos() ([]RingSubmitInfo, error)
+	GetFilledOrdersByRinghash(ringhash common.Hash) ([]FilledOrder, error)
 	RingMinedPageQuery(query map[string]interface{}, pageIndex, pageSize int) (res PageResult, err error)
 
+	// miner transaction
+	SaveMinerTransaction(tx *types.MinerTransaction) error
+	GetMinerTransactions(miner common.Address, fromNonce uint64) ([]MinerTransaction, error)
+	UpdateMinerTransactionsMined(miner common.Address, latestNonce uint64) error
+	UpdateMinerTransactionsPending(miner common.Address, latestNonce uint64) error
+	GetMinerTransactionsByHashes(txHashes []string) ([]MinerTransaction, error)
+
 	// token
 	FindUnDeniedTokens() ([]Token, error)
 	FindDeniedTokens() ([]Token, error)
@@ -0,0 +1,137 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package dao
+
+import (
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type MinerTransaction struct {
+	ID          int    `gorm:"column:id;primary_key;"`
+	Miner       string `gorm:"column:miner;type:varchar(42)"`
+	Nonce       int64  `gorm:"column:nonce;type:bigint"`
+	TxHash      string `gorm:"column:tx_hash;type:varchar(82);index"`
+	To          string `gorm:"column:to_address;type:varchar(42)"`
+	Gas         string `gorm:"column:gas;type:varchar(50)"`
+	GasPrice    string `gorm:"column:gas_price;type:varchar(50)"`
+	Value       string `gorm:"column:value;type:varchar(50)"`
+	Data        string `gorm:"column:data;type:text"`
+	TxType      uint8  `gorm:"column:tx_type"`
+	RingHashes  string `gorm:"column:ringhashes;type:text"`
+	SubmitBlock int64  `gorm:"column:submit_block;type:bigint"`
+	Status      uint8  `gorm:"column:status"`
+	CreateTime  int64  `gorm:"column:create_time;type:bigint"`
+	UpdateTime  int64  `gorm:"column:update_time;type:bigint"`
+}
+
+func (tx *MinerTransaction) ConvertDown(src *types.MinerTransaction) error {
+	tx.Miner = src.Miner.Hex()
+	tx.Nonce = int64(src.Nonce)
+	tx.TxHash = src.TxHash.Hex()
+	tx.To = src.To.Hex()
+	tx.Gas = getBigIntString(src.Gas)
+	tx.GasPrice = getBigIntString(src.GasPrice)
+	tx.Value = getBigIntString(src.Value)
+	tx.Data = common.ToHex(src.Data)
+	tx.TxType = uint8(src.TxType)
+	hashes := []string{}
+	for _, h := range src.RingHashes {
+		hashes = append(hashes, h.Hex())
+	}
+	tx.RingHashes = strings.Join(hashes, ",")
+	if nil != src.SubmitBlock {
+		tx.SubmitBlock = src.SubmitBlock.Int64()
+	}
+	tx.Status = uint8(src.Status)
+	return nil
+}
+
+func (tx *MinerTransaction) ConvertUp(dst *types.MinerTransaction) error {
+	dst.Miner = common.HexToAddress(tx.Miner)
+	dst.Nonce = uint64(tx.Nonce)
+	dst.TxHash = common.HexToHash(tx.TxHash)
+	dst.To = common.HexToAddress(tx.To)
+	dst.Gas, _ = new(big.Int).SetString(tx.Gas, 0)
+	dst.GasPrice, _ = new(big.Int).SetString(tx.GasPrice, 0)
+	dst.Value, _ = new(big.Int).SetString(tx.Value, 0)
+	dst.Data = common.FromHex(tx.Data)
+	dst.TxType = types.MinerTxType(tx.TxType)
+	dst.RingHashes = []common.Hash{}
+	for _, h := range strings.Split(tx.RingHashes, ",") {
+		if h != "" {
+			dst.RingHashes = append(dst.RingHashes, common.HexToHash(h))
+		}
+	}
+	dst.SubmitBlock = big.NewInt(tx.SubmitBlock)
+	dst.Status = types.MinerTxStatus(tx.Status)
+	return nil
+}
+
+// SaveMinerTransaction keeps only one tx for each nonce of miner, the replaced tx is overwritten
+func (s *RdsServiceImpl) SaveMinerTransaction(src *types.MinerTransaction) error {
+	model := &MinerTransaction{}
+	model.ConvertDown(src)
+	now := time.Now().Unix()
+	model.CreateTime = now
+	model.UpdateTime = now
+
+	tx := s.db.Begin()
+	if err := tx.Where("miner = ? and nonce = ?", model.Miner, model.Nonce).Delete(&MinerTransaction{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(model).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (s *RdsServiceImpl) GetMinerTransactions(miner common.Address, fromNonce uint64) ([]MinerTransaction, error) {
+	var list []MinerTransaction
+	err := s.db.Where("miner = ? and nonce >= ?", miner.Hex(), int64(fromNonce)).Order("nonce asc").Find(&list).Error
+	return list, err
+}
+
+// UpdateMinerTransactionsMined sets the pending txs whose nonce is less than the tx count of latest block to mined
+func (s *RdsServiceImpl) UpdateMinerTransactionsMined(miner common.Address, latestNonce uint64) error {
+	item := map[string]interface{}{"status": uint8(types.MINER_TX_MINED), "update_time": time.Now().Unix()}
+	return s.db.Model(&MinerTransaction{}).Where("miner = ? and nonce < ? and status = ?", miner.Hex(), int64(latestNonce), uint8(types.MINER_TX_PENDING)).Update(item).Error
+}
+
+// UpdateMinerTransactionsPending sets the mined txs rolled back by chain fork to pending again
+func (s *RdsServiceImpl) UpdateMinerTransactionsPending(miner common.Address, latestNonce uint64) error {
+	item := map[string]interface{}{"status": uint8(types.MINER_TX_PENDING), "update_time": time.Now().Unix()}
+	return s.db.Model(&MinerTransaction{}).Where("miner = ? and nonce >= ? and status = ?", miner.Hex(), int64(latestNonce), uint8(types.MINER_TX_MINED)).Update(item).Error
+}
+
+// GetMinerTransactionsByHashes returns the txs of miners in txHashes, the hashes are formatted as common.Hash.Hex
+func (s *RdsServiceImpl) GetMinerTransactionsByHashes(txHashes []string) ([]MinerTransaction, error) {
+	var list []MinerTransaction
+	if len(txHashes) == 0 {
+		return list, nil
+	}
+	err := s.db.Where("tx_hash in (?)", txHashes).Find(&list).Error
+	return list, err
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
 	"math/big"
 	"strconv"
 	"strings"
@@ -52,6 +53,7 @@ type Order struct {
 	S                     string  `gorm:"column:s;type:varchar(66)"`
 	Price                 float64 `gorm:"column:price;type:decimal(28,16);"`
 	UpdatedBlock          int64   `gorm:"column:updated_block;type:bigint"`
+	ExpiredBlock          int64   `gorm:"column:expired_block;type:bigint"`
 	DealtAmountS          string  `gorm:"column:dealt_amount_s;type:varchar(30)"`
 	DealtAmountB          string  `gorm:"column:dealt_amount_b;type:varchar(30)"`
 	CancelledAmountS      string  `gorm:"column:cancelled_amount_s;type:varchar(30)"`
@@ -150,6 +152,41 @@ func (s *RdsServiceImpl) GetOrderByHash(orderhash common.Hash) (*Order, error) {
 	return order, err
 }
 
+// LockOrder runs fn in a transaction with the order row locked by select for update, rds passed to fn works in the
+// transaction and order is nil if it doesn't exist. the updates of order amounts are serialized by it, so reindex
+// and the live node don't overwrite each other's amounts
+func (s *RdsServiceImpl) LockOrder(orderhash common.Hash, fn func(rds RdsService, order *Order) error) error {
+	tx := s.db.Begin()
+	var (
+		model Order
+		order *Order
+	)
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("order_hash = ?", orderhash.Hex()).First(&model).Error
+	if nil == err {
+		order = &model
+	} else if err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(&RdsServiceImpl{options: s.options, db: tx}, order); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// AddOrders inserts all orders in one transaction, none of them is inserted if any fails
+func (s *RdsServiceImpl) AddOrders(orders []*Order) error {
+	tx := s.db.Begin()
+	for _, order := range orders {
+		if err := tx.Create(order).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
 func (s *RdsServiceImpl) MarkMinerOrders(filterOrderhashs []string, blockNumber int64) error {
 	if len(filterOrderhashs) == 0 {
 		return nil
@@ -246,6 +283,12 @@ func (s *RdsServiceImpl) CheckOrderCutoff(orderhash string, cutoff int64) bool {
 	return true
 }
 
+func (s *RdsServiceImpl) GetOrdersByOwnerAndStatus(owner common.Address, statusSet []types.OrderStatus) ([]Order, error) {
+	var list []Order
+	err := s.db.Where("owner = ? and status in (?)", owner.Hex(), statusSet).Find(&list).Error
+	return list, err
+}
+
 func (s *RdsServiceImpl) SetCutOff(owner common.Address, cutoffTime *big.Int) error {
 	filterStatus := []types.OrderStatus{types.ORDER_PARTIAL, types.ORDER_NEW}
 	err := s.db.Model(&Order{}).Where("valid_time < ? and owner = ? and status in (?)", cutoffTime.Int64(), owner.Hex(), filterStatus).Update("status", types.ORDER_CUTOFF).Error
@@ -272,6 +315,69 @@ func (s *RdsServiceImpl) GetOrderBook(protocol, tokenS, tokenB common.Address, l
 	return list, err
 }
 
+// GetOpenOrders returns the unexpired new and partial orders whose id is greater than fromId, ordered by id
+func (s *RdsServiceImpl) GetOpenOrders(fromId, limit int) ([]Order, error) {
+	var (
+		list []Order
+		err  error
+	)
+
+	filterStatus := []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL}
+	nowtime := time.Now().Unix()
+	err = s.db.Where("id > ?", fromId).
+		Where("status in (?)", filterStatus).
+		Where("valid_time + ttl > ? ", nowtime).
+		Order("id asc").
+		Limit(limit).
+		Find(&list).Error
+
+	return list, err
+}
+
+// GetOrdersToExpire returns the new and partial orders whose valid_time + ttl is not later than blockTime
+func (s *RdsServiceImpl) GetOrdersToExpire(blockTime int64, limit int) ([]Order, error) {
+	var (
+		list []Order
+		err  error
+	)
+
+	filterStatus := []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL}
+	err = s.db.Where("status in (?)", filterStatus).
+		Where("valid_time + ttl <= ?", blockTime).
+		Order("id asc").
+		Limit(limit).
+		Find(&list).Error
+
+	return list, err
+}
+
+// ExpireOrders sets status of the open orders to expire, blockNumber is saved as expired_block so that it can be
+// rolled back, updated_block is kept for the fills and cancels
+func (s *RdsServiceImpl) ExpireOrders(orderhashs []string, blockNumber int64) error {
+	filterStatus := []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL}
+	items := map[string]interface{}{
+		"status":        uint8(types.ORDER_EXPIRE),
+		"expired_block": blockNumber,
+	}
+	return s.db.Model(&Order{}).
+		Where("order_hash in (?)", orderhashs).
+		Where("status in (?)", filterStatus).
+		Update(items).Error
+}
+
+func (s *RdsServiceImpl) GetExpiredOrdersWithBlockNumberRange(from, to int64) ([]Order, error) {
+	var (
+		list []Order
+		err  error
+	)
+
+	err = s.db.Where("expired_block > ? and expired_block <= ?", from, to).
+		Where("status = ?", uint8(types.ORDER_EXPIRE)).
+		Find(&list).Error
+
+	return list, err
+}
+
 func (s *RdsServiceImpl) OrderPageQuery(query map[string]interface{}, pageIndex, pageSize int) (PageResult, error) {
 	var (
 		orders     []Order
@@ -310,6 +416,15 @@ func (s *RdsServiceImpl) UpdateBroadcastTimeByHash(hash string, bt int) error {
 	return s.db.Model(&Order{}).Where("order_hash = ?", hash).Update("broadcast_time", bt).Error
 }
 
+// UpdateOrderStatusByHash only updates the order whose status is in fromStatusSet, and returns the count of updated rows
+func (s *RdsServiceImpl) UpdateOrderStatusByHash(hash common.Hash, status types.OrderStatus, fromStatusSet []types.OrderStatus) (int64, error) {
+	db := s.db.Model(&Order{}).
+		Where("order_hash = ?", hash.Hex()).
+		Where("status in "+buildStatusInSet(fromStatusSet)).
+		Update("status", uint8(status))
+	return db.RowsAffected, db.Error
+}
+
 func (s *RdsServiceImpl) UpdateOrderWhileFill(hash common.Hash, status types.OrderStatus, dealtAmountS, dealtAmountB, splitAmountS, splitAmountB, blockNumber *big.Int) error {
 	items := map[string]interface{}{
 		"status":         uint8(status),
@@ -361,6 +476,20 @@ func (s *RdsServiceImpl) GetFrozenLrcFee(owner common.Address, statusSet []types
 	return list, err
 }
 
+func (s *RdsServiceImpl) GetOrderCountByOwner(owner common.Address, statusSet []types.OrderStatus) (int, error) {
+	var (
+		count int
+		err   error
+	)
+
+	now := time.Now().Unix()
+	err = s.db.Model(&Order{}).
+		Where("owner = ? and status in "+buildStatusInSet(statusSet), owner.Hex()).
+		Where("valid_time + ttl > ? ", now).
+		Count(&count).Error
+	return count, err
+}
+
 func buildStatusInSet(statusSet []types.OrderStatus) string {
 	if len(statusSet) == 0 {
 		return ""
@@ -22,6 +22,7 @@ import (
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
+	"time"
 )
 
 type Ring struct {
@@ -129,6 +130,20 @@ type RingSubmitInfo struct {
 
 	Miner string `gorm:"column:miner;type:varchar(42)"`
 	Err   string `gorm:"column:err;type:text"`
+
+	Status     uint8 `gorm:"column:status"`
+	CreateTime int64 `gorm:"column:create_time;type:bigint"`
+	UpdateTime int64 `gorm:"column:update_time;type:bigint"`
+}
+
+// RingSubmitTransition records each change of the status of ring submit info
+type RingSubmitTransition struct {
+	ID         int    `gorm:"column:id;primary_key;"`
+	RingHash   string `gorm:"column:ringhash;type:varchar(82)"`
+	Status     uint8  `gorm:"column:status"`
+	TxHash     string `gorm:"column:tx_hash;type:varchar(82)"`
+	Err        string `gorm:"column:err;type:text"`
+	CreateTime int64  `gorm:"column:create_time;type:bigint"`
 }
 
 func getBigIntString(v *big.Int) string {
@@ -139,6 +154,13 @@ func getBigIntString(v *big.Int) string {
 	}
 }
 
+// GetFilledOrdersByRinghash returns the orders of ring saved when it was matched, in the order of ring
+func (s *RdsServiceImpl) GetFilledOrdersByRinghash(ringhash common.Hash) ([]FilledOrder, error) {
+	var list []FilledOrder
+	err := s.db.Where("ringhash = ?", ringhash.Hex()).Order("id asc").Find(&list).Error
+	return list, err
+}
+
 func (info *RingSubmitInfo) ConvertDown(typesInfo *types.RingSubmitInfo) error {
 	info.RingHash = typesInfo.Ringhash.Hex()
 	info.ProtocolAddress = typesInfo.ProtocolAddress.Hex()
@@ -152,6 +174,9 @@ func (info *RingSubmitInfo) ConvertDown(typesInfo *types.RingSubmitInfo) error {
 	info.RegistryUsedGas = getBigIntString(typesInfo.RegistryUsedGas)
 	info.RegistryGasPrice = getBigIntString(typesInfo.RegistryGasPrice)
 	info.Miner = typesInfo.Miner.Hex()
+	info.Status = uint8(typesInfo.Status)
+	info.CreateTime = typesInfo.CreateTime
+	info.Err = typesInfo.Err
 	return nil
 }
 
@@ -176,6 +201,9 @@ func (info *RingSubmitInfo) ConvertUp(typesInfo *types.RingSubmitInfo) error {
 	typesInfo.SubmitTxHash = common.HexToHash(info.ProtocolTxHash)
 	typesInfo.RegistryTxHash = common.HexToHash(info.RegistryTxHash)
 	typesInfo.Miner = common.HexToAddress(info.Miner)
+	typesInfo.Status = types.RingSubmitStatus(info.Status)
+	typesInfo.CreateTime = info.CreateTime
+	typesInfo.Err = info.Err
 	return nil
 }
 
@@ -230,3 +258,56 @@ func (s *RdsServiceImpl) UpdateRingSubmitInfoSubmitUsedGas(txHash string, usedGa
 	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("protocol_tx_hash = ?", txHash)
 	return dbForUpdate.Update("protocol_used_gas", getBigIntString(usedGas)).Error
 }
+
+// UpdateRingSubmitInfoStatus changes the status of unfinished rings and records the transition
+func (s *RdsServiceImpl) UpdateRingSubmitInfoStatus(ringhashs []common.Hash, status types.RingSubmitStatus, txHash string, errMsg string) error {
+	hashes := []string{}
+	for _, h := range ringhashs {
+		hashes = append(hashes, h.Hex())
+	}
+	finished := []uint8{uint8(types.RING_SUBMIT_MINED), uint8(types.RING_SUBMIT_FAILED), uint8(types.RING_SUBMIT_EXPIRED)}
+
+	var updatingHashes []string
+	if err := s.db.Model(&RingSubmitInfo{}).Where("ringhash in (?) and status not in (?)", hashes, finished).Pluck("ringhash", &updatingHashes).Error; err != nil {
+		return err
+	}
+	if len(updatingHashes) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	tx := s.db.Begin()
+	item := map[string]interface{}{"status": uint8(status), "update_time": now}
+	if err := tx.Model(&RingSubmitInfo{}).Where("ringhash in (?)", updatingHashes).Update(item).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, h := range updatingHashes {
+		transition := &RingSubmitTransition{RingHash: h, Status: uint8(status), TxHash: txHash, Err: errMsg, CreateTime: now}
+		if err := tx.Create(transition).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (s *RdsServiceImpl) GetRingSubmitTransitions(ringhash common.Hash) ([]RingSubmitTransition, error) {
+	var list []RingSubmitTransition
+	err := s.db.Where("ringhash = ?", ringhash.Hex()).Order("id asc").Find(&list).Error
+	return list, err
+}
+
+// GetUnfinishedRingSubmitInfos returns the rings whose lifecycle should be resumed after restart
+func (s *RdsServiceImpl) GetUnfinishedRingSubmitInfos() ([]RingSubmitInfo, error) {
+	var list []RingSubmitInfo
+	unfinished := []uint8{
+		uint8(types.RING_SUBMIT_MATCHED),
+		uint8(types.RING_SUBMIT_REGISTRY_SENT),
+		uint8(types.RING_SUBMIT_REGISTRY_MINED),
+		uint8(types.RING_SUBMIT_SENT),
+		uint8(types.RING_SUBMIT_REPLACED),
+	}
+	err := s.db.Where("status in (?)", unfinished).Order("id asc").Find(&list).Error
+	return list, err
+}
@@ -86,7 +86,17 @@ func GetTransactionByHash(result types.CheckNull, txHash string, blockParameter
 }
 
 func EstimateGasPrice() *big.Int {
-	return accessor.gasPriceEvaluator.gasPrice
+	return accessor.gasPriceEvaluator.standardGasPrice()
+}
+
+// EstimateGasPriceLevels returns the safe,standard and fast gas prices of the recent blocks, nil if it isn't evaluated yet
+func EstimateGasPriceLevels() *GasPriceLevels {
+	return accessor.gasPriceEvaluator.Levels()
+}
+
+// IgnoreGasPriceSenders excludes txs of the addresses when evaluating gas price
+func IgnoreGasPriceSenders(addresses ...common.Address) {
+	accessor.gasPriceEvaluator.IgnoreSenders(addresses...)
 }
 
 func GetBlockTransactionCountByHash(result interface{}, blockHash string, blockParameter string) error {
@@ -116,6 +126,10 @@ func SignAndSendTransaction(sender accounts.Account, to common.Address, gas, gas
 	return accessor.ContractSendTransactionByData("latest", sender, to, gas, gasPrice, value, callData)
 }
 
+func SignAndSendTransactionWithNonce(sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte, nonce uint64) (string, error) {
+	return accessor.ContractSendTransactionWithNonce(sender, to, gas, gasPrice, value, callData, nonce)
+}
+
 func ContractSendTransactionMethod(routeParam string, a *abi.ABI, contractAddress common.Address) func(sender accounts.Account, methodName string, gas, gasPrice, value *big.Int, args ...interface{}) (string, error) {
 	return accessor.ContractSendTransactionMethod(routeParam, a, contractAddress)
 }
@@ -163,6 +177,34 @@ func BatchTransactionRecipients(reqs []*BatchTransactionRecipientReq, blockNumbe
 	return accessor.BatchTransactionRecipients(blockNumber, 5, reqs)
 }
 
+// GetBlocks returns the blocks from fromBlock to toBlock in a batch, transactions are hashes
+func GetBlocks(fromBlock, toBlock *big.Int) ([]*BlockWithTxHash, error) {
+	numbers := []*big.Int{}
+	for number := new(big.Int).Set(fromBlock); number.Cmp(toBlock) <= 0; number.Add(number, big.NewInt(1)) {
+		numbers = append(numbers, new(big.Int).Set(number))
+	}
+	return accessor.BatchBlocks(toBlock.String(), 2, numbers)
+}
+
+// GetLogs returns the logs emitted by addresses from fromBlock to toBlock
+func GetLogs(result *[]Log, fromBlock, toBlock *big.Int, addresses []common.Address) error {
+	query := FilterQuery{}
+	query.FromBlock = fmt.Sprintf("%#x", fromBlock)
+	query.ToBlock = fmt.Sprintf("%#x", toBlock)
+	query.Address = addresses
+	query.Topics = [][]common.Hash{}
+	return accessor.RetryCall(toBlock.String(), 2, result, "eth_getLogs", query)
+}
+
+// GetFullBlock returns the block with its transactions and receipts
+func GetFullBlock(blockNumber *big.Int) (*BlockWithTxAndReceipt, error) {
+	block, err := accessor.getFullBlock(blockNumber, true)
+	if nil != err {
+		return nil, err
+	}
+	return block.(*BlockWithTxAndReceipt), nil
+}
+
 func NewBlockIterator(startNumber, endNumber *big.Int, withTxData bool, confirms uint64) *BlockIterator {
 	return accessor.BlockIterator(startNumber, endNumber, withTxData, confirms)
 }
@@ -277,7 +319,7 @@ func Initialize(accessorOptions config.AccessorOptions, commonOptions config.Com
 	}
 	accessor.MutilClient.startSyncStatus()
 
-	accessor.gasPriceEvaluator = &GasPriceEvaluator{}
+	accessor.gasPriceEvaluator = NewGasPriceEvaluator(accessorOptions)
 	accessor.gasPriceEvaluator.start()
 	return nil
 }
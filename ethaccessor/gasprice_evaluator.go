@@ -19,35 +19,125 @@
 package ethaccessor
 
 import (
-	"github.com/Loopring/relay/types"
+	"encoding/json"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	defaultGasPriceBlocks             = 20
+	defaultSafeGasPricePercentile     = 30
+	defaultStandardGasPricePercentile = 60
+	defaultFastGasPricePercentile     = 90
 )
 
+// GasPriceLevels are the percentiles of gas prices of txs in the recent blocks,
+// a tx with higher level is expected to be confirmed faster
+type GasPriceLevels struct {
+	Safe        *big.Int
+	Standard    *big.Int
+	Fast        *big.Int
+	BlockNumber *big.Int //the latest block in the window
+}
+
+// BlockGasPrices are the gas prices of txs in a block, the zero prices and the txs sent by relay are excluded
+type BlockGasPrices struct {
+	BlockNumber types.Big   `json:"blockNumber"`
+	Prices      []types.Big `json:"prices"`
+}
+
+// GasPriceEvaluator keeps the gas prices of the last GasPriceBlocks blocks, and computes
+// the safe,standard and fast levels by the percentiles of them
 type GasPriceEvaluator struct {
-	Blocks []*BlockWithTxAndReceipt
+	Blocks []*BlockGasPrices
+
+	windowSize  int
+	percentiles [3]int
+	file        string
+
+	ignoredSenders map[common.Address]bool
+	levels         *GasPriceLevels
+	gasPrice       *big.Int //standard level
+	mtx            sync.RWMutex
+	stopChan       chan bool
+}
 
-	gasPrice *big.Int
-	stopChan chan bool
+func NewGasPriceEvaluator(options config.AccessorOptions) *GasPriceEvaluator {
+	e := &GasPriceEvaluator{}
+	e.windowSize = options.GasPriceBlocks
+	if e.windowSize <= 0 {
+		e.windowSize = defaultGasPriceBlocks
+	}
+	e.percentiles = [3]int{defaultSafeGasPricePercentile, defaultStandardGasPricePercentile, defaultFastGasPricePercentile}
+	for idx, percentile := range []int{options.SafeGasPricePercentile, options.StandardGasPricePercentile, options.FastGasPricePercentile} {
+		if percentile > 0 && percentile <= 100 {
+			e.percentiles[idx] = percentile
+		}
+	}
+	e.file = options.GasPriceFile
+	e.ignoredSenders = make(map[common.Address]bool)
+	e.stopChan = make(chan bool, 1)
+	return e
 }
 
 func (e *GasPriceEvaluator) GasPrice(gasPriceLimit *big.Int) *big.Int {
-	if nil != e.gasPrice {
-		if nil != gasPriceLimit && gasPriceLimit.Cmp(e.gasPrice) < 0 {
+	gasPrice := e.standardGasPrice()
+	if nil != gasPrice {
+		if nil != gasPriceLimit && gasPriceLimit.Cmp(gasPrice) < 0 {
 			return gasPriceLimit
 		} else {
-			return e.gasPrice
+			return gasPrice
 		}
 	} else {
 		return gasPriceLimit
 	}
 }
 
+// Levels returns nil before any block is evaluated
+func (e *GasPriceEvaluator) Levels() *GasPriceLevels {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+	if nil == e.levels {
+		return nil
+	}
+	return &GasPriceLevels{
+		Safe:        new(big.Int).Set(e.levels.Safe),
+		Standard:    new(big.Int).Set(e.levels.Standard),
+		Fast:        new(big.Int).Set(e.levels.Fast),
+		BlockNumber: new(big.Int).Set(e.levels.BlockNumber),
+	}
+}
+
+// IgnoreSenders excludes txs sent by addresses, such as the miners of relay, their prices follow the evaluator
+func (e *GasPriceEvaluator) IgnoreSenders(addresses ...common.Address) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for _, address := range addresses {
+		e.ignoredSenders[address] = true
+	}
+}
+
+func (e *GasPriceEvaluator) standardGasPrice() *big.Int {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+	return e.gasPrice
+}
+
 func (e *GasPriceEvaluator) start() {
 	var blockNumber types.Big
 	if err := BlockNumber(&blockNumber); nil == err {
+		startNumber := e.loadWindow(blockNumber.BigInt())
 		go func() {
-			iterator := NewBlockIterator(blockNumber.BigInt(), nil, true, uint64(0))
+			iterator := NewBlockIterator(startNumber, nil, true, uint64(0))
 			for {
 				select {
 				case <-e.stopChan:
@@ -56,17 +146,8 @@ func (e *GasPriceEvaluator) start() {
 					blockInterface, err := iterator.Next()
 					if nil == err {
 						blockWithTxAndReceipt := blockInterface.(*BlockWithTxAndReceipt)
-						e.Blocks = append(e.Blocks, blockWithTxAndReceipt)
-						if len(e.Blocks) > 5 {
-							e.Blocks = e.Blocks[1:]
-						}
-						var prices gasPrices = []*big.Int{}
-						for _, block := range e.Blocks {
-							for _, tx := range block.Transactions {
-								prices = append(prices, tx.GasPrice.BigInt())
-							}
-						}
-						e.gasPrice = prices.bestGasPrice()
+						e.addBlock(blockWithTxAndReceipt)
+						e.saveWindow()
 					}
 				}
 			}
@@ -79,6 +160,117 @@ func (e *GasPriceEvaluator) stop() {
 	e.stopChan <- true
 }
 
+func (e *GasPriceEvaluator) addBlock(block *BlockWithTxAndReceipt) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	blockPrices := &BlockGasPrices{BlockNumber: new(types.Big).SetInt(block.Number.BigInt()), Prices: []types.Big{}}
+	for _, tx := range block.Transactions {
+		if tx.GasPrice.BigInt().Sign() <= 0 || e.ignoredSenders[common.HexToAddress(tx.From)] {
+			continue
+		}
+		blockPrices.Prices = append(blockPrices.Prices, new(types.Big).SetInt(tx.GasPrice.BigInt()))
+	}
+	e.Blocks = append(e.Blocks, blockPrices)
+	if len(e.Blocks) > e.windowSize {
+		e.Blocks = e.Blocks[len(e.Blocks)-e.windowSize:]
+	}
+	e.evaluate()
+}
+
+func (e *GasPriceEvaluator) evaluate() {
+	var prices gasPrices = []*big.Int{}
+	for _, block := range e.Blocks {
+		for idx := range block.Prices {
+			prices = append(prices, block.Prices[idx].BigInt())
+		}
+	}
+	// 窗口内没有可用的交易时保留上次的结果
+	if len(prices) == 0 {
+		return
+	}
+	sort.Sort(prices)
+	e.levels = &GasPriceLevels{
+		Safe:        prices.percentile(e.percentiles[0]),
+		Standard:    prices.percentile(e.percentiles[1]),
+		Fast:        prices.percentile(e.percentiles[2]),
+		BlockNumber: e.Blocks[len(e.Blocks)-1].BlockNumber.BigInt(),
+	}
+	e.gasPrice = e.levels.Standard
+}
+
+// loadWindow reads the window saved before restart, and returns the block to continue from.
+// blocks out of the window are dropped, the evaluator starts from the current block if nothing is usable
+func (e *GasPriceEvaluator) loadWindow(currentNumber *big.Int) *big.Int {
+	startNumber := new(big.Int).Set(currentNumber)
+	if "" == e.file {
+		return startNumber
+	}
+	data, err := ioutil.ReadFile(e.file)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			log.Errorf("gas price evaluator,read window file:%s err:%s", e.file, err.Error())
+		}
+		return startNumber
+	}
+	blocks := []*BlockGasPrices{}
+	if err := json.Unmarshal(data, &blocks); nil != err {
+		log.Errorf("gas price evaluator,unmarshal window file:%s err:%s", e.file, err.Error())
+		return startNumber
+	}
+
+	// 只保留当前窗口内的区块
+	oldest := new(big.Int).Sub(currentNumber, big.NewInt(int64(e.windowSize-1)))
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for _, block := range blocks {
+		if nil == block || block.BlockNumber.BigInt().Cmp(oldest) < 0 || block.BlockNumber.BigInt().Cmp(currentNumber) > 0 {
+			continue
+		}
+		e.Blocks = append(e.Blocks, block)
+	}
+	if len(e.Blocks) > e.windowSize {
+		e.Blocks = e.Blocks[len(e.Blocks)-e.windowSize:]
+	}
+	if len(e.Blocks) == 0 {
+		return startNumber
+	}
+	e.evaluate()
+	return new(big.Int).Add(e.Blocks[len(e.Blocks)-1].BlockNumber.BigInt(), big.NewInt(1))
+}
+
+// saveWindow writes the window to a temp file and renames it, the file is never half written
+func (e *GasPriceEvaluator) saveWindow() {
+	if "" == e.file {
+		return
+	}
+	e.mtx.RLock()
+	data, err := json.Marshal(e.Blocks)
+	e.mtx.RUnlock()
+	if nil != err {
+		log.Errorf("gas price evaluator,marshal window err:%s", err.Error())
+		return
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(e.file), filepath.Base(e.file)+".tmp")
+	if nil != err {
+		log.Errorf("gas price evaluator,create temp file err:%s", err.Error())
+		return
+	}
+	if _, err = tmpFile.Write(data); nil == err {
+		err = tmpFile.Close()
+	} else {
+		tmpFile.Close()
+	}
+	if nil == err {
+		err = os.Rename(tmpFile.Name(), e.file)
+	}
+	if nil != err {
+		os.Remove(tmpFile.Name())
+		log.Errorf("gas price evaluator,save window file:%s err:%s", e.file, err.Error())
+	}
+}
+
 type gasPrices []*big.Int
 
 func (prices gasPrices) Len() int {
@@ -90,19 +282,29 @@ func (prices gasPrices) Swap(i, j int) {
 }
 
 func (prices gasPrices) Less(i, j int) bool {
-	return prices[i].Cmp(prices[j]) > 0
+	return prices[i].Cmp(prices[j]) < 0
 }
 
-func (prices gasPrices) bestGasPrice() *big.Int {
-	sort.Sort(prices)
-	startIdx := len(prices) / 3
-	endIdx := startIdx * 2
-
-	averagePrice := big.NewInt(0)
-	for _, price := range prices[startIdx:endIdx] {
-		averagePrice.Add(averagePrice, price)
+// percentile returns the lowest price that is not less than percent of the sorted prices
+func (prices gasPrices) percentile(percent int) *big.Int {
+	idx := (len(prices)*percent+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	} else if idx >= len(prices) {
+		idx = len(prices) - 1
 	}
-	averagePrice.Div(averagePrice, big.NewInt(int64(endIdx-startIdx+1)))
+	return new(big.Int).Set(prices[idx])
+}
 
-	return averagePrice
+// GasPricePercentile returns the percentile of prices as the evaluator does, nil if prices is empty
+func GasPricePercentile(prices []*big.Int, percent int) *big.Int {
+	if len(prices) == 0 {
+		return nil
+	}
+	sorted := make(gasPrices, 0, len(prices))
+	for _, price := range prices {
+		sorted = append(sorted, price)
+	}
+	sort.Sort(sorted)
+	return sorted.percentile(percent)
 }
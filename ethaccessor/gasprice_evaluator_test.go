@@ -0,0 +1,49 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ethaccessor_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/Loopring/relay/ethaccessor"
+)
+
+func TestGasPricePercentile(t *testing.T) {
+	prices := []*big.Int{}
+	for i := 10; i >= 1; i-- {
+		prices = append(prices, big.NewInt(int64(i)))
+	}
+
+	for _, c := range []struct {
+		percent  int
+		expected int64
+	}{{30, 3}, {60, 6}, {90, 9}, {100, 10}, {1, 1}, {0, 1}, {35, 4}} {
+		if price := ethaccessor.GasPricePercentile(prices, c.percent); price.Int64() != c.expected {
+			t.Fatalf("%d percentile should be %d, but got %s", c.percent, c.expected, price.String())
+		}
+	}
+	// prices aren't sorted in place
+	if prices[0].Int64() != 10 {
+		t.Fatalf("prices shouldn't be changed")
+	}
+	if price := ethaccessor.GasPricePercentile([]*big.Int{}, 50); nil != price {
+		t.Fatalf("percentile of empty prices should be nil")
+	}
+}
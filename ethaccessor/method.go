@@ -33,6 +33,7 @@ import (
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
 	"math/big"
+	"sync"
 	"time"
 )
 
@@ -129,6 +130,44 @@ func (accessor *ethNodeAccessor) BatchErc20BalanceAndAllowance(routeParam string
 	return nil
 }
 
+// BatchBlocks returns the blocks with transaction hashes of numbers
+func (accessor *ethNodeAccessor) BatchBlocks(routeParam string, retry int, numbers []*big.Int) ([]*BlockWithTxHash, error) {
+	if len(numbers) < 1 || retry < 1 {
+		return nil, fmt.Errorf("ethaccessor:batchBlocks retry or numbers invalid")
+	}
+
+	blocks := make([]*BlockWithTxHash, len(numbers))
+	reqElems := make([]rpc.BatchElem, len(numbers))
+	for idx, number := range numbers {
+		blocks[idx] = &BlockWithTxHash{}
+		reqElems[idx] = rpc.BatchElem{
+			Method: "eth_getBlockByNumber",
+			Args:   []interface{}{fmt.Sprintf("%#x", number), false},
+			Result: blocks[idx],
+		}
+	}
+
+	var err error
+	for i := 0; i < retry; i++ {
+		if _, err = accessor.MutilClient.BatchCall(routeParam, reqElems); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, v := range reqElems {
+		if v.Error != nil {
+			return nil, v.Error
+		}
+		if blocks[idx].IsNull() {
+			return nil, fmt.Errorf("ethaccessor:block %s not found", numbers[idx].String())
+		}
+	}
+	return blocks, nil
+}
+
 func (accessor *ethNodeAccessor) BatchTransactions(routeParam string, retry int, reqs []*BatchTransactionReq) error {
 	if len(reqs) < 1 || retry < 1 {
 		return fmt.Errorf("ethaccessor:batchTransactions retry or reqs invalid")
@@ -225,12 +264,12 @@ func (accessor *ethNodeAccessor) BatchTransactionRecipients(routeParam string, r
 
 func (accessor *ethNodeAccessor) EstimateGas(routeParam string, callData []byte, to common.Address) (gas, gasPrice *big.Int, err error) {
 	var gasBig, gasPriceBig types.Big
-	if nil == accessor.gasPriceEvaluator.gasPrice {
+	if evaluated := accessor.gasPriceEvaluator.standardGasPrice(); nil == evaluated {
 		if err = accessor.RetryCall(routeParam, 2, &gasPriceBig, "eth_gasPrice"); nil != err {
 			return
 		}
 	} else {
-		gasPriceBig = new(types.Big).SetInt(accessor.gasPriceEvaluator.gasPrice)
+		gasPriceBig = new(types.Big).SetInt(evaluated)
 	}
 
 	callArg := &CallArg{}
@@ -277,6 +316,16 @@ func (ethAccessor *ethNodeAccessor) SignAndSendTransaction(result interface{}, s
 }
 
 func (accessor *ethNodeAccessor) ContractSendTransactionByData(routeParam string, sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte) (string, error) {
+	var nonce types.Big
+	if err := accessor.RetryCall(routeParam, 2, &nonce, "eth_getTransactionCount", sender.Address.Hex(), "pending"); nil != err {
+		return "", err
+	}
+	return accessor.ContractSendTransactionWithNonce(sender, to, gas, gasPrice, value, callData, nonce.Uint64())
+}
+
+// ContractSendTransactionWithNonce signs and sends the transaction with the nonce assigned by caller,
+// a pending transaction can be replaced by sending another one with the same nonce and higher gasPrice
+func (accessor *ethNodeAccessor) ContractSendTransactionWithNonce(sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte, nonce uint64) (string, error) {
 	if nil == gasPrice || gasPrice.Cmp(big.NewInt(0)) <= 0 {
 		return "", errors.New("gasPrice must be setted.")
 	}
@@ -284,16 +333,12 @@ func (accessor *ethNodeAccessor) ContractSendTransactionByData(routeParam string
 		return "", errors.New("gas must be setted.")
 	}
 	var txHash string
-	var nonce types.Big
-	if err := accessor.RetryCall(routeParam, 2, &nonce, "eth_getTransactionCount", sender.Address.Hex(), "pending"); nil != err {
-		return "", err
-	}
 	if value == nil {
 		value = big.NewInt(0)
 	}
 	// todo: modify gas
 	gas.SetString("1000000", 0)
-	transaction := ethTypes.NewTransaction(nonce.Uint64(),
+	transaction := ethTypes.NewTransaction(nonce,
 		common.HexToAddress(to.Hex()),
 		value,
 		gas,
@@ -415,11 +460,26 @@ func (accessor *ethNodeAccessor) getFullBlock(blockNumber *big.Int, withTxObject
 					rcReqs[idx] = &rcreq
 				}
 
-				if err := BatchTransactions(txReqs, blockWithTxAndReceipt.Number.BigInt().String()); err != nil {
-					return nil, err
+				// transactions and receipts are fetched concurrently
+				var (
+					wg           sync.WaitGroup
+					txErr, rcErr error
+				)
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					txErr = BatchTransactions(txReqs, blockWithTxAndReceipt.Number.BigInt().String())
+				}()
+				go func() {
+					defer wg.Done()
+					rcErr = BatchTransactionRecipients(rcReqs, blockWithTxAndReceipt.Number.BigInt().String())
+				}()
+				wg.Wait()
+				if txErr != nil {
+					return nil, txErr
 				}
-				if err := BatchTransactionRecipients(rcReqs, blockWithTxAndReceipt.Number.BigInt().String()); err != nil {
-					return nil, err
+				if rcErr != nil {
+					return nil, rcErr
 				}
 
 				for idx, _ := range txReqs {
@@ -0,0 +1,162 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ethaccessor
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// selector of Error(string), solidity encodes the reason of require/revert with it
+var revertReasonSelector = []byte{0x08, 0xc3, 0x79, 0xa0}
+
+var revertDataPattern = regexp.MustCompile(`0x[0-9a-fA-F]{8,}`)
+
+// RevertError means the transaction will be reverted, Reason is decoded from the revert data if there is
+type RevertError struct {
+	Reason string
+}
+
+func (e *RevertError) Error() string {
+	if e.Reason == "" {
+		return "transaction will be reverted"
+	}
+	return "transaction will be reverted:" + e.Reason
+}
+
+// SimulateTransaction executes the transaction with eth_call at blockNumber without broadcasting it,
+// *RevertError is returned if it will be reverted, other errors mean that it can't be simulated.
+// old nodes return 0x without error when the transaction throws, eth_estimateGas is used to tell it then
+func SimulateTransaction(sender, to common.Address, gas, gasPrice, value *big.Int, callData []byte, blockNumber string) error {
+	callArg := &CallArg{}
+	callArg.From = sender
+	callArg.To = to
+	callArg.Data = common.ToHex(callData)
+	if nil != gas {
+		callArg.Gas = new(types.Big).SetInt(gas)
+	}
+	if nil != gasPrice {
+		callArg.GasPrice = new(types.Big).SetInt(gasPrice)
+	}
+	if nil != value {
+		callArg.Value = new(types.Big).SetInt(value)
+	}
+
+	// routed as latest, the node that transactions are sent to is also used to simulate them
+	var result string
+	if _, err := accessor.Call("latest", &result, "eth_call", callArg, blockNumber); nil != err {
+		if revertErr := revertErrorOf(err); nil != revertErr {
+			return revertErr
+		}
+		return err
+	}
+
+	// some nodes return the revert data as result
+	if data, err := hexutil.Decode(result); nil == err && bytes.HasPrefix(data, revertReasonSelector) {
+		reason, _ := DecodeRevertReason(data)
+		return &RevertError{Reason: reason}
+	}
+
+	// submitRing returns nothing, 0x is the same whether it throws or not
+	if result == "" || result == "0x" {
+		var estimated types.Big
+		_, err := accessor.Call("latest", &estimated, "eth_estimateGas", callArg)
+		return estimatedRevertError(gas, estimated.BigInt(), err)
+	}
+	return nil
+}
+
+// estimatedRevertError judges whether the transaction throws by the result of eth_estimateGas, which fails with
+// "always failing transaction", or returns the gas limit as all gas is used by the throw of old evm
+func estimatedRevertError(gas, estimated *big.Int, err error) error {
+	if nil != err {
+		if revertErr := revertErrorOf(err); nil != revertErr {
+			return revertErr
+		}
+		return err
+	}
+	if nil != gas && gas.Sign() > 0 && nil != estimated && estimated.Cmp(gas) >= 0 {
+		return &RevertError{Reason: "all gas is used"}
+	}
+	return nil
+}
+
+// DecodeRevertReason decodes the abi encoded Error(string), the data is returned as hex if it isn't Error(string)
+func DecodeRevertReason(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+	if !bytes.HasPrefix(data, revertReasonSelector) {
+		return common.ToHex(data), fmt.Errorf("revert data isn't Error(string)")
+	}
+	data = data[len(revertReasonSelector):]
+	if len(data) < 64 {
+		return common.ToHex(data), fmt.Errorf("revert data is too short")
+	}
+	offset := new(big.Int).SetBytes(data[:32])
+	if !offset.IsInt64() || offset.Int64()+32 > int64(len(data)) {
+		return common.ToHex(data), fmt.Errorf("offset of revert reason is out of range")
+	}
+	start := offset.Int64() + 32
+	length := new(big.Int).SetBytes(data[offset.Int64():start])
+	if !length.IsInt64() || start+length.Int64() > int64(len(data)) {
+		return common.ToHex(data), fmt.Errorf("length of revert reason is out of range")
+	}
+	return string(data[start : start+length.Int64()]), nil
+}
+
+// revertErrorOf returns nil if err isn't caused by revert. nodes report revert in different ways, such as
+// "execution reverted: reason", "always failing transaction" of eth_estimateGas, or the revert data in the data field of json-rpc error
+func revertErrorOf(err error) *RevertError {
+	message := err.Error()
+	lowerMessage := strings.ToLower(message)
+	data := rpcErrorData(err)
+	if !strings.Contains(lowerMessage, "revert") && !strings.Contains(lowerMessage, "always failing") && data == "" {
+		return nil
+	}
+
+	revertErr := &RevertError{}
+	if idx := strings.Index(message, "reverted:"); idx >= 0 {
+		revertErr.Reason = strings.TrimSpace(message[idx+len("reverted:"):])
+	}
+	if hexData := revertDataPattern.FindString(data); hexData != "" {
+		if raw, err := hexutil.Decode(hexData); nil == err {
+			if reason, err := DecodeRevertReason(raw); nil == err || revertErr.Reason == "" {
+				revertErr.Reason = reason
+			}
+		}
+	}
+	return revertErr
+}
+
+// rpcErrorData returns the data field of json-rpc error as string
+func rpcErrorData(err error) string {
+	if dataErr, ok := err.(rpc.DataError); ok && nil != dataErr.ErrorData() {
+		return fmt.Sprintf("%v", dataErr.ErrorData())
+	}
+	return ""
+}
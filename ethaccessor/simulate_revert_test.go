@@ -0,0 +1,86 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ethaccessor
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Error("order expired")
+const orderExpiredData = "0x08c379a0" +
+	"0000000000000000000000000000000000000000000000000000000000000020" +
+	"000000000000000000000000000000000000000000000000000000000000000d" +
+	"6f72646572206578706972656400000000000000000000000000000000000000"
+
+type revertDataError struct{}
+
+func (e *revertDataError) Error() string          { return "execution reverted" }
+func (e *revertDataError) ErrorCode() int         { return 3 }
+func (e *revertDataError) ErrorData() interface{} { return orderExpiredData }
+
+type RevertService struct{}
+
+func (s *RevertService) Call() (string, error) {
+	return "", &revertDataError{}
+}
+
+func TestRevertErrorOfRpcData(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &RevertService{}); nil != err {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	var result string
+	err := client.Call(&result, "eth_call")
+	if nil == err {
+		t.Fatal("eth_call should fail")
+	}
+	if revertErr := revertErrorOf(err); nil == revertErr || revertErr.Reason != "order expired" {
+		t.Fatalf("reason should be decoded from the data of rpc error, but got %v", revertErr)
+	}
+}
+
+func TestEstimatedRevertError(t *testing.T) {
+	cases := []struct {
+		name      string
+		estimated int64
+		err       error
+		reverted  bool
+		failed    bool
+	}{
+		{"estimated under gas limit", 100000, nil, false, false},
+		{"all gas used", 300000, nil, true, true},
+		{"always failing", 0, errors.New("gas required exceeds allowance or always failing transaction"), true, true},
+		{"node unavailable", 0, errors.New("connection refused"), false, true},
+	}
+
+	for _, c := range cases {
+		err := estimatedRevertError(big.NewInt(300000), big.NewInt(c.estimated), c.err)
+		_, reverted := err.(*RevertError)
+		if reverted != c.reverted || (nil != err) != c.failed {
+			t.Errorf("%s: reverted should be %v, failed should be %v, but got err:%v", c.name, c.reverted, c.failed, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ethaccessor_test
+
+import (
+	"testing"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestDecodeRevertReason(t *testing.T) {
+	// Error("order expired")
+	data := common.FromHex("0x08c379a0" +
+		"0000000000000000000000000000000000000000000000000000000000000020" +
+		"000000000000000000000000000000000000000000000000000000000000000d" +
+		"6f72646572206578706972656400000000000000000000000000000000000000")
+	if reason, err := ethaccessor.DecodeRevertReason(data); nil != err || reason != "order expired" {
+		t.Fatalf("reason should be \"order expired\", but got %q, err:%v", reason, err)
+	}
+
+	// revert without reason
+	if reason, err := ethaccessor.DecodeRevertReason([]byte{}); nil != err || reason != "" {
+		t.Fatalf("reason of empty data should be empty")
+	}
+
+	// length out of range
+	if _, err := ethaccessor.DecodeRevertReason(data[:4+64+4]); nil == err {
+		t.Fatalf("truncated data should not be decoded")
+	}
+
+	// custom data is returned as hex
+	if reason, err := ethaccessor.DecodeRevertReason(common.FromHex("0x12345678")); nil == err || reason != "0x12345678" {
+		t.Fatalf("unknown data should be returned as hex, but got %q", reason)
+	}
+}
@@ -0,0 +1,373 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package eventemitter
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/log"
+)
+
+const (
+	BusBackendMemory = "memory"
+	BusBackendFile   = "file"
+
+	defaultRedeliverInterval = 1000
+	defaultMaxRedelivery     = 10
+	busReadBatchSize         = 100
+	drainInterval            = 10 * time.Millisecond
+)
+
+type Message struct {
+	Topic  string
+	Offset uint64
+	Data   EventData
+}
+
+// Bus keeps the events of each topic in publish order, every consumer of a topic
+// receives them one by one and acknowledges the offset it has handled. Unacknowledged
+// events are delivered again, so handlers must be idempotent.
+type Bus interface {
+	Publish(topic string, data EventData) (uint64, error)
+	Subscribe(topic, consumer string, handle func(msg *Message) error) (stopFunc func(), err error)
+	Ack(topic, consumer string, offset uint64) error
+	Replay(topic string, from uint64, handle func(msg *Message) error) error
+	// Drain waits until consumer has acknowledged all events of topic published before it's called,
+	// ErrDrainTimeout is returned if they aren't acknowledged in timeout
+	Drain(topic, consumer string, timeout time.Duration) error
+	Close() error
+}
+
+// eventStore is the storage of a Bus, offsets of a topic start from 0
+type eventStore interface {
+	append(topic string, data EventData) (uint64, error)
+	// read returns events from offset from, the events before the retained ones are skipped
+	read(topic string, from uint64, limit int) ([]*Message, error)
+	// head returns the offset of the next appended event
+	head(topic string) (uint64, error)
+	// committed returns the next offset that consumer should handle
+	committed(topic, consumer string) (uint64, error)
+	commit(topic, consumer string, next uint64) error
+	close() error
+}
+
+var ErrDrainTimeout = errors.New("eventemitter,drain timeout")
+
+var (
+	bus           Bus
+	durableTopics map[string]bool
+	eventTypes    = make(map[string]reflect.Type)
+	eventTypesMtx sync.RWMutex
+)
+
+// Initialize sets up the bus used by Emit and Subscribe for the durable topics
+func Initialize(options config.EventBusOptions) error {
+	var (
+		b   Bus
+		err error
+	)
+	switch options.Backend {
+	case "":
+		return nil
+	case BusBackendMemory:
+		b = NewMemoryBus(options)
+	case BusBackendFile:
+		if b, err = NewFileBus(options); err != nil {
+			return err
+		}
+	default:
+		return errors.New("eventemitter,unsupported bus backend:" + options.Backend)
+	}
+
+	topics := make(map[string]bool)
+	for _, topic := range options.DurableTopics {
+		topics[topic] = true
+	}
+
+	mtx.Lock()
+	bus = b
+	durableTopics = topics
+	mtx.Unlock()
+	return nil
+}
+
+// RegisterEventType tells the bus which type the events of topic should be decoded to,
+// prototype is a value or pointer of that type
+func RegisterEventType(topic string, prototype EventData) {
+	eventTypesMtx.Lock()
+	defer eventTypesMtx.Unlock()
+	eventTypes[topic] = reflect.TypeOf(prototype)
+}
+
+func encodeEvent(data EventData) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+func decodeEvent(topic string, raw []byte) (EventData, error) {
+	eventTypesMtx.RLock()
+	t, ok := eventTypes[topic]
+	eventTypesMtx.RUnlock()
+
+	if !ok {
+		return json.RawMessage(raw), nil
+	}
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if err := json.Unmarshal(raw, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	} else {
+		v := reflect.New(t)
+		if err := json.Unmarshal(raw, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Elem().Interface(), nil
+	}
+}
+
+func durableBus(topic string) Bus {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if nil != bus && durableTopics[topic] {
+		return bus
+	}
+	return nil
+}
+
+// Subscribe registers handle as the consumer named consumer of topic. If topic is durable,
+// events are delivered in order through the bus and redelivered until handle returns nil,
+// otherwise handle is registered as a serial watcher.
+func Subscribe(topic, consumer string, handle func(eventData EventData) error) (stopFunc func(), err error) {
+	if b := durableBus(topic); nil != b {
+		return b.Subscribe(topic, consumer, func(msg *Message) error {
+			return handle(msg.Data)
+		})
+	}
+
+	watcher := &Watcher{Concurrent: false, Handle: handle}
+	On(topic, watcher)
+	return func() {
+		Un(topic, watcher)
+	}, nil
+}
+
+// Replay delivers the events of a durable topic from offset to handle synchronously
+func Replay(topic string, from uint64, handle func(msg *Message) error) error {
+	if b := durableBus(topic); nil != b {
+		return b.Replay(topic, from, handle)
+	}
+	return errors.New("eventemitter,topic isn't durable:" + topic)
+}
+
+// ReplayDeadLetters delivers the events of topic parked after consumer failed MaxRedelivery times
+func ReplayDeadLetters(topic, consumer string, from uint64, handle func(msg *Message) error) error {
+	if b := durableBus(topic); nil != b {
+		return b.Replay(DeadLetterTopic(topic, consumer), from, handle)
+	}
+	return errors.New("eventemitter,topic isn't durable:" + topic)
+}
+
+// DeadLetterTopic is the topic that keeps the events of topic parked by consumer
+func DeadLetterTopic(topic, consumer string) string {
+	return topic + "-" + consumer + "-dead"
+}
+
+// Drain waits until consumer has handled the events of topic published so far, it returns at once
+// if topic isn't durable, because Emit has delivered the events to watchers synchronously
+func Drain(topic, consumer string, timeout time.Duration) error {
+	if b := durableBus(topic); nil != b {
+		return b.Drain(topic, consumer, timeout)
+	}
+	return nil
+}
+
+// logBus implements Bus on an eventStore
+type logBus struct {
+	store             eventStore
+	redeliverInterval time.Duration
+	maxRedelivery     int
+
+	mtx     sync.Mutex
+	signals map[string]chan struct{}
+}
+
+func newLogBus(store eventStore, options config.EventBusOptions) *logBus {
+	b := &logBus{}
+	b.store = store
+	b.redeliverInterval = time.Duration(options.RedeliverInterval) * time.Millisecond
+	if b.redeliverInterval <= 0 {
+		b.redeliverInterval = time.Duration(defaultRedeliverInterval) * time.Millisecond
+	}
+	b.maxRedelivery = options.MaxRedelivery
+	if b.maxRedelivery == 0 {
+		b.maxRedelivery = defaultMaxRedelivery
+	}
+	b.signals = make(map[string]chan struct{})
+	return b
+}
+
+// signal returns a channel that will be closed when a new event of topic is published
+func (b *logBus) signal(topic string) chan struct{} {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.signals[topic]; !ok {
+		b.signals[topic] = make(chan struct{})
+	}
+	return b.signals[topic]
+}
+
+func (b *logBus) Publish(topic string, data EventData) (uint64, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	offset, err := b.store.append(topic, data)
+	if err != nil {
+		return 0, err
+	}
+	if c, ok := b.signals[topic]; ok {
+		close(c)
+		delete(b.signals, topic)
+	}
+	return offset, nil
+}
+
+func (b *logBus) Subscribe(topic, consumer string, handle func(msg *Message) error) (stopFunc func(), err error) {
+	next, err := b.store.committed(topic, consumer)
+	if err != nil {
+		return nil, err
+	}
+
+	stopChan := make(chan bool)
+	go b.deliver(topic, consumer, next, handle, stopChan)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stopChan) })
+	}, nil
+}
+
+func (b *logBus) deliver(topic, consumer string, next uint64, handle func(msg *Message) error, stopChan chan bool) {
+	for {
+		signal := b.signal(topic)
+		msgs, err := b.store.read(topic, next, busReadBatchSize)
+		if err != nil {
+			log.Errorf("eventemitter,read topic:%s from offset:%d error:%s", topic, next, err.Error())
+			msgs = nil
+		}
+
+		if len(msgs) == 0 {
+			select {
+			case <-signal:
+			case <-time.After(b.redeliverInterval):
+			case <-stopChan:
+				return
+			}
+			continue
+		}
+
+		for _, msg := range msgs {
+			for attempts := 1; ; attempts++ {
+				err := handle(msg)
+				if nil == err {
+					break
+				}
+				log.Errorf("eventemitter,consumer:%s handle topic:%s offset:%d error:%s", consumer, topic, msg.Offset, err.Error())
+				// 超过重试次数的事件存入死信队列，不会丢失
+				if b.maxRedelivery > 0 && attempts >= b.maxRedelivery {
+					if _, err := b.store.append(DeadLetterTopic(topic, consumer), msg.Data); err == nil {
+						log.Errorf("eventemitter,consumer:%s parked topic:%s offset:%d after %d attempts", consumer, topic, msg.Offset, attempts)
+						break
+					} else {
+						log.Errorf("eventemitter,consumer:%s park topic:%s offset:%d error:%s", consumer, topic, msg.Offset, err.Error())
+					}
+				}
+				select {
+				case <-time.After(b.redeliverInterval):
+				case <-stopChan:
+					return
+				}
+			}
+
+			if err := b.Ack(topic, consumer, msg.Offset); err != nil {
+				log.Errorf("eventemitter,consumer:%s ack topic:%s offset:%d error:%s", consumer, topic, msg.Offset, err.Error())
+			}
+			next = msg.Offset + 1
+
+			select {
+			case <-stopChan:
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (b *logBus) Ack(topic, consumer string, offset uint64) error {
+	return b.store.commit(topic, consumer, offset+1)
+}
+
+func (b *logBus) Drain(topic, consumer string, timeout time.Duration) error {
+	head, err := b.store.head(topic)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		next, err := b.store.committed(topic, consumer)
+		if err != nil {
+			return err
+		}
+		if next >= head {
+			return nil
+		}
+		// 消费者一直处理失败时不能无限等待
+		if !time.Now().Before(deadline) {
+			return ErrDrainTimeout
+		}
+		time.Sleep(drainInterval)
+	}
+}
+
+func (b *logBus) Replay(topic string, from uint64, handle func(msg *Message) error) error {
+	for {
+		msgs, err := b.store.read(topic, from, busReadBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		for _, msg := range msgs {
+			if err := handle(msg); err != nil {
+				return err
+			}
+			from = msg.Offset + 1
+		}
+	}
+}
+
+func (b *logBus) Close() error {
+	return b.store.close()
+}
@@ -0,0 +1,333 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package eventemitter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/log"
+)
+
+type fileRecord struct {
+	Offset uint64          `json:"offset"`
+	Data   json.RawMessage `json:"data"`
+}
+
+const defaultCompactThreshold = 10000
+
+// topicLog keeps the events from offset base in memory, the events before it have been
+// acknowledged by all consumers and removed from the file
+type topicLog struct {
+	file      *os.File
+	base      uint64
+	raws      []json.RawMessage
+	consumers map[string]uint64 //next offset committed by each consumer
+}
+
+// fileStore writes the events of each topic to an append-only log named <topic>.log,
+// and the committed offset of each consumer to <topic>.<consumer>.offset. the log is
+// rewritten without the events handled by all consumers once there are compactThreshold of them
+type fileStore struct {
+	dir              string
+	compactThreshold uint64
+	mtx              sync.RWMutex
+	logs             map[string]*topicLog
+}
+
+func NewFileBus(options config.EventBusOptions) (Bus, error) {
+	if "" == options.Dir {
+		return nil, errors.New("eventemitter,dir of file bus must be setted")
+	}
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &fileStore{}
+	store.dir = options.Dir
+	store.compactThreshold = uint64(options.CompactThreshold)
+	if store.compactThreshold <= 0 {
+		store.compactThreshold = defaultCompactThreshold
+	}
+	store.logs = make(map[string]*topicLog)
+	return newLogBus(store, options), nil
+}
+
+// openLog loads the log of topic, a broken record left by a crash at the end of
+// the file will be truncated
+func (s *fileStore) openLog(topic string) (*topicLog, error) {
+	if l, ok := s.logs[topic]; ok {
+		return l, nil
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.dir, topic+".log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &topicLog{file: file, raws: []json.RawMessage{}, consumers: make(map[string]uint64)}
+	reader := bufio.NewReader(file)
+	var position int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Errorf("eventemitter,truncate incomplete record of topic:%s at:%d", topic, position)
+			}
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		record := &fileRecord{}
+		err = json.Unmarshal(line, record)
+		if err == nil && position == 0 {
+			l.base = record.Offset
+		}
+		if err != nil || record.Offset != l.base+uint64(len(l.raws)) {
+			log.Errorf("eventemitter,truncate broken record of topic:%s at:%d", topic, position)
+			break
+		}
+		l.raws = append(l.raws, record.Data)
+		position += int64(len(line))
+	}
+
+	if err := file.Truncate(position); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(position, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// consumers not subscribed yet keep the events they haven't handled
+	offsetFiles, err := filepath.Glob(filepath.Join(s.dir, topic+".*.offset"))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	for _, offsetFile := range offsetFiles {
+		consumer := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(offsetFile), topic+"."), ".offset")
+		next, err := s.readOffset(offsetFile)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		l.consumers[consumer] = next
+	}
+
+	s.logs[topic] = l
+	return l, nil
+}
+
+func (s *fileStore) append(topic string, data EventData) (uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	l, err := s.openLog(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	raw, err := encodeEvent(data)
+	if err != nil {
+		return 0, err
+	}
+	record := &fileRecord{Offset: l.base + uint64(len(l.raws)), Data: raw}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	if err := l.file.Sync(); err != nil {
+		return 0, err
+	}
+
+	l.raws = append(l.raws, raw)
+	return record.Offset, nil
+}
+
+func (s *fileStore) read(topic string, from uint64, limit int) ([]*Message, error) {
+	s.mtx.Lock()
+	l, err := s.openLog(topic)
+	if err != nil {
+		s.mtx.Unlock()
+		return nil, err
+	}
+	base, raws := l.base, l.raws
+	s.mtx.Unlock()
+
+	if from < base {
+		from = base
+	}
+	msgs := []*Message{}
+	for offset := from; offset < base+uint64(len(raws)) && len(msgs) < limit; offset++ {
+		data, err := decodeEvent(topic, raws[offset-base])
+		if err != nil {
+			return nil, fmt.Errorf("eventemitter,decode topic:%s offset:%d error:%s", topic, offset, err.Error())
+		}
+		msgs = append(msgs, &Message{Topic: topic, Offset: offset, Data: data})
+	}
+	return msgs, nil
+}
+
+func (s *fileStore) offsetFile(topic, consumer string) string {
+	return filepath.Join(s.dir, topic+"."+consumer+".offset")
+}
+
+func (s *fileStore) head(topic string) (uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	l, err := s.openLog(topic)
+	if err != nil {
+		return 0, err
+	}
+	return l.base + uint64(len(l.raws)), nil
+}
+
+func (s *fileStore) readOffset(file string) (uint64, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// committed also registers consumer, the events it hasn't handled won't be compacted
+func (s *fileStore) committed(topic, consumer string) (uint64, error) {
+	next, err := s.readOffset(s.offsetFile(topic, consumer))
+	if err != nil {
+		return 0, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	l, err := s.openLog(topic)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := l.consumers[consumer]; !ok {
+		l.consumers[consumer] = next
+	}
+	return next, nil
+}
+
+// commit writes a temp file and renames it, so the offset file is never half written
+func (s *fileStore) commit(topic, consumer string, next uint64) error {
+	file := s.offsetFile(topic, consumer)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(next, 10)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	l, err := s.openLog(topic)
+	if err != nil {
+		return err
+	}
+	l.consumers[consumer] = next
+	return s.compact(topic, l)
+}
+
+// compact rewrites the log from the lowest offset committed by consumers
+func (s *fileStore) compact(topic string, l *topicLog) error {
+	lowest := l.base + uint64(len(l.raws))
+	for _, next := range l.consumers {
+		if next < lowest {
+			lowest = next
+		}
+	}
+	// the last event is kept, offsets continue from it after restart
+	if head := l.base + uint64(len(l.raws)); lowest >= head && head > 0 {
+		lowest = head - 1
+	}
+	if lowest < l.base+s.compactThreshold {
+		return nil
+	}
+
+	name := filepath.Join(s.dir, topic+".log")
+	tmp, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	raws := l.raws[lowest-l.base:]
+	writer := bufio.NewWriter(tmp)
+	for idx, raw := range raws {
+		line, err := json.Marshal(&fileRecord{Offset: lowest + uint64(idx), Data: raw})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// the renamed file is written from now on
+	l.file.Close()
+	l.file = tmp
+	l.base = lowest
+	l.raws = append([]json.RawMessage{}, raws...)
+	log.Infof("eventemitter,compacted topic:%s before offset:%d", topic, lowest)
+	return nil
+}
+
+func (s *fileStore) close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var err error
+	for topic, l := range s.logs {
+		if closeErr := l.file.Close(); closeErr != nil {
+			err = closeErr
+		}
+		delete(s.logs, topic)
+	}
+	return err
+}
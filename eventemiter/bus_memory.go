@@ -0,0 +1,84 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package eventemitter
+
+import (
+	"sync"
+
+	"github.com/Loopring/relay/config"
+)
+
+// memoryStore keeps all events in memory, they are lost after restart
+type memoryStore struct {
+	mtx     sync.RWMutex
+	events  map[string][]EventData
+	offsets map[string]map[string]uint64
+}
+
+func NewMemoryBus(options config.EventBusOptions) Bus {
+	store := &memoryStore{}
+	store.events = make(map[string][]EventData)
+	store.offsets = make(map[string]map[string]uint64)
+	return newLogBus(store, options)
+}
+
+func (s *memoryStore) append(topic string, data EventData) (uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.events[topic] = append(s.events[topic], data)
+	return uint64(len(s.events[topic]) - 1), nil
+}
+
+func (s *memoryStore) read(topic string, from uint64, limit int) ([]*Message, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	msgs := []*Message{}
+	events := s.events[topic]
+	for offset := from; offset < uint64(len(events)) && len(msgs) < limit; offset++ {
+		msgs = append(msgs, &Message{Topic: topic, Offset: offset, Data: events[offset]})
+	}
+	return msgs, nil
+}
+
+func (s *memoryStore) head(topic string) (uint64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return uint64(len(s.events[topic])), nil
+}
+
+func (s *memoryStore) committed(topic, consumer string) (uint64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.offsets[topic][consumer], nil
+}
+
+func (s *memoryStore) commit(topic, consumer string, next uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.offsets[topic]; !ok {
+		s.offsets[topic] = make(map[string]uint64)
+	}
+	s.offsets[topic][consumer] = next
+	return nil
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
@@ -0,0 +1,272 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package eventemitter_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+type BusEvent struct {
+	Name  string
+	Index int
+}
+
+func TestMemoryBusOrderAndRedelivery(t *testing.T) {
+	bus := eventemitter.NewMemoryBus(config.EventBusOptions{RedeliverInterval: 10})
+	defer bus.Close()
+
+	received := make(chan int, 10)
+	failed := false
+	stop, err := bus.Subscribe("test", "consumer", func(msg *eventemitter.Message) error {
+		e := msg.Data.(BusEvent)
+		if e.Index == 1 && !failed {
+			failed = true
+			return errors.New("handle failed")
+		}
+		received <- e.Index
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		bus.Publish("test", BusEvent{Name: "bus", Index: i})
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case idx := <-received:
+			if idx != i {
+				t.Fatalf("expected event %d, got %d", i, idx)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+}
+
+func TestFileBusResumeAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	eventemitter.RegisterEventType("file_test", &BusEvent{})
+	options := config.EventBusOptions{Dir: dir, RedeliverInterval: 10}
+
+	bus, err := eventemitter.NewFileBus(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := bus.Publish("file_test", &BusEvent{Name: "file", Index: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// consumer has handled the first event before restart
+	if err := bus.Ack("file_test", "consumer", 0); err != nil {
+		t.Fatal(err)
+	}
+	bus.Close()
+
+	bus, err = eventemitter.NewFileBus(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+
+	received := make(chan int, 10)
+	stop, err := bus.Subscribe("file_test", "consumer", func(msg *eventemitter.Message) error {
+		received <- msg.Data.(*BusEvent).Index
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for i := 1; i < 3; i++ {
+		select {
+		case idx := <-received:
+			if idx != i {
+				t.Fatalf("expected event %d, got %d", i, idx)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+
+	replayed := []int{}
+	err = bus.Replay("file_test", 0, func(msg *eventemitter.Message) error {
+		replayed = append(replayed, msg.Data.(*BusEvent).Index)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 3 || replayed[0] != 0 || replayed[2] != 2 {
+		t.Fatalf("unexpected replayed events:%v", replayed)
+	}
+}
+
+func TestBusParkDeadLetter(t *testing.T) {
+	bus := eventemitter.NewMemoryBus(config.EventBusOptions{RedeliverInterval: 10, MaxRedelivery: 2})
+	defer bus.Close()
+
+	received := make(chan int, 10)
+	stop, err := bus.Subscribe("dead_test", "consumer", func(msg *eventemitter.Message) error {
+		e := msg.Data.(BusEvent)
+		if e.Index == 0 {
+			return errors.New("handle failed")
+		}
+		received <- e.Index
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	bus.Publish("dead_test", BusEvent{Name: "bus", Index: 0})
+	bus.Publish("dead_test", BusEvent{Name: "bus", Index: 1})
+	select {
+	case idx := <-received:
+		if idx != 1 {
+			t.Fatalf("expected event 1, got %d", idx)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("event 1 not delivered")
+	}
+
+	parked := []int{}
+	bus.Replay(eventemitter.DeadLetterTopic("dead_test", "consumer"), 0, func(msg *eventemitter.Message) error {
+		parked = append(parked, msg.Data.(BusEvent).Index)
+		return nil
+	})
+	if len(parked) != 1 || parked[0] != 0 {
+		t.Fatalf("event 0 should be parked, but got %v", parked)
+	}
+}
+
+func TestFileBusCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	eventemitter.RegisterEventType("compact_test", &BusEvent{})
+	options := config.EventBusOptions{Dir: dir, RedeliverInterval: 10, CompactThreshold: 3}
+	bus, err := eventemitter.NewFileBus(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		bus.Publish("compact_test", &BusEvent{Name: "file", Index: i})
+	}
+	// slow consumer keeps the events it hasn't handled
+	if err := bus.Ack("compact_test", "slow", 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		bus.Ack("compact_test", "fast", uint64(i))
+	}
+	if err := bus.Ack("compact_test", "slow", 3); err != nil {
+		t.Fatal(err)
+	}
+	bus.Close()
+
+	// events 0..3 are compacted, offsets continue after restart
+	bus, err = eventemitter.NewFileBus(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	if offset, err := bus.Publish("compact_test", &BusEvent{Name: "file", Index: 5}); err != nil || offset != 5 {
+		t.Fatalf("offset should be 5, but got %d, err:%v", offset, err)
+	}
+	replayed := []int{}
+	bus.Replay("compact_test", 0, func(msg *eventemitter.Message) error {
+		replayed = append(replayed, msg.Data.(*BusEvent).Index)
+		return nil
+	})
+	if len(replayed) != 2 || replayed[0] != 4 || replayed[1] != 5 {
+		t.Fatalf("events 4,5 should be kept, but got %v", replayed)
+	}
+}
+
+func TestBusDrain(t *testing.T) {
+	bus := eventemitter.NewMemoryBus(config.EventBusOptions{RedeliverInterval: 10})
+	defer bus.Close()
+
+	handled := 0
+	stop, err := bus.Subscribe("drain_test", "consumer", func(msg *eventemitter.Message) error {
+		time.Sleep(10 * time.Millisecond)
+		handled++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		bus.Publish("drain_test", BusEvent{Name: "bus", Index: i})
+	}
+	if err := bus.Drain("drain_test", "consumer", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if handled != 3 {
+		t.Fatalf("3 events should be handled after drain, but got %d", handled)
+	}
+}
+
+func TestBusDrainTimeout(t *testing.T) {
+	bus := eventemitter.NewMemoryBus(config.EventBusOptions{RedeliverInterval: 10, MaxRedelivery: -1})
+	defer bus.Close()
+
+	stop, err := bus.Subscribe("drain_timeout_test", "consumer", func(msg *eventemitter.Message) error {
+		return errors.New("handle failed")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	bus.Publish("drain_timeout_test", BusEvent{Name: "bus", Index: 0})
+	if err := bus.Drain("drain_timeout_test", "consumer", 100*time.Millisecond); err != eventemitter.ErrDrainTimeout {
+		t.Fatalf("drain should time out while the event is redelivered, but got %v", err)
+	}
+}
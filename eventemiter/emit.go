@@ -35,6 +35,7 @@ const (
 	RingSubmitFailed               = "RingSubmitFailed" //submit ring failed
 	Transaction                    = "Transaction"
 	Gateway                        = "Gateway"
+	GatewaySoftCancel              = "GatewaySoftCancel" //soft cancel received from ipfs
 	AccountTransfer                = "AccountTransfer"
 	AccountApproval                = "AccountApproval"
 	TokenRegistered                = "TokenRegistered"
@@ -47,6 +48,8 @@ const (
 	OrderManagerExtractorFill      = "OrderManagerExtractorFill"
 	OrderManagerExtractorCancel    = "OrderManagerExtractorCancel"
 	OrderManagerExtractorCutoff    = "OrderManagerExtractorCutoff"
+	OrderManagerSoftCancel         = "OrderManagerSoftCancel"
+	OrderManagerExpire             = "OrderManagerExpire"
 	MinedOrderState                = "MinedOrderState" //orderbook send orderstate to miner
 
 	//Miner
@@ -66,6 +69,7 @@ const (
 	SyncChainComplete = "SyncChainComplete"
 	ChainForkDetected = "ChainForkDetected"
 	ChainForkProcess  = "ChainForkProcess"
+	ChainForkComplete = "ChainForkComplete"
 
 	// Methods
 	WethDepositMethod    = "WethDepositMethod"
@@ -105,6 +109,13 @@ func On(topic string, watcher *Watcher) {
 }
 
 func Emit(topic string, eventData EventData) {
+	// consumers subscribed through the bus receive the event asynchronously
+	if b := durableBus(topic); nil != b {
+		if _, err := b.Publish(topic, eventData); err != nil {
+			log.Errorf("eventemitter,publish topic:%s error:%s", topic, err.Error())
+		}
+	}
+
 	//should limit the count of watchers
 	var wg sync.WaitGroup
 	for _, ob := range watchers[topic] {
@@ -126,29 +137,20 @@ func Emit(topic string, eventData EventData) {
 	wg.Wait()
 }
 
-//todo: impl it
+// NewSerialWatcher registers handle as a watcher of topic that never handles two events at the same time
 func NewSerialWatcher(topic string, handle func(e EventData) error) (stopFunc func(), err error) {
-	dataChan := make(chan EventData)
-	go func() {
-		for {
-			select {
-			case event := <-dataChan:
-				handle(event)
-			}
-		}
-	}()
-
+	var handleMtx sync.Mutex
 	watcher := &Watcher{
 		Concurrent: false,
 		Handle: func(eventData EventData) error {
-			dataChan <- eventData
-			return nil
+			handleMtx.Lock()
+			defer handleMtx.Unlock()
+			return handle(eventData)
 		},
 	}
 	On(topic, watcher)
 
 	return func() {
-		close(dataChan)
 		Un(topic, watcher)
 	}, nil
 }
@@ -0,0 +1,59 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TestForkDetectorMaxReorgDepth checks that a fork deeper than max reorg depth isn't searched to the genesis
+func TestForkDetectorMaxReorgDepth(t *testing.T) {
+	chainA := scriptedChain(10, 2, 'a')
+	chainB := scriptedChain(10, 2, 'b')
+
+	rds := newReorgRds()
+	for _, block := range chainA {
+		entity := &dao.Block{}
+		entity.ConvertDown(block)
+		rds.CommitExtractedBlock(entity, nil)
+	}
+	detector := newForkDetector(rds, 3)
+	detector.getBlock = func(hash common.Hash) (*types.Block, error) {
+		for _, block := range chainB {
+			if block.BlockHash == hash {
+				return block, nil
+			}
+		}
+		return nil, errors.New("block not found")
+	}
+
+	if _, err := detector.getForkedBlock(chainB[9], 0); nil == err {
+		t.Fatalf("fork from block 2 should exceed max reorg depth 3")
+	}
+	detector.maxReorgDepth = 10
+	forkBlock, err := detector.getForkedBlock(chainB[9], 0)
+	if err != nil || forkBlock.BlockHash != chainA[1].BlockHash {
+		t.Fatalf("forked block should be block 2 of chain a, but got %+v, err:%v", forkBlock, err)
+	}
+}
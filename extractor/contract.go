@@ -190,6 +190,15 @@ func (processor *AbiProcessor) HasContract(protocol common.Address) bool {
 	return ok
 }
 
+// ContractAddresses returns the protocol,registry,delegate and token addresses ever been load
+func (processor *AbiProcessor) ContractAddresses() []common.Address {
+	var addresses []common.Address
+	for address := range processor.protocols {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
 // HasSpender check approve spender address have ever been load
 func (processor *AbiProcessor) HasSpender(spender common.Address) bool {
 	_, ok := processor.delegates[spender]
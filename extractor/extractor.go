@@ -20,6 +20,7 @@ package extractor
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/dao"
 	"github.com/Loopring/relay/ethaccessor"
@@ -30,7 +31,9 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"math/big"
+	"reflect"
 	"sync"
+	"time"
 )
 
 /**
@@ -42,7 +45,6 @@ const defaultEndBlockNumber = 1000000000
 type ExtractorService interface {
 	Start()
 	Stop()
-	Fork(start *big.Int)
 }
 
 // TODO(fukun):不同的channel，应当交给orderbook统一进行后续处理，可以将channel作为函数返回值、全局变量、参数等方式
@@ -55,7 +57,7 @@ type ExtractorServiceImpl struct {
 	lock             sync.RWMutex
 	startBlockNumber *big.Int
 	endBlockNumber   *big.Int
-	iterator         *ethaccessor.BlockIterator
+	pipeline         *blockPipeline
 	syncComplete     bool
 	forkComplete     bool
 	forktest         bool
@@ -68,7 +70,7 @@ func NewExtractorService(options config.ExtractorOptions,
 	l.options = options
 	l.dao = rds
 	l.processor = newAbiProcessor(rds)
-	l.detector = newForkDetector(rds)
+	l.detector = newForkDetector(rds, options.MaxReorgDepth)
 	l.stop = make(chan bool, 1)
 
 	l.setBlockNumberRange()
@@ -79,32 +81,50 @@ func (l *ExtractorServiceImpl) Start() {
 	log.Info("extractor start...")
 	l.syncComplete = false
 
-	l.iterator = ethaccessor.NewBlockIterator(l.startBlockNumber, l.endBlockNumber, true, l.options.ConfirmBlockNumber)
-	go func() {
-		for {
-			select {
-			case <-l.stop:
-				return
-			default:
-				l.processBlock()
-			}
+	step, fetch, err := l.fetcher()
+	if err != nil {
+		log.Fatalf("extractor,%s", err.Error())
+	}
+	l.pipeline = newBlockPipeline(l.options.Workers, step, l.options.ConfirmBlockNumber, l.startBlockNumber, l.endBlockNumber, fetch, l.processBlock)
+	l.pipeline.metricsInterval = time.Duration(l.options.MetricsInterval) * time.Second
+	l.pipeline.maxRetries = l.options.MaxRetries
+	l.pipeline.retryInterval = l.retryInterval()
+	go l.pipeline.run(l.stop)
+}
+
+// fetcher returns the blocks fetched by each call and the fetch function of mode
+func (l *ExtractorServiceImpl) fetcher() (uint64, func(from, to *big.Int) ([]*extractedBlock, error), error) {
+	switch l.options.Mode {
+	case "logs":
+		logsRange := l.options.LogsRange
+		if logsRange <= 0 {
+			logsRange = defaultLogsRange
 		}
-	}()
+		return logsRange, l.extractLogs, nil
+	case "", "block":
+		return 1, l.extractBlocks, nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported mode:%s", l.options.Mode)
+	}
 }
 
 func (l *ExtractorServiceImpl) Stop() {
 	l.stop <- true
 }
 
-// 重启(分叉)时先关停subscribeEvents，然后关
-func (l *ExtractorServiceImpl) Fork(start *big.Int) {
-	l.startBlockNumber = start
+// Metrics returns the throughput since extractor started
+func (l *ExtractorServiceImpl) Metrics() ExtractorMetrics {
+	if nil == l.pipeline {
+		return ExtractorMetrics{}
+	}
+	return l.pipeline.metrics.snapshot()
 }
 
 func (l *ExtractorServiceImpl) sync(blockNumber *big.Int) {
 	var syncBlock types.Big
 	if err := ethaccessor.BlockNumber(&syncBlock); err != nil {
-		log.Fatalf("extractor,sync chain block,get ethereum node current block number error:%s", err.Error())
+		log.Errorf("extractor,sync chain block,get ethereum node current block number error:%s", err.Error())
+		return
 	}
 	currentBlockNumber := new(big.Int).Add(blockNumber, big.NewInt(int64(l.options.ConfirmBlockNumber)))
 	if syncBlock.BigInt().Cmp(currentBlockNumber) <= 0 {
@@ -116,87 +136,153 @@ func (l *ExtractorServiceImpl) sync(blockNumber *big.Int) {
 	}
 }
 
-func (l *ExtractorServiceImpl) processBlock() {
-	inter, err := l.iterator.Next()
+// extractedBlock is a block fetched and decoded by a worker of pipeline, items are emitted in order when it's applied
+type extractedBlock struct {
+	block        *ethaccessor.BlockWithTxAndReceipt
+	currentBlock *types.Block
+	items        []extractedItem
+}
+
+// extractedItem is an event or method to be emitted, eventLog is saved before it if SaveEventLog
+type extractedItem struct {
+	topic    string
+	data     eventemitter.EventData
+	eventLog *dao.EventLog
+}
+
+func (block *extractedBlock) emittedCount() int {
+	count := 0
+	for _, item := range block.items {
+		if item.topic != "" {
+			count++
+		}
+	}
+	return count
+}
+
+func (l *ExtractorServiceImpl) extractBlocks(from, to *big.Int) ([]*extractedBlock, error) {
+	blocks := []*extractedBlock{}
+	for number := new(big.Int).Set(from); number.Cmp(to) <= 0; number.Add(number, big.NewInt(1)) {
+		block, err := l.extractBlock(number)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// extractBlock fetches the block with its transactions and receipts, and decodes them. it runs concurrently in workers,
+// so nothing is saved or emitted here
+func (l *ExtractorServiceImpl) extractBlock(blockNumber *big.Int) (*extractedBlock, error) {
+	block, err := ethaccessor.GetFullBlock(blockNumber)
 	if err != nil {
-		log.Fatalf("extractor,iterator next error:%s", err.Error())
+		return nil, err
+	}
+	if len(block.Transactions) != len(block.Receipts) {
+		return nil, fmt.Errorf("transaction number %d != receipt number %d", len(block.Transactions), len(block.Receipts))
 	}
 
-	// get current block
-	block := inter.(*ethaccessor.BlockWithTxAndReceipt)
-	log.Infof("extractor,get block:%s->%s, transaction number:%d", block.Number.BigInt().String(), block.Hash.Hex(), len(block.Transactions))
+	extracted := &extractedBlock{block: block}
+	extracted.currentBlock = &types.Block{}
+	extracted.currentBlock.BlockNumber = block.Number.BigInt()
+	extracted.currentBlock.ParentHash = block.ParentHash
+	extracted.currentBlock.BlockHash = block.Hash
+	extracted.currentBlock.CreateTime = block.Timestamp.Int64()
+
+	for idx, transaction := range block.Transactions {
+		receipt := block.Receipts[idx]
 
-	currentBlock := &types.Block{}
-	currentBlock.BlockNumber = block.Number.BigInt()
-	currentBlock.ParentHash = block.ParentHash
-	currentBlock.BlockHash = block.Hash
-	currentBlock.CreateTime = block.Timestamp.Int64()
+		l.debug("extractor,tx:%s", transaction.Hash)
+		extracted.items = append(extracted.items, l.processTransaction(transaction, receipt, block.Timestamp.BigInt(), extracted.currentBlock.BlockNumber)...)
+	}
+	return extracted, nil
+}
+
+// processBlock applies the blocks in order, the next block is returned to rewind the pipeline if chain forked
+func (l *ExtractorServiceImpl) processBlock(extracted *extractedBlock) *big.Int {
+	block := extracted.block
+	currentBlock := extracted.currentBlock
+	log.Infof("extractor,get block:%s->%s, transaction number:%d", block.Number.BigInt().String(), block.Hash.Hex(), len(block.Transactions))
 
 	// sync blocks on chain
 	if l.syncComplete == false {
 		l.sync(block.Number.BigInt())
 	}
 
-	// detect chain fork
-	l.detector.Detect(currentBlock)
-
-	// convert block to dao entity
-	var entity dao.Block
-	if err := entity.ConvertDown(currentBlock); err != nil {
-		l.debug("extractor,convert block to dao/entity error:%s", err.Error())
-	} else {
-		l.dao.Add(&entity)
+	// detect chain fork, the checkpoint is rewound to the forked block and extractor continues from it
+	if forkEvent := l.detector.Detect(currentBlock); nil != forkEvent {
+		l.processFork(forkEvent)
+		return new(big.Int).Add(forkEvent.ForkBlock, big.NewInt(1))
 	}
 
 	// emit new block
 	blockEvent := &types.BlockEvent{}
 	blockEvent.BlockNumber = block.Number.BigInt()
 	blockEvent.BlockHash = block.Hash
+	blockEvent.BlockTime = block.Timestamp.Int64()
 	eventemitter.Emit(eventemitter.Block_New, blockEvent)
 
-	var txcnt types.Big
-	if err := ethaccessor.GetBlockTransactionCountByHash(&txcnt, block.Hash.Hex(), block.Number.BigInt().String()); err != nil {
-		log.Fatalf("extractor,getBlockTransactionCountByHash error:%s", err.Error())
+	var eventLogs []*dao.EventLog
+	for _, item := range extracted.items {
+		if nil != item.eventLog {
+			eventLogs = append(eventLogs, item.eventLog)
+		}
+		if item.topic != "" {
+			eventemitter.Emit(item.topic, item.data)
+		}
 	}
-	txcntinblock := len(block.Transactions)
-	if txcntinblock < 1 {
-		return
+
+	// the block is committed with checkpoint after all events emitted, it's processed again if node stops before that
+	var entity dao.Block
+	if err := entity.ConvertDown(currentBlock); err != nil {
+		l.debug("extractor,convert block to dao/entity error:%s", err.Error())
+		return nil
 	}
-	if txcnt.Int() != txcntinblock {
-		log.Fatalf("extractor,transaction number %d != len(block.transactions) %d", txcnt.Int(), txcntinblock)
+	err := retryWithBackoff(l.options.MaxRetries, l.retryInterval(), nil, func() error {
+		return l.dao.CommitExtractedBlock(&entity, eventLogs)
+	})
+	if err != nil {
+		log.Fatalf("extractor,commit block:%s checkpoint error:%s", currentBlock.BlockNumber.String(), err.Error())
 	}
+	return nil
+}
 
-	for idx, transaction := range block.Transactions {
-		receipt := block.Receipts[idx]
-
-		l.debug("extractor,tx:%s", transaction.Hash)
-		l.processTransaction(transaction, receipt, block.Timestamp.BigInt(), currentBlock.BlockNumber)
-	}
+// processFork reverts consumers to the forked block without stopping the node, the watchers of each phase
+// are finished before the next phase is emitted:
+// ChainForkDetected: gateway rejects orders and cancels, other apis keep serving
+// ChainForkProcess: ordermanager rolls back mysql and reloads order book, accountmanager drops its cache
+// ChainForkComplete: trendmanager and miner reload from the rolled back data, gateway accepts orders again
+func (l *ExtractorServiceImpl) processFork(forkEvent *types.ForkedEvent) {
+	eventemitter.Emit(eventemitter.ChainForkDetected, forkEvent)
+	eventemitter.Emit(eventemitter.ChainForkProcess, forkEvent)
+	eventemitter.Emit(eventemitter.ChainForkComplete, forkEvent)
+	log.Infof("extractor,chain fork processed, continue from block:%s", new(big.Int).Add(forkEvent.ForkBlock, big.NewInt(1)).String())
 }
 
-func (l *ExtractorServiceImpl) processTransaction(tx ethaccessor.Transaction, receipt ethaccessor.TransactionReceipt, time, blockNumber *big.Int) {
+func (l *ExtractorServiceImpl) processTransaction(tx ethaccessor.Transaction, receipt ethaccessor.TransactionReceipt, time, blockNumber *big.Int) []extractedItem {
+	var items []extractedItem
 	txIsFailed := receipt.IsFailed()
 
 	// process method
 	if txIsFailed || len(receipt.Logs) == 0 {
-		log.Debugf("extractor,tx:%s status :%s is failed and logs amount is %d", tx.Hash, receipt.Status.BigInt().String())
+		log.Debugf("extractor,tx:%s status :%s is failed and logs amount is %d", tx.Hash, receipt.Status.BigInt().String(), len(receipt.Logs))
 	} else {
-		if err := l.processEvent(receipt, time); err != nil {
-			log.Errorf(err.Error())
-		}
+		items = append(items, l.processEvent(receipt, time)...)
 	}
 
 	// process contract
 	if l.processor.HasContract(common.HexToAddress(tx.To)) {
-		if err := l.processMethod(tx, time, blockNumber, txIsFailed); err != nil {
-			log.Errorf(err.Error())
+		if item, ok := l.processMethod(tx, time, blockNumber, txIsFailed); ok {
+			items = append(items, item)
 		}
 	} else {
 		l.debug("extractor,tx:%s contract method unsupported protocol %s", tx.Hash, tx.To)
 	}
+	return items
 }
 
-func (l *ExtractorServiceImpl) processMethod(tx ethaccessor.Transaction, time, blockNumber *big.Int, txIsFailed bool) error {
+func (l *ExtractorServiceImpl) processMethod(tx ethaccessor.Transaction, time, blockNumber *big.Int, txIsFailed bool) (extractedItem, bool) {
 	var (
 		method MethodData
 		ok     bool
@@ -208,22 +294,22 @@ func (l *ExtractorServiceImpl) processMethod(tx ethaccessor.Transaction, time, b
 	// 过滤方法
 	if len(input) < 4 || len(tx.Input) < 10 {
 		l.debug("extractor,tx:%s contract method id %s length invalid", txhash, common.ToHex(input))
-		return nil
+		return extractedItem{}, false
 	}
 
 	id := common.ToHex(input[0:4])
 	if method, ok = l.processor.GetMethod(id); !ok {
 		l.debug("extractor,tx:%s contract method id error:%s", txhash, id)
-		return nil
+		return extractedItem{}, false
 	}
 
 	method.FullFilled(&tx, time, txIsFailed)
 
-	eventemitter.Emit(method.Id, method)
-	return nil
+	return extractedItem{topic: method.Id, data: method}, true
 }
 
-func (l *ExtractorServiceImpl) processEvent(receipt ethaccessor.TransactionReceipt, time *big.Int) error {
+func (l *ExtractorServiceImpl) processEvent(receipt ethaccessor.TransactionReceipt, time *big.Int) []extractedItem {
+	var items []extractedItem
 	txhash := receipt.TransactionHash
 
 	for _, evtLog := range receipt.Logs {
@@ -246,19 +332,21 @@ func (l *ExtractorServiceImpl) processEvent(receipt ethaccessor.TransactionRecei
 			l.debug("extractor,tx:%s contract event id error:%s", txhash, id.Hex())
 			continue
 		}
+		// blocks are decoded concurrently, each event is unpacked into its own struct
+		event.Event = newEventInstance(event.Event)
 
 		// 记录event log
+		var el *dao.EventLog
 		if l.options.SaveEventLog {
 			if bs, err := json.Marshal(evtLog); err != nil {
 				l.debug("extractor,tx:%s json unmarshal evtlog error:%s", txhash, err.Error())
 			} else {
-				el := &dao.EventLog{}
+				el = &dao.EventLog{}
 				el.Protocol = evtLog.Address
 				el.TxHash = txhash
 				el.BlockNumber = evtLog.BlockNumber.Int64()
 				el.CreateTime = time.Int64()
 				el.Data = bs
-				l.dao.Add(el)
 			}
 		}
 
@@ -266,16 +354,28 @@ func (l *ExtractorServiceImpl) processEvent(receipt ethaccessor.TransactionRecei
 			// 解析事件
 			if err := event.CAbi.Unpack(event.Event, event.Name, data, abi.SEL_UNPACK_EVENT); nil != err {
 				log.Errorf("extractor,tx:%s unpack event error:%s", txhash, err.Error())
+				if nil != el {
+					items = append(items, extractedItem{eventLog: el})
+				}
 				continue
 			}
 		}
 
 		// full filled event and emit to abi processor
 		event.FullFilled(&evtLog, time, txhash)
-		eventemitter.Emit(event.Id.Hex(), event)
+		items = append(items, extractedItem{topic: event.Id.Hex(), data: event, eventLog: el})
 	}
 
-	return nil
+	return items
+}
+
+// newEventInstance returns a new zero struct of the same type as event
+func newEventInstance(event interface{}) interface{} {
+	t := reflect.TypeOf(event)
+	if nil == t || t.Kind() != reflect.Ptr {
+		return event
+	}
+	return reflect.New(t.Elem()).Interface()
 }
 
 func (l *ExtractorServiceImpl) setBlockNumberRange() {
@@ -289,7 +389,14 @@ func (l *ExtractorServiceImpl) setBlockNumberRange() {
 		return
 	}
 
-	// 寻找最新块
+	// 从checkpoint的下一个块继续
+	if checkpoint, err := l.dao.GetExtractorCheckpoint(); err == nil {
+		l.startBlockNumber = big.NewInt(checkpoint.BlockNumber + 1)
+		log.Infof("extractor,resume from checkpoint:%d->%s", checkpoint.BlockNumber, checkpoint.BlockHash)
+		return
+	}
+
+	// 没有checkpoint时寻找最新块
 	var ret types.Block
 	latestBlock, err := l.dao.FindLatestBlock()
 	if err != nil {
@@ -300,6 +407,13 @@ func (l *ExtractorServiceImpl) setBlockNumberRange() {
 	l.startBlockNumber = ret.BlockNumber
 }
 
+func (l *ExtractorServiceImpl) retryInterval() time.Duration {
+	if l.options.RetryInterval <= 0 {
+		return defaultRetryInterval
+	}
+	return time.Duration(l.options.RetryInterval) * time.Millisecond
+}
+
 func (l *ExtractorServiceImpl) debug(template string, args ...interface{}) {
 	if l.options.Debug {
 		log.Debugf(template, args...)
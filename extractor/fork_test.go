@@ -0,0 +1,313 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+// reorgRds keeps blocks and checkpoint in memory, other methods of RdsService aren't used by extractor
+type reorgRds struct {
+	dao.RdsService
+
+	mtx        sync.Mutex
+	blocks     map[string]*dao.Block
+	checkpoint *dao.ExtractorCheckpoint
+}
+
+func newReorgRds() *reorgRds {
+	return &reorgRds{blocks: make(map[string]*dao.Block)}
+}
+
+func (s *reorgRds) GetExtractorCheckpoint() (*dao.ExtractorCheckpoint, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if nil == s.checkpoint {
+		return nil, errors.New("record not found")
+	}
+	checkpoint := *s.checkpoint
+	return &checkpoint, nil
+}
+
+func (s *reorgRds) SaveExtractorCheckpoint(blockNumber int64, blockHash common.Hash) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.checkpoint = &dao.ExtractorCheckpoint{BlockNumber: blockNumber, BlockHash: blockHash.Hex()}
+	return nil
+}
+
+func (s *reorgRds) CommitExtractedBlock(block *dao.Block, eventLogs []*dao.EventLog) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.blocks[block.BlockHash] = block
+	s.checkpoint = &dao.ExtractorCheckpoint{BlockNumber: block.BlockNumber, BlockHash: block.BlockHash}
+	return nil
+}
+
+func (s *reorgRds) FindLatestBlock() (*dao.Block, error) {
+	return nil, errors.New("record not found")
+}
+
+func (s *reorgRds) FindBlockByParentHash(parentHash common.Hash) (*dao.Block, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if block, ok := s.blocks[parentHash.Hex()]; ok {
+		return block, nil
+	}
+	return nil, errors.New("record not found")
+}
+
+func (s *reorgRds) SetForkBlock(blockHash common.Hash) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if block, ok := s.blocks[blockHash.Hex()]; ok {
+		block.Fork = true
+	}
+	return nil
+}
+
+// scriptedChain returns blocks 1..length, the blocks after forkBlock have different hashes on branch b
+func scriptedChain(length, forkBlock int64, branch byte) []*types.Block {
+	chain := []*types.Block{}
+	parentHash := common.Hash{}
+	parentHash[0] = 0xff
+	for number := int64(1); number <= length; number++ {
+		block := &types.Block{BlockNumber: big.NewInt(number), ParentHash: parentHash, CreateTime: number}
+		block.BlockHash[0] = 'a'
+		if number > forkBlock {
+			block.BlockHash[0] = branch
+		}
+		block.BlockHash[31] = byte(number)
+		chain = append(chain, block)
+		parentHash = block.BlockHash
+	}
+	return chain
+}
+
+func toExtractedBlock(block *types.Block) *extractedBlock {
+	extracted := &extractedBlock{currentBlock: block}
+	extracted.block = &ethaccessor.BlockWithTxAndReceipt{}
+	extracted.block.Number = new(types.Big).SetInt(block.BlockNumber)
+	extracted.block.Hash = block.BlockHash
+	extracted.block.ParentHash = block.ParentHash
+	extracted.block.Timestamp = new(types.Big).SetInt(big.NewInt(block.CreateTime))
+	return extracted
+}
+
+// TestReplayChainReorg replays a reorg: blocks 1..7 of chain a are extracted, then the chain is
+// replaced by chain b from block 6. the fork is processed in place and extractor continues from block 6 of b
+func TestReplayChainReorg(t *testing.T) {
+	chainA := scriptedChain(10, 5, 'a')
+	chainB := scriptedChain(10, 5, 'b')
+
+	var (
+		mtx      sync.Mutex
+		reorged  bool
+		phases   []string
+		newBlock []common.Hash
+	)
+	current := func() []*types.Block {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if reorged {
+			return chainB
+		}
+		return chainA
+	}
+
+	rds := newReorgRds()
+	l := &ExtractorServiceImpl{}
+	l.dao = rds
+	l.options.MaxReorgDepth = 3
+	l.detector = newForkDetector(rds, l.options.MaxReorgDepth)
+	l.detector.getBlock = func(hash common.Hash) (*types.Block, error) {
+		for _, block := range current() {
+			if block.BlockHash == hash {
+				return block, nil
+			}
+		}
+		return nil, errors.New("block not found")
+	}
+	l.syncComplete = true
+
+	record := func(topic string) *eventemitter.Watcher {
+		return &eventemitter.Watcher{Concurrent: false, Handle: func(input eventemitter.EventData) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if topic == eventemitter.Block_New {
+				newBlock = append(newBlock, input.(*types.BlockEvent).BlockHash)
+			} else {
+				phases = append(phases, topic)
+			}
+			return nil
+		}}
+	}
+	for _, topic := range []string{eventemitter.Block_New, eventemitter.ChainForkDetected, eventemitter.ChainForkProcess, eventemitter.ChainForkComplete} {
+		watcher := record(topic)
+		eventemitter.On(topic, watcher)
+		defer eventemitter.Un(topic, watcher)
+	}
+
+	var forkEvent *types.ForkedEvent
+	forkWatcher := &eventemitter.Watcher{Concurrent: false, Handle: func(input eventemitter.EventData) error {
+		forkEvent = input.(*types.ForkedEvent)
+		return nil
+	}}
+	eventemitter.On(eventemitter.ChainForkProcess, forkWatcher)
+	defer eventemitter.Un(eventemitter.ChainForkProcess, forkWatcher)
+
+	fetch := func(from, to *big.Int) ([]*extractedBlock, error) {
+		// the chain reorgs before block 8 is fetched
+		if from.Int64() == 8 {
+			mtx.Lock()
+			reorged = true
+			mtx.Unlock()
+		}
+		blocks := []*extractedBlock{}
+		chain := current()
+		for number := from.Int64(); number <= to.Int64(); number++ {
+			blocks = append(blocks, toExtractedBlock(chain[number-1]))
+		}
+		return blocks, nil
+	}
+	pipeline := newBlockPipeline(1, 1, 0, big.NewInt(1), big.NewInt(10), fetch, l.processBlock)
+	pipeline.latestBlock = func() (*big.Int, error) {
+		return big.NewInt(10), nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pipeline.run(make(chan bool, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("pipeline should reach the end block")
+	}
+
+	if nil == forkEvent || forkEvent.ForkBlock.Int64() != 5 || forkEvent.ForkHash != chainA[4].BlockHash || forkEvent.DetectedHash != chainB[7].BlockHash {
+		t.Fatalf("fork should be detected at block 8 of chain b and forked from block 5, but got %+v", forkEvent)
+	}
+	expectedPhases := []string{eventemitter.ChainForkDetected, eventemitter.ChainForkProcess, eventemitter.ChainForkComplete}
+	if len(phases) != len(expectedPhases) {
+		t.Fatalf("fork phases should be %v, but got %v", expectedPhases, phases)
+	}
+	for idx, phase := range phases {
+		if phase != expectedPhases[idx] {
+			t.Fatalf("fork phases should be %v, but got %v", expectedPhases, phases)
+		}
+	}
+
+	// blocks 1..7 of chain a, then 6..10 of chain b, block 8 of chain b isn't emitted before fork processed
+	expectedBlocks := []common.Hash{}
+	for _, block := range chainA[:7] {
+		expectedBlocks = append(expectedBlocks, block.BlockHash)
+	}
+	for _, block := range chainB[5:] {
+		expectedBlocks = append(expectedBlocks, block.BlockHash)
+	}
+	if len(newBlock) != len(expectedBlocks) {
+		t.Fatalf("%d blocks should be emitted, but got %d", len(expectedBlocks), len(newBlock))
+	}
+	for idx, hash := range newBlock {
+		if hash != expectedBlocks[idx] {
+			t.Fatalf("block %d should be %s, but got %s", idx, expectedBlocks[idx].Hex(), hash.Hex())
+		}
+	}
+
+	checkpoint, err := rds.GetExtractorCheckpoint()
+	if err != nil || checkpoint.BlockNumber != 10 || checkpoint.BlockHash != chainB[9].BlockHash.Hex() {
+		t.Fatalf("checkpoint should be block 10 of chain b, but got %+v", checkpoint)
+	}
+}
+
+// TestReindex checks that blocks are reindexed in chunks, and the blocks after checkpoint are refused
+func TestReindex(t *testing.T) {
+	chain := scriptedChain(10, 10, 'a')
+	rds := newReorgRds()
+	rds.SaveExtractorCheckpoint(8, chain[7].BlockHash)
+	l := &ExtractorServiceImpl{}
+	l.dao = rds
+
+	if err := l.Reindex(big.NewInt(1), big.NewInt(9), nil); nil == err {
+		t.Fatalf("block 9 after checkpoint 8 shouldn't be reindexed")
+	}
+
+	const topic = "TestReindex"
+	var emitted []int64
+	watcher := &eventemitter.Watcher{Concurrent: false, Handle: func(input eventemitter.EventData) error {
+		emitted = append(emitted, input.(*types.Block).BlockNumber.Int64())
+		return nil
+	}}
+	eventemitter.On(topic, watcher)
+	defer eventemitter.Un(topic, watcher)
+
+	fetch := func(from, to *big.Int) ([]*extractedBlock, error) {
+		blocks := []*extractedBlock{}
+		for number := from.Int64(); number <= to.Int64(); number++ {
+			block := toExtractedBlock(chain[number-1])
+			block.items = append(block.items, extractedItem{topic: topic, data: chain[number-1]})
+			blocks = append(blocks, block)
+		}
+		return blocks, nil
+	}
+	var chunks [][2]int64
+	err := l.reindex(big.NewInt(2), big.NewInt(8), 3, fetch, func(from, to *big.Int, emit func()) error {
+		// events of the chunk are emitted after it's rolled back
+		if len(emitted) != int(from.Int64()-2) {
+			t.Fatalf("events before block %s should be emitted, but got %v", from.String(), emitted)
+		}
+		chunks = append(chunks, [2]int64{from.Int64(), to.Int64()})
+		emit()
+		return nil
+	})
+	if nil != err {
+		t.Fatalf("reindex error:%s", err.Error())
+	}
+	expectedChunks := [][2]int64{{2, 4}, {5, 7}, {8, 8}}
+	if len(chunks) != len(expectedChunks) {
+		t.Fatalf("chunks should be %v, but got %v", expectedChunks, chunks)
+	}
+	for idx, chunk := range chunks {
+		if chunk != expectedChunks[idx] {
+			t.Fatalf("chunks should be %v, but got %v", expectedChunks, chunks)
+		}
+	}
+	if len(emitted) != 7 || emitted[0] != 2 || emitted[6] != 8 {
+		t.Fatalf("events of blocks 2..8 should be emitted, but got %v", emitted)
+	}
+}
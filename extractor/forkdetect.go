@@ -19,27 +19,35 @@
 package extractor
 
 import (
+	"fmt"
 	"github.com/Loopring/relay/dao"
 	"github.com/Loopring/relay/ethaccessor"
-	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
 )
 
 type forkDetector struct {
-	db          dao.RdsService
-	latestBlock *types.Block
+	db            dao.RdsService
+	latestBlock   *types.Block
+	maxReorgDepth int64
+	getBlock      func(hash common.Hash) (*types.Block, error) //gets block header from ethereum node
 }
 
-func newForkDetector(db dao.RdsService) *forkDetector {
+func newForkDetector(db dao.RdsService, maxReorgDepth int64) *forkDetector {
 	detector := &forkDetector{}
 	detector.db = db
 	detector.latestBlock = nil
+	detector.maxReorgDepth = maxReorgDepth
+	detector.getBlock = getBlockByHash
 
 	return detector
 }
 
-func (detector *forkDetector) Detect(currentBlock *types.Block) bool {
+// Detect returns the fork event if currentBlock isn't a child of the latest block, the latest block is
+// rewound to the forked block, and the blocks after it should be extracted again
+func (detector *forkDetector) Detect(currentBlock *types.Block) *types.ForkedEvent {
 	var (
 		forkEvent types.ForkedEvent
 	)
@@ -47,33 +55,40 @@ func (detector *forkDetector) Detect(currentBlock *types.Block) bool {
 	// filter invalid block
 	if types.IsZeroHash(currentBlock.ParentHash) || types.IsZeroHash(currentBlock.BlockHash) {
 		log.Debugf("extractor,fork detector find invalid block:%s", currentBlock.BlockNumber.String())
-		return false
+		return nil
 	}
 
-	// initialize latest block
+	// initialize latest block, it's the checkpoint of extractor
 	if detector.latestBlock == nil {
-		entity, err := detector.db.FindLatestBlock()
-		if err != nil {
-			detector.latestBlock = currentBlock
-			log.Debugf("extractor,fork detector started at first time")
-			return false
-		} else {
+		if checkpoint, err := detector.db.GetExtractorCheckpoint(); err == nil {
+			detector.latestBlock = new(types.Block)
+			checkpoint.ConvertUp(detector.latestBlock)
+		} else if entity, err := detector.db.FindLatestBlock(); err == nil {
 			detector.latestBlock = new(types.Block)
 			entity.ConvertUp(detector.latestBlock)
+		} else {
+			detector.latestBlock = currentBlock
+			log.Debugf("extractor,fork detector started at first time")
+			return nil
 		}
 	}
 
 	// no fork
 	if detector.latestBlock.BlockHash == currentBlock.BlockHash || detector.latestBlock.BlockHash == currentBlock.ParentHash {
 		detector.latestBlock = currentBlock
-		return false
+		return nil
 	}
 
 	// find forked root block
-	forkBlock, err := detector.getForkedBlock(currentBlock)
+	forkBlock, err := detector.getForkedBlock(currentBlock, 0)
 	if err != nil {
 		log.Fatalf("extractor,get forked block failed :%s,node should be shut down...", err.Error())
 	}
+	depth := new(big.Int).Sub(detector.latestBlock.BlockNumber, forkBlock.BlockNumber).Int64()
+	if detector.maxReorgDepth > 0 && depth > detector.maxReorgDepth {
+		log.Fatalf("extractor,chain reorg depth %d from block %s to %s exceeds max reorg depth %d, node halts and the rollback should be checked manually",
+			depth, forkBlock.BlockNumber.String(), detector.latestBlock.BlockNumber.String(), detector.maxReorgDepth)
+	}
 	detector.latestBlock = forkBlock
 
 	// mark fork block in database
@@ -84,23 +99,27 @@ func (detector *forkDetector) Detect(currentBlock *types.Block) bool {
 		}
 	}
 
-	// emit fork event
+	// rewind checkpoint, extractor starts from the forked block after restart even if fork isn't processed
+	if err := detector.db.SaveExtractorCheckpoint(forkBlock.BlockNumber.Int64(), forkBlock.BlockHash); err != nil {
+		log.Fatalf("extractor,fork detector rewind checkpoint to %s failed, err:%s", forkBlock.BlockHash.Hex(), err.Error())
+	}
+
 	forkEvent.ForkHash = forkBlock.BlockHash
 	forkEvent.ForkBlock = forkBlock.BlockNumber
 	forkEvent.DetectedHash = currentBlock.BlockHash
 	forkEvent.DetectedBlock = currentBlock.BlockNumber
 
-	log.Debugf("extractor,detected chain fork, from :%d to %d", forkEvent.ForkBlock.Int64(), forkEvent.DetectedBlock.Int64())
-	eventemitter.Emit(eventemitter.ChainForkDetected, &forkEvent)
+	log.Warnf("extractor,detected chain fork, from :%d to %d, depth:%d", forkEvent.ForkBlock.Int64(), forkEvent.DetectedBlock.Int64(), depth)
 
-	return true
+	return &forkEvent
 }
 
-func (detector *forkDetector) getForkedBlock(block *types.Block) (*types.Block, error) {
-	var (
-		ethBlock    ethaccessor.Block
-		parentBlock types.Block
-	)
+func (detector *forkDetector) getForkedBlock(block *types.Block, depth int64) (*types.Block, error) {
+	if detector.maxReorgDepth > 0 && depth > detector.maxReorgDepth {
+		return nil, fmt.Errorf("no forked block found in %d blocks before %s, it exceeds max reorg depth", depth, block.BlockNumber.String())
+	}
+
+	var parentBlock types.Block
 
 	// find parent block in database
 	if parentBlockModel, err := detector.db.FindBlockByParentHash(block.ParentHash); err == nil {
@@ -108,14 +127,23 @@ func (detector *forkDetector) getForkedBlock(block *types.Block) (*types.Block,
 		return &parentBlock, nil
 	}
 
-	if err := ethaccessor.GetBlockByHash(&ethBlock, block.ParentHash.Hex(), false); err != nil {
+	preBlock, err := detector.getBlock(block.ParentHash)
+	if err != nil {
 		return nil, err
 	}
 
-	preBlock := &types.Block{}
-	preBlock.BlockNumber = ethBlock.Number.BigInt()
-	preBlock.BlockHash = ethBlock.Hash
-	preBlock.ParentHash = ethBlock.ParentHash
+	return detector.getForkedBlock(preBlock, depth+1)
+}
+
+func getBlockByHash(hash common.Hash) (*types.Block, error) {
+	var ethBlock ethaccessor.Block
+	if err := ethaccessor.GetBlockByHash(&ethBlock, hash.Hex(), false); err != nil {
+		return nil, err
+	}
 
-	return detector.getForkedBlock(preBlock)
+	block := &types.Block{}
+	block.BlockNumber = ethBlock.Number.BigInt()
+	block.BlockHash = ethBlock.Hash
+	block.ParentHash = ethBlock.ParentHash
+	return block, nil
 }
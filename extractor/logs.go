@@ -0,0 +1,234 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	defaultLogsRange = 100
+
+	// tx hashes of each query of miner transactions
+	minerTxQuerySize = 500
+)
+
+// events emitted by the methods decoded by processor, the transaction is fetched to decode its method only if
+// it emits one of them. failed transactions emit nothing, only the failed ones sent by miners of relay are decoded
+var methodEventNames = map[string]bool{
+	RINGMINED_EVT_NAME:          true,
+	CANCEL_EVT_NAME:             true,
+	RINGHASHREGISTERED_EVT_NAME: true,
+	APPROVAL_EVT_NAME:           true,
+}
+
+// extractLogs gets the logs of contracts known to processor by eth_getLogs, instead of all transactions and
+// receipts of blocks. the block headers are still fetched to emit Block_New and detect fork
+func (l *ExtractorServiceImpl) extractLogs(from, to *big.Int) ([]*extractedBlock, error) {
+	headers, err := ethaccessor.GetBlocks(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []ethaccessor.Log
+	if err := ethaccessor.GetLogs(&logs, from, to, l.processor.ContractAddresses()); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		if c := logs[i].BlockNumber.BigInt().Cmp(logs[j].BlockNumber.BigInt()); c != 0 {
+			return c < 0
+		}
+		return logs[i].LogIndex.BigInt().Cmp(logs[j].LogIndex.BigInt()) < 0
+	})
+
+	// group logs by transaction
+	type txLogs struct {
+		receipt     ethaccessor.TransactionReceipt
+		needsMethod bool
+		minerTx     bool //sent by miners of relay without logs, its receipt is fetched to know whether it failed
+		transaction *ethaccessor.Transaction
+	}
+	txByHash := make(map[string]*txLogs)
+	for _, evtLog := range logs {
+		if evtLog.Removed {
+			continue
+		}
+		tx, ok := txByHash[evtLog.TransactionHash]
+		if !ok {
+			tx = &txLogs{}
+			tx.receipt.TransactionHash = evtLog.TransactionHash
+			tx.receipt.BlockHash = evtLog.BlockHash
+			tx.receipt.BlockNumber = evtLog.BlockNumber
+			txByHash[evtLog.TransactionHash] = tx
+		}
+		tx.receipt.Logs = append(tx.receipt.Logs, evtLog)
+		if l.needsMethod(evtLog) {
+			tx.needsMethod = true
+		}
+	}
+
+	// failed txs of miners emit no logs, they are found in the txs saved by nonce manager
+	var noLogsTxHashes []string
+	for _, header := range headers {
+		for _, hash := range header.Transactions {
+			if _, ok := txByHash[hash]; !ok {
+				noLogsTxHashes = append(noLogsTxHashes, hash)
+			}
+		}
+	}
+	minerTxHashes, err := l.minerTxHashes(noLogsTxHashes)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range minerTxHashes {
+		txByHash[hash] = &txLogs{needsMethod: true, minerTx: true}
+	}
+
+	// fetch transactions whose methods should be decoded, and receipts of the txs of miners
+	var (
+		txReqs []*ethaccessor.BatchTransactionReq
+		rcReqs []*ethaccessor.BatchTransactionRecipientReq
+	)
+	for hash, tx := range txByHash {
+		if tx.needsMethod {
+			txReqs = append(txReqs, &ethaccessor.BatchTransactionReq{TxHash: hash})
+		}
+		if tx.minerTx {
+			rcReqs = append(rcReqs, &ethaccessor.BatchTransactionRecipientReq{TxHash: hash})
+		}
+	}
+	if len(txReqs) > 0 {
+		if err := ethaccessor.BatchTransactions(txReqs, to.String()); err != nil {
+			return nil, err
+		}
+		for _, req := range txReqs {
+			if req.Err != nil {
+				return nil, req.Err
+			}
+			transaction := req.TxContent
+			txByHash[req.TxHash].transaction = &transaction
+		}
+	}
+	if len(rcReqs) > 0 {
+		if err := ethaccessor.BatchTransactionRecipients(rcReqs, to.String()); err != nil {
+			return nil, err
+		}
+		for _, req := range rcReqs {
+			if req.Err != nil {
+				return nil, req.Err
+			}
+			txByHash[req.TxHash].receipt = req.TxContent
+		}
+	}
+
+	blocks := []*extractedBlock{}
+	for idx, header := range headers {
+		number := new(big.Int).Add(from, big.NewInt(int64(idx)))
+		if header.Number.BigInt().Cmp(number) != 0 {
+			return nil, fmt.Errorf("block number %s != %s", header.Number.BigInt().String(), number.String())
+		}
+
+		extracted := &extractedBlock{}
+		extracted.block = &ethaccessor.BlockWithTxAndReceipt{Block: header.Block}
+		extracted.currentBlock = &types.Block{}
+		extracted.currentBlock.BlockNumber = header.Number.BigInt()
+		extracted.currentBlock.ParentHash = header.ParentHash
+		extracted.currentBlock.BlockHash = header.Hash
+		extracted.currentBlock.CreateTime = header.Timestamp.Int64()
+
+		// txs are emitted in the order of block as full block mode
+		for _, hash := range header.Transactions {
+			tx, ok := txByHash[hash]
+			if !ok {
+				continue
+			}
+			// logs of uncle block are returned if the block is replaced during the query
+			if common.HexToHash(tx.receipt.BlockHash) != header.Hash {
+				return nil, fmt.Errorf("block %s hash of tx %s %s != %s", number.String(), hash, tx.receipt.BlockHash, header.Hash.Hex())
+			}
+			l.debug("extractor,tx:%s", hash)
+			// only receipts of miner txs are fetched, the txs with logs succeeded
+			txIsFailed := tx.minerTx && tx.receipt.IsFailed()
+			if !txIsFailed {
+				extracted.items = append(extracted.items, l.processEvent(tx.receipt, header.Timestamp.BigInt())...)
+			}
+
+			if nil == tx.transaction {
+				continue
+			}
+			extracted.block.Transactions = append(extracted.block.Transactions, *tx.transaction)
+			if l.processor.HasContract(common.HexToAddress(tx.transaction.To)) {
+				if item, ok := l.processMethod(*tx.transaction, header.Timestamp.BigInt(), extracted.currentBlock.BlockNumber, txIsFailed); ok {
+					extracted.items = append(extracted.items, item)
+				}
+			}
+		}
+		blocks = append(blocks, extracted)
+	}
+	return blocks, nil
+}
+
+// minerTxHashes returns the hashes in txHashes of the txs sent by miners of relay
+func (l *ExtractorServiceImpl) minerTxHashes(txHashes []string) ([]string, error) {
+	var hashes []string
+	for start := 0; start < len(txHashes); start += minerTxQuerySize {
+		end := start + minerTxQuerySize
+		if end > len(txHashes) {
+			end = len(txHashes)
+		}
+		query := make(map[string]string)
+		var queryHashes []string
+		for _, hash := range txHashes[start:end] {
+			formatted := common.HexToHash(hash).Hex()
+			query[formatted] = hash
+			queryHashes = append(queryHashes, formatted)
+		}
+		minerTxs, err := l.dao.GetMinerTransactionsByHashes(queryHashes)
+		if err != nil {
+			return nil, err
+		}
+		for _, minerTx := range minerTxs {
+			if hash, ok := query[minerTx.TxHash]; ok {
+				hashes = append(hashes, hash)
+				delete(query, minerTx.TxHash)
+			}
+		}
+	}
+	return hashes, nil
+}
+
+// needsMethod returns true if the log may be emitted by a method decoded by processor,
+// the events of weth aren't all known, so the transactions emitting logs of weth are always fetched
+func (l *ExtractorServiceImpl) needsMethod(evtLog ethaccessor.Log) bool {
+	if common.HexToAddress(evtLog.Address) == util.WethTokenAddress() {
+		return true
+	}
+	if len(evtLog.Topics) == 0 {
+		return false
+	}
+	event, ok := l.processor.GetEvent(common.HexToHash(evtLog.Topics[0]))
+	return ok && methodEventNames[event.Name]
+}
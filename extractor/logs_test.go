@@ -0,0 +1,72 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Loopring/relay/dao"
+)
+
+// minerTxRds keeps the tx hashes of miners, other methods of RdsService aren't used
+type minerTxRds struct {
+	dao.RdsService
+	txHashes map[string]bool
+	queries  int
+}
+
+func (s *minerTxRds) GetMinerTransactionsByHashes(txHashes []string) ([]dao.MinerTransaction, error) {
+	s.queries++
+	var list []dao.MinerTransaction
+	for _, hash := range txHashes {
+		if s.txHashes[hash] {
+			list = append(list, dao.MinerTransaction{TxHash: hash})
+		}
+	}
+	return list, nil
+}
+
+func TestMinerTxHashes(t *testing.T) {
+	var txHashes, expected []string
+	rds := &minerTxRds{txHashes: make(map[string]bool)}
+	for i := 0; i < minerTxQuerySize+10; i++ {
+		hash := fmt.Sprintf("0x%064x", i)
+		txHashes = append(txHashes, hash)
+		if i%100 == 1 {
+			rds.txHashes[hash] = true
+			expected = append(expected, hash)
+		}
+	}
+
+	l := &ExtractorServiceImpl{dao: rds}
+	hashes, err := l.minerTxHashes(txHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(hashes)
+	if !reflect.DeepEqual(hashes, expected) {
+		t.Fatalf("miner txs should be %v, but got %v", expected, hashes)
+	}
+	if rds.queries != 2 {
+		t.Fatalf("tx hashes should be queried in 2 batches, but got %d", rds.queries)
+	}
+}
@@ -0,0 +1,300 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+)
+
+const (
+	// the interval to query the latest block after the pipeline catches up with the chain
+	blockPollInterval = 5 * time.Second
+
+	defaultRetryInterval = time.Second
+	maxRetryInterval     = time.Minute
+)
+
+// blockPipeline fetches and decodes at most workers ranges of blocks concurrently, and applies them strictly in block order.
+// a range holds its worker slot until it's applied, so no more than workers ranges are kept in memory.
+// apply returns the block to rewind to after chain fork, the fetched blocks after it are discarded
+type blockPipeline struct {
+	workers         int
+	step            uint64 //blocks of each range
+	confirms        uint64
+	start           *big.Int
+	end             *big.Int
+	fetch           func(from, to *big.Int) ([]*extractedBlock, error)
+	apply           func(block *extractedBlock) (rewind *big.Int)
+	latestBlock     func() (*big.Int, error)
+	metrics         *extractorMetrics
+	metricsInterval time.Duration
+	maxRetries      int //a range is fetched again after failed, 0 means never
+	retryInterval   time.Duration
+}
+
+type fetchResult struct {
+	from     uint64
+	to       uint64
+	blocks   []*extractedBlock
+	err      error
+	duration time.Duration
+}
+
+func newBlockPipeline(workers int, step uint64, confirms uint64, start, end *big.Int, fetch func(from, to *big.Int) ([]*extractedBlock, error), apply func(block *extractedBlock) *big.Int) *blockPipeline {
+	p := &blockPipeline{}
+	p.workers = workers
+	if p.workers <= 0 {
+		p.workers = 1
+	}
+	p.step = step
+	if p.step <= 0 {
+		p.step = 1
+	}
+	p.confirms = confirms
+	p.start = new(big.Int).Set(start)
+	if nil != end && end.Sign() > 0 {
+		p.end = new(big.Int).Set(end)
+	}
+	p.fetch = fetch
+	p.apply = apply
+	p.latestBlock = latestBlockNumber
+	p.metrics = newExtractorMetrics()
+	p.retryInterval = defaultRetryInterval
+	return p
+}
+
+func (p *blockPipeline) run(stop chan bool) {
+	start := new(big.Int).Set(p.start)
+	for {
+		rewind, stopped := p.runFrom(start, stop)
+		if stopped {
+			return
+		}
+		log.Infof("extractor,pipeline rewinds to block:%s", rewind.String())
+		start = rewind
+	}
+}
+
+// runFrom applies blocks from start until stopped, or a block is rewound by apply. workers of the
+// discarded ranges are stopped by quit, and their results are dropped with the buffered channel
+func (p *blockPipeline) runFrom(start *big.Int, stop chan bool) (rewind *big.Int, stopped bool) {
+	quit := make(chan struct{})
+	defer close(quit)
+
+	slots := make(chan struct{}, p.workers)
+	results := make(chan *fetchResult, p.workers)
+	go p.dispatch(start, slots, results, quit)
+
+	var tick <-chan time.Time
+	if p.metricsInterval > 0 {
+		ticker := time.NewTicker(p.metricsInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	pending := make(map[uint64]*fetchResult)
+	next := start.Uint64()
+	for {
+		select {
+		case <-stop:
+			return nil, true
+		case <-tick:
+			p.metrics.log()
+		case result := <-results:
+			pending[result.from] = result
+			for {
+				ready, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				if nil != ready.err {
+					log.Fatalf("extractor,fetch block:%d->%d error:%s", ready.from, ready.to, ready.err.Error())
+				}
+				for _, block := range ready.blocks {
+					if rewind := p.apply(block); nil != rewind {
+						return rewind, false
+					}
+					p.metrics.record(block, ready.duration/time.Duration(len(ready.blocks)))
+				}
+				<-slots
+
+				if nil != p.end && ready.to >= p.end.Uint64() {
+					log.Infof("extractor,reached end block:%d", ready.to)
+					return nil, true
+				}
+				next = ready.to + 1
+			}
+		}
+	}
+}
+
+// dispatch starts a worker for each range of confirmed blocks in order once a slot is released,
+// the range is shorter than step if it reaches the confirmed or end block
+func (p *blockPipeline) dispatch(start *big.Int, slots chan struct{}, results chan *fetchResult, quit chan struct{}) {
+	number := new(big.Int).Set(start)
+	confirmed := big.NewInt(-1)
+	for {
+		if nil != p.end && number.Cmp(p.end) > 0 {
+			return
+		}
+		for number.Cmp(confirmed) > 0 {
+			if latest, err := p.latestBlock(); nil != err {
+				log.Errorf("extractor,get ethereum node current block number error:%s", err.Error())
+			} else {
+				confirmed.Sub(latest, new(big.Int).SetUint64(p.confirms))
+			}
+			if number.Cmp(confirmed) <= 0 {
+				break
+			}
+			select {
+			case <-quit:
+				return
+			case <-time.After(blockPollInterval):
+			}
+		}
+
+		select {
+		case <-quit:
+			return
+		case slots <- struct{}{}:
+		}
+		to := new(big.Int).Add(number, new(big.Int).SetUint64(p.step-1))
+		if to.Cmp(confirmed) > 0 {
+			to.Set(confirmed)
+		}
+		if nil != p.end && to.Cmp(p.end) > 0 {
+			to.Set(p.end)
+		}
+		go func(from, to *big.Int) {
+			startTime := time.Now()
+			var blocks []*extractedBlock
+			err := retryWithBackoff(p.maxRetries, p.retryInterval, quit, func() (err error) {
+				if blocks, err = p.fetch(from, to); err != nil {
+					log.Errorf("extractor,fetch block:%s->%s error:%s", from.String(), to.String(), err.Error())
+				}
+				return err
+			})
+			results <- &fetchResult{from: from.Uint64(), to: to.Uint64(), blocks: blocks, err: err, duration: time.Since(startTime)}
+		}(new(big.Int).Set(number), to)
+		number.Add(to, big.NewInt(1))
+	}
+}
+
+// retryWithBackoff calls fn until it succeeds or maxRetries retries failed, the interval is doubled after
+// each retry up to maxRetryInterval. it stops waiting when quit is closed, a nil quit never closes
+func retryWithBackoff(maxRetries int, interval time.Duration, quit <-chan struct{}, fn func() error) error {
+	err := fn()
+	for retried := 0; err != nil && retried < maxRetries; retried++ {
+		select {
+		case <-quit:
+			return err
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+		err = fn()
+	}
+	return err
+}
+
+func latestBlockNumber() (*big.Int, error) {
+	var blockNumber types.Big
+	if err := ethaccessor.BlockNumber(&blockNumber); nil != err {
+		return nil, err
+	}
+	return blockNumber.BigInt(), nil
+}
+
+// ExtractorMetrics is the throughput of extractor since it's started
+type ExtractorMetrics struct {
+	Blocks                int64
+	Transactions          int64
+	Events                int64 //events and methods emitted
+	LatestBlock           int64
+	BlocksPerSecond       float64
+	TransactionsPerSecond float64
+	AvgFetchDuration      time.Duration //average time to fetch and decode a block by a worker
+}
+
+type extractorMetrics struct {
+	mtx           sync.Mutex
+	startTime     time.Time
+	current       ExtractorMetrics
+	fetchDuration time.Duration
+
+	lastLogTime time.Time
+	lastLogged  ExtractorMetrics
+}
+
+func newExtractorMetrics() *extractorMetrics {
+	m := &extractorMetrics{}
+	m.startTime = time.Now()
+	m.lastLogTime = m.startTime
+	return m
+}
+
+func (m *extractorMetrics) record(block *extractedBlock, fetchDuration time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.current.Blocks++
+	m.current.Transactions += int64(len(block.block.Transactions))
+	m.current.Events += int64(block.emittedCount())
+	m.current.LatestBlock = block.currentBlock.BlockNumber.Int64()
+	m.fetchDuration += fetchDuration
+}
+
+func (m *extractorMetrics) snapshot() ExtractorMetrics {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	metrics := m.current
+	if seconds := time.Since(m.startTime).Seconds(); seconds > 0 {
+		metrics.BlocksPerSecond = float64(metrics.Blocks) / seconds
+		metrics.TransactionsPerSecond = float64(metrics.Transactions) / seconds
+	}
+	if metrics.Blocks > 0 {
+		metrics.AvgFetchDuration = m.fetchDuration / time.Duration(metrics.Blocks)
+	}
+	return metrics
+}
+
+// log prints the throughput of the last interval
+func (m *extractorMetrics) log() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now()
+	seconds := now.Sub(m.lastLogTime).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	blocks := m.current.Blocks - m.lastLogged.Blocks
+	txs := m.current.Transactions - m.lastLogged.Transactions
+	events := m.current.Events - m.lastLogged.Events
+	log.Infof("extractor,metrics latest block:%d, blocks:%d(%.2f/s), transactions:%d(%.2f/s), events:%d",
+		m.current.LatestBlock, blocks, float64(blocks)/seconds, txs, float64(txs)/seconds, events)
+	m.lastLogTime = now
+	m.lastLogged = m.current
+}
@@ -0,0 +1,80 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+)
+
+// Reindex extracts the blocks from..to again in chunks, for each chunk handle is called after all blocks of it
+// fetched, and emit emits their events in order. blocks, event logs and checkpoint aren't saved, and no fork is
+// detected, so the blocks after the checkpoint are refused, they belong to the extractor of the live node
+func (l *ExtractorServiceImpl) Reindex(from, to *big.Int, handle func(from, to *big.Int, emit func()) error) error {
+	if checkpoint, err := l.dao.GetExtractorCheckpoint(); err == nil && to.Int64() > checkpoint.BlockNumber {
+		return fmt.Errorf("block:%s is after the checkpoint:%d of live node", to.String(), checkpoint.BlockNumber)
+	}
+	_, fetch, err := l.fetcher()
+	if err != nil {
+		return err
+	}
+	step := l.options.LogsRange
+	if step <= 0 {
+		step = defaultLogsRange
+	}
+	return l.reindex(from, to, step, fetch, handle)
+}
+
+func (l *ExtractorServiceImpl) reindex(from, to *big.Int, step uint64, fetch func(from, to *big.Int) ([]*extractedBlock, error), handle func(from, to *big.Int, emit func()) error) error {
+	for start := new(big.Int).Set(from); start.Cmp(to) <= 0; start.Add(start, new(big.Int).SetUint64(step)) {
+		end := new(big.Int).Add(start, new(big.Int).SetUint64(step-1))
+		if end.Cmp(to) > 0 {
+			end.Set(to)
+		}
+
+		var blocks []*extractedBlock
+		err := retryWithBackoff(l.options.MaxRetries, l.retryInterval(), nil, func() (err error) {
+			if blocks, err = fetch(start, end); err != nil {
+				log.Errorf("extractor,reindex fetch block:%s->%s error:%s", start.String(), end.String(), err.Error())
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		emit := func() {
+			for _, block := range blocks {
+				for _, item := range block.items {
+					if item.topic != "" {
+						eventemitter.Emit(item.topic, item.data)
+					}
+				}
+			}
+		}
+		if err := handle(new(big.Int).Set(start), new(big.Int).Set(end), emit); err != nil {
+			return err
+		}
+		log.Infof("extractor,reindexed block:%s->%s", start.String(), end.String())
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// 错误码一旦发布不能修改，钱包根据code展示提示信息
+const (
+	InvalidParamsErrorCode       = -32602
+	InvalidOrderErrorCode        = 10001
+	InvalidSignatureErrorCode    = 10002
+	UnsupportedTokenErrorCode    = 10003
+	UnsupportedMarketErrorCode   = 10004
+	OrderCutoffErrorCode         = 10005
+	PriceOutOfRangeErrorCode     = 10006
+	OrderExistsErrorCode         = 10007
+	OrderValueTooLowErrorCode    = 10008
+	OrderExpiredErrorCode        = 10009
+	InsufficientBalanceErrorCode = 10010
+	TooManyOpenOrdersErrorCode   = 10011
+	NotInWhiteListErrorCode      = 10012
+	OrderNotFoundErrorCode       = 10013
+	OrderNotCancellableErrorCode = 10014
+	RingNotFoundErrorCode        = 10015
+	StorageUnavailableErrorCode  = 10100
+	NodeUnavailableErrorCode     = 10101
+	ChainForkingErrorCode        = 10102
+	RateLimitErrorCode           = -32005
+)
+
+type ErrorKind struct {
+	Code int
+	Name string
+}
+
+var (
+	ErrInvalidParams       = ErrorKind{InvalidParamsErrorCode, "INVALID_PARAMS"}
+	ErrInvalidOrder        = ErrorKind{InvalidOrderErrorCode, "INVALID_ORDER"}
+	ErrInvalidSignature    = ErrorKind{InvalidSignatureErrorCode, "INVALID_SIGNATURE"}
+	ErrUnsupportedToken    = ErrorKind{UnsupportedTokenErrorCode, "UNSUPPORTED_TOKEN"}
+	ErrUnsupportedMarket   = ErrorKind{UnsupportedMarketErrorCode, "UNSUPPORTED_MARKET"}
+	ErrOrderCutoff         = ErrorKind{OrderCutoffErrorCode, "ORDER_CUTOFF"}
+	ErrPriceOutOfRange     = ErrorKind{PriceOutOfRangeErrorCode, "PRICE_OUT_OF_RANGE"}
+	ErrOrderExists         = ErrorKind{OrderExistsErrorCode, "ORDER_EXISTS"}
+	ErrOrderValueTooLow    = ErrorKind{OrderValueTooLowErrorCode, "ORDER_VALUE_TOO_LOW"}
+	ErrOrderExpired        = ErrorKind{OrderExpiredErrorCode, "ORDER_EXPIRED"}
+	ErrInsufficientBalance = ErrorKind{InsufficientBalanceErrorCode, "INSUFFICIENT_BALANCE"}
+	ErrTooManyOpenOrders   = ErrorKind{TooManyOpenOrdersErrorCode, "TOO_MANY_OPEN_ORDERS"}
+	ErrNotInWhiteList      = ErrorKind{NotInWhiteListErrorCode, "NOT_IN_WHITE_LIST"}
+	ErrOrderNotFound       = ErrorKind{OrderNotFoundErrorCode, "ORDER_NOT_FOUND"}
+	ErrOrderNotCancellable = ErrorKind{OrderNotCancellableErrorCode, "ORDER_NOT_CANCELLABLE"}
+	ErrRingNotFound        = ErrorKind{RingNotFoundErrorCode, "RING_NOT_FOUND"}
+	ErrStorageUnavailable  = ErrorKind{StorageUnavailableErrorCode, "STORAGE_UNAVAILABLE"}
+	ErrNodeUnavailable     = ErrorKind{NodeUnavailableErrorCode, "NODE_UNAVAILABLE"}
+	ErrChainForking        = ErrorKind{ChainForkingErrorCode, "CHAIN_FORKING"}
+	ErrRateLimited         = ErrorKind{RateLimitErrorCode, "RATE_LIMITED"}
+)
+
+// RpcError implements rpc.Error and rpc.DataError, the rpc server responds its code, message
+// and data instead of the default -32000. rpc.DataError is added by patches/go-ethereum-rpc-error-data.patch
+type RpcError struct {
+	Code    int
+	Name    string
+	Message string
+	Data    map[string]interface{}
+}
+
+var (
+	_ rpc.Error     = (*RpcError)(nil)
+	_ rpc.DataError = (*RpcError)(nil)
+)
+
+func (k ErrorKind) Errorf(format string, args ...interface{}) *RpcError {
+	return &RpcError{Code: k.Code, Name: k.Name, Message: fmt.Sprintf(format, args...), Data: make(map[string]interface{})}
+}
+
+// Is returns true if err is an RpcError of this kind
+func (k ErrorKind) Is(err error) bool {
+	e, ok := err.(*RpcError)
+	return ok && e.Code == k.Code
+}
+
+// With adds a field to the data of error
+func (e *RpcError) With(key string, value interface{}) *RpcError {
+	e.Data[key] = value
+	return e
+}
+
+func (e *RpcError) Error() string {
+	return e.Message
+}
+
+func (e *RpcError) ErrorCode() int {
+	return e.Code
+}
+
+func (e *RpcError) ErrorData() interface{} {
+	data := make(map[string]interface{})
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	data["name"] = e.Name
+	return data
+}
@@ -0,0 +1,267 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/market"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/Loopring/relay/usermanager"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	BaseFilterName          = "base"
+	SignFilterName          = "sign"
+	TokenFilterName         = "token"
+	CutoffFilterName        = "cutoff"
+	MinValueFilterName      = "min_value"
+	TtlFilterName           = "ttl"
+	BalanceFilterName       = "balance"
+	MaxOpenOrdersFilterName = "max_open_orders"
+	WhiteListFilterName     = "white_list"
+)
+
+// Filter returns false and the reason if the order should be rejected by gateway
+type Filter interface {
+	Filter(o *types.Order) (bool, error)
+}
+
+// FilterDependencies are the services that filters can use
+type FilterDependencies struct {
+	OrderManager   ordermanager.OrderManager
+	MarketCap      marketcap.MarketCapProvider
+	AccountManager *market.AccountManager
+	UserManager    usermanager.UserManager
+}
+
+type FilterCreator func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error)
+
+var (
+	filterCreators    = make(map[string]FilterCreator)
+	filterCreatorsMtx sync.RWMutex
+
+	defaultFilters = []string{BaseFilterName, SignFilterName, TokenFilterName, CutoffFilterName}
+)
+
+// RegisterFilter makes a filter can be enabled by name in gateway_filters.enabled
+func RegisterFilter(name string, creator FilterCreator) {
+	filterCreatorsMtx.Lock()
+	defer filterCreatorsMtx.Unlock()
+	filterCreators[name] = creator
+}
+
+// NewFilters creates the enabled filters in the configured order
+func NewFilters(options *config.GatewayFiltersOptions, deps *FilterDependencies) ([]Filter, error) {
+	names := options.Enabled
+	if len(names) == 0 {
+		names = defaultFilters
+	}
+
+	filterCreatorsMtx.RLock()
+	defer filterCreatorsMtx.RUnlock()
+
+	filters := []Filter{}
+	for _, name := range names {
+		creator, ok := filterCreators[name]
+		if !ok {
+			return nil, fmt.Errorf("gateway,filter:%s isn't registered", name)
+		}
+		filter, err := creator(options, deps)
+		if err != nil {
+			return nil, fmt.Errorf("gateway,create filter:%s error:%s", name, err.Error())
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+func init() {
+	RegisterFilter(BaseFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		return &BaseFilter{MinLrcFee: big.NewInt(options.BaseFilter.MinLrcFee), MaxPrice: big.NewInt(options.BaseFilter.MaxPrice)}, nil
+	})
+	RegisterFilter(SignFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		return &SignFilter{}, nil
+	})
+	RegisterFilter(TokenFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		return &TokenFilter{}, nil
+	})
+	RegisterFilter(CutoffFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		return &CutoffFilter{om: deps.OrderManager}, nil
+	})
+	RegisterFilter(MinValueFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		return &MinValueFilter{MinValue: new(big.Rat).SetFloat64(options.MinValueFilter.MinValue), mc: deps.MarketCap}, nil
+	})
+	RegisterFilter(TtlFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		return &TtlFilter{}, nil
+	})
+	RegisterFilter(BalanceFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		if nil == deps.AccountManager {
+			return nil, fmt.Errorf("account manager is required")
+		}
+		return &BalanceFilter{RequireFullAmount: options.BalanceFilter.RequireFullAmount, om: deps.OrderManager, am: deps.AccountManager}, nil
+	})
+	RegisterFilter(MaxOpenOrdersFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		// max_count为0时会拒绝所有订单，不限制时应该去掉该filter
+		if options.MaxOpenOrdersFilter.MaxCount <= 0 {
+			return nil, fmt.Errorf("max count of open orders should be positive, but got %d", options.MaxOpenOrdersFilter.MaxCount)
+		}
+		return &MaxOpenOrdersFilter{MaxCount: options.MaxOpenOrdersFilter.MaxCount, om: deps.OrderManager}, nil
+	})
+	RegisterFilter(WhiteListFilterName, func(options *config.GatewayFiltersOptions, deps *FilterDependencies) (Filter, error) {
+		if nil == deps.UserManager {
+			return nil, fmt.Errorf("user manager is required")
+		}
+		return &WhiteListFilter{um: deps.UserManager}, nil
+	})
+}
+
+var openOrderStatus = []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL}
+
+type MinValueFilter struct {
+	MinValue *big.Rat
+	mc       marketcap.MarketCapProvider
+}
+
+// 订单卖出金额的法币价值低于MinValue时过滤
+func (f *MinValueFilter) Filter(o *types.Order) (bool, error) {
+	value, err := f.mc.LegalCurrencyValue(o.TokenS, new(big.Rat).SetInt(o.AmountS))
+	if err != nil {
+		return false, ErrUnsupportedToken.Errorf("gateway,min value filter,order %s get legal value error:%s", o.Hash.Hex(), err.Error()).With("token", o.TokenS.Hex())
+	}
+	if value.Cmp(f.MinValue) < 0 {
+		return false, ErrOrderValueTooLow.Errorf("gateway,min value filter,order %s value %s less than %s", o.Hash.Hex(), value.FloatString(2), f.MinValue.FloatString(2)).
+			With("value", value.FloatString(2)).
+			With("minValue", f.MinValue.FloatString(2))
+	}
+	return true, nil
+}
+
+type TtlFilter struct {
+}
+
+func (f *TtlFilter) Filter(o *types.Order) (bool, error) {
+	if nil == o.Timestamp || nil == o.Ttl {
+		return false, ErrInvalidOrder.Errorf("gateway,ttl filter,order %s timestamp and ttl are required", o.Hash.Hex()).With("field", "ttl")
+	}
+	expireTime := new(big.Int).Add(o.Timestamp, o.Ttl)
+	if expireTime.Int64() <= time.Now().Unix() {
+		return false, ErrOrderExpired.Errorf("gateway,ttl filter,order %s expired at %d", o.Hash.Hex(), expireTime.Int64()).With("expireTime", expireTime.Int64())
+	}
+	return true, nil
+}
+
+type BalanceFilter struct {
+	RequireFullAmount bool
+	om                ordermanager.OrderManager
+	am                *market.AccountManager
+}
+
+// 可用余额为min(balance, allowance)减去其他未完成订单冻结的金额，RequireFullAmount时需要覆盖amountS，否则大于0即可
+func (f *BalanceFilter) Filter(o *types.Order) (bool, error) {
+	available, err := f.availableAmount(o, o.TokenS)
+	if err != nil {
+		return false, err
+	}
+	lrcAddress := util.AliasToAddress("LRC")
+	hasLrcFee := nil != o.LrcFee && o.LrcFee.Sign() > 0
+
+	// tokenS为LRC时，lrcFee也从同一余额中扣除
+	required := new(big.Int).Set(o.AmountS)
+	if hasLrcFee && o.TokenS == lrcAddress {
+		required.Add(required, o.LrcFee)
+	}
+	if f.RequireFullAmount && available.Cmp(required) < 0 {
+		return false, ErrInsufficientBalance.Errorf("gateway,balance filter,order %s available amount %s less than required %s", o.Hash.Hex(), available.String(), required.String()).
+			With("token", o.TokenS.Hex()).
+			With("available", available.String())
+	} else if available.Sign() <= 0 {
+		return false, ErrInsufficientBalance.Errorf("gateway,balance filter,order %s has no available amount of tokenS", o.Hash.Hex()).
+			With("token", o.TokenS.Hex()).
+			With("available", available.String())
+	}
+
+	if hasLrcFee && o.TokenS != lrcAddress {
+		availableLrc, err := f.availableAmount(o, lrcAddress)
+		if err != nil {
+			return false, err
+		}
+		if availableLrc.Cmp(o.LrcFee) < 0 {
+			return false, ErrInsufficientBalance.Errorf("gateway,balance filter,order %s available lrc %s less than lrcFee %s", o.Hash.Hex(), availableLrc.String(), o.LrcFee.String()).
+				With("token", lrcAddress.Hex()).
+				With("available", availableLrc.String())
+		}
+	}
+	return true, nil
+}
+
+func (f *BalanceFilter) availableAmount(o *types.Order, token common.Address) (*big.Int, error) {
+	balance, allowance, err := f.am.GetBalanceByTokenAddress(o.Owner, token)
+	if err != nil {
+		return nil, ErrNodeUnavailable.Errorf("gateway,balance filter,order %s get balance error:%s", o.Hash.Hex(), err.Error())
+	}
+	available := big.NewInt(0)
+	if nil != balance && nil != allowance {
+		available.Set(balance)
+		if allowance.Cmp(balance) < 0 {
+			available.Set(allowance)
+		}
+	}
+
+	frozen, err := f.om.GetFrozenAmount(o.Owner, token, openOrderStatus)
+	if err != nil {
+		return nil, ErrStorageUnavailable.Errorf("gateway,balance filter,order %s get frozen amount error:%s", o.Hash.Hex(), err.Error())
+	}
+	return available.Sub(available, frozen), nil
+}
+
+type MaxOpenOrdersFilter struct {
+	MaxCount int
+	om       ordermanager.OrderManager
+}
+
+func (f *MaxOpenOrdersFilter) Filter(o *types.Order) (bool, error) {
+	count, err := f.om.GetOrderCount(o.Owner, openOrderStatus)
+	if err != nil {
+		return false, ErrStorageUnavailable.Errorf("gateway,max open orders filter,order %s get count error:%s", o.Hash.Hex(), err.Error())
+	}
+	if count >= f.MaxCount {
+		return false, ErrTooManyOpenOrders.Errorf("gateway,max open orders filter,owner %s already has %d open orders", o.Owner.Hex(), count).With("maxCount", f.MaxCount)
+	}
+	return true, nil
+}
+
+type WhiteListFilter struct {
+	um usermanager.UserManager
+}
+
+func (f *WhiteListFilter) Filter(o *types.Order) (bool, error) {
+	if !f.um.InWhiteList(o.Owner) {
+		return false, ErrNotInWhiteList.Errorf("gateway,white list filter,owner %s isn't in white list", o.Owner.Hex()).With("owner", o.Owner.Hex())
+	}
+	return true, nil
+}
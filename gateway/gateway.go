@@ -19,7 +19,6 @@
 package gateway
 
 import (
-	"fmt"
 	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
@@ -27,7 +26,9 @@ import (
 	"github.com/Loopring/relay/ordermanager"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
 	"math/big"
+	"sync/atomic"
 )
 
 type Gateway struct {
@@ -35,72 +36,91 @@ type Gateway struct {
 	om               ordermanager.OrderManager
 	isBroadcast      bool
 	maxBroadcastTime int
+	maxBatchSize     int
 	ipfsPubService   IPFSPubService
 }
 
 var gateway Gateway
 
-type Filter interface {
-	filter(o *types.Order) (bool, error)
-}
+// readOnly is set while chain fork is being processed, orders and cancels are rejected
+// until the orders have been rolled back, queries are still served
+var readOnly int32
 
-func Initialize(filterOptions *config.GatewayFiltersOptions, options *config.GateWayOptions, ipfsOptions *config.IpfsOptions, om ordermanager.OrderManager) {
+func Initialize(filterOptions *config.GatewayFiltersOptions, options *config.GateWayOptions, ipfsOptions *config.IpfsOptions, deps *FilterDependencies) {
 	// add gateway watcher
 	gatewayWatcher := &eventemitter.Watcher{Concurrent: false, Handle: HandleOrder}
 	eventemitter.On(eventemitter.Gateway, gatewayWatcher)
-
-	gateway = Gateway{filters: make([]Filter, 0), om: om, isBroadcast: options.IsBroadcast, maxBroadcastTime: options.MaxBroadcastTime}
+	softCancelWatcher := &eventemitter.Watcher{Concurrent: false, Handle: HandleSoftCancel}
+	eventemitter.On(eventemitter.GatewaySoftCancel, softCancelWatcher)
+	forkDetectedWatcher := &eventemitter.Watcher{Concurrent: false, Handle: func(input eventemitter.EventData) error {
+		atomic.StoreInt32(&readOnly, 1)
+		return nil
+	}}
+	eventemitter.On(eventemitter.ChainForkDetected, forkDetectedWatcher)
+	forkCompleteWatcher := &eventemitter.Watcher{Concurrent: false, Handle: func(input eventemitter.EventData) error {
+		atomic.StoreInt32(&readOnly, 0)
+		return nil
+	}}
+	eventemitter.On(eventemitter.ChainForkComplete, forkCompleteWatcher)
+
+	gateway = Gateway{filters: make([]Filter, 0), om: deps.OrderManager, isBroadcast: options.IsBroadcast, maxBroadcastTime: options.MaxBroadcastTime, maxBatchSize: options.MaxBatchSize}
 	gateway.ipfsPubService = NewIPFSPubService(ipfsOptions)
 
-	// new base filter
-	baseFilter := &BaseFilter{MinLrcFee: big.NewInt(filterOptions.BaseFilter.MinLrcFee), MaxPrice: big.NewInt(filterOptions.BaseFilter.MaxPrice)}
-
-	// new token filter
-	tokenFilter := &TokenFilter{}
-
-	// new sign filter
-	signFilter := &SignFilter{}
-
-	// new cutoff filter
-	cutoffFilter := &CutoffFilter{om: om}
+	filters, err := NewFilters(filterOptions, deps)
+	if err != nil {
+		log.Fatalf("gateway,create filters error:%s", err.Error())
+	}
+	gateway.filters = filters
+}
 
-	gateway.filters = append(gateway.filters, baseFilter)
-	gateway.filters = append(gateway.filters, signFilter)
-	gateway.filters = append(gateway.filters, tokenFilter)
-	gateway.filters = append(gateway.filters, cutoffFilter)
+func isReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
 }
 
+// HandleOrder handles the orders from ipfs and the contract, an order that already exists
+// is not an error for them
 func HandleOrder(input eventemitter.EventData) error {
+	err := handleOrder(input.(*types.Order))
+	if ErrOrderExists.Is(err) {
+		log.Infof(err.Error())
+		return nil
+	}
+	return err
+}
+
+// handleOrder returns RpcError, so that the error can be responded by jsonrpc directly
+func handleOrder(order *types.Order) error {
 	var (
 		state *types.OrderState
 		err   error
 	)
 
-	order := input.(*types.Order)
 	order.Hash = order.GenerateHash()
 
-	var broadcastTime int
+	var (
+		broadcastTime int
+		existsErr     error
+	)
 
-	//TODO(xiaolu) 这里需要测试一下，超时error和查询数据为空的error，处理方式不应该一样
-	if state, err = gateway.om.GetOrderByHash(order.Hash); err != nil && err.Error() == "record not found" {
-		if err = generatePrice(order); err != nil {
+	if state, err = gateway.om.GetOrderByHash(order.Hash); err == gorm.ErrRecordNotFound {
+		if err = checkOrder(order); err != nil {
 			return err
 		}
-
-		for _, v := range gateway.filters {
-			valid, err := v.filter(order)
-			if !valid {
-				log.Errorf(err.Error())
-				return err
-			}
-		}
 		state = &types.OrderState{}
 		state.RawOrder = *order
 		broadcastTime = 0
+		// the order is saved before responding and broadcasting, ordermanager will skip it
+		if err = gateway.om.InsertOrders([]*types.OrderState{state}); err != nil {
+			log.Errorf("gateway,insert order %s error:%s", order.Hash.Hex(), err.Error())
+			return ErrStorageUnavailable.Errorf("gateway,insert order %s failed", order.Hash.Hex())
+		}
 		eventemitter.Emit(eventemitter.OrderManagerGatewayNewOrder, state)
+	} else if err != nil {
+		log.Errorf("gateway,get order %s error:%s", order.Hash.Hex(), err.Error())
+		return ErrStorageUnavailable.Errorf("gateway,get order %s failed", order.Hash.Hex())
 	} else {
 		broadcastTime = state.BroadcastTime
-		log.Infof("gateway,order %s exist,will not insert again", order.Hash.Hex())
+		existsErr = ErrOrderExists.Errorf("gateway,order %s exist,will not insert again", order.Hash.Hex()).With("orderHash", order.Hash.Hex())
 	}
 
 	if gateway.isBroadcast && broadcastTime < gateway.maxBroadcastTime {
@@ -111,36 +131,179 @@ func HandleOrder(input eventemitter.EventData) error {
 			log.Errorf("gateway,publish order %s failed", state.RawOrder.Hash.String())
 		} else {
 			if err = gateway.om.UpdateBroadcastTimeByHash(state.RawOrder.Hash, state.BroadcastTime+1); nil != err {
-				return err
+				log.Errorf("gateway,update broadcast time of order %s error:%s", state.RawOrder.Hash.Hex(), err.Error())
+				return ErrStorageUnavailable.Errorf("gateway,update broadcast time of order %s failed", state.RawOrder.Hash.Hex())
+			}
+		}
+	}
+	return existsErr
+}
+
+// handleOrders checks all orders, saves the valid ones in one transaction and broadcasts
+// them in one message, errs[i] is the result of orders[i]
+func handleOrders(orders []*types.Order) (errs []error) {
+	var (
+		states  = []*types.OrderState{}
+		indexes = []int{}
+		hashes  = make(map[common.Hash]bool)
+	)
+
+	errs = make([]error, len(orders))
+	for i, order := range orders {
+		order.Hash = order.GenerateHash()
+		if _, exists := hashes[order.Hash]; exists {
+			errs[i] = ErrOrderExists.Errorf("gateway,order %s is duplicated in batch", order.Hash.Hex()).With("orderHash", order.Hash.Hex())
+			continue
+		}
+		hashes[order.Hash] = true
+
+		if _, err := gateway.om.GetOrderByHash(order.Hash); err == nil {
+			errs[i] = ErrOrderExists.Errorf("gateway,order %s exist,will not insert again", order.Hash.Hex()).With("orderHash", order.Hash.Hex())
+			continue
+		} else if err != gorm.ErrRecordNotFound {
+			log.Errorf("gateway,get order %s error:%s", order.Hash.Hex(), err.Error())
+			errs[i] = ErrStorageUnavailable.Errorf("gateway,get order %s failed", order.Hash.Hex())
+			continue
+		}
+
+		if err := checkOrder(order); err != nil {
+			errs[i] = err
+			continue
+		}
+		state := &types.OrderState{}
+		state.RawOrder = *order
+		states = append(states, state)
+		indexes = append(indexes, i)
+	}
+
+	if len(states) == 0 {
+		return errs
+	}
+
+	if err := gateway.om.InsertOrders(states); err != nil {
+		log.Errorf("gateway,insert %d orders error:%s", len(states), err.Error())
+		for _, i := range indexes {
+			errs[i] = ErrStorageUnavailable.Errorf("gateway,insert order %s failed", orders[i].Hash.Hex())
+		}
+		return errs
+	}
+
+	// orders have been saved, ordermanager will skip them, other watchers such as push service still need the event
+	rawOrders := []types.Order{}
+	for _, state := range states {
+		eventemitter.Emit(eventemitter.OrderManagerGatewayNewOrder, state)
+		rawOrders = append(rawOrders, state.RawOrder)
+	}
+
+	if gateway.isBroadcast && gateway.maxBroadcastTime > 0 {
+		log.Infof("gateway,broadcast %d orders to ipfs", len(rawOrders))
+		if err := gateway.ipfsPubService.PublishOrders(rawOrders); err != nil {
+			log.Errorf("gateway,publish %d orders failed", len(rawOrders))
+			return errs
+		}
+		for _, order := range rawOrders {
+			if err := gateway.om.UpdateBroadcastTimeByHash(order.Hash, 1); nil != err {
+				log.Errorf("gateway,update broadcast time of order %s error:%s", order.Hash.Hex(), err.Error())
 			}
 		}
 	}
+	return errs
+}
+
+// 链下取消请求的timestamp与当前时间的最大差值
+const softCancelTimeWindow = 600
+
+// HandleSoftCancel handles the soft cancels from ipfs, orders that have not been received
+// or have been closed by this relay are ignored
+func HandleSoftCancel(input eventemitter.EventData) error {
+	err := handleSoftCancel(input.(*types.OrderSoftCancel))
+	if ErrOrderNotFound.Is(err) || ErrOrderNotCancellable.Is(err) {
+		log.Debugf(err.Error())
+		return nil
+	}
+	return err
+}
+
+// handleSoftCancel marks the order as soft cancelled and broadcasts the cancel if it's the first time
+func handleSoftCancel(cancel *types.OrderSoftCancel) error {
+	signer, err := cancel.SignerAddress()
+	if err != nil {
+		return ErrInvalidSignature.Errorf("gateway,soft cancel of order %s signature error:%s", cancel.OrderHash.Hex(), err.Error())
+	}
+	if signer != cancel.Owner {
+		return ErrInvalidSignature.Errorf("gateway,soft cancel of order %s owner %s and signer %s are not match", cancel.OrderHash.Hex(), cancel.Owner.Hex(), signer.Hex()).With("signer", signer.Hex())
+	}
+
+	state, err := gateway.om.GetOrderByHash(cancel.OrderHash)
+	if err == gorm.ErrRecordNotFound {
+		return ErrOrderNotFound.Errorf("gateway,order %s not found", cancel.OrderHash.Hex()).With("orderHash", cancel.OrderHash.Hex())
+	} else if err != nil {
+		log.Errorf("gateway,get order %s error:%s", cancel.OrderHash.Hex(), err.Error())
+		return ErrStorageUnavailable.Errorf("gateway,get order %s failed", cancel.OrderHash.Hex())
+	}
+	if state.RawOrder.Owner != cancel.Owner {
+		return ErrInvalidSignature.Errorf("gateway,soft cancel of order %s isn't signed by owner", cancel.OrderHash.Hex()).With("owner", state.RawOrder.Owner.Hex())
+	}
+
+	cancelled, err := gateway.om.SoftCancelOrder(cancel.OrderHash)
+	if err != nil {
+		log.Errorf("gateway,soft cancel order %s error:%s", cancel.OrderHash.Hex(), err.Error())
+		return ErrStorageUnavailable.Errorf("gateway,soft cancel order %s failed", cancel.OrderHash.Hex())
+	}
+	if !cancelled {
+		if state.Status == types.ORDER_SOFT_CANCEL {
+			return nil
+		}
+		return ErrOrderNotCancellable.Errorf("gateway,order %s can't be cancelled in status %d", cancel.OrderHash.Hex(), state.Status).With("status", getStringStatus(state.Status))
+	}
+
+	if gateway.isBroadcast {
+		if err := gateway.ipfsPubService.PublishSoftCancel(cancel); err != nil {
+			log.Errorf("gateway,publish soft cancel of order %s failed", cancel.OrderHash.Hex())
+		}
+	}
+	return nil
+}
+
+// checkOrder generates the price of order and runs it through the filters
+func checkOrder(order *types.Order) error {
+	if err := generatePrice(order); err != nil {
+		return err
+	}
+
+	for _, v := range gateway.filters {
+		valid, err := v.Filter(order)
+		if !valid {
+			log.Errorf(err.Error())
+			return err
+		}
+	}
 	return nil
 }
 
 func generatePrice(order *types.Order) error {
 	tokenS, err := util.AddressToToken(order.TokenS)
 	if err != nil {
-		return err
+		return ErrUnsupportedToken.Errorf("order's tokenS %s unsupported", order.TokenS.Hex()).With("token", order.TokenS.Hex())
 	}
 	if tokenS.Decimals == nil || tokenS.Decimals.Cmp(big.NewInt(0)) < 1 {
-		return fmt.Errorf("order's tokenS decimals invalid")
+		return ErrUnsupportedToken.Errorf("order's tokenS decimals invalid").With("token", order.TokenS.Hex())
 	}
 
 	tokenB, err := util.AddressToToken(order.TokenB)
 	if err != nil {
-		return err
+		return ErrUnsupportedToken.Errorf("order's tokenB %s unsupported", order.TokenB.Hex()).With("token", order.TokenB.Hex())
 	}
 	if tokenB.Decimals == nil || tokenB.Decimals.Cmp(big.NewInt(0)) < 1 {
-		return fmt.Errorf("order's tokenS decimals invalid")
+		return ErrUnsupportedToken.Errorf("order's tokenB decimals invalid").With("token", order.TokenB.Hex())
 	}
 
 	if order.AmountS == nil || order.AmountS.Cmp(big.NewInt(0)) < 1 {
-		return fmt.Errorf("order's amountS invalid")
+		return ErrInvalidOrder.Errorf("order's amountS invalid").With("field", "amountS")
 	}
 
 	if order.AmountB == nil || order.AmountB.Cmp(big.NewInt(0)) < 1 {
-		return fmt.Errorf("order's amountB invalid")
+		return ErrInvalidOrder.Errorf("order's amountB invalid").With("field", "amountB")
 	}
 
 	order.Price = new(big.Rat).Mul(
@@ -156,32 +319,34 @@ type BaseFilter struct {
 	MaxPrice  *big.Int
 }
 
-func (f *BaseFilter) filter(o *types.Order) (bool, error) {
+func (f *BaseFilter) Filter(o *types.Order) (bool, error) {
 	const (
 		addrLength = 20
 		hashLength = 32
 	)
 
 	if len(o.Hash) != hashLength {
-		return false, fmt.Errorf("gateway,base filter,order %s length error", o.Hash.Hex())
+		return false, ErrInvalidOrder.Errorf("gateway,base filter,order %s length error", o.Hash.Hex()).With("field", "hash")
 	}
 	if len(o.TokenB) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenB %s address length error", o.Hash.Hex(), o.TokenB.Hex())
+		return false, ErrInvalidOrder.Errorf("gateway,base filter,order %s tokenB %s address length error", o.Hash.Hex(), o.TokenB.Hex()).With("field", "tokenB")
 	}
 	if len(o.TokenS) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenS %s address length error", o.Hash.Hex(), o.TokenS.Hex())
+		return false, ErrInvalidOrder.Errorf("gateway,base filter,order %s tokenS %s address length error", o.Hash.Hex(), o.TokenS.Hex()).With("field", "tokenS")
 	}
 	if o.TokenB == o.TokenS {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenB == tokenS", o.Hash.Hex())
+		return false, ErrInvalidOrder.Errorf("gateway,base filter,order %s tokenB == tokenS", o.Hash.Hex()).With("field", "tokenB")
 	}
 	if len(o.Owner) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s owner %s address length error", o.Hash.Hex(), o.Owner.Hex())
+		return false, ErrInvalidOrder.Errorf("gateway,base filter,order %s owner %s address length error", o.Hash.Hex(), o.Owner.Hex()).With("field", "owner")
 	}
 	if len(o.Protocol) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s protocol %s address length error", o.Hash.Hex(), o.Owner.Hex())
+		return false, ErrInvalidOrder.Errorf("gateway,base filter,order %s protocol %s address length error", o.Hash.Hex(), o.Owner.Hex()).With("field", "protocol")
 	}
 	if o.Price.Cmp(new(big.Rat).SetFrac(f.MaxPrice, big.NewInt(1))) > 0 || o.Price.Cmp(new(big.Rat).SetFrac(big.NewInt(1), f.MaxPrice)) < 0 {
-		return false, fmt.Errorf("dao order convert down,price out of range")
+		return false, ErrPriceOutOfRange.Errorf("gateway,base filter,order %s price out of range", o.Hash.Hex()).
+			With("price", o.Price.FloatString(10)).
+			With("maxPrice", f.MaxPrice.String())
 	}
 	return true, nil
 }
@@ -189,13 +354,13 @@ func (f *BaseFilter) filter(o *types.Order) (bool, error) {
 type SignFilter struct {
 }
 
-func (f *SignFilter) filter(o *types.Order) (bool, error) {
+func (f *SignFilter) Filter(o *types.Order) (bool, error) {
 	o.Hash = o.GenerateHash()
 
 	if addr, err := o.SignerAddress(); nil != err {
-		return false, err
+		return false, ErrInvalidSignature.Errorf("gateway,sign filter,order %s signature error:%s", o.Hash.Hex(), err.Error())
 	} else if addr != o.Owner {
-		return false, fmt.Errorf("gateway,sign filter,o.Owner %s and signeraddress %s are not match", o.Owner.Hex(), addr.Hex())
+		return false, ErrInvalidSignature.Errorf("gateway,sign filter,o.Owner %s and signeraddress %s are not match", o.Owner.Hex(), addr.Hex()).With("signer", addr.Hex())
 	}
 
 	return true, nil
@@ -206,7 +371,7 @@ type TokenFilter struct {
 	DeniedTokens map[common.Address]bool
 }
 
-func (f *TokenFilter) filter(o *types.Order) (bool, error) {
+func (f *TokenFilter) Filter(o *types.Order) (bool, error) {
 	supportTokenS := false
 	supportTokenB := false
 	for _, v := range util.AllTokens {
@@ -219,10 +384,10 @@ func (f *TokenFilter) filter(o *types.Order) (bool, error) {
 	}
 
 	if !supportTokenS {
-		return false, fmt.Errorf("gateway,token filter,tokenS:%s do not supported", o.TokenS.Hex())
+		return false, ErrUnsupportedToken.Errorf("gateway,token filter,tokenS:%s do not supported", o.TokenS.Hex()).With("token", o.TokenS.Hex())
 	}
 	if !supportTokenB {
-		return false, fmt.Errorf("gateway,token filter,tokenB:%s do not supported", o.TokenB.Hex())
+		return false, ErrUnsupportedToken.Errorf("gateway,token filter,tokenB:%s do not supported", o.TokenB.Hex()).With("token", o.TokenB.Hex())
 	}
 
 	return true, nil
@@ -233,9 +398,9 @@ type CutoffFilter struct {
 }
 
 // 如果订单接收在cutoff(cancel)事件之后，则该订单直接过滤
-func (f *CutoffFilter) filter(o *types.Order) (bool, error) {
+func (f *CutoffFilter) Filter(o *types.Order) (bool, error) {
 	if f.om.IsOrderCutoff(o.Protocol, o.Owner, o.Timestamp) {
-		return false, fmt.Errorf("gateway,cutoff filter order:%s should be cutoff", o.Owner.Hex())
+		return false, ErrOrderCutoff.Errorf("gateway,cutoff filter order:%s should be cutoff", o.Owner.Hex()).With("owner", o.Owner.Hex())
 	}
 
 	return true, nil
@@ -19,6 +19,7 @@
 package gateway
 
 import (
+	"encoding/json"
 	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/types"
@@ -27,6 +28,16 @@ import (
 
 type IPFSPubService interface {
 	PublishOrder(order types.Order) error
+	PublishOrders(orders []types.Order) error
+	PublishSoftCancel(cancel *types.OrderSoftCancel) error
+}
+
+const softCancelMessageType = "soft_cancel"
+
+// ipfsMessage wraps the messages other than orders, orders are published without it for compatibility
+type ipfsMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
 }
 
 type IPFSPubServiceImpl struct {
@@ -57,3 +68,37 @@ func (p *IPFSPubServiceImpl) PublishOrder(order types.Order) error {
 	}
 	return pubErr
 }
+
+func (p *IPFSPubServiceImpl) PublishSoftCancel(cancel *types.OrderSoftCancel) error {
+	data, err := json.Marshal(cancel)
+	if err != nil {
+		return err
+	}
+	msgJson, err := json.Marshal(&ipfsMessage{Type: softCancelMessageType, Data: data})
+	if err != nil {
+		return err
+	}
+	pubErr := p.sh.PubSubPublish(p.options.BroadcastTopics[0], string(msgJson))
+	if pubErr != nil {
+		log.Debugf("ipfs pub,pub sub publish error:%s", pubErr.Error())
+	} else {
+		log.Debugf("ipfs publish soft cancel of order:%s", cancel.OrderHash.Hex())
+	}
+	return pubErr
+}
+
+// PublishOrders publishes orders as a json array in one message
+func (p *IPFSPubServiceImpl) PublishOrders(orders []types.Order) error {
+	ordersJson, err := json.Marshal(orders)
+	if err != nil {
+		log.Debugf("ipfs pub,marshal orders error:%s", err.Error())
+		return err
+	}
+	pubErr := p.sh.PubSubPublish(p.options.BroadcastTopics[0], string(ordersJson))
+	if pubErr != nil {
+		log.Debugf("ipfs pub,pub sub publish error:%s", pubErr.Error())
+	} else {
+		log.Debugf("ipfs publish %d orders", len(orders))
+	}
+	return pubErr
+}
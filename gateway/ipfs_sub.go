@@ -19,6 +19,7 @@
 package gateway
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/eventemiter"
@@ -165,20 +166,50 @@ func (p *subProxy) listen() {
 			if err != nil {
 				log.Fatalf("ipfs sub,ipfs occurs err:%s shut down!", err.Error())
 			}
-			//record.data() have to contain two char: '{' and '}'
+			//record.data() have to contain two char: '{' and '}', or '[' and ']' for orders published in batch
 			if len(record.Data()) > 2 {
-				ord := &types.Order{}
-				if err := ord.UnmarshalJSON(record.Data()); err != nil {
+				log.Debugf("ipfs sub,accept data from topic %s and data is %s", p.topic, string(record.Data()))
+				if record.Data()[0] != '[' {
+					p.emitMessage(record.Data())
+					continue
+				}
+				raws := []json.RawMessage{}
+				if err := json.Unmarshal(record.Data(), &raws); err != nil {
 					log.Errorf("ipfs sub,failed to accept data %s", err.Error())
 					continue
 				}
-				log.Debugf("ipfs sub,accept data from topic %s and data is %s", p.topic, string(record.Data()))
-				eventemitter.Emit(eventemitter.Gateway, ord)
+				for _, raw := range raws {
+					p.emitOrder(raw)
+				}
 			}
 		}
 	}()
 }
 
+func (p *subProxy) emitMessage(data []byte) {
+	msg := &ipfsMessage{}
+	if err := json.Unmarshal(data, msg); err != nil || msg.Type != softCancelMessageType {
+		p.emitOrder(data)
+		return
+	}
+
+	cancel := &types.OrderSoftCancel{}
+	if err := json.Unmarshal(msg.Data, cancel); err != nil {
+		log.Errorf("ipfs sub,failed to accept soft cancel %s", err.Error())
+		return
+	}
+	eventemitter.Emit(eventemitter.GatewaySoftCancel, cancel)
+}
+
+func (p *subProxy) emitOrder(data []byte) {
+	ord := &types.Order{}
+	if err := ord.UnmarshalJSON(data); err != nil {
+		log.Errorf("ipfs sub,failed to accept data %s", err.Error())
+		return
+	}
+	eventemitter.Emit(eventemitter.Gateway, ord)
+}
+
 func (p *subProxy) quit() {
 	close(p.stop)
 }
@@ -19,8 +19,9 @@
 package gateway
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/dao"
 	"github.com/Loopring/relay/ethaccessor"
 	"github.com/Loopring/relay/log"
@@ -29,13 +30,17 @@ import (
 	"github.com/Loopring/relay/marketcap"
 	"github.com/Loopring/relay/ordermanager"
 	"github.com/Loopring/relay/types"
+	"github.com/Loopring/relay/usermanager"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/jinzhu/gorm"
 	"math/big"
 	"net"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (*JsonrpcServiceImpl) Ping(val string, val2 int) (res string, err error) {
@@ -82,10 +87,17 @@ type OrderQuery struct {
 	OrderHash       string `json:"orderHash"`
 }
 
+const (
+	defaultDepthLength    = 20
+	defaultDepthPrecision = 10
+	maxDepthPrecision     = 18
+)
+
 type DepthQuery struct {
 	Length          int    `json:"length"`
 	ContractVersion string `json:"contractVersion"`
 	Market          string `json:"market"`
+	Precision       *int   `json:"precision"` // decimal places of price, orders are grouped by the rounded price
 }
 
 type FillQuery struct {
@@ -105,6 +117,37 @@ type RingMinedQuery struct {
 	PageSize        int
 }
 
+type RingSubmitTransitionJson struct {
+	Status string `json:"status"`
+	TxHash string `json:"txHash"`
+	Err    string `json:"err"`
+	Time   int64  `json:"time"`
+}
+
+// RingSubmitLifecycle is the ring submitted by miner with each transition of its status
+type RingSubmitLifecycle struct {
+	RingHash         string                     `json:"ringHash"`
+	Protocol         string                     `json:"protocol"`
+	Miner            string                     `json:"miner"`
+	Status           string                     `json:"status"`
+	RegistryTxHash   string                     `json:"registryTxHash"`
+	SubmitTxHash     string                     `json:"submitTxHash"`
+	ProtocolGas      string                     `json:"protocolGas"`
+	ProtocolGasPrice string                     `json:"protocolGasPrice"`
+	ProtocolUsedGas  string                     `json:"protocolUsedGas"`
+	Err              string                     `json:"err"`
+	CreateTime       int64                      `json:"createTime"`
+	UpdateTime       int64                      `json:"updateTime"`
+	Transitions      []RingSubmitTransitionJson `json:"transitions"`
+}
+
+type GasPriceResult struct {
+	Safe        string `json:"safe"`
+	Standard    string `json:"standard"`
+	Fast        string `json:"fast"`
+	BlockNumber int64  `json:"blockNumber"`
+}
+
 type RawOrderJsonResult struct {
 	Protocol              string `json:"protocol"` // 智能合约地址
 	Owner                 string `json:"address"`
@@ -146,69 +189,204 @@ type TokenPrice struct {
 var RemoteAddrContextKey = "RemoteAddr"
 
 type JsonrpcService interface {
-	Start(port string)
+	Start()
 	Stop()
 }
 
 type JsonrpcServiceImpl struct {
-	port           string
+	options        config.JsonrpcOptions
 	trendManager   market.TrendManager
 	orderManager   ordermanager.OrderManager
 	accountManager market.AccountManager
 	ethForwarder   *EthForwarder
 	marketCap      marketcap.MarketCapProvider
+	pushService    *pushService
+	rateLimiter    *RateLimiter
+
+	rpcServer  *rpc.Server
+	httpServer *http.Server
+	wsServer   *http.Server
 }
 
-func NewJsonrpcService(port string, trendManager market.TrendManager, orderManager ordermanager.OrderManager, accountManager market.AccountManager, ethForwarder *EthForwarder, capProvider marketcap.MarketCapProvider) *JsonrpcServiceImpl {
+func NewJsonrpcService(options config.JsonrpcOptions, trendManager market.TrendManager, orderManager ordermanager.OrderManager, accountManager market.AccountManager, userManager usermanager.UserManager, ethForwarder *EthForwarder, capProvider marketcap.MarketCapProvider) *JsonrpcServiceImpl {
 	l := &JsonrpcServiceImpl{}
-	l.port = port
+	l.options = options
 	l.trendManager = trendManager
 	l.orderManager = orderManager
 	l.accountManager = accountManager
 	l.ethForwarder = ethForwarder
 	l.marketCap = capProvider
+	l.pushService = newPushService(l)
+	l.rateLimiter = NewRateLimiter(options.RateLimits, userManager)
 	return l
 }
 
 func (j *JsonrpcServiceImpl) Start() {
 	handler := rpc.NewServer()
 	if err := handler.RegisterName("loopring", j); err != nil {
-		fmt.Println(err)
+		log.Errorf("gateway,register jsonrpc service error:%s", err.Error())
 		return
 	}
 	if err := handler.RegisterName("eth", j.ethForwarder); err != nil {
-		fmt.Println(err)
+		log.Errorf("gateway,register eth forwarder error:%s", err.Error())
 		return
 	}
-	var (
-		listener net.Listener
-		err      error
-	)
-	if listener, err = net.Listen("tcp", ":8083"); err != nil {
+	j.rpcServer = handler
+
+	address := net.JoinHostPort(j.options.Host, strconv.Itoa(j.options.Port))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Errorf("gateway,listen jsonrpc address:%s error:%s", address, err.Error())
 		return
 	}
-	go rpc.NewHTTPServer([]string{"*"}, handler).Serve(listener)
-	log.Info(fmt.Sprintf("HTTP endpoint opened on 8083"))
+	j.httpServer = rpc.NewHTTPServer(j.options.CorsDomains, handler)
+	j.httpServer.Handler = limitRequestBody(j.rateLimiter.Handler(j.httpServer.Handler), j.options.MaxRequestBodySize)
+	j.httpServer.ReadTimeout = time.Duration(j.options.ReadTimeout) * time.Second
+	j.httpServer.WriteTimeout = time.Duration(j.options.WriteTimeout) * time.Second
+	go j.serve(j.httpServer, listener)
+	log.Infof("HTTP endpoint opened on %s", address)
 
-	return
+	if j.options.WsPort > 0 {
+		wsAddress := net.JoinHostPort(j.options.Host, strconv.Itoa(j.options.WsPort))
+		wsListener, err := net.Listen("tcp", wsAddress)
+		if err != nil {
+			log.Errorf("gateway,listen websocket address:%s error:%s", wsAddress, err.Error())
+			return
+		}
+		j.wsServer = &http.Server{Handler: j.rateLimiter.WebsocketHandler(handler, j.options.CorsDomains)}
+		j.wsServer.ReadTimeout = time.Duration(j.options.ReadTimeout) * time.Second
+		go j.serve(j.wsServer, wsListener)
+		j.pushService.start()
+		log.Infof("WebSocket endpoint opened on %s", wsAddress)
+	}
+}
+
+func (j *JsonrpcServiceImpl) serve(server *http.Server, listener net.Listener) {
+	var err error
+	if j.options.TlsCertFile != "" && j.options.TlsKeyFile != "" {
+		err = server.ServeTLS(listener, j.options.TlsCertFile, j.options.TlsKeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Errorf("gateway,jsonrpc server error:%s", err.Error())
+	}
+}
+
+// Stop closes the listeners and waits for in-flight requests until ShutdownTimeout,
+// then the websocket connections are closed
+func (j *JsonrpcServiceImpl) Stop() {
+	j.pushService.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(j.options.ShutdownTimeout)*time.Second)
+	defer cancel()
+	for _, server := range []*http.Server{j.httpServer, j.wsServer} {
+		if nil == server {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("gateway,shutdown jsonrpc server error:%s", err.Error())
+		}
+	}
+	if nil != j.rpcServer {
+		j.rpcServer.Stop()
+	}
+
+	j.httpServer, j.wsServer, j.rpcServer = nil, nil, nil
+}
+
+// limitRequestBody rejects the body larger than maxSize, maxSize <= 0 means no limit except
+// the one of rpc package
+func limitRequestBody(handler http.Handler, maxSize int64) http.Handler {
+	if maxSize <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxSize {
+			http.Error(w, fmt.Sprintf("content length too large (%d>%d)", r.ContentLength, maxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		handler.ServeHTTP(w, r)
+	})
 }
 
 func (j *JsonrpcServiceImpl) SubmitOrder(order *types.OrderJsonRequest) (res string, err error) {
-	err = HandleOrder(types.ToOrder(order))
-	if err != nil {
-		fmt.Println(err)
+	if isReadOnly() {
+		return "", ErrChainForking.Errorf("relay is processing chain fork, please submit later")
+	}
+	if err = handleOrder(types.ToOrder(order)); err != nil {
+		return "", err
+	}
+	return "SUBMIT_SUCCESS", nil
+}
+
+// CancelOrder cancels the order in relays without sending transaction, the order can still be
+// filled by other relays until it's cancelled on chain
+func (j *JsonrpcServiceImpl) CancelOrder(cancel *types.OrderSoftCancel) (res string, err error) {
+	if isReadOnly() {
+		return "", ErrChainForking.Errorf("relay is processing chain fork, please cancel later")
+	}
+	if now := time.Now().Unix(); cancel.Timestamp < now-softCancelTimeWindow || cancel.Timestamp > now+softCancelTimeWindow {
+		return "", ErrInvalidParams.Errorf("timestamp of cancel should be within %d seconds from now", softCancelTimeWindow).With("timestamp", cancel.Timestamp)
+	}
+	if err = handleSoftCancel(cancel); err != nil {
+		return "", err
+	}
+	return "CANCEL_SUCCESS", nil
+}
+
+type SubmitOrderResult struct {
+	OrderHash string      `json:"orderHash"`
+	Code      int         `json:"code,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// SubmitOrders submits orders in batch, the result of each order is at the same index
+// of the request, code is set if the order is rejected
+func (j *JsonrpcServiceImpl) SubmitOrders(orders []*types.OrderJsonRequest) (res []SubmitOrderResult, err error) {
+	if len(orders) == 0 {
+		return nil, ErrInvalidParams.Errorf("orders are required")
+	}
+	if isReadOnly() {
+		return nil, ErrChainForking.Errorf("relay is processing chain fork, please submit later")
+	}
+	if gateway.maxBatchSize > 0 && len(orders) > gateway.maxBatchSize {
+		return nil, ErrInvalidParams.Errorf("at most %d orders can be submitted at once", gateway.maxBatchSize).With("maxBatchSize", gateway.maxBatchSize)
+	}
+
+	rawOrders := make([]*types.Order, len(orders))
+	for i, order := range orders {
+		rawOrders[i] = types.ToOrder(order)
+	}
+
+	errs := handleOrders(rawOrders)
+	res = make([]SubmitOrderResult, len(rawOrders))
+	for i, order := range rawOrders {
+		res[i] = SubmitOrderResult{OrderHash: order.Hash.Hex()}
+		if nil == errs[i] {
+			continue
+		}
+		res[i].Message = errs[i].Error()
+		if rpcErr, ok := errs[i].(*RpcError); ok {
+			res[i].Code = rpcErr.ErrorCode()
+			res[i].Data = rpcErr.ErrorData()
+		} else {
+			res[i].Code = InvalidOrderErrorCode
+		}
 	}
-	res = "SUBMIT_SUCCESS"
-	return res, err
+	return res, nil
 }
 
 func (j *JsonrpcServiceImpl) GetOrders(query *OrderQuery) (res PageResult, err error) {
 	orderQuery, pi, ps := convertFromQuery(query)
 	queryRst, err := j.orderManager.GetOrders(orderQuery, pi, ps)
 	if err != nil {
-		fmt.Println(err)
+		log.Errorf("gateway,get orders error:%s", err.Error())
+		return res, ErrStorageUnavailable.Errorf("get orders failed")
 	}
-	return buildOrderResult(queryRst), err
+	return buildOrderResult(queryRst), nil
 }
 
 func (j *JsonrpcServiceImpl) GetDepth(query DepthQuery) (res Depth, err error) {
@@ -218,19 +396,28 @@ func (j *JsonrpcServiceImpl) GetDepth(query DepthQuery) (res Depth, err error) {
 	length := query.Length
 
 	if mkt == "" || protocol == "" || util.ContractVersionConfig[protocol] == "" {
-		err = errors.New("market and correct contract version must be applied")
+		err = ErrInvalidParams.Errorf("market and correct contract version must be applied")
 		return
 	}
 
-	if length <= 0 || length > 20 {
-		length = 20
+	if length <= 0 {
+		length = defaultDepthLength
+	}
+
+	precision := defaultDepthPrecision
+	if nil != query.Precision {
+		precision = *query.Precision
+	}
+	if precision < 0 || precision > maxDepthPrecision {
+		err = ErrInvalidParams.Errorf("precision should be between 0 and %d", maxDepthPrecision).With("precision", precision)
+		return
 	}
 
 	a, b := util.UnWrap(mkt)
 
 	_, err = util.WrapMarket(a, b)
 	if err != nil {
-		err = errors.New("unsupported market type")
+		err = ErrUnsupportedMarket.Errorf("unsupported market type").With("market", mkt)
 		return
 	}
 
@@ -242,30 +429,12 @@ func (j *JsonrpcServiceImpl) GetDepth(query DepthQuery) (res Depth, err error) {
 	askBid := AskBid{Buy: empty, Sell: empty}
 	depth := Depth{ContractVersion: util.ContractVersionConfig[protocol], Market: mkt, Depth: askBid}
 
-	//(TODO) 考虑到需要聚合的情况，所以每次取2倍的数据，先聚合完了再cut, 不是完美方案，后续再优化
-	asks, askErr := j.orderManager.GetOrderBook(
-		common.HexToAddress(util.ContractVersionConfig[protocol]),
-		util.AllTokens[a].Protocol,
-		util.AllTokens[b].Protocol, length*2)
-
-	if askErr != nil {
-		err = errors.New("get depth error , please refresh again")
-		return
-	}
-
-	depth.Depth.Sell = calculateDepth(asks, length, true, util.AllTokens[a].Decimals, util.AllTokens[b].Decimals)
+	contractAddress := common.HexToAddress(util.ContractVersionConfig[protocol])
+	asks := j.orderManager.GetDepth(contractAddress, util.AllTokens[a].Protocol, util.AllTokens[b].Protocol, 0)
+	depth.Depth.Sell = calculateDepth(asks, length, precision, true, util.AllTokens[a].Decimals, util.AllTokens[b].Decimals)
 
-	bids, bidErr := j.orderManager.GetOrderBook(
-		common.HexToAddress(util.ContractVersionConfig[protocol]),
-		util.AllTokens[b].Protocol,
-		util.AllTokens[a].Protocol, length*2)
-
-	if bidErr != nil {
-		err = errors.New("get depth error , please refresh again")
-		return
-	}
-
-	depth.Depth.Buy = calculateDepth(bids, length, false, util.AllTokens[b].Decimals, util.AllTokens[a].Decimals)
+	bids := j.orderManager.GetDepth(contractAddress, util.AllTokens[b].Protocol, util.AllTokens[a].Protocol, 0)
+	depth.Depth.Buy = calculateDepth(bids, length, precision, false, util.AllTokens[b].Decimals, util.AllTokens[a].Decimals)
 
 	return depth, err
 }
@@ -274,7 +443,8 @@ func (j *JsonrpcServiceImpl) GetFills(query FillQuery) (dao.PageResult, error) {
 	res, err := j.orderManager.FillsPageQuery(fillQueryToMap(query))
 
 	if err != nil {
-		return dao.PageResult{}, nil
+		log.Errorf("gateway,get fills error:%s", err.Error())
+		return dao.PageResult{}, ErrStorageUnavailable.Errorf("get fills failed")
 	}
 
 	result := dao.PageResult{PageIndex: res.PageIndex, PageSize: res.PageSize, Total: res.Total, Data: make([]interface{}, 0)}
@@ -290,6 +460,10 @@ func (j *JsonrpcServiceImpl) GetFills(query FillQuery) (dao.PageResult, error) {
 
 func (j *JsonrpcServiceImpl) GetTicker(contractVersion string) (res []market.Ticker, err error) {
 	res, err = j.trendManager.GetTicker()
+	if err != nil {
+		log.Errorf("gateway,get ticker error:%s", err.Error())
+		return nil, ErrStorageUnavailable.Errorf("get ticker failed")
+	}
 
 	for i, t := range res {
 		j.fillBuyAndSell(&t, contractVersion)
@@ -300,6 +474,10 @@ func (j *JsonrpcServiceImpl) GetTicker(contractVersion string) (res []market.Tic
 
 func (j *JsonrpcServiceImpl) GetTrend(market string) (res []market.Trend, err error) {
 	res, err = j.trendManager.GetTrends(market)
+	if err != nil {
+		log.Errorf("gateway,get trends of %s error:%s", market, err.Error())
+		return nil, ErrStorageUnavailable.Errorf("get trends failed")
+	}
 	sort.Slice(res, func(i, j int) bool {
 		return res[i].Start < res[j].Start
 	})
@@ -307,7 +485,60 @@ func (j *JsonrpcServiceImpl) GetTrend(market string) (res []market.Trend, err er
 }
 
 func (j *JsonrpcServiceImpl) GetRingMined(query RingMinedQuery) (res dao.PageResult, err error) {
-	return j.orderManager.RingMinedPageQuery(ringMinedQueryToMap(query))
+	if res, err = j.orderManager.RingMinedPageQuery(ringMinedQueryToMap(query)); err != nil {
+		log.Errorf("gateway,get ring mined error:%s", err.Error())
+		return res, ErrStorageUnavailable.Errorf("get ring mined failed")
+	}
+	return res, nil
+}
+
+// GetGasPrice returns the gas prices in wei of the recent blocks, a tx with fast price is expected to be confirmed fastest
+func (j *JsonrpcServiceImpl) GetGasPrice() (res GasPriceResult, err error) {
+	levels := ethaccessor.EstimateGasPriceLevels()
+	if nil == levels {
+		return res, ErrNodeUnavailable.Errorf("gas price isn't evaluated yet")
+	}
+	res.Safe = levels.Safe.String()
+	res.Standard = levels.Standard.String()
+	res.Fast = levels.Fast.String()
+	res.BlockNumber = levels.BlockNumber.Int64()
+	return res, nil
+}
+
+func (j *JsonrpcServiceImpl) GetRingSubmitLifecycle(ringHash string) (res RingSubmitLifecycle, err error) {
+	if len(common.FromHex(ringHash)) != common.HashLength {
+		return res, ErrInvalidParams.Errorf("ring hash must be 32 bytes hex").With("ringHash", ringHash)
+	}
+	info, transitions, err := j.orderManager.GetRingSubmitInfo(common.HexToHash(ringHash))
+	if err == gorm.ErrRecordNotFound {
+		return res, ErrRingNotFound.Errorf("ring %s not found", ringHash).With("ringHash", ringHash)
+	} else if err != nil {
+		log.Errorf("gateway,get ring submit info error:%s", err.Error())
+		return res, ErrStorageUnavailable.Errorf("get ring submit info failed")
+	}
+
+	res.RingHash = info.RingHash
+	res.Protocol = info.ProtocolAddress
+	res.Miner = info.Miner
+	res.Status = getRingSubmitStatusString(types.RingSubmitStatus(info.Status))
+	res.RegistryTxHash = info.RegistryTxHash
+	res.SubmitTxHash = info.ProtocolTxHash
+	res.ProtocolGas = info.ProtocolGas
+	res.ProtocolGasPrice = info.ProtocolGasPrice
+	res.ProtocolUsedGas = info.ProtocolUsedGas
+	res.Err = info.Err
+	res.CreateTime = info.CreateTime
+	res.UpdateTime = info.UpdateTime
+	res.Transitions = []RingSubmitTransitionJson{}
+	for _, t := range transitions {
+		res.Transitions = append(res.Transitions, RingSubmitTransitionJson{
+			Status: getRingSubmitStatusString(types.RingSubmitStatus(t.Status)),
+			TxHash: t.TxHash,
+			Err:    t.Err,
+			Time:   t.CreateTime,
+		})
+	}
+	return res, nil
 }
 
 func (j *JsonrpcServiceImpl) GetBalance(balanceQuery CommonTokenRequest) (res market.AccountJson, err error) {
@@ -328,9 +559,13 @@ func (j *JsonrpcServiceImpl) GetBalance(balanceQuery CommonTokenRequest) (res ma
 }
 
 func (j *JsonrpcServiceImpl) GetCutoff(address, contractVersion, blockNumber string) (result string, err error) {
+	if util.ContractVersionConfig[contractVersion] == "" {
+		return "", ErrInvalidParams.Errorf("unsupported contract version %s", contractVersion).With("contractVersion", contractVersion)
+	}
 	cutoff, err := ethaccessor.GetCutoff(common.HexToAddress(util.ContractVersionConfig[contractVersion]), common.HexToAddress(address), blockNumber)
 	if err != nil {
-		return "", err
+		log.Errorf("gateway,get cutoff of %s error:%s", address, err.Error())
+		return "", ErrNodeUnavailable.Errorf("get cutoff failed")
 	}
 	return cutoff.String(), nil
 }
@@ -352,19 +587,21 @@ func (j *JsonrpcServiceImpl) GetEstimatedAllocatedAllowance(owner, token string)
 	statusSet = append(statusSet, types.ORDER_NEW)
 	statusSet = append(statusSet, types.ORDER_PARTIAL)
 
-	tokenAddress := util.AliasToAddress(token)
-	if tokenAddress.Hex() == "" {
-		return "", errors.New("unsupported token alias " + token)
+	if _, ok := util.AllTokens[token]; !ok {
+		return "", ErrUnsupportedToken.Errorf("unsupported token alias %s", token).With("token", token)
 	}
+	tokenAddress := util.AliasToAddress(token)
 	amount, err := j.orderManager.GetFrozenAmount(common.HexToAddress(owner), tokenAddress, statusSet)
 	if err != nil {
-		return "", err
+		log.Errorf("gateway,get frozen amount of %s error:%s", owner, err.Error())
+		return "", ErrStorageUnavailable.Errorf("get frozen amount failed")
 	}
 
 	if token == "LRC" {
 		allLrcFee, err := j.orderManager.GetFrozenLRCFee(common.HexToAddress(owner), statusSet)
 		if err != nil {
-			return "", err
+			log.Errorf("gateway,get frozen lrc fee of %s error:%s", owner, err.Error())
+			return "", ErrStorageUnavailable.Errorf("get frozen lrc fee failed")
 		}
 		amount.Add(amount, allLrcFee)
 	}
@@ -413,6 +650,10 @@ func convertStatus(s string) types.OrderStatus {
 		return types.ORDER_CANCEL
 	case "ORDER_CUTOFF":
 		return types.ORDER_CUTOFF
+	case "ORDER_SOFT_CANCELED":
+		return types.ORDER_SOFT_CANCEL
+	case "ORDER_EXPIRED":
+		return types.ORDER_EXPIRE
 	}
 	return types.ORDER_UNKNOWN
 }
@@ -429,85 +670,73 @@ func getStringStatus(s types.OrderStatus) string {
 		return "ORDER_CANCELED"
 	case types.ORDER_CUTOFF:
 		return "ORDER_CUTOFF"
+	case types.ORDER_SOFT_CANCEL:
+		return "ORDER_SOFT_CANCELED"
+	case types.ORDER_EXPIRE:
+		return "ORDER_EXPIRED"
 	}
 	return "ORDER_UNKNOWN"
 }
 
-func calculateDepth(states []types.OrderState, length int, isAsk bool, tokenSDecimal, tokenBDecimal *big.Int) [][]string {
-
-	if len(states) == 0 {
-		return [][]string{}
-	}
-
+func getRingSubmitStatusString(s types.RingSubmitStatus) string {
+	switch s {
+	case types.RING_SUBMIT_MATCHED:
+		return "RING_MATCHED"
+	case types.RING_SUBMIT_REGISTRY_SENT:
+		return "RING_REGISTRY_SENT"
+	case types.RING_SUBMIT_REGISTRY_MINED:
+		return "RING_REGISTRY_MINED"
+	case types.RING_SUBMIT_SENT:
+		return "RING_SUBMIT_SENT"
+	case types.RING_SUBMIT_MINED:
+		return "RING_MINED"
+	case types.RING_SUBMIT_FAILED:
+		return "RING_FAILED"
+	case types.RING_SUBMIT_REPLACED:
+		return "RING_REPLACED"
+	case types.RING_SUBMIT_EXPIRED:
+		return "RING_EXPIRED"
+	}
+	return "RING_UNKNOWN"
+}
+
+// calculateDepth groups the levels whose prices are the same after rounded to precision,
+// levels are sorted by price of order desc, which is the best first for both asks and bids
+func calculateDepth(levels []ordermanager.DepthLevel, length, precision int, isAsk bool, tokenSDecimal, tokenBDecimal *big.Int) [][]string {
 	depth := make([][]string, 0)
-	for i := range depth {
-		depth[i] = make([]string, 0)
-	}
-
-	depthMap := make(map[string]DepthElement)
-
-	for _, s := range states {
-
-		price := *s.RawOrder.Price
-		amountS, amountB := s.RemainedAmount()
-		amountS = amountS.Quo(amountS, new(big.Rat).SetFrac(tokenSDecimal, big.NewInt(1)))
-		amountB = amountB.Quo(amountB, new(big.Rat).SetFrac(tokenBDecimal, big.NewInt(1)))
-
-		if amountS.Cmp(new(big.Rat).SetFloat64(0)) == 0 {
-			log.Debug("amount s is zero, skipped")
-			continue
-		}
+	elements := []*DepthElement{}
 
-		if amountB.Cmp(new(big.Rat).SetFloat64(0)) == 0 {
-			log.Debug("amount b is zero, skipped")
+	for _, level := range levels {
+		amountS := new(big.Rat).Quo(level.AmountS, new(big.Rat).SetInt(tokenSDecimal))
+		amountB := new(big.Rat).Quo(level.AmountB, new(big.Rat).SetInt(tokenBDecimal))
+		if amountS.Sign() == 0 || amountB.Sign() == 0 {
+			log.Debug("amount is zero, skipped")
 			continue
 		}
 
+		var price, amount, size *big.Rat
 		if isAsk {
-			price = *price.Inv(&price)
-			priceFloatStr := price.FloatString(10)
-			if v, ok := depthMap[priceFloatStr]; ok {
-				amount := v.Amount
-				size := v.Size
-				amount = amount.Add(amount, amountS)
-				size = size.Add(size, amountB)
-				depthMap[priceFloatStr] = DepthElement{Price: v.Price, Amount: amount, Size: size}
-			} else {
-				depthMap[priceFloatStr] = DepthElement{Price: priceFloatStr, Amount: amountS, Size: amountB}
-			}
+			price, amount, size = new(big.Rat).Inv(level.Price), amountS, amountB
 		} else {
-			priceFloatStr := price.FloatString(10)
-			if v, ok := depthMap[priceFloatStr]; ok {
-				amount := v.Amount
-				size := v.Size
-				amount = amount.Add(amount, amountB)
-				size = size.Add(size, amountS)
-				depthMap[priceFloatStr] = DepthElement{Price: v.Price, Amount: amount, Size: size}
-			} else {
-				depthMap[priceFloatStr] = DepthElement{Price: priceFloatStr, Amount: amountB, Size: amountS}
-			}
+			price, amount, size = new(big.Rat).Set(level.Price), amountB, amountS
 		}
+
+		priceStr := price.FloatString(precision)
+		if n := len(elements); n > 0 && elements[n-1].Price == priceStr {
+			elements[n-1].Amount.Add(elements[n-1].Amount, amount)
+			elements[n-1].Size.Add(elements[n-1].Size, size)
+			continue
+		}
+		if len(elements) >= length {
+			break
+		}
+		elements = append(elements, &DepthElement{Price: priceStr, Amount: amount, Size: size})
 	}
 
-	for k, v := range depthMap {
+	for _, v := range elements {
 		amount, _ := v.Amount.Float64()
 		size, _ := v.Size.Float64()
-		depth = append(depth, []string{k, strconv.FormatFloat(amount, 'f', 10, 64), strconv.FormatFloat(size, 'f', 10, 64)})
-	}
-
-	sort.Slice(depth, func(i, j int) bool {
-		cmpA, _ := strconv.ParseFloat(depth[i][0], 64)
-		cmpB, _ := strconv.ParseFloat(depth[j][0], 64)
-		if isAsk {
-			return cmpA < cmpB
-		} else {
-			return cmpA > cmpB
-		}
-
-	})
-
-	if length < len(depth) {
-		return depth[:length]
+		depth = append(depth, []string{v.Price, strconv.FormatFloat(amount, 'f', 10, 64), strconv.FormatFloat(size, 'f', 10, 64)})
 	}
 	return depth
 }
@@ -608,7 +837,7 @@ func orderStateToJson(src types.OrderState) OrderJsonResult {
 }
 
 func (j *JsonrpcServiceImpl) fillBuyAndSell(ticker *market.Ticker, contractVersion string) {
-	queryDepth := DepthQuery{1, contractVersion, ticker.Market}
+	queryDepth := DepthQuery{Length: 1, ContractVersion: contractVersion, Market: ticker.Market}
 
 	depth, err := j.GetDepth(queryDepth)
 	if err != nil {
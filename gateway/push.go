@@ -0,0 +1,418 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// 推送前合并同一市场的多次变化，避免每个事件都重新计算深度
+const pushFlushInterval = 500 * time.Millisecond
+
+type DepthUpdate struct {
+	ContractVersion string `json:"contractVersion"`
+	Market          string `json:"market"`
+	Snapshot        bool   `json:"snapshot"`
+	Depth           AskBid `json:"depth"`
+}
+
+type depthSubscriber struct {
+	notifier *rpc.Notifier
+	id       rpc.ID
+	query    DepthQuery
+	buy      map[string][]string
+	sell     map[string][]string
+}
+
+type tickerSubscriber struct {
+	notifier        *rpc.Notifier
+	id              rpc.ID
+	contractVersion string
+	last            map[string]market.Ticker
+}
+
+type fillSubscriber struct {
+	notifier *rpc.Notifier
+	id       rpc.ID
+	query    FillQuery
+}
+
+// pushService keeps the websocket subscriptions and sends depth diffs, tickers and fills
+// to them when the related events are emitted
+type pushService struct {
+	j *JsonrpcServiceImpl
+
+	mtx          sync.Mutex
+	depthSubs    map[rpc.ID]*depthSubscriber
+	tickerSubs   map[rpc.ID]*tickerSubscriber
+	fillSubs     map[rpc.ID]*fillSubscriber
+	dirtyMarkets map[string]bool
+	tickerDirty  bool
+
+	watchers map[string]*eventemitter.Watcher
+	stopChan chan bool
+}
+
+func newPushService(j *JsonrpcServiceImpl) *pushService {
+	p := &pushService{}
+	p.j = j
+	p.depthSubs = make(map[rpc.ID]*depthSubscriber)
+	p.tickerSubs = make(map[rpc.ID]*tickerSubscriber)
+	p.fillSubs = make(map[rpc.ID]*fillSubscriber)
+	p.dirtyMarkets = make(map[string]bool)
+	p.watchers = make(map[string]*eventemitter.Watcher)
+	p.watchers[eventemitter.OrderManagerGatewayNewOrder] = &eventemitter.Watcher{Concurrent: true, Handle: p.handleNewOrder}
+	p.watchers[eventemitter.OrderManagerExtractorFill] = &eventemitter.Watcher{Concurrent: true, Handle: p.handleOrderFilled}
+	p.watchers[eventemitter.OrderManagerExtractorCancel] = &eventemitter.Watcher{Concurrent: true, Handle: p.handleOrderCancelled}
+	p.watchers[eventemitter.OrderManagerSoftCancel] = &eventemitter.Watcher{Concurrent: true, Handle: p.handleOrderSoftCancelled}
+	p.watchers[eventemitter.OrderManagerExpire] = &eventemitter.Watcher{Concurrent: true, Handle: p.handleOrderExpired}
+	p.watchers[eventemitter.Block_New] = &eventemitter.Watcher{Concurrent: true, Handle: p.handleBlockNew}
+	return p
+}
+
+func (p *pushService) start() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.stopChan != nil {
+		return
+	}
+	p.stopChan = make(chan bool)
+	for topic, watcher := range p.watchers {
+		eventemitter.On(topic, watcher)
+	}
+
+	go func(stopChan chan bool) {
+		ticker := time.NewTicker(pushFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.flush()
+			case <-stopChan:
+				return
+			}
+		}
+	}(p.stopChan)
+}
+
+func (p *pushService) stop() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.stopChan == nil {
+		return
+	}
+	for topic, watcher := range p.watchers {
+		eventemitter.Un(topic, watcher)
+	}
+	close(p.stopChan)
+	p.stopChan = nil
+}
+
+func (p *pushService) subscribeDepth(notifier *rpc.Notifier, sub *rpc.Subscription, query DepthQuery) {
+	p.mtx.Lock()
+	p.depthSubs[sub.ID] = &depthSubscriber{notifier: notifier, id: sub.ID, query: query}
+	p.dirtyMarkets[query.Market] = true
+	p.mtx.Unlock()
+
+	go p.waitUnsubscribe(notifier, sub, func() { delete(p.depthSubs, sub.ID) })
+}
+
+func (p *pushService) subscribeTicker(notifier *rpc.Notifier, sub *rpc.Subscription, contractVersion string) {
+	p.mtx.Lock()
+	p.tickerSubs[sub.ID] = &tickerSubscriber{notifier: notifier, id: sub.ID, contractVersion: contractVersion}
+	p.tickerDirty = true
+	p.mtx.Unlock()
+
+	go p.waitUnsubscribe(notifier, sub, func() { delete(p.tickerSubs, sub.ID) })
+}
+
+func (p *pushService) subscribeFills(notifier *rpc.Notifier, sub *rpc.Subscription, query FillQuery) {
+	p.mtx.Lock()
+	p.fillSubs[sub.ID] = &fillSubscriber{notifier: notifier, id: sub.ID, query: query}
+	p.mtx.Unlock()
+
+	go p.waitUnsubscribe(notifier, sub, func() { delete(p.fillSubs, sub.ID) })
+}
+
+func (p *pushService) waitUnsubscribe(notifier *rpc.Notifier, sub *rpc.Subscription, remove func()) {
+	select {
+	case <-sub.Err():
+	case <-notifier.Closed():
+	}
+	p.mtx.Lock()
+	remove()
+	p.mtx.Unlock()
+}
+
+func (p *pushService) markMarketDirty(mkt string) {
+	p.mtx.Lock()
+	p.dirtyMarkets[strings.ToUpper(mkt)] = true
+	p.mtx.Unlock()
+}
+
+func (p *pushService) handleNewOrder(input eventemitter.EventData) error {
+	state := input.(*types.OrderState)
+	mkt, err := util.WrapMarketByAddress(state.RawOrder.TokenS.Hex(), state.RawOrder.TokenB.Hex())
+	if err != nil {
+		return err
+	}
+	p.markMarketDirty(mkt)
+	return nil
+}
+
+func (p *pushService) handleOrderSoftCancelled(input eventemitter.EventData) error {
+	return p.handleNewOrder(input)
+}
+
+func (p *pushService) handleOrderExpired(input eventemitter.EventData) error {
+	return p.handleNewOrder(input)
+}
+
+func (p *pushService) handleOrderFilled(input eventemitter.EventData) error {
+	event := input.(*types.OrderFilledEvent)
+
+	fill := dao.FillEvent{}
+	if err := fill.ConvertDown(event); err != nil {
+		return err
+	}
+	mkt, err := util.WrapMarketByAddress(fill.TokenS, fill.TokenB)
+	if err != nil {
+		return err
+	}
+	fill.Market = mkt
+	fill.TokenS = util.AddressToAlias(fill.TokenS)
+	fill.TokenB = util.AddressToAlias(fill.TokenB)
+
+	p.mtx.Lock()
+	p.dirtyMarkets[mkt] = true
+	p.tickerDirty = true
+	subs := make([]*fillSubscriber, 0, len(p.fillSubs))
+	for _, s := range p.fillSubs {
+		subs = append(subs, s)
+	}
+	p.mtx.Unlock()
+
+	for _, s := range subs {
+		if s.query.Market != "" && strings.ToUpper(s.query.Market) != mkt {
+			continue
+		}
+		if s.query.Owner != "" && strings.ToLower(s.query.Owner) != strings.ToLower(fill.Owner) {
+			continue
+		}
+		if s.query.ContractVersion != "" && strings.ToLower(util.ContractVersionConfig[s.query.ContractVersion]) != strings.ToLower(fill.Protocol) {
+			continue
+		}
+		if err := s.notifier.Notify(s.id, fill); err != nil {
+			log.Debugf("gateway,push fill to subscription:%s error:%s", s.id, err.Error())
+		}
+	}
+	return nil
+}
+
+func (p *pushService) handleOrderCancelled(input eventemitter.EventData) error {
+	event := input.(*types.OrderCancelledEvent)
+	state, err := p.j.orderManager.GetOrderByHash(event.OrderHash)
+	if err != nil {
+		return err
+	}
+	mkt, err := util.WrapMarketByAddress(state.RawOrder.TokenS.Hex(), state.RawOrder.TokenB.Hex())
+	if err != nil {
+		return err
+	}
+	p.markMarketDirty(mkt)
+	return nil
+}
+
+// 新块可能带来cutoff等无法直接定位市场的变化，因此刷新所有被订阅的市场
+func (p *pushService) handleBlockNew(input eventemitter.EventData) error {
+	p.mtx.Lock()
+	for _, s := range p.depthSubs {
+		p.dirtyMarkets[strings.ToUpper(s.query.Market)] = true
+	}
+	p.tickerDirty = true
+	p.mtx.Unlock()
+	return nil
+}
+
+func (p *pushService) flush() {
+	p.mtx.Lock()
+	dirtyMarkets := p.dirtyMarkets
+	p.dirtyMarkets = make(map[string]bool)
+	tickerDirty := p.tickerDirty
+	p.tickerDirty = false
+
+	depthSubs := []*depthSubscriber{}
+	for _, s := range p.depthSubs {
+		if dirtyMarkets[strings.ToUpper(s.query.Market)] {
+			depthSubs = append(depthSubs, s)
+		}
+	}
+	tickerSubs := []*tickerSubscriber{}
+	if tickerDirty {
+		for _, s := range p.tickerSubs {
+			tickerSubs = append(tickerSubs, s)
+		}
+	}
+	p.mtx.Unlock()
+
+	for _, s := range depthSubs {
+		p.pushDepth(s)
+	}
+	for _, s := range tickerSubs {
+		p.pushTicker(s)
+	}
+}
+
+func (p *pushService) pushDepth(s *depthSubscriber) {
+	depth, err := p.j.GetDepth(s.query)
+	if err != nil {
+		log.Debugf("gateway,push depth of market:%s error:%s", s.query.Market, err.Error())
+		return
+	}
+
+	buy, sell := depthLevels(depth.Depth.Buy), depthLevels(depth.Depth.Sell)
+	update := DepthUpdate{ContractVersion: depth.ContractVersion, Market: depth.Market}
+	if s.buy == nil || s.sell == nil {
+		update.Snapshot = true
+		update.Depth = depth.Depth
+	} else {
+		update.Depth.Buy = diffDepthLevels(s.buy, buy)
+		update.Depth.Sell = diffDepthLevels(s.sell, sell)
+		if len(update.Depth.Buy) == 0 && len(update.Depth.Sell) == 0 {
+			return
+		}
+	}
+
+	if err := s.notifier.Notify(s.id, update); err != nil {
+		log.Debugf("gateway,push depth to subscription:%s error:%s", s.id, err.Error())
+		return
+	}
+	s.buy, s.sell = buy, sell
+}
+
+func (p *pushService) pushTicker(s *tickerSubscriber) {
+	tickers, err := p.j.GetTicker(s.contractVersion)
+	if err != nil {
+		log.Debugf("gateway,push ticker error:%s", err.Error())
+		return
+	}
+
+	changed := []market.Ticker{}
+	current := make(map[string]market.Ticker)
+	for _, t := range tickers {
+		current[t.Market] = t
+		if last, ok := s.last[t.Market]; !ok || last != t {
+			changed = append(changed, t)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	if err := s.notifier.Notify(s.id, changed); err != nil {
+		log.Debugf("gateway,push ticker to subscription:%s error:%s", s.id, err.Error())
+		return
+	}
+	s.last = current
+}
+
+func depthLevels(levels [][]string) map[string][]string {
+	res := make(map[string][]string)
+	for _, level := range levels {
+		res[level[0]] = level
+	}
+	return res
+}
+
+// diffDepthLevels returns the levels added or changed in current, and the levels removed
+// from last with zero amount and size
+func diffDepthLevels(last, current map[string][]string) [][]string {
+	diff := [][]string{}
+	for price, level := range current {
+		if lastLevel, ok := last[price]; !ok || lastLevel[1] != level[1] || lastLevel[2] != level[2] {
+			diff = append(diff, level)
+		}
+	}
+	for price := range last {
+		if _, ok := current[price]; !ok {
+			diff = append(diff, []string{price, "0", "0"})
+		}
+	}
+	return diff
+}
+
+// Depth is called through loopring_subscribe("depth", query), the first notification
+// is a snapshot and the following ones only contain the changed price levels
+func (j *JsonrpcServiceImpl) Depth(ctx context.Context, query DepthQuery) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	query.Market = strings.ToUpper(query.Market)
+	if query.Market == "" || util.ContractVersionConfig[query.ContractVersion] == "" {
+		return nil, ErrInvalidParams.Errorf("market and correct contract version must be applied")
+	}
+	if _, err := util.WrapMarket(util.UnWrap(query.Market)); err != nil {
+		return nil, ErrUnsupportedMarket.Errorf("unsupported market type").With("market", query.Market)
+	}
+
+	sub := notifier.CreateSubscription()
+	j.pushService.subscribeDepth(notifier, sub, query)
+	return sub, nil
+}
+
+// Ticker is called through loopring_subscribe("ticker", contractVersion), only the
+// changed tickers are pushed
+func (j *JsonrpcServiceImpl) Ticker(ctx context.Context, contractVersion string) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	sub := notifier.CreateSubscription()
+	j.pushService.subscribeTicker(notifier, sub, contractVersion)
+	return sub, nil
+}
+
+// Fills is called through loopring_subscribe("fills", query), market, owner and
+// contract version of the query are used as filters
+func (j *JsonrpcServiceImpl) Fills(ctx context.Context, query FillQuery) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	sub := notifier.CreateSubscription()
+	j.pushService.subscribeFills(notifier, sub, query)
+	return sub, nil
+}
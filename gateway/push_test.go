@@ -0,0 +1,185 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	pushLrc  = common.HexToAddress("0x01")
+	pushWeth = common.HexToAddress("0x02")
+)
+
+// depthStub returns the levels of tokenS, they are replaced by tests
+type depthStub struct {
+	ordermanager.OrderManager
+	mtx    sync.Mutex
+	levels map[common.Address][]ordermanager.DepthLevel
+}
+
+func (s *depthStub) GetDepth(protocol, tokenS, tokenB common.Address, length int) []ordermanager.DepthLevel {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.levels[tokenS]
+}
+
+func (s *depthStub) setLevels(tokenS common.Address, levels ...ordermanager.DepthLevel) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.levels[tokenS] = levels
+}
+
+// buyLevel is a level of order selling weth at price, amount is the amount of lrc
+func buyLevel(price, amount int64) ordermanager.DepthLevel {
+	return ordermanager.DepthLevel{
+		Price:   big.NewRat(price, 1),
+		AmountS: big.NewRat(price*amount, 1),
+		AmountB: big.NewRat(amount, 1),
+		Count:   1,
+	}
+}
+
+func sortedLevels(levels [][]string) [][]string {
+	sort.Slice(levels, func(i, j int) bool { return levels[i][0] < levels[j][0] })
+	return levels
+}
+
+func TestDiffDepthLevels(t *testing.T) {
+	tests := []struct {
+		name          string
+		last, current [][]string
+		expected      [][]string
+	}{
+		{"unchanged", [][]string{{"1", "10", "10"}}, [][]string{{"1", "10", "10"}}, [][]string{}},
+		{"added", [][]string{{"1", "10", "10"}}, [][]string{{"1", "10", "10"}, {"2", "5", "10"}}, [][]string{{"2", "5", "10"}}},
+		{"amount changed", [][]string{{"1", "10", "10"}}, [][]string{{"1", "8", "10"}}, [][]string{{"1", "8", "10"}}},
+		{"size changed", [][]string{{"1", "10", "10"}}, [][]string{{"1", "10", "8"}}, [][]string{{"1", "10", "8"}}},
+		{"removed", [][]string{{"1", "10", "10"}, {"2", "5", "10"}}, [][]string{{"2", "5", "10"}}, [][]string{{"1", "0", "0"}}},
+		{"all", [][]string{{"1", "10", "10"}, {"2", "5", "10"}}, [][]string{{"2", "6", "12"}, {"3", "1", "3"}}, [][]string{{"1", "0", "0"}, {"2", "6", "12"}, {"3", "1", "3"}}},
+	}
+
+	for _, test := range tests {
+		diff := sortedLevels(diffDepthLevels(depthLevels(test.last), depthLevels(test.current)))
+		if !reflect.DeepEqual(diff, test.expected) {
+			t.Errorf("%s: diff should be %v, but got %v", test.name, test.expected, diff)
+		}
+	}
+}
+
+// TestPushDepthDiff subscribes depth through websocket rpc and checks the diffs pushed after fill and new block
+func TestPushDepthDiff(t *testing.T) {
+	supportTokens, supportMarkets, allTokens, contractVersions := util.SupportTokens, util.SupportMarkets, util.AllTokens, util.ContractVersionConfig
+	defer func() {
+		util.SupportTokens, util.SupportMarkets, util.AllTokens, util.ContractVersionConfig = supportTokens, supportMarkets, allTokens, contractVersions
+	}()
+	lrc := types.Token{Protocol: pushLrc, Symbol: "LRC", Decimals: big.NewInt(1)}
+	weth := types.Token{Protocol: pushWeth, Symbol: "WETH", Decimals: big.NewInt(1), IsMarket: true}
+	util.SupportTokens = map[string]types.Token{"LRC": lrc}
+	util.SupportMarkets = map[string]types.Token{"WETH": weth}
+	util.AllTokens = map[string]types.Token{"LRC": lrc, "WETH": weth}
+	util.ContractVersionConfig = map[string]string{"v1.0": "0x03"}
+
+	om := &depthStub{levels: make(map[common.Address][]ordermanager.DepthLevel)}
+	om.setLevels(pushWeth, buyLevel(2, 10), buyLevel(3, 10))
+	j := &JsonrpcServiceImpl{orderManager: om}
+	j.pushService = newPushService(j)
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("loopring", j); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	client := rpc.DialInProc(srv)
+	defer client.Close()
+
+	precision := 0
+	ch := make(chan DepthUpdate, 10)
+	sub, err := client.Subscribe(context.Background(), "loopring", ch, "depth", DepthQuery{ContractVersion: "v1.0", Market: "lrc-weth", Precision: &precision})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	// 订阅在返回id后才被激活，之前的推送会被丢弃，再调用一次确保已激活
+	var depth Depth
+	if err := client.Call(&depth, "loopring_getDepth", DepthQuery{ContractVersion: "v1.0", Market: "LRC-WETH"}); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() DepthUpdate {
+		select {
+		case update := <-ch:
+			return update
+		case err := <-sub.Err():
+			t.Fatalf("subscription error:%v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("depth update isn't pushed")
+		}
+		return DepthUpdate{}
+	}
+
+	j.pushService.flush()
+	update := receive()
+	if !update.Snapshot || update.Market != "LRC-WETH" {
+		t.Fatalf("first update should be the snapshot of LRC-WETH, but got %+v", update)
+	}
+	if expected := [][]string{{"2", "10.0000000000", "20.0000000000"}, {"3", "10.0000000000", "30.0000000000"}}; !reflect.DeepEqual(sortedLevels(update.Depth.Buy), expected) {
+		t.Fatalf("snapshot buy should be %v, but got %v", expected, update.Depth.Buy)
+	}
+
+	// level 2 changed, level 3 removed and level 4 added by the fill
+	om.setLevels(pushWeth, buyLevel(2, 5), buyLevel(4, 1))
+	fill := &types.OrderFilledEvent{TokenS: pushWeth, TokenB: pushLrc}
+	fill.RingIndex, fill.Blocknumber, fill.Time, fill.FillIndex = big.NewInt(1), big.NewInt(1), big.NewInt(0), big.NewInt(0)
+	fill.AmountS, fill.AmountB, fill.LrcReward, fill.LrcFee, fill.SplitS, fill.SplitB = big.NewInt(50), big.NewInt(5), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0)
+	if err := j.pushService.handleOrderFilled(fill); err != nil {
+		t.Fatal(err)
+	}
+	j.pushService.flush()
+	update = receive()
+	if update.Snapshot || len(update.Depth.Sell) != 0 {
+		t.Fatalf("update after fill should only contain the changed buy levels, but got %+v", update)
+	}
+	if expected := [][]string{{"2", "5.0000000000", "10.0000000000"}, {"3", "0", "0"}, {"4", "1.0000000000", "4.0000000000"}}; !reflect.DeepEqual(sortedLevels(update.Depth.Buy), expected) {
+		t.Fatalf("buy diff after fill should be %v, but got %v", expected, update.Depth.Buy)
+	}
+
+	// 新块刷新所有订阅的市场
+	om.setLevels(pushWeth, buyLevel(4, 1))
+	if err := j.pushService.handleBlockNew(&types.BlockEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	j.pushService.flush()
+	update = receive()
+	if expected := [][]string{{"2", "0", "0"}}; !reflect.DeepEqual(update.Depth.Buy, expected) {
+		t.Fatalf("buy diff after new block should be %v, but got %v", expected, update.Depth.Buy)
+	}
+}
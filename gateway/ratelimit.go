@@ -0,0 +1,380 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/types"
+	"github.com/Loopring/relay/usermanager"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"golang.org/x/net/websocket"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketLimiter refills rate tokens per second up to burst for each key
+type tokenBucketLimiter struct {
+	rate      float64
+	burst     float64
+	mtx       sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newTokenBucketLimiter(rate float64, burst int) *tokenBucketLimiter {
+	l := &tokenBucketLimiter{}
+	l.rate = rate
+	l.burst = math.Max(float64(burst), 1)
+	l.buckets = make(map[string]*tokenBucket)
+	l.lastSweep = time.Now()
+	return l
+}
+
+// allow takes n tokens of key, or returns the time to wait for them. n larger than burst is allowed
+// with a full bucket, the tokens become negative and delay the following requests
+func (l *tokenBucketLimiter) allow(key string, n int, now time.Time) (bool, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	need := math.Min(float64(n), l.burst)
+	if bucket.tokens >= need {
+		bucket.tokens -= float64(n)
+		return true, 0
+	}
+	return false, time.Duration((need - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep removes the buckets that have been refilled, they are the same as new ones
+func (l *tokenBucketLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+type methodLimiter struct {
+	ip    *tokenBucketLimiter
+	owner *tokenBucketLimiter
+}
+
+type rpcRequestHeader struct {
+	Id     *json.RawMessage  `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// rpcLimitError is the error object of jsonrpc as the rpc server responds RpcError
+type rpcLimitError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+type rpcLimitErrorResponse struct {
+	Version string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Error   rpcLimitError    `json:"error"`
+}
+
+// RateLimiter limits the configured methods by the remote ip and by the owner found in
+// the first param, each order of loopring_submitOrders is counted as a request of its owner.
+// the ip is always limited, owners in the white list aren't limited by owner only if the orders
+// they submit are signed by them
+type RateLimiter struct {
+	limiters    map[string]*methodLimiter
+	userManager usermanager.UserManager
+}
+
+func NewRateLimiter(options map[string]config.RateLimitOptions, userManager usermanager.UserManager) *RateLimiter {
+	r := &RateLimiter{}
+	r.userManager = userManager
+	r.limiters = make(map[string]*methodLimiter)
+	for method, opts := range options {
+		limiter := &methodLimiter{}
+		if opts.IpRate > 0 {
+			limiter.ip = newTokenBucketLimiter(opts.IpRate, opts.IpBurst)
+		}
+		if opts.OwnerRate > 0 {
+			limiter.owner = newTokenBucketLimiter(opts.OwnerRate, opts.OwnerBurst)
+		}
+		r.limiters[method] = limiter
+	}
+	return r
+}
+
+// Handler reads the requests in body before handing it to handler, and responds errors
+// with RateLimitErrorCode if any of them exceeds the limit
+func (r *RateLimiter) Handler(handler http.Handler) http.Handler {
+	if len(r.limiters) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ip = req.RemoteAddr
+		}
+		req = req.WithContext(context.WithValue(req.Context(), RemoteAddrContextKey, ip))
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		response, limited := r.limit(req.Context(), body, time.Now())
+		if !limited {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write(response)
+	})
+}
+
+// WebsocketHandler serves jsonrpc on websocket as srv.WebsocketHandler does, and limits each message
+// of the connection. the limited message is responded with errors and never reaches srv
+func (r *RateLimiter) WebsocketHandler(srv *rpc.Server, allowedOrigins []string) http.Handler {
+	wsServer, ok := srv.WebsocketHandler(allowedOrigins).(websocket.Server)
+	if !ok || len(r.limiters) == 0 {
+		return srv.WebsocketHandler(allowedOrigins)
+	}
+	wsServer.Handler = func(conn *websocket.Conn) {
+		ip, _, err := net.SplitHostPort(conn.Request().RemoteAddr)
+		if err != nil {
+			ip = conn.Request().RemoteAddr
+		}
+		limitedConn := &rateLimitedConn{conn: conn, limiter: r}
+		limitedConn.ctx = context.WithValue(conn.Request().Context(), RemoteAddrContextKey, ip)
+		srv.ServeCodec(rpc.NewJSONCodec(limitedConn), rpc.OptionMethodInvocation|rpc.OptionSubscriptions)
+	}
+	return wsServer
+}
+
+// limit checks all requests in body, the error response is returned if any of them exceeds the limit
+func (r *RateLimiter) limit(ctx context.Context, body []byte, now time.Time) ([]byte, bool) {
+	headers, isBatch := parseRequestHeaders(body)
+	responses := []*rpcLimitErrorResponse{}
+	for _, header := range headers {
+		if err, limited := r.check(ctx, header, now); limited {
+			responses = append(responses, &rpcLimitErrorResponse{
+				Version: "2.0",
+				Id:      header.Id,
+				Error:   rpcLimitError{Code: err.ErrorCode(), Message: err.Error(), Data: err.ErrorData()},
+			})
+		}
+	}
+	if len(responses) == 0 {
+		return nil, false
+	}
+
+	var response []byte
+	if isBatch {
+		response, _ = json.Marshal(responses)
+	} else {
+		response, _ = json.Marshal(responses[0])
+	}
+	return response, true
+}
+
+// rateLimitedConn reads the messages of websocket one by one, and hands the allowed ones to rpc codec
+type rateLimitedConn struct {
+	conn    *websocket.Conn
+	limiter *RateLimiter
+	ctx     context.Context
+	buf     bytes.Buffer
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	for c.buf.Len() == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(c.conn, &msg); err != nil {
+			return 0, err
+		}
+		response, limited := c.limiter.limit(c.ctx, msg, time.Now())
+		if !limited {
+			c.buf.Write(msg)
+			break
+		}
+		// websocket.Conn is safe to write concurrently with the responses of rpc codec
+		if err := websocket.Message.Send(c.conn, string(response)); err != nil {
+			return 0, err
+		}
+	}
+	return c.buf.Read(p)
+}
+
+func (c *rateLimitedConn) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+func (c *rateLimitedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (r *RateLimiter) check(ctx context.Context, header *rpcRequestHeader, now time.Time) (*RpcError, bool) {
+	limiter, ok := r.limiters[header.Method]
+	if !ok {
+		return nil, false
+	}
+
+	params := ownerParams(header.Method, header.Params)
+	if nil != limiter.ip {
+		ip, _ := ctx.Value(RemoteAddrContextKey).(string)
+		n := len(params)
+		if n == 0 {
+			n = 1
+		}
+		if allowed, wait := limiter.ip.allow(ip, n, now); !allowed {
+			return rateLimitedError(header.Method, ip, wait), true
+		}
+	}
+	if nil == limiter.owner {
+		return nil, false
+	}
+
+	owners := []string{}
+	counts := make(map[string]int)
+	for _, param := range params {
+		owner := ownerOfParam(param)
+		if owner == "" || r.isWhiteListed(header.Method, owner, param) {
+			continue
+		}
+		if _, ok := counts[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		counts[owner]++
+	}
+	for _, owner := range owners {
+		if allowed, wait := limiter.owner.allow(owner, counts[owner], now); !allowed {
+			return rateLimitedError(header.Method, owner, wait), true
+		}
+	}
+	return nil, false
+}
+
+// isWhiteListed returns true if the owner of param isn't limited by owner
+func (r *RateLimiter) isWhiteListed(method, owner string, param json.RawMessage) bool {
+	// 白名单只能跳过owner的限制，且订单必须由owner签名，否则任何人都能冒用白名单地址
+	// InWhiteList is always true when the white list is closed
+	return nil != r.userManager && r.userManager.IsWhiteListOpen() &&
+		r.userManager.InWhiteList(common.HexToAddress(owner)) && isSignedByOwner(method, param)
+}
+
+// rateLimitedError tells the limited key and the milliseconds to wait before retrying
+func rateLimitedError(method, key string, wait time.Duration) *RpcError {
+	return ErrRateLimited.Errorf("rate limit exceeded").
+		With("method", method).
+		With("key", key).
+		With("retryAfter", int64(wait/time.Millisecond))
+}
+
+// parseRequestHeaders decodes a single request or a batch, the body that can't be decoded
+// is left to the rpc server to respond
+func parseRequestHeaders(body []byte) ([]*rpcRequestHeader, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		headers := []*rpcRequestHeader{}
+		if err := json.Unmarshal(trimmed, &headers); err != nil {
+			return nil, true
+		}
+		return headers, true
+	}
+
+	header := &rpcRequestHeader{}
+	if err := json.Unmarshal(trimmed, header); err != nil {
+		return nil, false
+	}
+	return []*rpcRequestHeader{header}, false
+}
+
+// ownerParams returns the params that have owners, they are the orders of loopring_submitOrders,
+// or the first param of other methods
+func ownerParams(method string, params []json.RawMessage) []json.RawMessage {
+	if len(params) == 0 {
+		return nil
+	}
+	if method != "loopring_submitOrders" {
+		return params[:1]
+	}
+	orders := []json.RawMessage{}
+	if err := json.Unmarshal(params[0], &orders); err != nil {
+		return nil
+	}
+	return orders
+}
+
+// isSignedByOwner returns true if the order param of submit methods is signed by its owner as SignFilter
+// judges, params of other methods aren't signed
+func isSignedByOwner(method string, param json.RawMessage) bool {
+	if method != "loopring_submitOrder" && method != "loopring_submitOrders" {
+		return false
+	}
+	request := &types.OrderJsonRequest{}
+	if err := json.Unmarshal(param, request); err != nil {
+		return false
+	}
+	order := types.ToOrder(request)
+	order.Hash = order.GenerateHash()
+	signer, err := order.SignerAddress()
+	return err == nil && signer == order.Owner
+}
+
+// ownerOfParam returns the owner field of param, such as OrderJsonRequest and OrderQuery
+func ownerOfParam(param json.RawMessage) string {
+	value := struct {
+		Owner string `json:"owner"`
+	}{}
+	if err := json.Unmarshal(param, &value); err != nil || !common.IsHexAddress(value.Owner) {
+		return ""
+	}
+	return strings.ToLower(value.Owner)
+}
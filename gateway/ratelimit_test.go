@@ -0,0 +1,254 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	relayCrypto "github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+type whiteListStub struct {
+	owners map[common.Address]bool
+}
+
+func (s *whiteListStub) AddWhiteListUser(user types.WhiteListUser) error { return nil }
+func (s *whiteListStub) DelWhiteListUser(user types.WhiteListUser) error { return nil }
+func (s *whiteListStub) InWhiteList(owner common.Address) bool           { return s.owners[owner] }
+func (s *whiteListStub) IsWhiteListOpen() bool                           { return true }
+
+// signedOrderParams returns the params of submitOrder with an order of owner, it's signed by signer
+func signedOrderParams(t *testing.T, owner common.Address, signer func(hash []byte) []byte) []json.RawMessage {
+	order := &types.Order{}
+	order.Owner = owner
+	order.AmountS = big.NewInt(100)
+	order.AmountB = big.NewInt(10)
+	order.Timestamp = big.NewInt(time.Now().Unix())
+	order.Ttl = big.NewInt(3600)
+	order.Salt = big.NewInt(1)
+	order.LrcFee = big.NewInt(1)
+	order.Hash = order.GenerateHash()
+	v, r, s := relayCrypto.SigToVRS(signer(order.Hash.Bytes()))
+	order.V = v
+	order.R = types.BytesToBytes32(r)
+	order.S = types.BytesToBytes32(s)
+
+	request := &types.OrderJsonRequest{
+		Protocol: order.Protocol, TokenS: order.TokenS, TokenB: order.TokenB,
+		AmountS: order.AmountS, AmountB: order.AmountB, Timestamp: order.Timestamp.Int64(),
+		Ttl: order.Ttl.Int64(), Salt: order.Salt.Int64(), LrcFee: order.LrcFee,
+		V: order.V, R: order.R, S: order.S, Owner: order.Owner,
+	}
+	param, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []json.RawMessage{param}
+}
+
+func TestRateLimiterWhiteListNeedsSignature(t *testing.T) {
+	relayCrypto.Initialize(relayCrypto.NewCrypto(true, nil))
+	key, _ := ethCrypto.GenerateKey()
+	owner := ethCrypto.PubkeyToAddress(key.PublicKey)
+	sign := func(hash []byte) []byte {
+		sig, _ := ethCrypto.Sign(ethCrypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), hash), key)
+		return sig
+	}
+	other, _ := ethCrypto.GenerateKey()
+	forge := func(hash []byte) []byte {
+		sig, _ := ethCrypto.Sign(ethCrypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), hash), other)
+		return sig
+	}
+
+	options := map[string]config.RateLimitOptions{
+		"loopring_submitOrder": {IpRate: 1000, IpBurst: 1000, OwnerRate: 0.001, OwnerBurst: 1},
+	}
+	limiter := NewRateLimiter(options, &whiteListStub{owners: map[common.Address]bool{owner: true}})
+	ctx := context.WithValue(context.Background(), RemoteAddrContextKey, "127.0.0.1")
+	now := time.Now()
+
+	// the order signed by the white listed owner isn't limited by owner
+	signed := &rpcRequestHeader{Method: "loopring_submitOrder", Params: signedOrderParams(t, owner, sign)}
+	for i := 0; i < 3; i++ {
+		if _, limited := limiter.check(ctx, signed, now); limited {
+			t.Fatalf("order signed by white listed owner shouldn't be limited")
+		}
+	}
+
+	// anyone can put the white listed owner in the order, but can't sign it
+	limiter = NewRateLimiter(options, &whiteListStub{owners: map[common.Address]bool{owner: true}})
+	forged := &rpcRequestHeader{Method: "loopring_submitOrder", Params: signedOrderParams(t, owner, forge)}
+	if _, limited := limiter.check(ctx, forged, now); limited {
+		t.Fatalf("first order should be allowed")
+	}
+	err, limited := limiter.check(ctx, forged, now)
+	if !limited || err.Data["key"] != strings.ToLower(owner.Hex()) {
+		t.Fatalf("forged order should be limited by owner, but got %+v", err)
+	}
+}
+
+func TestRateLimiterIpAlwaysLimited(t *testing.T) {
+	relayCrypto.Initialize(relayCrypto.NewCrypto(true, nil))
+	key, _ := ethCrypto.GenerateKey()
+	owner := ethCrypto.PubkeyToAddress(key.PublicKey)
+	sign := func(hash []byte) []byte {
+		sig, _ := ethCrypto.Sign(ethCrypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), hash), key)
+		return sig
+	}
+
+	options := map[string]config.RateLimitOptions{
+		"loopring_submitOrder": {IpRate: 0.001, IpBurst: 1},
+	}
+	limiter := NewRateLimiter(options, &whiteListStub{owners: map[common.Address]bool{owner: true}})
+	ctx := context.WithValue(context.Background(), RemoteAddrContextKey, "127.0.0.1")
+	header := &rpcRequestHeader{Method: "loopring_submitOrder", Params: signedOrderParams(t, owner, sign)}
+	if _, limited := limiter.check(ctx, header, time.Now()); limited {
+		t.Fatalf("first order should be allowed")
+	}
+	if err, limited := limiter.check(ctx, header, time.Now()); !limited || err.Data["key"] != "127.0.0.1" {
+		t.Fatalf("white listed owner should still be limited by ip, but got %+v", err)
+	}
+}
+
+type EchoService struct{}
+
+func (s *EchoService) Echo(msg string) string {
+	return msg
+}
+
+func TestRateLimiterWebsocket(t *testing.T) {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("loopring", &EchoService{}); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	limiter := NewRateLimiter(map[string]config.RateLimitOptions{
+		"loopring_echo": {IpRate: 0.001, IpBurst: 2},
+	}, nil)
+	server := httptest.NewServer(limiter.WebsocketHandler(srv, []string{"*"}))
+	defer server.Close()
+
+	client, err := rpc.DialWebsocket(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		var res string
+		if err := client.Call(&res, "loopring_echo", "hello"); err != nil || res != "hello" {
+			t.Fatalf("call %d should be allowed, but got %s, err:%v", i, res, err)
+		}
+	}
+	var res string
+	if err := client.Call(&res, "loopring_echo", "hello"); nil == err || !strings.Contains(err.Error(), "rate limit") {
+		t.Fatalf("the third call on websocket should be limited, but got %s, err:%v", res, err)
+	}
+}
+
+func TestRateLimiterErrorResponse(t *testing.T) {
+	limiter := NewRateLimiter(map[string]config.RateLimitOptions{
+		"loopring_getOrders": {IpRate: 0.001, IpBurst: 1},
+	}, nil)
+	ctx := context.WithValue(context.Background(), RemoteAddrContextKey, "127.0.0.1")
+	body := []byte(`[{"jsonrpc":"2.0","id":1,"method":"loopring_getOrders","params":[]},{"jsonrpc":"2.0","id":2,"method":"loopring_getOrders","params":[]}]`)
+	response, limited := limiter.limit(ctx, body, time.Now())
+	if !limited {
+		t.Fatalf("the second request of batch should be limited")
+	}
+
+	responses := []struct {
+		Id    int `json:"id"`
+		Error struct {
+			Code int                    `json:"code"`
+			Data map[string]interface{} `json:"data"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(response, &responses); err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || responses[0].Id != 2 {
+		t.Fatalf("only the second request should be responded, but got %s", string(response))
+	}
+	if e := responses[0].Error; e.Code != RateLimitErrorCode || e.Data["name"] != ErrRateLimited.Name || e.Data["key"] != "127.0.0.1" {
+		t.Fatalf("limited error should be responded as RpcError, but got %s", string(response))
+	}
+}
+
+func TestRateLimiterSubmitOrders(t *testing.T) {
+	relayCrypto.Initialize(relayCrypto.NewCrypto(true, nil))
+	key, _ := ethCrypto.GenerateKey()
+	owner := ethCrypto.PubkeyToAddress(key.PublicKey)
+	sign := func(hash []byte) []byte {
+		sig, _ := ethCrypto.Sign(ethCrypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), hash), key)
+		return sig
+	}
+	batch := func(n int) []json.RawMessage {
+		orders := []json.RawMessage{}
+		for i := 0; i < n; i++ {
+			orders = append(orders, signedOrderParams(t, owner, sign)[0])
+		}
+		param, _ := json.Marshal(orders)
+		return []json.RawMessage{param}
+	}
+	ctx := context.WithValue(context.Background(), RemoteAddrContextKey, "127.0.0.1")
+	now := time.Now()
+
+	// each order of batch is counted by owner
+	limiter := NewRateLimiter(map[string]config.RateLimitOptions{
+		"loopring_submitOrders": {IpRate: 1000, IpBurst: 1000, OwnerRate: 0.001, OwnerBurst: 3},
+	}, nil)
+	if _, limited := limiter.check(ctx, &rpcRequestHeader{Method: "loopring_submitOrders", Params: batch(2)}, now); limited {
+		t.Fatalf("the first 2 orders should be allowed")
+	}
+	err, limited := limiter.check(ctx, &rpcRequestHeader{Method: "loopring_submitOrders", Params: batch(2)}, now)
+	if !limited || err.Data["key"] != strings.ToLower(owner.Hex()) {
+		t.Fatalf("the orders after burst should be limited by owner, but got %+v", err)
+	}
+
+	// and by ip
+	limiter = NewRateLimiter(map[string]config.RateLimitOptions{
+		"loopring_submitOrders": {IpRate: 0.001, IpBurst: 3},
+	}, nil)
+	if _, limited := limiter.check(ctx, &rpcRequestHeader{Method: "loopring_submitOrders", Params: batch(3)}, now); limited {
+		t.Fatalf("the first 3 orders should be allowed")
+	}
+	if _, limited := limiter.check(ctx, &rpcRequestHeader{Method: "loopring_submitOrders", Params: batch(1)}, now); !limited {
+		t.Fatalf("the orders after burst should be limited by ip")
+	}
+
+	// signed orders of white listed owner aren't limited by owner
+	limiter = NewRateLimiter(map[string]config.RateLimitOptions{
+		"loopring_submitOrders": {OwnerRate: 0.001, OwnerBurst: 1},
+	}, &whiteListStub{owners: map[common.Address]bool{owner: true}})
+	if _, limited := limiter.check(ctx, &rpcRequestHeader{Method: "loopring_submitOrders", Params: batch(5)}, now); limited {
+		t.Fatalf("signed orders of white listed owner shouldn't be limited")
+	}
+}
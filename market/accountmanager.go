@@ -84,6 +84,8 @@ func NewAccountManager() AccountManager {
 	eventemitter.On(eventemitter.AccountApproval, approveWatcher)
 	eventemitter.On(eventemitter.WethDepositMethod, wethDepositWatcher)
 	eventemitter.On(eventemitter.WethWithdrawalMethod, wethWithdrawalWatcher)
+	forkWatcher := &eventemitter.Watcher{Concurrent: false, Handle: accountManager.handleFork}
+	eventemitter.On(eventemitter.ChainForkProcess, forkWatcher)
 
 	return accountManager
 }
@@ -213,6 +215,15 @@ func (a *AccountManager) HandleWethWithdrawal(input eventemitter.EventData) (err
 	return
 }
 
+// handleFork drops all cached accounts, the transfers and approvals of forked blocks have been applied to them,
+// accounts are loaded from the ethereum node again when they are queried
+func (a *AccountManager) handleFork(input eventemitter.EventData) error {
+	forkEvent := input.(*types.ForkedEvent)
+	log.Infof("account manager,flush accounts cache after chain fork at block:%s", forkEvent.ForkBlock.String())
+	a.c.Flush()
+	return nil
+}
+
 func (a *AccountManager) GetBalanceFromAccessor(token string, owner string) (*big.Int, error) {
 	return ethaccessor.Erc20Balance(util.AllTokens[token].Protocol, common.HexToAddress(owner), "latest")
 }
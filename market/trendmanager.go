@@ -87,6 +87,7 @@ var trendManager TrendManager
 
 const trendKey = "market_ticker"
 const tickerKey = "market_ticker_view"
+const forkDrainTimeout = 60 * time.Second
 
 func NewTrendManager(dao dao.RdsService) TrendManager {
 
@@ -95,8 +96,11 @@ func NewTrendManager(dao dao.RdsService) TrendManager {
 		trendManager.c = cache.New(cache.NoExpiration, cache.NoExpiration)
 		trendManager.refreshCache()
 		trendManager.startScheduleUpdate()
-		fillOrderWatcher := &eventemitter.Watcher{Concurrent: false, Handle: trendManager.handleOrderFilled}
-		eventemitter.On(eventemitter.OrderManagerExtractorFill, fillOrderWatcher)
+		if _, err := eventemitter.Subscribe(eventemitter.OrderManagerExtractorFill, "trendmanager", trendManager.handleOrderFilled); err != nil {
+			log.Fatalf("trend manager,subscribe fill event error:%s", err.Error())
+		}
+		forkWatcher := &eventemitter.Watcher{Concurrent: false, Handle: trendManager.handleFork}
+		eventemitter.On(eventemitter.ChainForkComplete, forkWatcher)
 		//trendManager.startScheduleUpdate()
 	})
 
@@ -505,14 +509,21 @@ func (t *TrendManager) handleOrderFilled(input eventemitter.EventData) (err erro
 
 		market, wrapErr := util.WrapMarketByAddress(newFillModel.TokenS, newFillModel.TokenB)
 
+		// 不支持的市场重试也不会成功，跳过以免阻塞后续的成交
 		if wrapErr != nil {
-			err = wrapErr
+			log.Printf("trend manager,skip fill of order:%s error:%s", newFillModel.OrderHash, wrapErr.Error())
 			return
 		}
 
 		if tickerInCache, ok := t.c.Get(trendKey); ok {
 			trendMap := tickerInCache.(map[string]Cache)
 			tc := trendMap[market]
+			// 重启后重放的成交可能已经由refreshCache从数据库加载
+			for _, fill := range tc.Fills {
+				if fill.RingHash == newFillModel.RingHash && fill.OrderHash == newFillModel.OrderHash {
+					return
+				}
+			}
 			tc.Fills = append(tc.Fills, *newFillModel)
 			trendMap[market] = tc
 			t.c.Set(trendKey, trendMap, cache.NoExpiration)
@@ -531,6 +542,18 @@ func (t *TrendManager) handleOrderFilled(input eventemitter.EventData) (err erro
 	return
 }
 
+// handleFork reloads fills after ordermanager rolled back the fills of forked blocks
+func (t *TrendManager) handleFork(input eventemitter.EventData) error {
+	forkEvent := input.(*types.ForkedEvent)
+	// 分叉前的成交处理完后再刷新，否则分叉块中的成交会在刷新后被加入缓存
+	if err := eventemitter.Drain(eventemitter.OrderManagerExtractorFill, "trendmanager", forkDrainTimeout); err != nil {
+		log.Printf("trend manager,drain fills before refresh error:%s", err.Error())
+	}
+	log.Printf("trend manager,refresh cache after chain fork at block:%s", forkEvent.ForkBlock.String())
+	t.refreshCache()
+	return nil
+}
+
 func (t *TrendManager) reCalTicker(market string) {
 	trendInCache, _ := t.c.Get(trendKey)
 	mktCache := trendInCache.(map[string]Cache)[market]
@@ -0,0 +1,300 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	DryRunCandidate = "candidate" // rings evaluated by matcher
+	DryRunChosen    = "chosen"    // rings chosen by matcher that would be submitted
+
+	DefaultDryRunFile = "miner_dryrun.ndjson"
+
+	dryRunLegalPrecision = 8
+)
+
+type DryRunOrder struct {
+	OrderHash        common.Hash    `json:"orderHash"`
+	Owner            common.Address `json:"owner"`
+	Market           string         `json:"market"`
+	TokenS           common.Address `json:"tokenS"`
+	TokenB           common.Address `json:"tokenB"`
+	RateAmountS      string         `json:"rateAmountS"`
+	FillAmountS      string         `json:"fillAmountS"`
+	FillAmountB      string         `json:"fillAmountB"`
+	AvailableAmountS string         `json:"availableAmountS"`
+	LrcFee           string         `json:"lrcFee"`
+	FeeSelection     uint8          `json:"feeSelection"`
+	LegalFee         string         `json:"legalFee"`
+}
+
+// DryRunRecord is a line of the dry-run file, legal amounts are in the currency of marketcap
+type DryRunRecord struct {
+	Type             string         `json:"type"`
+	Round            string         `json:"round"`
+	Time             int64          `json:"time"`
+	RingHash         common.Hash    `json:"ringHash"`
+	Protocol         common.Address `json:"protocol"`
+	Miner            common.Address `json:"miner"`
+	Market           string         `json:"market"`
+	Orders           []DryRunOrder  `json:"orders"`
+	LegalFee         string         `json:"legalFee"`
+	LegalCost        string         `json:"legalCost"`
+	Received         string         `json:"received"`
+	ProtocolGas      string         `json:"protocolGas"`
+	ProtocolGasPrice string         `json:"protocolGasPrice"`
+}
+
+// DryRunWriter appends the rings to a NDJSON file instead of submitting them
+type DryRunWriter struct {
+	mtx  sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewDryRunWriter(path string) (*DryRunWriter, error) {
+	if path == "" {
+		path = DefaultDryRunFile
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &DryRunWriter{}
+	w.file = file
+	w.enc = json.NewEncoder(file)
+	return w, nil
+}
+
+func (w *DryRunWriter) Write(recordType string, round *big.Int, infos ...*types.RingSubmitInfo) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	now := time.Now().Unix()
+	for _, info := range infos {
+		if err := w.enc.Encode(NewDryRunRecord(recordType, round, now, info)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *DryRunWriter) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.file.Close()
+}
+
+func NewDryRunRecord(recordType string, round *big.Int, now int64, info *types.RingSubmitInfo) *DryRunRecord {
+	record := &DryRunRecord{}
+	record.Type = recordType
+	if nil != round {
+		record.Round = round.String()
+	}
+	record.Time = now
+	record.RingHash = info.Ringhash
+	record.Protocol = info.ProtocolAddress
+	record.Miner = info.Miner
+	record.LegalCost = ratString(info.LegalCost, dryRunLegalPrecision)
+	record.Received = ratString(info.Received, dryRunLegalPrecision)
+	record.ProtocolGas = intString(info.ProtocolGas)
+	record.ProtocolGasPrice = intString(info.ProtocolGasPrice)
+
+	markets := []string{}
+	if nil != info.RawRing {
+		record.LegalFee = ratString(info.RawRing.LegalFee, dryRunLegalPrecision)
+		for _, filledOrder := range info.RawRing.Orders {
+			rawOrder := filledOrder.OrderState.RawOrder
+			order := DryRunOrder{}
+			order.OrderHash = rawOrder.Hash
+			order.Owner = rawOrder.Owner
+			order.TokenS = rawOrder.TokenS
+			order.TokenB = rawOrder.TokenB
+			order.Market, _ = util.WrapMarketByAddress(rawOrder.TokenS.Hex(), rawOrder.TokenB.Hex())
+			order.RateAmountS = ratString(filledOrder.RateAmountS, 0)
+			order.FillAmountS = ratString(filledOrder.FillAmountS, 0)
+			order.FillAmountB = ratString(filledOrder.FillAmountB, 0)
+			order.AvailableAmountS = ratString(filledOrder.AvailableAmountS, 0)
+			order.LrcFee = ratString(filledOrder.LrcFee, 0)
+			order.FeeSelection = filledOrder.FeeSelection
+			order.LegalFee = ratString(filledOrder.LegalFee, dryRunLegalPrecision)
+			record.Orders = append(record.Orders, order)
+			markets = appendMarket(markets, order.Market)
+		}
+	}
+	sort.Strings(markets)
+	record.Market = strings.Join(markets, ",")
+	return record
+}
+
+type DryRunSummaryItem struct {
+	Key       string `json:"key"`
+	RingCount int    `json:"ringCount"`
+	LegalFee  string `json:"legalFee"`
+	LegalCost string `json:"legalCost"`
+	Received  string `json:"received"`
+}
+
+// DryRunSummary is the hypothetical profit of the chosen rings
+type DryRunSummary struct {
+	CandidateCount int                 `json:"candidateCount"`
+	ChosenCount    int                 `json:"chosenCount"`
+	Total          DryRunSummaryItem   `json:"total"`
+	Markets        []DryRunSummaryItem `json:"markets"`
+	Hours          []DryRunSummaryItem `json:"hours"`
+}
+
+type dryRunSum struct {
+	count     int
+	legalFee  *big.Rat
+	legalCost *big.Rat
+	received  *big.Rat
+}
+
+func (s *dryRunSum) add(record *DryRunRecord) {
+	s.count++
+	s.legalFee.Add(s.legalFee, parseRat(record.LegalFee))
+	s.legalCost.Add(s.legalCost, parseRat(record.LegalCost))
+	s.received.Add(s.received, parseRat(record.Received))
+}
+
+func (s *dryRunSum) item(key string) DryRunSummaryItem {
+	return DryRunSummaryItem{
+		Key:       key,
+		RingCount: s.count,
+		LegalFee:  s.legalFee.FloatString(dryRunLegalPrecision),
+		LegalCost: s.legalCost.FloatString(dryRunLegalPrecision),
+		Received:  s.received.FloatString(dryRunLegalPrecision),
+	}
+}
+
+func newDryRunSum() *dryRunSum {
+	return &dryRunSum{legalFee: new(big.Rat), legalCost: new(big.Rat), received: new(big.Rat)}
+}
+
+// SummarizeDryRun sums the chosen rings in the dry-run file by market and by hour(UTC),
+// records between from and to(unix seconds, 0 means unlimited) are summarized
+func SummarizeDryRun(r io.Reader, from, to int64) (*DryRunSummary, error) {
+	summary := &DryRunSummary{}
+	total := newDryRunSum()
+	markets := make(map[string]*dryRunSum)
+	hours := make(map[string]*dryRunSum)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		record := &DryRunRecord{}
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			return nil, err
+		}
+		if (from > 0 && record.Time < from) || (to > 0 && record.Time > to) {
+			continue
+		}
+
+		switch record.Type {
+		case DryRunCandidate:
+			summary.CandidateCount++
+		case DryRunChosen:
+			summary.ChosenCount++
+			total.add(record)
+			if _, ok := markets[record.Market]; !ok {
+				markets[record.Market] = newDryRunSum()
+			}
+			markets[record.Market].add(record)
+			hour := time.Unix(record.Time, 0).UTC().Format("2006-01-02T15:00Z")
+			if _, ok := hours[hour]; !ok {
+				hours[hour] = newDryRunSum()
+			}
+			hours[hour].add(record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	summary.Total = total.item("total")
+	summary.Markets = sortedSummaryItems(markets)
+	summary.Hours = sortedSummaryItems(hours)
+	return summary, nil
+}
+
+func sortedSummaryItems(sums map[string]*dryRunSum) []DryRunSummaryItem {
+	keys := []string{}
+	for key := range sums {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	items := []DryRunSummaryItem{}
+	for _, key := range keys {
+		items = append(items, sums[key].item(key))
+	}
+	return items
+}
+
+func appendMarket(markets []string, market string) []string {
+	if market == "" {
+		return markets
+	}
+	for _, m := range markets {
+		if m == market {
+			return markets
+		}
+	}
+	return append(markets, market)
+}
+
+func ratString(r *big.Rat, precision int) string {
+	if nil == r {
+		return "0"
+	}
+	return r.FloatString(precision)
+}
+
+func intString(i *big.Int) string {
+	if nil == i {
+		return "0"
+	}
+	return i.String()
+}
+
+func parseRat(s string) *big.Rat {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return new(big.Rat)
+	}
+	return r
+}
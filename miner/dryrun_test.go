@@ -0,0 +1,124 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func dryRunRingInfo(hash int64, received, legalCost *big.Rat) *types.RingSubmitInfo {
+	info := &types.RingSubmitInfo{}
+	info.Ringhash = common.BigToHash(big.NewInt(hash))
+	info.Received = received
+	info.LegalCost = legalCost
+	info.ProtocolGas = big.NewInt(400000)
+	info.ProtocolGasPrice = big.NewInt(1000000000)
+	info.RawRing = &types.Ring{LegalFee: new(big.Rat).Add(received, legalCost)}
+	return info
+}
+
+func TestDryRunWriterAndSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dryrun")
+	if err != nil {
+		t.Fatalf("create temp dir error:%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, miner.DefaultDryRunFile)
+
+	writer, err := miner.NewDryRunWriter(path)
+	if err != nil {
+		t.Fatalf("create dry-run writer error:%s", err.Error())
+	}
+	round := big.NewInt(100)
+	candidate := dryRunRingInfo(1, big.NewRat(1, 2), big.NewRat(1, 10))
+	chosen1 := dryRunRingInfo(2, big.NewRat(3, 2), big.NewRat(1, 10))
+	chosen2 := dryRunRingInfo(3, big.NewRat(1, 4), big.NewRat(1, 20))
+	if err := writer.Write(miner.DryRunCandidate, round, candidate, chosen1, chosen2); err != nil {
+		t.Fatalf("write candidates error:%s", err.Error())
+	}
+	if err := writer.Write(miner.DryRunChosen, round, chosen1, chosen2); err != nil {
+		t.Fatalf("write chosen rings error:%s", err.Error())
+	}
+	writer.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open dry-run file error:%s", err.Error())
+	}
+	defer file.Close()
+	summary, err := miner.SummarizeDryRun(file, 0, 0)
+	if err != nil {
+		t.Fatalf("summarize error:%s", err.Error())
+	}
+
+	if summary.CandidateCount != 3 || summary.ChosenCount != 2 {
+		t.Fatalf("candidate count:%d, chosen count:%d", summary.CandidateCount, summary.ChosenCount)
+	}
+	if summary.Total.RingCount != 2 || summary.Total.Received != "1.75000000" || summary.Total.LegalCost != "0.15000000" {
+		t.Fatalf("total:%+v", summary.Total)
+	}
+	if len(summary.Hours) != 1 || summary.Hours[0].RingCount != 2 {
+		t.Fatalf("hours:%+v", summary.Hours)
+	}
+	if len(summary.Markets) != 1 || summary.Markets[0].Received != "1.75000000" {
+		t.Fatalf("markets:%+v", summary.Markets)
+	}
+}
+
+func TestSummarizeDryRunTimeRange(t *testing.T) {
+	record1 := miner.NewDryRunRecord(miner.DryRunChosen, big.NewInt(1), 3600, dryRunRingInfo(1, big.NewRat(1, 1), big.NewRat(0, 1)))
+	record2 := miner.NewDryRunRecord(miner.DryRunChosen, big.NewInt(2), 7200, dryRunRingInfo(2, big.NewRat(2, 1), big.NewRat(0, 1)))
+
+	dir, err := ioutil.TempDir("", "dryrun")
+	if err != nil {
+		t.Fatalf("create temp dir error:%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, miner.DefaultDryRunFile)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create dry-run file error:%s", err.Error())
+	}
+	for _, record := range []*miner.DryRunRecord{record1, record2} {
+		bs, _ := json.Marshal(record)
+		file.Write(append(bs, '\n'))
+	}
+	file.Seek(0, 0)
+	defer file.Close()
+
+	summary, err := miner.SummarizeDryRun(file, 7000, 0)
+	if err != nil {
+		t.Fatalf("summarize error:%s", err.Error())
+	}
+	if summary.ChosenCount != 1 || summary.Total.Received != "2.00000000" {
+		t.Fatalf("total:%+v", summary.Total)
+	}
+	if len(summary.Hours) != 1 || summary.Hours[0].Key != "1970-01-01T02:00Z" {
+		t.Fatalf("hours:%+v", summary.Hours)
+	}
+}
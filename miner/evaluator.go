@@ -21,7 +21,6 @@ package miner
 import (
 	"errors"
 	"github.com/Loopring/relay/log"
-	"math"
 	"math/big"
 
 	"github.com/Loopring/relay/ethaccessor"
@@ -33,116 +32,21 @@ import (
 type Evaluator struct {
 	marketCapProvider     marketcap.MarketCapProvider
 	rateRatioCVSThreshold int64
+	ratePrecision         uint
 }
 
 func (e *Evaluator) ComputeRing(ringState *types.Ring) error {
-
-	productAmountS := big.NewRat(int64(1), int64(1))
-	productAmountB := big.NewRat(int64(1), int64(1))
-
-	//compute price
-	for _, order := range ringState.Orders {
-		amountS := new(big.Rat).SetInt(order.OrderState.RawOrder.AmountS)
-		amountB := new(big.Rat).SetInt(order.OrderState.RawOrder.AmountB)
-
-		productAmountS.Mul(productAmountS, amountS)
-		productAmountB.Mul(productAmountB, amountB)
-
-		order.SPrice = new(big.Rat)
-		order.SPrice.Quo(amountS, amountB)
-
-		order.BPrice = new(big.Rat)
-		order.BPrice.Quo(amountB, amountS)
-	}
-
-	productPrice := new(big.Rat)
-	productPrice.Quo(productAmountS, productAmountB)
-	//todo:change pow to big.Int
-	priceOfFloat, _ := productPrice.Float64()
-	rootOfRing := math.Pow(priceOfFloat, 1/float64(len(ringState.Orders)))
-	rate := new(big.Rat).SetFloat64(rootOfRing)
-	ringState.ReducedRate = new(big.Rat)
-	ringState.ReducedRate.Inv(rate)
-	log.Debugf("Miner,rate:%s, priceFloat:%f , len:%d, rootOfRing:%f, reducedRate:%s ", rate.String(), priceOfFloat, len(ringState.Orders), rootOfRing, ringState.ReducedRate.RatString())
-
-	//todo:get the fee for select the ring of mix income
-	//LRC等比例下降，首先需要计算fillAmountS
-	//分润的fee，首先需要计算fillAmountS，fillAmountS取决于整个环路上的完全匹配的订单
-	//如何计算最小成交量的订单，计算下一次订单的卖出或买入，然后根据比例替换
-	minVolumeIdx := 0
-
-	for idx, filledOrder := range ringState.Orders {
-		filledOrder.SPrice.Mul(filledOrder.SPrice, ringState.ReducedRate)
-
-		filledOrder.BPrice.Inv(filledOrder.SPrice)
-
-		amountS := new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS)
-		//amountB := new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB)
-
-		//根据用户设置，判断是以卖还是买为基准
-		//买入不超过amountB
-		filledOrder.RateAmountS = new(big.Rat).Set(amountS)
-		filledOrder.RateAmountS.Mul(amountS, ringState.ReducedRate)
-		//if BuyNoMoreThanAmountB , AvailableAmountS need to be reduced by the ratePrice
-		//if filledOrder.OrderState.RawOrder.BuyNoMoreThanAmountB {
-		//	availbleAmountB := new(big.Rat).Set(filledOrder.AvailableAmountB)
-		//	availableAmountS := new(big.Rat).Mul(filledOrder.RateAmountS, availbleAmountB)
-		//	availableAmountS.Quo(availableAmountS, amountB)
-		//	if filledOrder.AvailableAmountB.Cmp(new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB)) < 0 {
-		//		filledOrder.AvailableAmountS.Set(availableAmountS)
-		//	}
-		//}
-
-		//与上一订单的买入进行比较
-		var lastOrder *types.FilledOrder
-		if idx > 0 {
-			lastOrder = ringState.Orders[idx-1]
-		}
-
-		filledOrder.FillAmountS = new(big.Rat)
-		if lastOrder != nil && lastOrder.FillAmountB.Cmp(filledOrder.AvailableAmountS) >= 0 {
-			//当前订单为最小订单
-			filledOrder.FillAmountS.Set(filledOrder.AvailableAmountS)
-			minVolumeIdx = idx
-			//根据minVolumeIdx进行最小交易量的计算,两个方向进行
-		} else if lastOrder == nil {
-			filledOrder.FillAmountS.Set(filledOrder.AvailableAmountS)
-		} else {
-			//上一订单为最小订单需要对remainAmountS进行折扣计算
-			filledOrder.FillAmountS.Set(lastOrder.FillAmountB)
-		}
-		filledOrder.FillAmountB = new(big.Rat).Mul(filledOrder.FillAmountS, filledOrder.BPrice)
-	}
-
-	//compute the volume of the ring by the min volume
-	//todo:the first and the last
-	//if (ring.RawRing.Orders[len(ring.RawRing.Orders) - 1].FillAmountB.Cmp(ring.RawRing.Orders[0].FillAmountS) < 0) {
-	//	minVolumeIdx = len(ring.RawRing.Orders) - 1
-	//	for i := minVolumeIdx-1; i >= 0; i-- {
-	//		//按照前面的，同步减少交易量
-	//		order := ring.RawRing.Orders[i]
-	//		var nextOrder *types.FilledOrder
-	//		nextOrder = ring.RawRing.Orders[i + 1]
-	//		order.FillAmountB = nextOrder.FillAmountS
-	//		order.FillAmountS.Mul(order.FillAmountB, order.EnlargedSPrice)
-	//	}
-	//}
-
-	for i := minVolumeIdx - 1; i >= 0; i-- {
-		//按照前面的，同步减少交易量
-		order := ringState.Orders[i]
-		var nextOrder *types.FilledOrder
-		nextOrder = ringState.Orders[i+1]
-		order.FillAmountB = nextOrder.FillAmountS
-		order.FillAmountS.Mul(order.FillAmountB, order.SPrice)
+	//compute the reduced rate with big.Float instead of math.Pow, float64 loses precision of 18-decimal tokens
+	reducedRate, err := ReducedRate(ringState, e.ratePrecision)
+	if nil != err {
+		return err
 	}
+	ringState.ReducedRate = reducedRate
+	log.Debugf("Miner,reducedRate:%s, len:%d", ringState.ReducedRate.FloatString(18), len(ringState.Orders))
 
-	for i := minVolumeIdx + 1; i < len(ringState.Orders); i++ {
-		order := ringState.Orders[i]
-		var lastOrder *types.FilledOrder
-		lastOrder = ringState.Orders[i-1]
-		order.FillAmountS = lastOrder.FillAmountB
-		order.FillAmountB.Mul(order.FillAmountS, order.BPrice)
+	//fill amounts are computed in the same way as contract, the ring volume is reduced to the min order
+	if err := ComputeFillAmounts(ringState); nil != err {
+		return err
 	}
 
 	//compute the fee of this ring and orders, and set the feeSelection
@@ -169,51 +73,52 @@ func (e *Evaluator) computeFeeOfRingAndOrder(ringState *types.Ring) {
 			lrcAddress = implAddress.LrcTokenAddress
 		}
 
+		rawOrder := filledOrder.OrderState.RawOrder
+		fillAmountS := ratFloor(filledOrder.FillAmountS)
+		fillAmountB := ratFloor(filledOrder.FillAmountB)
+
 		//todo:成本节约
+		//节约的金额与合约一致，按订单价格计算后向下取整
 		legalAmountOfSaving := new(big.Rat)
-		if filledOrder.OrderState.RawOrder.BuyNoMoreThanAmountB {
-			amountS := new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS)
-			amountB := new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB)
-			sPrice := new(big.Rat)
-			sPrice.Quo(amountS, amountB)
-			savingAmount := new(big.Rat)
-			savingAmount.Mul(filledOrder.FillAmountB, sPrice)
-			savingAmount.Sub(savingAmount, filledOrder.FillAmountS)
-			filledOrder.FeeS = savingAmount
-			legalAmountOfSaving = e.getLegalCurrency(filledOrder.OrderState.RawOrder.TokenS, filledOrder.FeeS)
+		var lrcFee *big.Int
+		if rawOrder.BuyNoMoreThanAmountB {
+			savingAmount := new(big.Int).Mul(fillAmountB, rawOrder.AmountS)
+			savingAmount.Div(savingAmount, rawOrder.AmountB).Sub(savingAmount, fillAmountS)
+			filledOrder.FeeS = new(big.Rat).SetInt(savingAmount)
+			legalAmountOfSaving = e.getLegalCurrency(rawOrder.TokenS, filledOrder.FeeS)
+
+			lrcFee = new(big.Int).Mul(rawOrder.LrcFee, fillAmountB)
+			lrcFee.Div(lrcFee, rawOrder.AmountB)
 		} else {
-			savingAmount := new(big.Rat).Set(filledOrder.FillAmountB)
-			savingAmount.Mul(savingAmount, ringState.ReducedRate)
-			savingAmount.Sub(filledOrder.FillAmountB, savingAmount)
-			filledOrder.FeeS = savingAmount
-			legalAmountOfSaving = e.getLegalCurrency(filledOrder.OrderState.RawOrder.TokenB, filledOrder.FeeS)
+			savingAmount := new(big.Int).Mul(fillAmountS, rawOrder.AmountB)
+			savingAmount.Div(savingAmount, rawOrder.AmountS)
+			savingAmount.Sub(fillAmountB, savingAmount)
+			filledOrder.FeeS = new(big.Rat).SetInt(savingAmount)
+			legalAmountOfSaving = e.getLegalCurrency(rawOrder.TokenB, filledOrder.FeeS)
+
+			lrcFee = new(big.Int).Mul(rawOrder.LrcFee, fillAmountS)
+			lrcFee.Div(lrcFee, rawOrder.AmountS)
 		}
 
 		//compute lrcFee
-		rate := new(big.Rat).Quo(filledOrder.FillAmountS, new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS))
-		filledOrder.LrcFee = new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.LrcFee)
-		filledOrder.LrcFee.Mul(filledOrder.LrcFee, rate)
-
+		filledOrder.LrcFee = new(big.Rat).SetInt(lrcFee)
 		if filledOrder.AvailableLrcBalance.Cmp(filledOrder.LrcFee) <= 0 {
-			filledOrder.LrcFee = filledOrder.AvailableLrcBalance
+			filledOrder.LrcFee = new(big.Rat).SetInt(ratFloor(filledOrder.AvailableLrcBalance))
 		}
 
 		legalAmountOfLrc := e.getLegalCurrency(lrcAddress, filledOrder.LrcFee)
-		log.Debugf("raw.lrc:%s, AvailableLrcBalance:%s, legalAmountOfLrc:%s saving:%s", filledOrder.OrderState.RawOrder.LrcFee.String(), filledOrder.AvailableLrcBalance.FloatString(0), legalAmountOfLrc.String(), legalAmountOfSaving.String())
+		log.Debugf("raw.lrc:%s, AvailableLrcBalance:%s, legalAmountOfLrc:%s saving:%s", rawOrder.LrcFee.String(), filledOrder.AvailableLrcBalance.FloatString(0), legalAmountOfLrc.String(), legalAmountOfSaving.String())
 		filledOrder.LegalLrcFee = legalAmountOfLrc
 
-		splitPer := new(big.Rat).SetInt64(int64(filledOrder.OrderState.RawOrder.MarginSplitPercentage))
-		legalAmountOfSaving.Mul(legalAmountOfSaving, splitPer)
-		filledOrder.LegalFeeS = legalAmountOfSaving
+		//LegalFeeS is the margin split miner can get
+		filledOrder.LegalFeeS = MarginSplit(ratOrZero(legalAmountOfSaving), rawOrder.MarginSplitPercentage)
 	}
 
 }
 
 //成环之后才可计算能否成交，否则不需计算，判断是否能够成交，不能使用除法计算
 func PriceValid(a2BOrder *types.OrderState, b2AOrder *types.OrderState) bool {
-	amountS := new(big.Int).Mul(a2BOrder.RawOrder.AmountS, b2AOrder.RawOrder.AmountS)
-	amountB := new(big.Int).Mul(a2BOrder.RawOrder.AmountB, b2AOrder.RawOrder.AmountB)
-	return amountS.Cmp(amountB) >= 0
+	return RingPriceValid(a2BOrder, b2AOrder)
 }
 
 func PriceRateCVSquare(ringState *types.Ring) (*big.Int, error) {
@@ -262,6 +167,9 @@ func (e *Evaluator) getLegalCurrency(tokenAddress common.Address, amount *big.Ra
 	return c
 }
 
-func NewEvaluator(marketCapProvider marketcap.MarketCapProvider, rateRatioCVSThreshold int64) *Evaluator {
-	return &Evaluator{marketCapProvider: marketCapProvider, rateRatioCVSThreshold: rateRatioCVSThreshold}
+func NewEvaluator(marketCapProvider marketcap.MarketCapProvider, rateRatioCVSThreshold int64, ratePrecision uint) *Evaluator {
+	if ratePrecision == 0 {
+		ratePrecision = DefaultRatePrecision
+	}
+	return &Evaluator{marketCapProvider: marketCapProvider, rateRatioCVSThreshold: rateRatioCVSThreshold, ratePrecision: ratePrecision}
 }
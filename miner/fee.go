@@ -0,0 +1,137 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"math/big"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/types"
+)
+
+const (
+	FeeSelectionLrc         uint8 = 0
+	FeeSelectionMarginSplit uint8 = 1
+
+	marginSplitPercentageBase = 100
+)
+
+// RingFee is the fee miner receives from a ring and the fee selection of each order, LrcRewards are the
+// lrc paid to the owners of orders whose margin split is chosen
+type RingFee struct {
+	LegalFee      *big.Rat
+	FeeSelections []uint8
+	LegalFees     []*big.Rat
+	LrcRewards    []*big.Rat
+}
+
+// ComputeRingFee chooses margin split for an order if the legal value of split minus the lrc reward is more than
+// the lrcFee, and lrcBalance of the fee recipient is enough to pay the reward, otherwise lrcFee is chosen.
+// the contract gives no split at all if the fee recipient can't pay the reward, so the balance is checked order by order
+func ComputeRingFee(orders []*types.FilledOrder, lrcBalance *big.Rat) *RingFee {
+	fee := &RingFee{LegalFee: new(big.Rat)}
+	balance := new(big.Rat)
+	if nil != lrcBalance {
+		balance.Set(lrcBalance)
+	}
+
+	for _, filledOrder := range orders {
+		legalLrcFee := ratOrZero(filledOrder.LegalLrcFee)
+		legalSplit := ratOrZero(filledOrder.LegalFeeS)
+		lrcFee := ratOrZero(filledOrder.LrcFee)
+
+		splitFee := new(big.Rat).Sub(legalSplit, legalLrcFee)
+		if splitFee.Cmp(legalLrcFee) > 0 && balance.Cmp(lrcFee) >= 0 {
+			balance.Sub(balance, lrcFee)
+			fee.FeeSelections = append(fee.FeeSelections, FeeSelectionMarginSplit)
+			fee.LegalFees = append(fee.LegalFees, splitFee)
+			fee.LrcRewards = append(fee.LrcRewards, new(big.Rat).Set(lrcFee))
+			fee.LegalFee.Add(fee.LegalFee, splitFee)
+		} else {
+			fee.FeeSelections = append(fee.FeeSelections, FeeSelectionLrc)
+			fee.LegalFees = append(fee.LegalFees, new(big.Rat).Set(legalLrcFee))
+			fee.LrcRewards = append(fee.LrcRewards, new(big.Rat))
+			fee.LegalFee.Add(fee.LegalFee, legalLrcFee)
+		}
+	}
+	return fee
+}
+
+func (fee *RingFee) apply(ringState *types.Ring) {
+	ringState.LegalFee = fee.LegalFee
+	for idx, filledOrder := range ringState.Orders {
+		filledOrder.FeeSelection = fee.FeeSelections[idx]
+		filledOrder.LegalFee = fee.LegalFees[idx]
+		filledOrder.LrcReward = fee.LrcRewards[idx]
+	}
+}
+
+// MarginSplit is the part of saving paid to miner, the percentage is based on 100 as the contract
+func MarginSplit(saving *big.Rat, marginSplitPercentage uint8) *big.Rat {
+	return new(big.Rat).Mul(saving, big.NewRat(int64(marginSplitPercentage), marginSplitPercentageBase))
+}
+
+// SplitMinerGasPrice spends feePercent of the legal fee on gas, gasPrice = (feePercent/100)*legalFee/ethPrice/gas,
+// ethPrice is the legal value of 1 wei
+func SplitMinerGasPrice(legalFee *big.Rat, feePercent float64, ethPrice *big.Rat, gas *big.Int) *big.Int {
+	if nil == legalFee || nil == ethPrice || nil == gas || legalFee.Sign() <= 0 || ethPrice.Sign() <= 0 || gas.Sign() <= 0 || feePercent <= 0 {
+		return big.NewInt(0)
+	}
+	percent := new(big.Rat).SetFloat64(feePercent)
+	if nil == percent {
+		return big.NewInt(0)
+	}
+	wei := new(big.Rat).Mul(legalFee, percent)
+	wei.Quo(wei, big.NewRat(100, 1))
+	wei.Quo(wei, ethPrice)
+	wei.Quo(wei, new(big.Rat).SetInt(gas))
+	return ratFloor(wei)
+}
+
+// SelectGasPrice chooses the gas price level by the urgency of ring. the ring is sent with fast price if it still
+// receives more than the gas cost, with standard price if it still receives something, otherwise with safe price.
+// ethPrice is the legal value of 1 wei, nil is returned if levels is nil
+func SelectGasPrice(legalFee *big.Rat, gas *big.Int, ethPrice *big.Rat, levels *ethaccessor.GasPriceLevels) *big.Int {
+	if nil == levels {
+		return nil
+	}
+	if nil == legalFee || nil == gas || nil == ethPrice {
+		return new(big.Int).Set(levels.Safe)
+	}
+	legalCost := func(gasPrice *big.Int) *big.Rat {
+		cost := new(big.Rat).SetInt(new(big.Int).Mul(gas, gasPrice))
+		return cost.Mul(cost, ethPrice)
+	}
+
+	fastCost := legalCost(levels.Fast)
+	if new(big.Rat).Sub(legalFee, fastCost).Cmp(fastCost) >= 0 {
+		return new(big.Int).Set(levels.Fast)
+	}
+	if new(big.Rat).Sub(legalFee, legalCost(levels.Standard)).Sign() > 0 {
+		return new(big.Int).Set(levels.Standard)
+	}
+	return new(big.Int).Set(levels.Safe)
+}
+
+func ratOrZero(r *big.Rat) *big.Rat {
+	if nil == r {
+		return new(big.Rat)
+	}
+	return r
+}
@@ -0,0 +1,154 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+)
+
+// newFeeOrder returns an order whose lrcFee is lrcFee tokens worth legalLrcFee, and margin split is worth legalSplit
+func newFeeOrder(lrcFee, legalLrcFee, legalSplit int64) *types.FilledOrder {
+	filledOrder := &types.FilledOrder{}
+	filledOrder.LrcFee = big.NewRat(lrcFee, 1)
+	filledOrder.LegalLrcFee = big.NewRat(legalLrcFee, 1)
+	filledOrder.LegalFeeS = big.NewRat(legalSplit, 1)
+	return filledOrder
+}
+
+func TestComputeRingFee(t *testing.T) {
+	orders := []*types.FilledOrder{
+		// split 30 - reward 10 > lrcFee 10
+		newFeeOrder(100, 10, 30),
+		// split 15 - reward 10 < lrcFee 10
+		newFeeOrder(100, 10, 15),
+	}
+
+	fee := miner.ComputeRingFee(orders, big.NewRat(1000, 1))
+	if fee.FeeSelections[0] != miner.FeeSelectionMarginSplit || fee.FeeSelections[1] != miner.FeeSelectionLrc {
+		t.Fatalf("fee selections should be [1 0], but got %v", fee.FeeSelections)
+	}
+	if fee.LegalFees[0].Cmp(big.NewRat(20, 1)) != 0 || fee.LegalFees[1].Cmp(big.NewRat(10, 1)) != 0 {
+		t.Fatalf("legal fees should be [20 10], but got [%s %s]", fee.LegalFees[0].FloatString(0), fee.LegalFees[1].FloatString(0))
+	}
+	if fee.LegalFee.Cmp(big.NewRat(30, 1)) != 0 {
+		t.Fatalf("legal fee should be 30, but got %s", fee.LegalFee.FloatString(0))
+	}
+	// the lrc reward paid to owner is the lrcFee of order
+	if fee.LrcRewards[0].Cmp(big.NewRat(100, 1)) != 0 || fee.LrcRewards[1].Sign() != 0 {
+		t.Fatalf("lrc rewards should be [100 0], but got [%s %s]", fee.LrcRewards[0].FloatString(0), fee.LrcRewards[1].FloatString(0))
+	}
+}
+
+func TestComputeRingFeeInsufficientLrc(t *testing.T) {
+	orders := []*types.FilledOrder{
+		newFeeOrder(100, 10, 50),
+		newFeeOrder(100, 10, 40),
+	}
+
+	// miner can only pay the reward of the first order
+	fee := miner.ComputeRingFee(orders, big.NewRat(150, 1))
+	if fee.FeeSelections[0] != miner.FeeSelectionMarginSplit || fee.FeeSelections[1] != miner.FeeSelectionLrc {
+		t.Fatalf("fee selections should be [1 0], but got %v", fee.FeeSelections)
+	}
+	if fee.LegalFee.Cmp(big.NewRat(50, 1)) != 0 {
+		t.Fatalf("legal fee should be 50, but got %s", fee.LegalFee.FloatString(0))
+	}
+
+	// miner without lrc can't choose margin split
+	fee = miner.ComputeRingFee(orders, new(big.Rat))
+	for idx, selection := range fee.FeeSelections {
+		if selection != miner.FeeSelectionLrc {
+			t.Fatalf("order %d should select lrc fee when miner has no lrc", idx)
+		}
+		if fee.LrcRewards[idx].Sign() != 0 {
+			t.Fatalf("order %d should get no lrc reward", idx)
+		}
+	}
+	if fee.LegalFee.Cmp(big.NewRat(20, 1)) != 0 {
+		t.Fatalf("legal fee should be 20, but got %s", fee.LegalFee.FloatString(0))
+	}
+
+	// nil balance is same as no lrc
+	fee = miner.ComputeRingFee(orders, nil)
+	if fee.FeeSelections[0] != miner.FeeSelectionLrc {
+		t.Fatalf("order should select lrc fee when balance is unknown")
+	}
+
+	// order without lrcFee needs no reward
+	fee = miner.ComputeRingFee([]*types.FilledOrder{newFeeOrder(0, 0, 5)}, new(big.Rat))
+	if fee.FeeSelections[0] != miner.FeeSelectionMarginSplit || fee.LegalFee.Cmp(big.NewRat(5, 1)) != 0 {
+		t.Fatalf("order without lrcFee should select margin split")
+	}
+}
+
+func TestMarginSplit(t *testing.T) {
+	if split := miner.MarginSplit(big.NewRat(200, 1), 50); split.Cmp(big.NewRat(100, 1)) != 0 {
+		t.Fatalf("split of 50%% should be 100, but got %s", split.FloatString(0))
+	}
+	if split := miner.MarginSplit(big.NewRat(200, 1), 0); split.Sign() != 0 {
+		t.Fatalf("split of 0%% should be 0, but got %s", split.FloatString(0))
+	}
+}
+
+func TestSplitMinerGasPrice(t *testing.T) {
+	// eth is 500 legal currency, 1 wei is 5e-16
+	ethPrice := big.NewRat(5, 10000000000000000)
+	// 10% of 20 is 2, which is 4e15 wei, gasPrice is 4e15/200000 = 2e10
+	gasPrice := miner.SplitMinerGasPrice(big.NewRat(20, 1), 10, ethPrice, big.NewInt(200000))
+	if gasPrice.Cmp(big.NewInt(20000000000)) != 0 {
+		t.Fatalf("gas price should be 20000000000, but got %s", gasPrice.String())
+	}
+	if gasPrice := miner.SplitMinerGasPrice(big.NewRat(-1, 1), 10, ethPrice, big.NewInt(200000)); gasPrice.Sign() != 0 {
+		t.Fatalf("gas price of ring without fee should be 0")
+	}
+}
+
+func TestSelectGasPrice(t *testing.T) {
+	levels := &ethaccessor.GasPriceLevels{
+		Safe:        big.NewInt(1000000000),
+		Standard:    big.NewInt(2000000000),
+		Fast:        big.NewInt(5000000000),
+		BlockNumber: big.NewInt(100),
+	}
+	// eth is 500 legal currency, 1 wei is 5e-16
+	ethPrice := big.NewRat(5, 10000000000000000)
+	gas := big.NewInt(200000)
+
+	// cost with fast price is 0.5, with standard price is 0.2
+	for _, c := range []struct {
+		legalFee *big.Rat
+		expected *big.Int
+	}{
+		{big.NewRat(1, 1), levels.Fast},
+		{big.NewRat(6, 10), levels.Standard},
+		{big.NewRat(1, 10), levels.Safe},
+	} {
+		if gasPrice := miner.SelectGasPrice(c.legalFee, gas, ethPrice, levels); gasPrice.Cmp(c.expected) != 0 {
+			t.Fatalf("gas price of fee %s should be %s, but got %s", c.legalFee.FloatString(2), c.expected.String(), gasPrice.String())
+		}
+	}
+	if gasPrice := miner.SelectGasPrice(big.NewRat(1, 1), gas, ethPrice, nil); nil != gasPrice {
+		t.Fatalf("gas price should be nil before it's evaluated")
+	}
+}
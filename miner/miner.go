@@ -40,6 +40,8 @@ func (minerInstance *Miner) Stop() {
 }
 
 func NewMiner(submitter *RingSubmitter, matcher Matcher, evaluator *Evaluator, marketCapProvider marketcap.MarketCapProvider) *Miner {
+	//submitter evaluates the rings matched before restart again
+	submitter.evaluator = evaluator
 	return &Miner{
 		marketCapProvider: marketCapProvider,
 		submitter:         submitter,
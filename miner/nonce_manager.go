@@ -0,0 +1,418 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// 节点要求替换交易的gasPrice至少提高10%
+const replaceGasPriceBumpPercent = 10
+
+type minerNonce struct {
+	mtx           sync.Mutex
+	address       common.Address
+	gasPriceLimit *big.Int
+	maxPendingTtl int
+
+	nonce    uint64   // next nonce to be assigned
+	released []uint64 // nonces of txs failed to send, they are assigned first to avoid nonce gap
+	pending  map[uint64]*types.MinerTransaction
+}
+
+// NonceManager assigns nonces of miner addresses locally and tracks the txs sent by them,
+// a tx still pending after MaxPendingTtl blocks is sent again with the same nonce and higher gasPrice.
+// the state is saved in db and rebuilt from db and chain when miner starts, also after chain fork
+type NonceManager struct {
+	dbService dao.RdsService
+	miners    map[common.Address]*minerNonce
+
+	blockMtx    sync.RWMutex
+	blockNumber *big.Int
+
+	blocks  chan *types.BlockEvent
+	stop    chan struct{}
+	watcher *eventemitter.Watcher
+
+	// 访问链上的方法，测试时替换
+	getTransactionCount func(result interface{}, address common.Address, blockNumber string) error
+	sendTransaction     func(sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte, nonce uint64) (string, error)
+}
+
+func NewNonceManager(dbService dao.RdsService, minerAddresses []*NormalMinerAddress) *NonceManager {
+	manager := &NonceManager{}
+	manager.dbService = dbService
+	manager.getTransactionCount = ethaccessor.GetTransactionCount
+	manager.sendTransaction = ethaccessor.SignAndSendTransactionWithNonce
+	manager.miners = make(map[common.Address]*minerNonce)
+	for _, minerAddress := range minerAddresses {
+		miner := &minerNonce{}
+		miner.address = minerAddress.Address
+		miner.gasPriceLimit = minerAddress.GasPriceLimit
+		miner.maxPendingTtl = minerAddress.MaxPendingTtl
+		miner.pending = make(map[uint64]*types.MinerTransaction)
+		manager.miners[miner.address] = miner
+	}
+	return manager
+}
+
+func (manager *NonceManager) Start() {
+	var blockNumber types.Big
+	if err := ethaccessor.BlockNumber(&blockNumber); nil != err {
+		log.Errorf("Miner nonce manager,get block number err:%s", err.Error())
+	} else {
+		manager.setBlockNumber(blockNumber.BigInt())
+	}
+	manager.recoverMiners()
+
+	manager.blocks = make(chan *types.BlockEvent, 1)
+	manager.stop = make(chan struct{})
+	manager.watcher = &eventemitter.Watcher{Concurrent: false, Handle: manager.handleNewBlock}
+	eventemitter.On(eventemitter.Block_New, manager.watcher)
+	go manager.loop(manager.blocks, manager.stop)
+}
+
+func (manager *NonceManager) Stop() {
+	if nil == manager.stop {
+		return
+	}
+	eventemitter.Un(eventemitter.Block_New, manager.watcher)
+	close(manager.stop)
+	manager.stop = nil
+}
+
+func (manager *NonceManager) IsManaged(address common.Address) bool {
+	_, ok := manager.miners[address]
+	return ok
+}
+
+// IsTracked returns whether the tx sent by address is tracked until mined
+func (manager *NonceManager) IsTracked(address common.Address, txHash common.Hash) bool {
+	miner, ok := manager.miners[address]
+	if !ok {
+		return false
+	}
+	miner.mtx.Lock()
+	defer miner.mtx.Unlock()
+	for _, tx := range miner.pending {
+		if tx.TxHash == txHash {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingCount returns the count of txs sent by address and not mined yet
+func (manager *NonceManager) PendingCount(address common.Address) int {
+	miner, ok := manager.miners[address]
+	if !ok {
+		return 0
+	}
+	miner.mtx.Lock()
+	defer miner.mtx.Unlock()
+	return len(miner.pending)
+}
+
+// SendTransaction signs and sends the tx with the nonce assigned locally and tracks it until mined
+func (manager *NonceManager) SendTransaction(txType types.MinerTxType, ringhashes []common.Hash, sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte) (string, error) {
+	miner, ok := manager.miners[sender.Address]
+	if !ok {
+		return "", errors.New("nonce of " + sender.Address.Hex() + " isn't managed")
+	}
+	if nil == gas || nil == gasPrice {
+		return "", errors.New("gas and gasPrice must be setted")
+	}
+	if nil == value {
+		value = big.NewInt(0)
+	}
+
+	miner.mtx.Lock()
+	defer miner.mtx.Unlock()
+
+	nonce := miner.nextNonce()
+	gasCopy := new(big.Int).Set(gas)
+	txHash, err := manager.sendTransaction(sender, to, gasCopy, gasPrice, value, callData, nonce)
+	if nil != err {
+		miner.releaseNonce(nonce)
+		return "", err
+	}
+
+	tx := &types.MinerTransaction{}
+	tx.Miner = sender.Address
+	tx.Nonce = nonce
+	tx.TxHash = common.HexToHash(txHash)
+	tx.To = to
+	tx.Gas = gasCopy
+	tx.GasPrice = new(big.Int).Set(gasPrice)
+	tx.Value = new(big.Int).Set(value)
+	tx.Data = callData
+	tx.TxType = txType
+	tx.RingHashes = ringhashes
+	tx.SubmitBlock = manager.currentBlockNumber()
+	tx.Status = types.MINER_TX_PENDING
+	miner.pending[nonce] = tx
+	if err := manager.dbService.SaveMinerTransaction(tx); nil != err {
+		log.Errorf("Miner nonce manager,save tx:%s err:%s", txHash, err.Error())
+	}
+	return txHash, nil
+}
+
+// recover rebuilds the pending txs and nonce from db and chain, the txs rolled back by fork are pending again
+func (manager *NonceManager) recover(miner *minerNonce) error {
+	var latestCount, pendingCount types.Big
+	if err := manager.getTransactionCount(&latestCount, miner.address, "latest"); nil != err {
+		return err
+	}
+	if err := manager.getTransactionCount(&pendingCount, miner.address, "pending"); nil != err {
+		return err
+	}
+	latestNonce := latestCount.Uint64()
+	if err := manager.dbService.UpdateMinerTransactionsPending(miner.address, latestNonce); nil != err {
+		return err
+	}
+	if err := manager.dbService.UpdateMinerTransactionsMined(miner.address, latestNonce); nil != err {
+		return err
+	}
+	models, err := manager.dbService.GetMinerTransactions(miner.address, latestNonce)
+	if nil != err {
+		return err
+	}
+
+	miner.mtx.Lock()
+	defer miner.mtx.Unlock()
+
+	miner.pending = make(map[uint64]*types.MinerTransaction)
+	for _, model := range models {
+		tx := &types.MinerTransaction{}
+		model.ConvertUp(tx)
+		miner.pending[tx.Nonce] = tx
+	}
+
+	miner.nonce = pendingCount.Uint64()
+	if miner.nonce < latestNonce {
+		miner.nonce = latestNonce
+	}
+	for nonce := range miner.pending {
+		if nonce+1 > miner.nonce {
+			miner.nonce = nonce + 1
+		}
+	}
+	// 本地记录的交易之间若有空缺，需要优先补上，否则之后的交易都无法被打包
+	miner.released = []uint64{}
+	for nonce := pendingCount.Uint64(); nonce < miner.nonce; nonce++ {
+		if _, ok := miner.pending[nonce]; !ok {
+			miner.released = append(miner.released, nonce)
+		}
+	}
+	log.Infof("Miner nonce manager,%s next nonce:%d, pending txs:%d", miner.address.Hex(), miner.nonce, len(miner.pending))
+	return nil
+}
+
+func (manager *NonceManager) recoverMiners() {
+	for _, miner := range manager.miners {
+		if err := manager.recover(miner); nil != err {
+			log.Errorf("Miner nonce manager,recover nonce of %s err:%s", miner.address.Hex(), err.Error())
+		}
+	}
+}
+
+// handleChainFork rebuilds nonces and pending txs from the rolled back db and new chain,
+// the txs mined in forked blocks are tracked again
+func (manager *NonceManager) handleChainFork(input eventemitter.EventData) error {
+	forkEvent := input.(*types.ForkedEvent)
+	manager.setBlockNumber(forkEvent.ForkBlock)
+	manager.recoverMiners()
+	return nil
+}
+
+// handleNewBlock only keeps the latest block if the manager is busy
+func (manager *NonceManager) handleNewBlock(input eventemitter.EventData) error {
+	block := input.(*types.BlockEvent)
+	for {
+		select {
+		case manager.blocks <- block:
+			return nil
+		default:
+			select {
+			case <-manager.blocks:
+			default:
+			}
+		}
+	}
+}
+
+func (manager *NonceManager) loop(blocks chan *types.BlockEvent, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case block := <-blocks:
+			if nil == block.BlockNumber {
+				continue
+			}
+			manager.setBlockNumber(block.BlockNumber)
+			for _, miner := range manager.miners {
+				manager.checkPending(miner, block.BlockNumber)
+			}
+		}
+	}
+}
+
+// checkPending removes the mined txs and replaces the txs pending longer than maxPendingTtl
+func (manager *NonceManager) checkPending(miner *minerNonce, blockNumber *big.Int) {
+	var latestCount types.Big
+	if err := manager.getTransactionCount(&latestCount, miner.address, "latest"); nil != err {
+		log.Errorf("Miner nonce manager,get tx count of %s err:%s", miner.address.Hex(), err.Error())
+		return
+	}
+	latestNonce := latestCount.Uint64()
+
+	miner.mtx.Lock()
+	defer miner.mtx.Unlock()
+
+	for nonce := range miner.pending {
+		if nonce < latestNonce {
+			delete(miner.pending, nonce)
+		}
+	}
+	if err := manager.dbService.UpdateMinerTransactionsMined(miner.address, latestNonce); nil != err {
+		log.Errorf("Miner nonce manager,update mined txs of %s err:%s", miner.address.Hex(), err.Error())
+	}
+
+	if miner.maxPendingTtl <= 0 {
+		return
+	}
+	nonces := []uint64{}
+	for nonce, tx := range miner.pending {
+		if new(big.Int).Sub(blockNumber, tx.SubmitBlock).Int64() >= int64(miner.maxPendingTtl) {
+			nonces = append(nonces, nonce)
+		}
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	for _, nonce := range nonces {
+		manager.replace(miner, miner.pending[nonce], blockNumber)
+	}
+}
+
+// replace sends the tx again with the same nonce and bumped gasPrice, if gasPrice has reached
+// the limit, the same tx is broadcasted again in case that it has been dropped by nodes
+func (manager *NonceManager) replace(miner *minerNonce, tx *types.MinerTransaction, blockNumber *big.Int) {
+	gasPrice := ReplacementGasPrice(tx.GasPrice, miner.gasPriceLimit)
+	tx.SubmitBlock = new(big.Int).Set(blockNumber)
+
+	txHash, err := manager.sendTransaction(accounts.Account{Address: miner.address}, tx.To, new(big.Int).Set(tx.Gas), gasPrice, tx.Value, tx.Data, tx.Nonce)
+	if nil != err {
+		if strings.Contains(err.Error(), "known transaction") || strings.Contains(err.Error(), "already known") {
+			log.Debugf("Miner nonce manager,tx:%s with nonce:%d is still in pool", tx.TxHash.Hex(), tx.Nonce)
+		} else {
+			log.Errorf("Miner nonce manager,replace tx:%s with nonce:%d err:%s", tx.TxHash.Hex(), tx.Nonce, err.Error())
+		}
+	} else {
+		log.Infof("Miner nonce manager,tx:%s with nonce:%d is replaced by tx:%s, gasPrice:%s", tx.TxHash.Hex(), tx.Nonce, txHash, gasPrice.String())
+		tx.TxHash = common.HexToHash(txHash)
+		tx.GasPrice = gasPrice
+		manager.updateRingSubmitInfo(tx)
+	}
+	if err := manager.dbService.SaveMinerTransaction(tx); nil != err {
+		log.Errorf("Miner nonce manager,save tx:%s err:%s", tx.TxHash.Hex(), err.Error())
+	}
+}
+
+func (manager *NonceManager) updateRingSubmitInfo(tx *types.MinerTransaction) {
+	var err error
+	if tx.TxType == types.MINER_TX_REGISTRY {
+		err = manager.dbService.UpdateRingSubmitInfoRegistryTxHash(tx.RingHashes, tx.TxHash.Hex())
+	} else {
+		for _, ringhash := range tx.RingHashes {
+			if err1 := manager.dbService.UpdateRingSubmitInfoProtocolTxHash(ringhash, tx.TxHash.Hex()); nil != err1 {
+				err = err1
+			}
+		}
+	}
+	if nil != err {
+		log.Errorf("Miner nonce manager,update tx hash of rings err:%s", err.Error())
+	}
+	if err := manager.dbService.UpdateRingSubmitInfoStatus(tx.RingHashes, types.RING_SUBMIT_REPLACED, tx.TxHash.Hex(), ""); nil != err {
+		log.Errorf("Miner nonce manager,update status of rings err:%s", err.Error())
+	}
+}
+
+func (manager *NonceManager) setBlockNumber(blockNumber *big.Int) {
+	manager.blockMtx.Lock()
+	defer manager.blockMtx.Unlock()
+	manager.blockNumber = new(big.Int).Set(blockNumber)
+}
+
+func (manager *NonceManager) currentBlockNumber() *big.Int {
+	manager.blockMtx.RLock()
+	defer manager.blockMtx.RUnlock()
+	if nil == manager.blockNumber {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(manager.blockNumber)
+}
+
+func (miner *minerNonce) nextNonce() uint64 {
+	if len(miner.released) > 0 {
+		nonce := miner.released[0]
+		miner.released = miner.released[1:]
+		return nonce
+	}
+	nonce := miner.nonce
+	miner.nonce++
+	return nonce
+}
+
+// releaseNonce gives back the nonce of a tx failed to send
+func (miner *minerNonce) releaseNonce(nonce uint64) {
+	if nonce+1 == miner.nonce {
+		miner.nonce--
+		return
+	}
+	miner.released = append(miner.released, nonce)
+	sort.Slice(miner.released, func(i, j int) bool { return miner.released[i] < miner.released[j] })
+}
+
+// ReplacementGasPrice returns gasPrice bumped by 10% and capped by gasPriceLimit
+func ReplacementGasPrice(gasPrice, gasPriceLimit *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(gasPrice, big.NewInt(100+replaceGasPriceBumpPercent))
+	bumped.Div(bumped, big.NewInt(100))
+	if bumped.Cmp(gasPrice) <= 0 {
+		bumped.Add(gasPrice, big.NewInt(1))
+	}
+	if nil != gasPriceLimit && gasPriceLimit.Sign() > 0 && bumped.Cmp(gasPriceLimit) > 0 {
+		bumped.Set(gasPriceLimit)
+	}
+	if bumped.Cmp(gasPrice) < 0 {
+		bumped.Set(gasPrice)
+	}
+	return bumped
+}
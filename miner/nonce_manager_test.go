@@ -0,0 +1,251 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+func TestReplacementGasPrice(t *testing.T) {
+	cases := []struct {
+		gasPrice int64
+		limit    int64
+		expected int64
+	}{
+		{1000000000, 0, 1100000000},
+		{1000000000, 1050000000, 1050000000},
+		{1000000000, 1000000000, 1000000000},
+		{2000000000, 1000000000, 2000000000},
+		{5, 100, 6},
+	}
+	for _, c := range cases {
+		price := ReplacementGasPrice(big.NewInt(c.gasPrice), big.NewInt(c.limit))
+		if price.Int64() != c.expected {
+			t.Fatalf("gasPrice:%d limit:%d, expected:%d, got:%s", c.gasPrice, c.limit, c.expected, price.String())
+		}
+	}
+}
+
+var nonceTestMiner = common.HexToAddress("0x0a")
+
+// nonceRds keeps miner txs in memory, other methods of RdsService aren't used by nonce manager
+type nonceRds struct {
+	dao.RdsService
+	txs map[uint64]*types.MinerTransaction
+}
+
+func (r *nonceRds) SaveMinerTransaction(tx *types.MinerTransaction) error {
+	saved := *tx
+	r.txs[tx.Nonce] = &saved
+	return nil
+}
+
+func (r *nonceRds) GetMinerTransactions(miner common.Address, fromNonce uint64) ([]dao.MinerTransaction, error) {
+	list := []dao.MinerTransaction{}
+	for nonce, tx := range r.txs {
+		if nonce >= fromNonce && tx.Miner == miner {
+			model := dao.MinerTransaction{}
+			model.ConvertDown(tx)
+			list = append(list, model)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nonce < list[j].Nonce })
+	return list, nil
+}
+
+func (r *nonceRds) UpdateMinerTransactionsMined(miner common.Address, latestNonce uint64) error {
+	for nonce, tx := range r.txs {
+		if nonce < latestNonce && tx.Status == types.MINER_TX_PENDING {
+			tx.Status = types.MINER_TX_MINED
+		}
+	}
+	return nil
+}
+
+func (r *nonceRds) UpdateMinerTransactionsPending(miner common.Address, latestNonce uint64) error {
+	for nonce, tx := range r.txs {
+		if nonce >= latestNonce && tx.Status == types.MINER_TX_MINED {
+			tx.Status = types.MINER_TX_PENDING
+		}
+	}
+	return nil
+}
+
+// nonceChain returns the tx counts of latest and pending block, and fails the txs with nonce in failed
+type nonceChain struct {
+	latest  uint64
+	pending uint64
+	failed  map[uint64]bool
+	sent    []uint64
+}
+
+func (c *nonceChain) getTransactionCount(result interface{}, address common.Address, blockNumber string) error {
+	count := c.latest
+	if blockNumber == "pending" {
+		count = c.pending
+	}
+	*(result.(*types.Big)) = types.Big(*new(big.Int).SetUint64(count))
+	return nil
+}
+
+func (c *nonceChain) sendTransaction(sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte, nonce uint64) (string, error) {
+	if c.failed[nonce] {
+		return "", errors.New("insufficient funds for gas * price + value")
+	}
+	c.sent = append(c.sent, nonce)
+	return common.BigToHash(new(big.Int).SetUint64(nonce + 1000)).Hex(), nil
+}
+
+func newTestNonceManager(rds *nonceRds, chain *nonceChain) *NonceManager {
+	manager := NewNonceManager(rds, []*NormalMinerAddress{{Address: nonceTestMiner, GasPriceLimit: big.NewInt(100)}})
+	manager.getTransactionCount = chain.getTransactionCount
+	manager.sendTransaction = chain.sendTransaction
+	return manager
+}
+
+func (manager *NonceManager) send() (uint64, error) {
+	txHash, err := manager.SendTransaction(types.MINER_TX_SUBMIT_RING, nil, accounts.Account{Address: nonceTestMiner}, common.HexToAddress("0x01"), big.NewInt(21000), big.NewInt(1), nil, nil)
+	if nil != err {
+		return 0, err
+	}
+	return common.HexToHash(txHash).Big().Uint64() - 1000, nil
+}
+
+func TestNonceManagerSendTransaction(t *testing.T) {
+	rds := &nonceRds{txs: make(map[uint64]*types.MinerTransaction)}
+	chain := &nonceChain{latest: 5, pending: 5, failed: map[uint64]bool{6: true}}
+	manager := newTestNonceManager(rds, chain)
+	if err := manager.recover(manager.miners[nonceTestMiner]); nil != err {
+		t.Fatal(err)
+	}
+
+	// the nonce of failed tx is given back and assigned to the next tx
+	results := []string{}
+	for i := 0; i < 3; i++ {
+		nonce, err := manager.send()
+		results = append(results, fmt.Sprintf("%d:%v", nonce, nil == err))
+	}
+	delete(chain.failed, 6)
+	for i := 0; i < 2; i++ {
+		nonce, err := manager.send()
+		results = append(results, fmt.Sprintf("%d:%v", nonce, nil == err))
+	}
+	expected := []string{"5:true", "0:false", "0:false", "6:true", "7:true"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("nonces should be %v, but got %v", expected, results)
+	}
+	if !reflect.DeepEqual(chain.sent, []uint64{5, 6, 7}) {
+		t.Fatalf("sent nonces should be continuous, but got %v", chain.sent)
+	}
+	if manager.PendingCount(nonceTestMiner) != 3 || len(rds.txs) != 3 {
+		t.Fatalf("3 txs should be tracked, but got %d, saved %d", manager.PendingCount(nonceTestMiner), len(rds.txs))
+	}
+}
+
+func TestMinerNonceReleaseNonce(t *testing.T) {
+	cases := []struct {
+		name     string
+		assigned int
+		released []uint64
+		next     []uint64
+	}{
+		{"release last nonce", 3, []uint64{12}, []uint64{12, 13, 14}},
+		{"release middle nonce", 3, []uint64{11}, []uint64{11, 13, 14}},
+		{"released gaps are assigned in order", 4, []uint64{12, 10}, []uint64{10, 12, 14, 15}},
+		{"release last nonces in reverse order", 3, []uint64{12, 11}, []uint64{11, 12, 13}},
+		{"release last nonces in order", 3, []uint64{11, 12}, []uint64{11, 12, 13}},
+		{"release all", 3, []uint64{10, 11, 12}, []uint64{10, 11, 12}},
+	}
+
+	for _, c := range cases {
+		miner := &minerNonce{nonce: 10}
+		for i := 0; i < c.assigned; i++ {
+			miner.nextNonce()
+		}
+		for _, nonce := range c.released {
+			miner.releaseNonce(nonce)
+		}
+		next := []uint64{}
+		for range c.next {
+			next = append(next, miner.nextNonce())
+		}
+		if !reflect.DeepEqual(next, c.next) {
+			t.Errorf("%s: next nonces should be %v, but got %v", c.name, c.next, next)
+		}
+	}
+}
+
+func TestNonceManagerRecover(t *testing.T) {
+	cases := []struct {
+		name     string
+		latest   uint64
+		pending  uint64
+		txs      map[uint64]types.MinerTxStatus
+		nonce    uint64
+		tracked  []uint64
+		released []uint64
+	}{
+		{"no txs", 5, 5, nil, 5, []uint64{}, []uint64{}},
+		{"txs in pool", 5, 7, nil, 7, []uint64{}, []uint64{}},
+		{"pending txs tracked", 5, 7, map[uint64]types.MinerTxStatus{5: types.MINER_TX_PENDING, 6: types.MINER_TX_PENDING}, 7, []uint64{5, 6}, []uint64{}},
+		{"mined txs not tracked", 5, 6, map[uint64]types.MinerTxStatus{3: types.MINER_TX_PENDING, 4: types.MINER_TX_MINED, 5: types.MINER_TX_PENDING}, 6, []uint64{5}, []uint64{}},
+		{"txs rolled back by fork", 3, 3, map[uint64]types.MinerTxStatus{3: types.MINER_TX_MINED, 4: types.MINER_TX_MINED}, 5, []uint64{3, 4}, []uint64{}},
+		{"txs dropped by nodes", 5, 5, map[uint64]types.MinerTxStatus{5: types.MINER_TX_PENDING, 7: types.MINER_TX_PENDING}, 8, []uint64{5, 7}, []uint64{6}},
+		{"gaps after txs in pool", 5, 6, map[uint64]types.MinerTxStatus{8: types.MINER_TX_PENDING}, 9, []uint64{8}, []uint64{6, 7}},
+	}
+
+	for _, c := range cases {
+		rds := &nonceRds{txs: make(map[uint64]*types.MinerTransaction)}
+		for nonce, status := range c.txs {
+			rds.SaveMinerTransaction(&types.MinerTransaction{Miner: nonceTestMiner, Nonce: nonce, Status: status, SubmitBlock: big.NewInt(1)})
+		}
+		manager := newTestNonceManager(rds, &nonceChain{latest: c.latest, pending: c.pending})
+		miner := manager.miners[nonceTestMiner]
+		if err := manager.recover(miner); nil != err {
+			t.Fatal(err)
+		}
+
+		tracked := []uint64{}
+		for nonce := range miner.pending {
+			tracked = append(tracked, nonce)
+		}
+		sort.Slice(tracked, func(i, j int) bool { return tracked[i] < tracked[j] })
+		if miner.nonce != c.nonce || !reflect.DeepEqual(tracked, c.tracked) || !reflect.DeepEqual(miner.released, c.released) {
+			t.Errorf("%s: nonce:%d, tracked:%v, released:%v expected, but got nonce:%d, tracked:%v, released:%v",
+				c.name, c.nonce, c.tracked, c.released, miner.nonce, tracked, miner.released)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/Loopring/relay/types"
+)
+
+// DefaultRatePrecision is the mantissa bits of big.Float used to compute the reduced rate
+const DefaultRatePrecision uint = 256
+
+const nthRootMaxIterations = 200
+
+// ReducedRate returns r = (∏amountB/∏amountS)^(1/n) rounded down at precision bits, so that
+// ∏(amountS*r)/∏amountB <= 1 always holds and no order is sold at a price higher than the ring can pay
+func ReducedRate(ringState *types.Ring, precision uint) (*big.Rat, error) {
+	if len(ringState.Orders) < 2 {
+		return nil, errors.New("Miner,ring must have at least 2 orders")
+	}
+	if precision == 0 {
+		precision = DefaultRatePrecision
+	}
+
+	productAmountS := big.NewInt(1)
+	productAmountB := big.NewInt(1)
+	for _, order := range ringState.Orders {
+		amountS := order.OrderState.RawOrder.AmountS
+		amountB := order.OrderState.RawOrder.AmountB
+		if nil == amountS || nil == amountB || amountS.Sign() <= 0 || amountB.Sign() <= 0 {
+			return nil, fmt.Errorf("Miner,order:%s amountS and amountB must be positive", order.OrderState.RawOrder.Hash.Hex())
+		}
+		productAmountS.Mul(productAmountS, amountS)
+		productAmountB.Mul(productAmountB, amountB)
+	}
+	if productAmountS.Cmp(productAmountB) < 0 {
+		return nil, errors.New("Miner,product of amountS is less than product of amountB")
+	}
+
+	n := len(ringState.Orders)
+	productPrice := new(big.Rat).SetFrac(productAmountB, productAmountS)
+	x := new(big.Float).SetPrec(precision + 64).SetRat(productPrice)
+	rate := nthRoot(x, n, precision+64)
+
+	// 截断到precision位之后，逐个ulp向下调整，直到 productPrice^-1 * rate^n <= 1
+	rate.SetMode(big.ToZero).SetPrec(precision)
+	one := big.NewRat(1, 1)
+	for i := 0; ; i++ {
+		rateRat, _ := rate.Rat(nil)
+		if rateRat.Cmp(one) > 0 {
+			rateRat = one
+		}
+		power := big.NewRat(1, 1)
+		for j := 0; j < n; j++ {
+			power.Mul(power, rateRat)
+		}
+		if power.Cmp(productPrice) <= 0 {
+			return rateRat, nil
+		}
+		if i >= nthRootMaxIterations {
+			return nil, errors.New("Miner,can't compute reduced rate")
+		}
+		ulp := new(big.Float).SetPrec(precision).SetMantExp(big.NewFloat(1), rate.MantExp(nil)-int(precision))
+		rate.Sub(rate, ulp)
+	}
+}
+
+// nthRoot computes x^(1/n) with newton's method, x > 0
+func nthRoot(x *big.Float, n int, prec uint) *big.Float {
+	xf, _ := x.Float64()
+	guess := math.Pow(xf, 1/float64(n))
+	y := new(big.Float).SetPrec(prec)
+	if guess > 0 && !math.IsInf(guess, 0) && !math.IsNaN(guess) {
+		y.SetFloat64(guess)
+	} else {
+		y.SetInt64(1)
+	}
+
+	nf := new(big.Float).SetPrec(prec).SetInt64(int64(n))
+	n1 := new(big.Float).SetPrec(prec).SetInt64(int64(n - 1))
+	threshold := new(big.Float).SetPrec(prec).SetMantExp(big.NewFloat(1), -int(prec))
+	for i := 0; i < nthRootMaxIterations; i++ {
+		// y = ((n-1)*y + x/y^(n-1)) / n
+		power := new(big.Float).SetPrec(prec).SetInt64(1)
+		for j := 0; j < n-1; j++ {
+			power.Mul(power, y)
+		}
+		next := new(big.Float).SetPrec(prec).Quo(x, power)
+		next.Add(next, new(big.Float).SetPrec(prec).Mul(n1, y))
+		next.Quo(next, nf)
+
+		diff := new(big.Float).SetPrec(prec).Sub(next, y)
+		y = next
+		if diff.Sign() == 0 || new(big.Float).Quo(diff.Abs(diff), y).Cmp(threshold) <= 0 {
+			break
+		}
+	}
+	return y
+}
+
+// ComputeFillAmounts computes rateAmountS and the fill amounts with integers in the same way as
+// the protocol contract, orders[i].TokenB must be orders[i+1].TokenS.
+// rateAmountS = floor(amountS*rate), fillAmountB = floor(fillAmountS*amountB/rateAmountS), the amount
+// is passed to the next order and reduced to the min volume of the ring, and orders[i] receives
+// fillAmountS of orders[i+1], which is set as FillAmountB after computed
+func ComputeFillAmounts(ringState *types.Ring) error {
+	n := len(ringState.Orders)
+	if n < 2 || nil == ringState.ReducedRate {
+		return errors.New("Miner,ring must have at least 2 orders and reduced rate")
+	}
+
+	rateAmountS := make([]*big.Int, n)
+	fillAmountS := make([]*big.Int, n)
+	availableAmountB := make([]*big.Int, n)
+	for i, order := range ringState.Orders {
+		rawOrder := order.OrderState.RawOrder
+		amountS := new(big.Rat).SetInt(rawOrder.AmountS)
+		amountB := new(big.Rat).SetInt(rawOrder.AmountB)
+
+		order.SPrice = new(big.Rat).Quo(amountS, amountB)
+		order.SPrice.Mul(order.SPrice, ringState.ReducedRate)
+		order.BPrice = new(big.Rat).Inv(order.SPrice)
+
+		rateAmountS[i] = ratFloor(new(big.Rat).Mul(amountS, ringState.ReducedRate))
+		if rateAmountS[i].Cmp(rawOrder.AmountS) > 0 {
+			rateAmountS[i].Set(rawOrder.AmountS)
+		}
+		if rateAmountS[i].Sign() <= 0 {
+			return fmt.Errorf("Miner,order:%s rateAmountS is zero", rawOrder.Hash.Hex())
+		}
+		order.RateAmountS = new(big.Rat).SetInt(rateAmountS[i])
+
+		if nil == order.AvailableAmountS || nil == order.AvailableAmountB {
+			return fmt.Errorf("Miner,order:%s available amount is required", rawOrder.Hash.Hex())
+		}
+		fillAmountS[i] = ratFloor(order.AvailableAmountS)
+		availableAmountB[i] = ratFloor(order.AvailableAmountB)
+	}
+
+	calculate := func(i, j, smallestIdx int) int {
+		rawOrder := ringState.Orders[i].OrderState.RawOrder
+		newSmallestIdx := smallestIdx
+
+		amountB := new(big.Int).Mul(fillAmountS[i], rawOrder.AmountB)
+		amountB.Div(amountB, rateAmountS[i])
+		if rawOrder.BuyNoMoreThanAmountB && amountB.Cmp(availableAmountB[i]) > 0 {
+			amountB.Set(availableAmountB[i])
+			fillAmountS[i] = new(big.Int).Mul(amountB, rateAmountS[i])
+			fillAmountS[i].Div(fillAmountS[i], rawOrder.AmountB)
+			newSmallestIdx = i
+		}
+
+		if amountB.Cmp(fillAmountS[j]) <= 0 {
+			fillAmountS[j] = new(big.Int).Set(amountB)
+		} else {
+			newSmallestIdx = j
+		}
+		return newSmallestIdx
+	}
+
+	smallestIdx := 0
+	for i := 0; i < n; i++ {
+		smallestIdx = calculate(i, (i+1)%n, smallestIdx)
+	}
+	for i := 0; i < smallestIdx; i++ {
+		calculate(i, i+1, 0)
+	}
+
+	for i, order := range ringState.Orders {
+		rawOrder := order.OrderState.RawOrder
+		received := fillAmountS[(i+1)%n]
+		if fillAmountS[i].Sign() <= 0 || received.Sign() <= 0 {
+			return fmt.Errorf("Miner,order:%s can't be filled", rawOrder.Hash.Hex())
+		}
+		// 成交价格不能低于订单价格: received/fillAmountS >= amountB/amountS
+		if new(big.Int).Mul(received, rawOrder.AmountS).Cmp(new(big.Int).Mul(fillAmountS[i], rawOrder.AmountB)) < 0 {
+			return fmt.Errorf("Miner,order:%s will be filled beyond its price", rawOrder.Hash.Hex())
+		}
+		order.FillAmountS = new(big.Rat).SetInt(fillAmountS[i])
+		order.FillAmountB = new(big.Rat).SetInt(received)
+	}
+
+	return nil
+}
+
+// ratFloor rounds the non-negative rat down to integer, same as the integer division of contract
+func ratFloor(r *big.Rat) *big.Int {
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
@@ -0,0 +1,168 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// randomAmount returns an amount of 18-decimal token between 0.001 and 1000000
+func randomAmount(r *rand.Rand) *big.Int {
+	amount := new(big.Int).Rand(r, new(big.Int).Exp(big.NewInt(10), big.NewInt(24), nil))
+	return amount.Add(amount, new(big.Int).Exp(big.NewInt(10), big.NewInt(15), nil))
+}
+
+// randomRing generates a ring whose product of amountS is not less than product of amountB,
+// the ring without margin may be rejected because of the rounding of integers
+func randomRing(r *rand.Rand) (*types.Ring, bool) {
+	n := 2 + r.Intn(3)
+	tokens := make([]common.Address, n)
+	for i := range tokens {
+		tokens[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+	}
+
+	orders := []*types.FilledOrder{}
+	productS := big.NewInt(1)
+	productB := big.NewInt(1)
+	hasMargin := r.Intn(4) > 0
+	for i := 0; i < n; i++ {
+		state := types.OrderState{}
+		state.RawOrder.Hash = common.BigToHash(big.NewInt(int64(i + 1)))
+		state.RawOrder.TokenS = tokens[i]
+		state.RawOrder.TokenB = tokens[(i+1)%n]
+		state.RawOrder.AmountS = randomAmount(r)
+		state.RawOrder.AmountB = randomAmount(r)
+		state.RawOrder.BuyNoMoreThanAmountB = r.Intn(2) == 0
+		if i == n-1 {
+			// amountB = amountS * ∏S / ∏B / (1 + margin)
+			amountB := new(big.Int).Mul(state.RawOrder.AmountS, productS)
+			amountB.Div(amountB, productB)
+			if hasMargin {
+				amountB.Mul(amountB, big.NewInt(1000)).Div(amountB, big.NewInt(1001+int64(r.Intn(100))))
+			}
+			if amountB.Sign() <= 0 {
+				amountB.SetInt64(1)
+			}
+			state.RawOrder.AmountB = amountB
+		}
+		productS.Mul(productS, state.RawOrder.AmountS)
+		productB.Mul(productB, state.RawOrder.AmountB)
+
+		filledOrder := &types.FilledOrder{}
+		filledOrder.OrderState = state
+		availableS := new(big.Rat).SetInt(state.RawOrder.AmountS)
+		availableS.Mul(availableS, big.NewRat(int64(1+r.Intn(100)), 100))
+		filledOrder.AvailableAmountS = availableS
+		filledOrder.AvailableAmountB = new(big.Rat).Mul(availableS, new(big.Rat).SetFrac(state.RawOrder.AmountB, state.RawOrder.AmountS))
+		orders = append(orders, filledOrder)
+	}
+	return &types.Ring{Orders: orders}, hasMargin
+}
+
+func TestReducedRate(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	precision := miner.DefaultRatePrecision
+	// rate is at most 2^-(precision-8) less than the exact root
+	tolerance := new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), precision-8))
+	one := big.NewRat(1, 1)
+
+	for i := 0; i < 500; i++ {
+		ring, _ := randomRing(r)
+		rate, err := miner.ReducedRate(ring, precision)
+		if err != nil {
+			t.Fatalf("ring %d, compute reduced rate error:%s", i, err.Error())
+		}
+
+		// rate^n * ∏S/∏B <= 1
+		product := big.NewRat(1, 1)
+		for _, order := range ring.Orders {
+			product.Mul(product, rate)
+			product.Mul(product, new(big.Rat).SetFrac(order.OrderState.RawOrder.AmountS, order.OrderState.RawOrder.AmountB))
+		}
+		if product.Cmp(one) > 0 {
+			t.Fatalf("ring %d, rate^n * price product %s is greater than 1", i, product.FloatString(30))
+		}
+		if new(big.Rat).Sub(one, product).Cmp(tolerance) > 0 {
+			t.Fatalf("ring %d, rate^n * price product %s isn't precise", i, product.FloatString(80))
+		}
+	}
+}
+
+func TestComputeFillAmounts(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	accepted := 0
+	total := 0
+
+	for i := 0; i < 2000; i++ {
+		ring, hasMargin := randomRing(r)
+		if hasMargin {
+			total++
+		}
+		rate, err := miner.ReducedRate(ring, miner.DefaultRatePrecision)
+		if err != nil {
+			t.Fatalf("ring %d, compute reduced rate error:%s", i, err.Error())
+		}
+		ring.ReducedRate = rate
+		if err := miner.ComputeFillAmounts(ring); err != nil {
+			continue
+		}
+		if hasMargin {
+			accepted++
+		}
+
+		n := len(ring.Orders)
+		for idx, order := range ring.Orders {
+			rawOrder := order.OrderState.RawOrder
+			if !order.FillAmountS.IsInt() || !order.FillAmountB.IsInt() || !order.RateAmountS.IsInt() {
+				t.Fatalf("ring %d order %d, amounts submitted to contract must be integers", i, idx)
+			}
+			if order.FillAmountS.Sign() <= 0 {
+				t.Fatalf("ring %d order %d, fillAmountS must be positive", i, idx)
+			}
+			if order.FillAmountS.Cmp(order.AvailableAmountS) > 0 {
+				t.Fatalf("ring %d order %d, fillAmountS %s is greater than availableAmountS %s", i, idx, order.FillAmountS.String(), order.AvailableAmountS.FloatString(0))
+			}
+			if rawOrder.BuyNoMoreThanAmountB && order.FillAmountB.Cmp(order.AvailableAmountB) > 0 {
+				t.Fatalf("ring %d order %d, fillAmountB %s is greater than availableAmountB %s", i, idx, order.FillAmountB.String(), order.AvailableAmountB.FloatString(0))
+			}
+			if order.RateAmountS.Cmp(new(big.Rat).SetInt(rawOrder.AmountS)) > 0 {
+				t.Fatalf("ring %d order %d, rateAmountS is greater than amountS", i, idx)
+			}
+			// fillAmountB/fillAmountS >= amountB/amountS
+			limit := new(big.Rat).Mul(order.FillAmountS, new(big.Rat).SetFrac(rawOrder.AmountB, rawOrder.AmountS))
+			if order.FillAmountB.Cmp(limit) < 0 {
+				t.Fatalf("ring %d order %d, filled beyond its limit price", i, idx)
+			}
+			// the order receives what the next order sells
+			if order.FillAmountB.Cmp(ring.Orders[(idx+1)%n].FillAmountS) != 0 {
+				t.Fatalf("ring %d order %d, fillAmountB isn't fillAmountS of next order", i, idx)
+			}
+		}
+	}
+
+	if accepted < total*99/100 {
+		t.Fatalf("only %d of %d rings with margin can be filled", accepted, total)
+	}
+}
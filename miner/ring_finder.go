@@ -0,0 +1,197 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type tokenEdge struct {
+	tokenS common.Address
+	tokenB common.Address
+}
+
+// RingFinder builds a token graph from orders, orders selling tokenS for tokenB are the
+// edges from tokenS to tokenB, and finds the cycles of orders that can be a ring
+type RingFinder struct {
+	MinLength        int // min count of orders in a ring
+	MaxLength        int // max count of orders in a ring, same as MinerOptions.RingMaxLength
+	MaxOrdersPerEdge int // only the orders with the best price of each token pair are used
+	MaxCandidates    int // stop finding after MaxCandidates rings found
+}
+
+// Find returns the rings sorted as orders[i].TokenB == orders[i+1].TokenS, such as LRC->WETH->EOS->LRC.
+// all orders should have the same protocol, and each ring satisfies RingPriceValid
+func (f *RingFinder) Find(orders []*types.OrderState) [][]*types.OrderState {
+	candidates := [][]*types.OrderState{}
+	if f.MaxLength < f.MinLength || f.MaxLength < 2 {
+		return candidates
+	}
+
+	edges := f.buildEdges(orders)
+	graph := make(map[common.Address][]common.Address)
+	tokenSet := make(map[common.Address]bool)
+	for edge := range edges {
+		graph[edge.tokenS] = append(graph[edge.tokenS], edge.tokenB)
+		tokenSet[edge.tokenS] = true
+		tokenSet[edge.tokenB] = true
+	}
+
+	tokens := []common.Address{}
+	for token := range tokenSet {
+		tokens = append(tokens, token)
+	}
+	sortAddresses(tokens)
+	tokenIdx := make(map[common.Address]int)
+	for idx, token := range tokens {
+		tokenIdx[token] = idx
+		sortAddresses(graph[token])
+	}
+
+	// 只从环中地址最小的token开始搜索，同一个环只会被找到一次
+	for startIdx, start := range tokens {
+		path := []common.Address{start}
+		visited := map[common.Address]bool{start: true}
+		var walk func(token common.Address) bool
+		walk = func(token common.Address) bool {
+			for _, next := range graph[token] {
+				if next == start {
+					if len(path) >= f.MinLength {
+						if !f.expand(path, edges, &candidates) {
+							return false
+						}
+					}
+					continue
+				}
+				if visited[next] || tokenIdx[next] < startIdx || len(path) >= f.MaxLength {
+					continue
+				}
+				visited[next] = true
+				path = append(path, next)
+				goOn := walk(next)
+				path = path[:len(path)-1]
+				visited[next] = false
+				if !goOn {
+					return false
+				}
+			}
+			return true
+		}
+		if !walk(start) {
+			break
+		}
+	}
+
+	return candidates
+}
+
+// buildEdges groups orders by token pair, sorted by price amountS/amountB desc
+func (f *RingFinder) buildEdges(orders []*types.OrderState) map[tokenEdge][]*types.OrderState {
+	edges := make(map[tokenEdge][]*types.OrderState)
+	for _, order := range orders {
+		raw := order.RawOrder
+		if raw.TokenS == raw.TokenB || nil == raw.AmountS || nil == raw.AmountB || raw.AmountS.Sign() <= 0 || raw.AmountB.Sign() <= 0 {
+			continue
+		}
+		edge := tokenEdge{tokenS: raw.TokenS, tokenB: raw.TokenB}
+		edges[edge] = append(edges[edge], order)
+	}
+
+	for edge, list := range edges {
+		sort.Slice(list, func(i, j int) bool {
+			if c := orderPrice(list[i]).Cmp(orderPrice(list[j])); c != 0 {
+				return c > 0
+			}
+			return bytes.Compare(list[i].RawOrder.Hash.Bytes(), list[j].RawOrder.Hash.Bytes()) < 0
+		})
+		if f.MaxOrdersPerEdge > 0 && len(list) > f.MaxOrdersPerEdge {
+			list = list[:f.MaxOrdersPerEdge]
+		}
+		edges[edge] = list
+	}
+	return edges
+}
+
+// expand chooses an order for each edge of the token cycle, orders of each edge are sorted by price desc,
+// so the rest orders of an edge can be skipped once the best possible product of price is less than 1.
+// it returns false if MaxCandidates is reached
+func (f *RingFinder) expand(path []common.Address, edges map[tokenEdge][]*types.OrderState, candidates *[][]*types.OrderState) bool {
+	pathEdges := make([][]*types.OrderState, len(path))
+	for i := range path {
+		pathEdges[i] = edges[tokenEdge{tokenS: path[i], tokenB: path[(i+1)%len(path)]}]
+	}
+
+	// bestRest[i] is the product of the best price of edges from i to the end
+	bestRest := make([]*big.Rat, len(path)+1)
+	bestRest[len(path)] = big.NewRat(1, 1)
+	for i := len(path) - 1; i >= 0; i-- {
+		bestRest[i] = new(big.Rat).Mul(bestRest[i+1], orderPrice(pathEdges[i][0]))
+	}
+
+	one := big.NewRat(1, 1)
+	chosen := make([]*types.OrderState, len(path))
+	var choose func(i int, product *big.Rat) bool
+	choose = func(i int, product *big.Rat) bool {
+		if i == len(path) {
+			ring := make([]*types.OrderState, len(chosen))
+			copy(ring, chosen)
+			*candidates = append(*candidates, ring)
+			return f.MaxCandidates <= 0 || len(*candidates) < f.MaxCandidates
+		}
+		for _, order := range pathEdges[i] {
+			next := new(big.Rat).Mul(product, orderPrice(order))
+			if new(big.Rat).Mul(next, bestRest[i+1]).Cmp(one) < 0 {
+				break
+			}
+			chosen[i] = order
+			if !choose(i+1, next) {
+				return false
+			}
+		}
+		return true
+	}
+	return choose(0, big.NewRat(1, 1))
+}
+
+// RingPriceValid returns true if the product of amountS is not less than the product of amountB,
+// which means every order can get the price it wants
+func RingPriceValid(orders ...*types.OrderState) bool {
+	amountS := big.NewInt(1)
+	amountB := big.NewInt(1)
+	for _, order := range orders {
+		amountS.Mul(amountS, order.RawOrder.AmountS)
+		amountB.Mul(amountB, order.RawOrder.AmountB)
+	}
+	return amountS.Cmp(amountB) >= 0
+}
+
+func orderPrice(order *types.OrderState) *big.Rat {
+	return new(big.Rat).SetFrac(order.RawOrder.AmountS, order.RawOrder.AmountB)
+}
+
+func sortAddresses(addresses []common.Address) {
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i].Bytes(), addresses[j].Bytes()) < 0
+	})
+}
@@ -0,0 +1,93 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	lrc  = common.HexToAddress("0x01")
+	weth = common.HexToAddress("0x02")
+	eos  = common.HexToAddress("0x03")
+	rdn  = common.HexToAddress("0x04")
+)
+
+func newFinderOrder(hash int64, tokenS, tokenB common.Address, amountS, amountB int64) *types.OrderState {
+	state := &types.OrderState{}
+	state.RawOrder.Hash = common.BigToHash(big.NewInt(hash))
+	state.RawOrder.TokenS = tokenS
+	state.RawOrder.TokenB = tokenB
+	state.RawOrder.AmountS = big.NewInt(amountS)
+	state.RawOrder.AmountB = big.NewInt(amountB)
+	return state
+}
+
+func TestRingFinder_Find(t *testing.T) {
+	orders := []*types.OrderState{
+		newFinderOrder(1, lrc, weth, 100, 1),
+		newFinderOrder(2, weth, eos, 1, 10),
+		newFinderOrder(3, eos, lrc, 10, 90),
+		// price of the ring is less than 1
+		newFinderOrder(4, eos, lrc, 10, 110),
+		// 2 orders in one market are matched by market
+		newFinderOrder(5, weth, lrc, 1, 100),
+		// 4 orders
+		newFinderOrder(6, eos, rdn, 10, 5),
+		newFinderOrder(7, rdn, lrc, 5, 100),
+	}
+
+	finder := &miner.RingFinder{MinLength: 3, MaxLength: 4, MaxOrdersPerEdge: 5}
+	rings := finder.Find(orders)
+	if len(rings) != 2 {
+		t.Fatalf("expect 2 rings, but got %d", len(rings))
+	}
+	for _, ring := range rings {
+		for i, order := range ring {
+			next := ring[(i+1)%len(ring)]
+			if order.RawOrder.TokenB != next.RawOrder.TokenS {
+				t.Fatalf("order %d tokenB isn't tokenS of next order", i)
+			}
+		}
+		if !miner.RingPriceValid(ring...) {
+			t.Fatalf("price of ring is invalid")
+		}
+		for _, order := range ring {
+			if order.RawOrder.Hash == common.BigToHash(big.NewInt(4)) {
+				t.Fatalf("order 4 can't be in a ring")
+			}
+		}
+	}
+
+	finder.MaxLength = 3
+	if rings := finder.Find(orders); len(rings) != 1 || len(rings[0]) != 3 {
+		t.Fatalf("expect 1 ring of 3 orders when MaxLength is 3")
+	}
+
+	finder.MaxCandidates = 1
+	finder.MaxLength = 4
+	if rings := finder.Find(orders); len(rings) != 1 {
+		t.Fatalf("expect 1 ring when MaxCandidates is 1, but got %d", len(rings))
+	}
+}
@@ -0,0 +1,204 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// the deadline is checked once every selectCheckInterval nodes of the search
+const selectCheckInterval = 256
+
+// RingCandidate is a ring evaluated in a round, Fills are the amountS filled of each order in the ring,
+// Cost is the legal cost of gas which isn't reduced when the ring is partially filled
+type RingCandidate struct {
+	Received *big.Rat
+	Cost     *big.Rat
+	Fills    map[common.Hash]*big.Rat
+}
+
+// RingSelector chooses the set of candidate rings with max total received in a round. orders shared by
+// rings are capacity constraints, the sum of amountS filled by the chosen rings can't exceed the available
+// amountS of the order. a ring whose orders haven't enough amountS left is partially filled in the same way
+// as the matcher reduces the rings after their orders are filled, all fills are reduced by the same rate and
+// the received is (received+cost)*rate-cost. the chosen rings are filled in order, so the order matters.
+// it searches with branch and bound, and falls back to greedy after TimeBudget
+type RingSelector struct {
+	TimeBudget time.Duration // 0 means greedy only
+}
+
+// Select returns the indexes of chosen candidates sorted by received desc, optimal is false if the
+// greedy selection is returned
+func (s *RingSelector) Select(candidates []RingCandidate, capacities map[common.Hash]*big.Rat) (chosen []int, optimal bool) {
+	order := sortedByReceived(candidates)
+	if s.TimeBudget <= 0 {
+		return greedySelect(candidates, capacities, order), false
+	}
+
+	// 只有received为正的环会增加总收益
+	positive := []int{}
+	for _, idx := range order {
+		if candidates[idx].Received.Sign() > 0 {
+			positive = append(positive, idx)
+		}
+	}
+	// restReceived[i] is the sum of received from i to the end, the upper bound of the rest
+	restReceived := make([]*big.Rat, len(positive)+1)
+	restReceived[len(positive)] = new(big.Rat)
+	for i := len(positive) - 1; i >= 0; i-- {
+		restReceived[i] = new(big.Rat).Add(restReceived[i+1], candidates[positive[i]].Received)
+	}
+
+	deadline := time.Now().Add(s.TimeBudget)
+	remained := copyCapacities(capacities)
+	best := []int{}
+	bestReceived := new(big.Rat)
+	current := []int{}
+	nodes := 0
+	timeout := false
+
+	var search func(i int, received *big.Rat)
+	search = func(i int, received *big.Rat) {
+		if timeout {
+			return
+		}
+		nodes++
+		if nodes%selectCheckInterval == 0 && time.Now().After(deadline) {
+			timeout = true
+			return
+		}
+		if received.Cmp(bestReceived) > 0 {
+			bestReceived = new(big.Rat).Set(received)
+			best = append([]int{}, current...)
+		}
+		if i >= len(positive) || new(big.Rat).Add(received, restReceived[i]).Cmp(bestReceived) <= 0 {
+			return
+		}
+
+		candidate := candidates[positive[i]]
+		rate := fillRate(candidate, remained)
+		if candidateReceived := partialReceived(candidate, rate); candidateReceived.Sign() > 0 {
+			consume(candidate, remained, rate, -1)
+			current = append(current, positive[i])
+			search(i+1, new(big.Rat).Add(received, candidateReceived))
+			current = current[:len(current)-1]
+			consume(candidate, remained, rate, 1)
+		}
+		search(i+1, received)
+	}
+	search(0, new(big.Rat))
+
+	if timeout {
+		return greedySelect(candidates, capacities, order), false
+	}
+	return best, true
+}
+
+// GreedySelect chooses the candidates by received desc, a candidate is partially filled if any of its orders
+// hasn't enough amountS left, and skipped if it receives nothing then
+func GreedySelect(candidates []RingCandidate, capacities map[common.Hash]*big.Rat) []int {
+	return greedySelect(candidates, capacities, sortedByReceived(candidates))
+}
+
+// TotalReceived sums the received of chosen candidates filled in order, including the partially filled ones
+func TotalReceived(candidates []RingCandidate, capacities map[common.Hash]*big.Rat, chosen []int) *big.Rat {
+	remained := copyCapacities(capacities)
+	total := new(big.Rat)
+	for _, idx := range chosen {
+		rate := fillRate(candidates[idx], remained)
+		consume(candidates[idx], remained, rate, -1)
+		total.Add(total, partialReceived(candidates[idx], rate))
+	}
+	return total
+}
+
+func greedySelect(candidates []RingCandidate, capacities map[common.Hash]*big.Rat, order []int) []int {
+	remained := copyCapacities(capacities)
+	chosen := []int{}
+	for _, idx := range order {
+		rate := fillRate(candidates[idx], remained)
+		if partialReceived(candidates[idx], rate).Sign() > 0 {
+			consume(candidates[idx], remained, rate, -1)
+			chosen = append(chosen, idx)
+		}
+	}
+	return chosen
+}
+
+func sortedByReceived(candidates []RingCandidate) []int {
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return candidates[order[i]].Received.Cmp(candidates[order[j]].Received) > 0
+	})
+	return order
+}
+
+// fillRate returns the rate of fills that the amountS left of orders can afford, 1 means fully filled,
+// orders without capacity are unlimited
+func fillRate(candidate RingCandidate, remained map[common.Hash]*big.Rat) *big.Rat {
+	rate := big.NewRat(1, 1)
+	for hash, amountS := range candidate.Fills {
+		if capacity, exists := remained[hash]; exists && amountS.Sign() > 0 && capacity.Cmp(amountS) < 0 {
+			if orderRate := new(big.Rat).Quo(capacity, amountS); orderRate.Cmp(rate) < 0 {
+				rate = orderRate
+			}
+		}
+	}
+	if rate.Sign() < 0 {
+		rate.SetInt64(0)
+	}
+	return rate
+}
+
+// partialReceived is the received of candidate filled by rate, cost of gas is the same
+func partialReceived(candidate RingCandidate, rate *big.Rat) *big.Rat {
+	if rate.Sign() <= 0 {
+		return new(big.Rat)
+	}
+	cost := new(big.Rat)
+	if nil != candidate.Cost {
+		cost.Set(candidate.Cost)
+	}
+	received := new(big.Rat).Add(candidate.Received, cost)
+	return received.Mul(received, rate).Sub(received, cost)
+}
+
+func consume(candidate RingCandidate, remained map[common.Hash]*big.Rat, rate *big.Rat, sign int64) {
+	for hash, amountS := range candidate.Fills {
+		if capacity, exists := remained[hash]; exists {
+			filled := new(big.Rat).Mul(amountS, rate)
+			capacity.Add(capacity, filled.Mul(filled, big.NewRat(sign, 1)))
+		}
+	}
+}
+
+func copyCapacities(capacities map[common.Hash]*big.Rat) map[common.Hash]*big.Rat {
+	remained := make(map[common.Hash]*big.Rat)
+	for hash, capacity := range capacities {
+		remained[hash] = new(big.Rat).Set(capacity)
+	}
+	return remained
+}
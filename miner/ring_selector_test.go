@@ -0,0 +1,303 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"math/big"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/miner"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// go test -run NONE -bench RingSelection -dryrun miner_dryrun.ndjson ./miner/
+var dryRunBooks = flag.String("dryrun", "", "dry-run file recorded by miner, the candidate rings of each round are used as order books of benchmark")
+
+type selectionRound struct {
+	candidates []miner.RingCandidate
+	capacities map[common.Hash]*big.Rat
+}
+
+func hashOf(i int) common.Hash {
+	return common.BigToHash(big.NewInt(int64(i)))
+}
+
+// checkCapacities fills the chosen rings in order, each of them should be filled with the amountS left
+func checkCapacities(t *testing.T, round selectionRound, chosen []int) {
+	remained := make(map[common.Hash]*big.Rat)
+	for hash, capacity := range round.capacities {
+		remained[hash] = new(big.Rat).Set(capacity)
+	}
+	for _, idx := range chosen {
+		rate := big.NewRat(1, 1)
+		for hash, amountS := range round.candidates[idx].Fills {
+			if capacity, exists := remained[hash]; exists && capacity.Cmp(amountS) < 0 {
+				if r := new(big.Rat).Quo(capacity, amountS); r.Cmp(rate) < 0 {
+					rate = r
+				}
+			}
+		}
+		if rate.Sign() <= 0 {
+			t.Fatalf("ring %d is chosen, but its orders have nothing left", idx)
+		}
+		for hash, amountS := range round.candidates[idx].Fills {
+			if capacity, exists := remained[hash]; exists {
+				capacity.Sub(capacity, new(big.Rat).Mul(amountS, rate))
+			}
+		}
+	}
+}
+
+func TestRingSelector_Select(t *testing.T) {
+	// greedy takes ring 0 and then nothing else, ring 1 and ring 2 get more together
+	round := selectionRound{
+		candidates: []miner.RingCandidate{
+			{Received: big.NewRat(10, 1), Fills: map[common.Hash]*big.Rat{hashOf(1): big.NewRat(100, 1), hashOf(2): big.NewRat(100, 1)}},
+			{Received: big.NewRat(7, 1), Fills: map[common.Hash]*big.Rat{hashOf(1): big.NewRat(100, 1), hashOf(3): big.NewRat(100, 1)}},
+			{Received: big.NewRat(6, 1), Fills: map[common.Hash]*big.Rat{hashOf(2): big.NewRat(100, 1), hashOf(4): big.NewRat(100, 1)}},
+			{Received: big.NewRat(-1, 1), Fills: map[common.Hash]*big.Rat{hashOf(5): big.NewRat(100, 1), hashOf(6): big.NewRat(100, 1)}},
+		},
+		capacities: map[common.Hash]*big.Rat{
+			hashOf(1): big.NewRat(100, 1),
+			hashOf(2): big.NewRat(100, 1),
+			hashOf(3): big.NewRat(100, 1),
+			hashOf(4): big.NewRat(100, 1),
+		},
+	}
+
+	greedy := miner.GreedySelect(round.candidates, round.capacities)
+	if len(greedy) != 1 || greedy[0] != 0 {
+		t.Fatalf("greedy should choose ring 0 only, but got %v", greedy)
+	}
+
+	selector := &miner.RingSelector{TimeBudget: time.Second}
+	chosen, optimal := selector.Select(round.candidates, round.capacities)
+	if !optimal {
+		t.Fatalf("selection should be optimal")
+	}
+	if len(chosen) != 2 || chosen[0] != 1 || chosen[1] != 2 {
+		t.Fatalf("should choose ring 1 and 2, but got %v", chosen)
+	}
+	if miner.TotalReceived(round.candidates, round.capacities, chosen).Cmp(big.NewRat(13, 1)) != 0 {
+		t.Fatalf("total received should be 13")
+	}
+	checkCapacities(t, round, chosen)
+
+	// without time budget, it's greedy
+	selector.TimeBudget = 0
+	if chosen, optimal := selector.Select(round.candidates, round.capacities); optimal || len(chosen) != 1 || chosen[0] != 0 {
+		t.Fatalf("selection without time budget should be greedy, but got %v", chosen)
+	}
+}
+
+func TestRingSelector_SelectPartialFills(t *testing.T) {
+	// ring 1 can only be half filled after ring 0, the cost of gas is the same
+	candidates := func(cost1 int64) []miner.RingCandidate {
+		return []miner.RingCandidate{
+			{Received: big.NewRat(10, 1), Cost: big.NewRat(1, 1), Fills: map[common.Hash]*big.Rat{hashOf(1): big.NewRat(100, 1), hashOf(2): big.NewRat(100, 1)}},
+			{Received: big.NewRat(8, 1), Cost: big.NewRat(cost1, 1), Fills: map[common.Hash]*big.Rat{hashOf(1): big.NewRat(100, 1), hashOf(3): big.NewRat(100, 1)}},
+		}
+	}
+	capacities := map[common.Hash]*big.Rat{hashOf(1): big.NewRat(150, 1)}
+
+	cases := []struct {
+		name     string
+		cost1    int64
+		chosen   int
+		received *big.Rat
+	}{
+		{"partially filled ring is chosen", 2, 2, big.NewRat(13, 1)},
+		{"partially filled ring receives nothing", 8, 1, big.NewRat(10, 1)},
+	}
+	for _, c := range cases {
+		round := selectionRound{candidates: candidates(c.cost1), capacities: capacities}
+		greedy := miner.GreedySelect(round.candidates, round.capacities)
+		selector := &miner.RingSelector{TimeBudget: time.Second}
+		chosen, _ := selector.Select(round.candidates, round.capacities)
+		for _, selected := range [][]int{greedy, chosen} {
+			if len(selected) != c.chosen || selected[0] != 0 {
+				t.Errorf("%s: %d rings should be chosen, but got %v", c.name, c.chosen, selected)
+			}
+			if received := miner.TotalReceived(round.candidates, round.capacities, selected); received.Cmp(c.received) != 0 {
+				t.Errorf("%s: total received should be %s, but got %s", c.name, c.received.FloatString(0), received.FloatString(0))
+			}
+			checkCapacities(t, round, selected)
+		}
+	}
+}
+
+func TestRingSelector_SelectRandomBooks(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	selector := &miner.RingSelector{TimeBudget: 10 * time.Second}
+	for i := 0; i < 50; i++ {
+		round := randomSelectionRound(r, 6)
+		chosen, optimal := selector.Select(round.candidates, round.capacities)
+		if !optimal {
+			t.Fatalf("round %d, selection should be optimal", i)
+		}
+		checkCapacities(t, round, chosen)
+		greedy := miner.GreedySelect(round.candidates, round.capacities)
+		checkCapacities(t, round, greedy)
+		if miner.TotalReceived(round.candidates, round.capacities, chosen).Cmp(miner.TotalReceived(round.candidates, round.capacities, greedy)) < 0 {
+			t.Fatalf("round %d, optimal received is less than greedy", i)
+		}
+	}
+}
+
+func TestRingSelector_SelectTimeout(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	round := randomSelectionRound(r, 40)
+	selector := &miner.RingSelector{TimeBudget: time.Nanosecond}
+	chosen, optimal := selector.Select(round.candidates, round.capacities)
+	if optimal {
+		t.Fatalf("selection should fall back to greedy after time budget")
+	}
+	greedy := miner.GreedySelect(round.candidates, round.capacities)
+	if len(chosen) != len(greedy) {
+		t.Fatalf("fallback should be greedy, expect %v, but got %v", greedy, chosen)
+	}
+	for i := range greedy {
+		if chosen[i] != greedy[i] {
+			t.Fatalf("fallback should be greedy, expect %v, but got %v", greedy, chosen)
+		}
+	}
+}
+
+// randomSelectionRound generates a market of n orders on each side, every crossing pair is a candidate ring
+func randomSelectionRound(r *rand.Rand, n int) selectionRound {
+	round := selectionRound{capacities: make(map[common.Hash]*big.Rat)}
+	for i := 0; i < 2*n; i++ {
+		round.capacities[hashOf(i+1)] = big.NewRat(int64(100+r.Intn(900)), 1)
+	}
+	for a := 1; a <= n; a++ {
+		for b := n + 1; b <= 2*n; b++ {
+			if r.Intn(3) == 0 {
+				continue
+			}
+			fillA := new(big.Rat).Set(round.capacities[hashOf(a)])
+			if other := round.capacities[hashOf(b)]; other.Cmp(fillA) < 0 {
+				fillA = new(big.Rat).Set(other)
+			}
+			fillA.Mul(fillA, big.NewRat(int64(30+r.Intn(71)), 100))
+			fillA.SetInt(new(big.Int).Div(fillA.Num(), fillA.Denom()))
+			received := new(big.Rat).Mul(fillA, big.NewRat(int64(r.Intn(50)-5), 1000))
+			round.candidates = append(round.candidates, miner.RingCandidate{
+				Received: received,
+				Fills:    map[common.Hash]*big.Rat{hashOf(a): fillA, hashOf(b): new(big.Rat).Set(fillA)},
+			})
+		}
+	}
+	return round
+}
+
+// loadSelectionRounds reads candidate rings of each round from dry-run file
+func loadSelectionRounds(b *testing.B, path string) []selectionRound {
+	file, err := os.Open(path)
+	if err != nil {
+		b.Fatalf("open dry-run file error:%s", err.Error())
+	}
+	defer file.Close()
+
+	rounds := make(map[string]*selectionRound)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := &miner.DryRunRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil || record.Type != miner.DryRunCandidate {
+			continue
+		}
+		round, exists := rounds[record.Round]
+		if !exists {
+			round = &selectionRound{capacities: make(map[common.Hash]*big.Rat)}
+			rounds[record.Round] = round
+		}
+		received, _ := new(big.Rat).SetString(record.Received)
+		if nil == received {
+			continue
+		}
+		candidate := miner.RingCandidate{Received: received, Fills: make(map[common.Hash]*big.Rat)}
+		for _, order := range record.Orders {
+			if fillAmountS, ok := new(big.Rat).SetString(order.FillAmountS); ok {
+				candidate.Fills[order.OrderHash] = fillAmountS
+			}
+			if available, ok := new(big.Rat).SetString(order.AvailableAmountS); ok {
+				round.capacities[order.OrderHash] = available
+			}
+		}
+		round.candidates = append(round.candidates, candidate)
+	}
+
+	keys := []string{}
+	for key := range rounds {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := []selectionRound{}
+	for _, key := range keys {
+		list = append(list, *rounds[key])
+	}
+	return list
+}
+
+func BenchmarkRingSelection(b *testing.B) {
+	var rounds []selectionRound
+	if *dryRunBooks != "" {
+		rounds = loadSelectionRounds(b, *dryRunBooks)
+	} else {
+		r := rand.New(rand.NewSource(5))
+		for i := 0; i < 20; i++ {
+			rounds = append(rounds, randomSelectionRound(r, 8))
+		}
+	}
+	if len(rounds) == 0 {
+		b.Skip("no candidate rings")
+	}
+
+	strategies := map[string]func(round selectionRound) []int{
+		"greedy": func(round selectionRound) []int {
+			return miner.GreedySelect(round.candidates, round.capacities)
+		},
+		"optimal": func(round selectionRound) []int {
+			selector := &miner.RingSelector{TimeBudget: 200 * time.Millisecond}
+			chosen, _ := selector.Select(round.candidates, round.capacities)
+			return chosen
+		},
+	}
+	for _, name := range []string{"greedy", "optimal"} {
+		selectRings := strategies[name]
+		b.Run(name, func(b *testing.B) {
+			total := new(big.Rat)
+			for i := 0; i < b.N; i++ {
+				total.SetInt64(0)
+				for _, round := range rounds {
+					total.Add(total, miner.TotalReceived(round.candidates, round.capacities, selectRings(round)))
+				}
+			}
+			received, _ := total.Float64()
+			b.ReportMetric(received, "received/op")
+		})
+	}
+}
@@ -20,7 +20,9 @@ package miner
 
 import (
 	"errors"
+	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/dao"
@@ -41,18 +43,26 @@ type RingSubmitter struct {
 	ks                  *keystore.KeyStore
 	feeReceipt          common.Address //used to receive fee
 	ifRegistryRingHash  bool
+	ringExpireTime      int64 //seconds, rings matched but not sent before restart are expired after it
 
 	maxGasLimit *big.Int
 	minGasLimit *big.Int
 
 	normalMinerAddresses  []*NormalMinerAddress
 	percentMinerAddresses []*SplitMinerAddress
+	nonceManager          *NonceManager
 
 	dbService         dao.RdsService
 	marketCapProvider marketcap.MarketCapProvider
 	matcher           Matcher
+	evaluator         *Evaluator
+
+	dryRunWriter *DryRunWriter //rings are written to file instead of being submitted if it isn't nil
 
 	stopFuncs []func()
+
+	// 访问链上的方法，测试时替换
+	getTransactionByHash func(result types.CheckNull, txHash string, blockParameter string) error
 }
 
 type RingSubmitFailed struct {
@@ -93,6 +103,9 @@ func NewSubmitter(options config.MinerOptions, dbService dao.RdsService, marketC
 
 	submitter.dbService = dbService
 	submitter.marketCapProvider = marketCapProvider
+	submitter.getTransactionByHash = ethaccessor.GetTransactionByHash
+	submitter.nonceManager = NewNonceManager(dbService, submitter.normalMinerAddresses)
+	submitter.ignoreMinersGasPrice()
 	if len(options.NormalMiners) > 0 {
 		submitter.minerAccountForSign = accounts.Account{Address: common.HexToAddress(options.NormalMiners[0].Address)}
 	} else {
@@ -101,6 +114,20 @@ func NewSubmitter(options config.MinerOptions, dbService dao.RdsService, marketC
 
 	submitter.feeReceipt = common.HexToAddress(options.FeeReceipt)
 	submitter.ifRegistryRingHash = options.IfRegistryRingHash
+	submitter.ringExpireTime = options.RingExpireTime
+
+	if options.DryRun {
+		dryRunFile := options.DryRunFile
+		if "" == dryRunFile {
+			dryRunFile = DefaultDryRunFile
+		}
+		writer, err := NewDryRunWriter(dryRunFile)
+		if nil != err {
+			log.Fatalf("Miner submitter,open dry-run file err:%s", err.Error())
+		}
+		submitter.dryRunWriter = writer
+		log.Infof("Miner submitter,dry-run mode, rings will be written to %s and never be submitted", dryRunFile)
+	}
 
 	submitter.stopFuncs = []func(){}
 	return submitter
@@ -112,13 +139,16 @@ func (submitter *RingSubmitter) listenNewRings() {
 		for {
 			select {
 			case ringInfos := <-ringSubmitInfoChan:
-				if nil != ringInfos {
+				//dry-run的环路已由matcher写入文件，不保存也不提交
+				if nil != ringInfos && !submitter.IsDryRun() {
 					for _, info := range ringInfos {
+						info.CreateTime = time.Now().Unix()
 						daoInfo := &dao.RingSubmitInfo{}
 						daoInfo.ConvertDown(info)
 						if err := submitter.dbService.Add(daoInfo); nil != err {
 							log.Errorf("Miner submitter,insert new ring err:%s", err.Error())
 						} else {
+							submitter.transition([]common.Hash{info.Ringhash}, types.RING_SUBMIT_MATCHED, "", "")
 							for _, filledOrder := range info.RawRing.Orders {
 								daoOrder := &dao.FilledOrder{}
 								daoOrder.ConvertDown(filledOrder, info.Ringhash)
@@ -133,6 +163,7 @@ func (submitter *RingSubmitter) listenNewRings() {
 						if len(ringInfos) == 1 {
 							if err := submitter.ringhashRegistry(ringInfos[0]); nil != err {
 								submitter.dbService.UpdateRingSubmitInfoFailed([]common.Hash{ringInfos[0].Ringhash}, err.Error())
+								submitter.transition([]common.Hash{ringInfos[0].Ringhash}, types.RING_SUBMIT_FAILED, "", err.Error())
 							}
 						} else {
 							infosMap := make(map[common.Address][]*types.RingSubmitInfo)
@@ -151,6 +182,7 @@ func (submitter *RingSubmitter) listenNewRings() {
 								}
 								if err := submitter.batchRinghashRegistry(protocolAddr, ringhashes, miners); nil != err {
 									submitter.dbService.UpdateRingSubmitInfoFailed(ringhashes, err.Error())
+									submitter.transition(ringhashes, types.RING_SUBMIT_FAILED, "", err.Error())
 								}
 							}
 						}
@@ -201,10 +233,11 @@ func (submitter *RingSubmitter) batchRinghashRegistry(contractAddress common.Add
 		if gas, gasPrice, err := ethaccessor.EstimateGas(registryData, ringhashRegistryAddress, "latest"); nil != err {
 			return err
 		} else {
-			if txHash, err := ethaccessor.SignAndSendTransaction(accounts.Account{Address: miners[0]}, ringhashRegistryAddress, gas, gasPrice, nil, registryData); nil != err {
+			if txHash, err := submitter.sendTransaction(types.MINER_TX_REGISTRY, ringhashes, accounts.Account{Address: miners[0]}, ringhashRegistryAddress, gas, gasPrice, nil, registryData); nil != err {
 				return err
 			} else {
 				submitter.dbService.UpdateRingSubmitInfoRegistryTxHash(ringhashes, txHash)
+				submitter.transition(ringhashes, types.RING_SUBMIT_REGISTRY_SENT, txHash, "")
 			}
 		}
 	}
@@ -220,26 +253,59 @@ func (submitter *RingSubmitter) ringhashRegistry(ringSubmitInfo *types.RingSubmi
 		ringhashRegistryAddress = implAddress.RinghashRegistryAddress
 	}
 
-	if txHash, err := ethaccessor.SignAndSendTransaction(accounts.Account{Address: ringSubmitInfo.Miner}, ringhashRegistryAddress, ringSubmitInfo.RegistryGas, ringSubmitInfo.RegistryGasPrice, nil, ringSubmitInfo.RegistryData); nil != err {
+	if txHash, err := submitter.sendTransaction(types.MINER_TX_REGISTRY, []common.Hash{ringSubmitInfo.Ringhash}, accounts.Account{Address: ringSubmitInfo.Miner}, ringhashRegistryAddress, ringSubmitInfo.RegistryGas, ringSubmitInfo.RegistryGasPrice, nil, ringSubmitInfo.RegistryData); nil != err {
 		return err
 	} else {
 		ringSubmitInfo.RegistryTxHash = common.HexToHash(txHash)
 		submitter.dbService.UpdateRingSubmitInfoRegistryTxHash([]common.Hash{ringSubmitInfo.Ringhash}, txHash)
+		submitter.transition([]common.Hash{ringSubmitInfo.Ringhash}, types.RING_SUBMIT_REGISTRY_SENT, txHash, "")
 	}
 	return nil
 }
 
 func (submitter *RingSubmitter) submitRing(ringSubmitInfo *types.RingSubmitInfo) error {
-	if txHash, err := ethaccessor.SignAndSendTransaction(accounts.Account{Address: ringSubmitInfo.Miner}, ringSubmitInfo.ProtocolAddress, ringSubmitInfo.ProtocolGas, ringSubmitInfo.ProtocolGasPrice, nil, ringSubmitInfo.ProtocolData); nil != err {
+	if submitter.IsDryRun() {
+		return errors.New("can't submit ring in dry-run mode")
+	}
+	if err := submitter.simulateRing(ringSubmitInfo); nil != err {
+		return err
+	}
+	if txHash, err := submitter.sendTransaction(types.MINER_TX_SUBMIT_RING, []common.Hash{ringSubmitInfo.Ringhash}, accounts.Account{Address: ringSubmitInfo.Miner}, ringSubmitInfo.ProtocolAddress, ringSubmitInfo.ProtocolGas, ringSubmitInfo.ProtocolGasPrice, nil, ringSubmitInfo.ProtocolData); nil != err {
 		submitter.submitFailed([]common.Hash{ringSubmitInfo.Ringhash}, err)
 		return err
 	} else {
 		ringSubmitInfo.SubmitTxHash = common.HexToHash(txHash)
 		submitter.dbService.UpdateRingSubmitInfoProtocolTxHash(ringSubmitInfo.Ringhash, txHash)
+		submitter.transition([]common.Hash{ringSubmitInfo.Ringhash}, types.RING_SUBMIT_SENT, txHash, "")
+	}
+	return nil
+}
+
+// simulateRing executes the ring with eth_call against the pending block, the ring that will be reverted is
+// dropped as failed instead of spending gas. it is still submitted if the node can't simulate it
+func (submitter *RingSubmitter) simulateRing(ringSubmitInfo *types.RingSubmitInfo) error {
+	err := ethaccessor.SimulateTransaction(ringSubmitInfo.Miner, ringSubmitInfo.ProtocolAddress, ringSubmitInfo.ProtocolGas, ringSubmitInfo.ProtocolGasPrice, nil, ringSubmitInfo.ProtocolData, "pending")
+	if nil == err {
+		return nil
 	}
+	if revertErr, ok := err.(*ethaccessor.RevertError); ok {
+		log.Errorf("Miner submitter,ring:%s will be reverted, reason:%s", ringSubmitInfo.Ringhash.Hex(), revertErr.Reason)
+		ringSubmitInfo.Err = revertErr.Error()
+		submitter.submitFailed([]common.Hash{ringSubmitInfo.Ringhash}, revertErr)
+		return revertErr
+	}
+	log.Errorf("Miner submitter,simulate ring:%s err:%s", ringSubmitInfo.Ringhash.Hex(), err.Error())
 	return nil
 }
 
+// sendTransaction uses the nonce assigned by nonceManager if the address is a normal miner
+func (submitter *RingSubmitter) sendTransaction(txType types.MinerTxType, ringhashes []common.Hash, sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte) (string, error) {
+	if submitter.nonceManager.IsManaged(sender.Address) {
+		return submitter.nonceManager.SendTransaction(txType, ringhashes, sender, to, gas, gasPrice, value, callData)
+	}
+	return ethaccessor.SignAndSendTransaction(sender, to, gas, gasPrice, value, callData)
+}
+
 func (submitter *RingSubmitter) listenSubmitRingMethodEvent() {
 	submitRingMethodChan := make(chan *types.SubmitRingMethodEvent)
 	go func() {
@@ -312,6 +378,7 @@ func (submitter *RingSubmitter) listenBatchSubmitRingMethodEvent() {
 
 //提交错误，执行错误
 func (submitter *RingSubmitter) submitFailed(ringhashes []common.Hash, err error) {
+	submitter.transition(ringhashes, types.RING_SUBMIT_FAILED, "", err.Error())
 	if err := submitter.dbService.UpdateRingSubmitInfoFailed(ringhashes, err.Error()); nil != err {
 		log.Errorf("err:%s", err.Error())
 	} else {
@@ -365,34 +432,13 @@ func (submitter *RingSubmitter) listenRegistryEvent() {
 			select {
 			case event := <-registryChan:
 				if nil != event {
-					var (
-						err         error
-						implAddress *ethaccessor.ProtocolAddress
-						exists      bool
-					)
 					info := &types.RingSubmitInfo{}
 					daoInfo, _ := submitter.dbService.GetRingForSubmitByHash(event.RingHash)
 					daoInfo.ConvertUp(info)
-					if types.IsZeroHash(info.Ringhash) {
-						err = errors.New("ring hash is zero")
-					} else {
-						if implAddress, exists = ethaccessor.ProtocolAddresses()[info.ProtocolAddress]; !exists {
-							err = errors.New("doesn't contain this version of protocol:" + info.ProtocolAddress.Hex())
-						}
-						var canSubmit bool
-						canSubmit, err = ethaccessor.ProtocolCanSubmit(implAddress, info.Ringhash, info.Miner)
-						if nil != err {
-							log.Errorf("err:%s", err.Error())
-						} else {
-							if !canSubmit {
-								err = errors.New("failed to call method:canSubmit")
-							}
-						}
-					}
-
-					if nil == err {
-						submitter.submitRing(info)
+					if !types.IsZeroHash(info.Ringhash) {
+						submitter.transition([]common.Hash{info.Ringhash}, types.RING_SUBMIT_REGISTRY_MINED, event.TxHash.Hex(), "")
 					}
+					submitter.submitRegisteredRing(info)
 				}
 			}
 		}
@@ -413,6 +459,188 @@ func (submitter *RingSubmitter) listenRegistryEvent() {
 	})
 }
 
+// submitRegisteredRing submits the ring whose ringhash has been registered
+func (submitter *RingSubmitter) submitRegisteredRing(info *types.RingSubmitInfo) error {
+	if types.IsZeroHash(info.Ringhash) {
+		return errors.New("ring hash is zero")
+	}
+	implAddress, exists := ethaccessor.ProtocolAddresses()[info.ProtocolAddress]
+	if !exists {
+		return errors.New("doesn't contain this version of protocol:" + info.ProtocolAddress.Hex())
+	}
+	canSubmit, err := ethaccessor.ProtocolCanSubmit(implAddress, info.Ringhash, info.Miner)
+	if nil != err {
+		log.Errorf("err:%s", err.Error())
+		return err
+	}
+	if !canSubmit {
+		err = errors.New("failed to call method:canSubmit")
+		submitter.submitFailed([]common.Hash{info.Ringhash}, err)
+		return err
+	}
+	return submitter.submitRing(info)
+}
+
+func (submitter *RingSubmitter) listenRingMinedEvent() {
+	ringMinedChan := make(chan *types.RingMinedEvent)
+	go func() {
+		for {
+			select {
+			case event := <-ringMinedChan:
+				if nil != event {
+					submitter.transition([]common.Hash{event.Ringhash}, types.RING_SUBMIT_MINED, event.TxHash.Hex(), "")
+				}
+			}
+		}
+	}()
+
+	watcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			e := eventData.(*types.RingMinedEvent)
+			ringMinedChan <- e
+			return nil
+		},
+	}
+	eventemitter.On(eventemitter.OrderManagerExtractorRingMined, watcher)
+	submitter.stopFuncs = append(submitter.stopFuncs, func() {
+		close(ringMinedChan)
+		eventemitter.Un(eventemitter.OrderManagerExtractorRingMined, watcher)
+	})
+}
+
+// recoverRings resumes the rings unfinished before restart. the matched rings are evaluated again with
+// current orders and balances before submitted, the rings whose tx is neither tracked by nonceManager
+// nor known by nodes will never be mined, they are expired
+func (submitter *RingSubmitter) recoverRings() {
+	daoInfos, err := submitter.dbService.GetUnfinishedRingSubmitInfos()
+	if nil != err {
+		log.Errorf("Miner submitter,get unfinished rings err:%s", err.Error())
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, daoInfo := range daoInfos {
+		info := &types.RingSubmitInfo{}
+		daoInfo.ConvertUp(info)
+		switch info.Status {
+		case types.RING_SUBMIT_MATCHED:
+			if now-info.CreateTime > submitter.ringExpireTime {
+				submitter.transition([]common.Hash{info.Ringhash}, types.RING_SUBMIT_EXPIRED, "", "")
+				continue
+			}
+			reevaluated, err := submitter.reevaluateRing(info)
+			if nil != err {
+				log.Errorf("Miner submitter,ring:%s can't be resumed, err:%s", info.Ringhash.Hex(), err.Error())
+				submitter.submitFailed([]common.Hash{info.Ringhash}, err)
+				continue
+			}
+			daoInfo.ConvertDown(reevaluated)
+			if err := submitter.dbService.Save(&daoInfo); nil != err {
+				log.Errorf("Miner submitter,save ring:%s err:%s", info.Ringhash.Hex(), err.Error())
+			}
+			log.Infof("Miner submitter,resume ring:%s", info.Ringhash.Hex())
+			if submitter.ifRegistryRingHash {
+				if err := submitter.ringhashRegistry(reevaluated); nil != err {
+					submitter.submitFailed([]common.Hash{info.Ringhash}, err)
+				}
+			} else {
+				submitter.submitRing(reevaluated)
+			}
+		case types.RING_SUBMIT_REGISTRY_SENT, types.RING_SUBMIT_SENT, types.RING_SUBMIT_REPLACED:
+			submitter.expireLostRing(info)
+		case types.RING_SUBMIT_REGISTRY_MINED:
+			log.Infof("Miner submitter,resume registered ring:%s", info.Ringhash.Hex())
+			submitter.submitRegisteredRing(info)
+		}
+	}
+}
+
+// reevaluateRing computes the ring again with current states and balances of its orders,
+// they may have been filled, cancelled or transferred while the relay was down
+func (submitter *RingSubmitter) reevaluateRing(info *types.RingSubmitInfo) (*types.RingSubmitInfo, error) {
+	daoFilledOrders, err := submitter.dbService.GetFilledOrdersByRinghash(info.Ringhash)
+	if nil != err {
+		return nil, err
+	}
+	if len(daoFilledOrders) < 2 {
+		return nil, errors.New("orders of ring are lost")
+	}
+	states := []types.OrderState{}
+	for _, daoFilledOrder := range daoFilledOrders {
+		filledOrder := &types.FilledOrder{}
+		if err := daoFilledOrder.ConvertUp(filledOrder, submitter.dbService); nil != err {
+			return nil, err
+		}
+		state := filledOrder.OrderState
+		if (state.Status != types.ORDER_NEW && state.Status != types.ORDER_PARTIAL) || state.IsOrderExpired() {
+			return nil, fmt.Errorf("order:%s isn't open, status:%d", state.RawOrder.Hash.Hex(), state.Status)
+		}
+		states = append(states, state)
+	}
+
+	if nil == submitter.evaluator || nil == submitter.matcher {
+		return nil, errors.New("evaluator and matcher must be setted")
+	}
+	implAddress, exists := ethaccessor.ProtocolAddresses()[info.ProtocolAddress]
+	if !exists {
+		return nil, errors.New("doesn't contain this version of protocol:" + info.ProtocolAddress.Hex())
+	}
+	filledOrders := []*types.FilledOrder{}
+	for _, state := range states {
+		lrcBalance, err := submitter.matcher.GetAccountAvailableAmount(state.RawOrder.Owner, implAddress.LrcTokenAddress)
+		if nil != err {
+			return nil, err
+		}
+		tokenSBalance, err := submitter.matcher.GetAccountAvailableAmount(state.RawOrder.Owner, state.RawOrder.TokenS)
+		if nil != err {
+			return nil, err
+		}
+		if tokenSBalance.Sign() <= 0 {
+			return nil, fmt.Errorf("owner:%s token:%s balance or allowance is zero", state.RawOrder.Owner.Hex(), state.RawOrder.TokenS.Hex())
+		}
+		filledOrders = append(filledOrders, types.ConvertOrderStateToFilledOrder(state, lrcBalance, tokenSBalance))
+	}
+
+	ring := NewRing(filledOrders)
+	if err := submitter.evaluator.ComputeRing(ring); nil != err {
+		return nil, err
+	}
+	reevaluated, err := submitter.GenerateRingSubmitInfo(ring)
+	if nil != err {
+		return nil, err
+	}
+	reevaluated.Status = info.Status
+	reevaluated.CreateTime = info.CreateTime
+	return reevaluated, nil
+}
+
+// expireLostRing expires the ring whose tx is neither tracked by nonceManager nor known by nodes, nobody
+// will send it again. the txs of split miners aren't tracked, they are only looked up on chain
+func (submitter *RingSubmitter) expireLostRing(info *types.RingSubmitInfo) {
+	txHash := info.SubmitTxHash
+	if types.IsZeroHash(txHash) {
+		txHash = info.RegistryTxHash
+	}
+	if !types.IsZeroHash(txHash) {
+		if submitter.nonceManager.IsTracked(info.Miner, txHash) {
+			return
+		}
+		var tx ethaccessor.Transaction
+		if err := submitter.getTransactionByHash(&tx, txHash.Hex(), "latest"); nil == err {
+			return
+		}
+	}
+	log.Infof("Miner submitter,tx:%s of ring:%s is lost, the ring is expired", txHash.Hex(), info.Ringhash.Hex())
+	submitter.transition([]common.Hash{info.Ringhash}, types.RING_SUBMIT_EXPIRED, txHash.Hex(), "tx is lost")
+}
+
+func (submitter *RingSubmitter) transition(ringhashes []common.Hash, status types.RingSubmitStatus, txHash string, errMsg string) {
+	if err := submitter.dbService.UpdateRingSubmitInfoStatus(ringhashes, status, txHash, errMsg); nil != err {
+		log.Errorf("Miner submitter,update status of rings err:%s", err.Error())
+	}
+}
+
 func (submitter *RingSubmitter) GenerateRingSubmitInfo(ringState *types.Ring) (*types.RingSubmitInfo, error) {
 	protocolAddress := ringState.Orders[0].OrderState.RawOrder.Protocol
 	var (
@@ -487,7 +715,9 @@ func (submitter *RingSubmitter) GenerateRingSubmitInfo(ringState *types.Ring) (*
 
 	ringSubmitInfo.ProtocolGas.Add(ringSubmitInfo.ProtocolGas, big.NewInt(1000))
 
-	submitter.computeReceivedAndSelectMiner(ringSubmitInfo)
+	if err := submitter.computeReceivedAndSelectMiner(ringSubmitInfo); nil != err {
+		return nil, err
+	}
 	log.Debugf("miner,submitter generate ring info, legal cost:%s, legalFee:%s, received:%s", ringSubmitInfo.LegalCost.FloatString(2), ringState.LegalFee.FloatString(2), ringSubmitInfo.Received.FloatString(2))
 
 	if ringSubmitInfo.Received.Sign() <= 0 {
@@ -501,117 +731,126 @@ func (submitter *RingSubmitter) stop() {
 	for _, stop := range submitter.stopFuncs {
 		stop()
 	}
+	submitter.stopFuncs = []func(){}
+	submitter.nonceManager.Stop()
+	if submitter.IsDryRun() {
+		if err := submitter.dryRunWriter.Close(); nil != err {
+			log.Errorf("Miner submitter,close dry-run file err:%s", err.Error())
+		}
+	}
+}
+
+func (submitter *RingSubmitter) IsDryRun() bool {
+	return nil != submitter.dryRunWriter
+}
+
+// RecordDryRun writes the candidate or chosen rings of the round to dry-run file, it does nothing if dry-run is disabled
+func (submitter *RingSubmitter) RecordDryRun(recordType string, round *big.Int, infos ...*types.RingSubmitInfo) {
+	if !submitter.IsDryRun() || len(infos) == 0 {
+		return
+	}
+	if err := submitter.dryRunWriter.Write(recordType, round, infos...); nil != err {
+		log.Errorf("Miner submitter,write dry-run file err:%s", err.Error())
+	}
 }
 
 func (submitter *RingSubmitter) start() {
+	if !submitter.IsDryRun() {
+		submitter.nonceManager.Start()
+		submitter.recoverRings()
+	}
 	submitter.listenNewRings()
 	submitter.listenRegistryMethodEvent()
 	submitter.listenBatchSubmitRingMethodEvent()
 	submitter.listenSubmitRingMethodEvent()
 	submitter.listenRegistryEvent()
+	submitter.listenRingMinedEvent()
+	submitter.listenChainFork()
+}
+
+// listenChainFork recovers nonces and rings after ordermanager rolled back mysql. watchers of a topic run
+// concurrently, so the nonce manager is recovered here before rings, which rely on the txs it tracks
+func (submitter *RingSubmitter) listenChainFork() {
+	if submitter.IsDryRun() {
+		return
+	}
+	watcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle:     submitter.handleChainFork,
+	}
+	eventemitter.On(eventemitter.ChainForkComplete, watcher)
+	submitter.stopFuncs = append(submitter.stopFuncs, func() {
+		eventemitter.Un(eventemitter.ChainForkComplete, watcher)
+	})
+}
+
+func (submitter *RingSubmitter) handleChainFork(input eventemitter.EventData) error {
+	log.Infof("Miner submitter,chain fork at block:%s, recover nonces and rings", input.(*types.ForkedEvent).ForkBlock.String())
+	submitter.nonceManager.handleChainFork(input)
+	submitter.recoverRings()
+	return nil
 }
 
 func (submitter *RingSubmitter) availabeMinerAddress() []*NormalMinerAddress {
 	minerAddresses := []*NormalMinerAddress{}
 	for _, minerAddress := range submitter.normalMinerAddresses {
-		var blockedTxCount, txCount types.Big
-		ethaccessor.GetTransactionCount(&blockedTxCount, minerAddress.Address, "latest")
-		ethaccessor.GetTransactionCount(&txCount, minerAddress.Address, "pending")
-		//submitter.Accessor.Call("latest", &blockedTxCount, "eth_getTransactionCount", minerAddress.Address.Hex(), "latest")
-		//submitter.Accessor.Call("latest", &txCount, "eth_getTransactionCount", minerAddress.Address.Hex(), "pending")
-
-		pendingCount := big.NewInt(int64(0))
-		pendingCount.Sub(txCount.BigInt(), blockedTxCount.BigInt())
-		if pendingCount.Int64() <= minerAddress.MaxPendingCount {
+		pendingCount := submitter.nonceManager.PendingCount(minerAddress.Address)
+		if int64(pendingCount) <= minerAddress.MaxPendingCount {
 			minerAddresses = append(minerAddresses, minerAddress)
 		}
 	}
 
-	if len(minerAddresses) <= 0 {
+	if len(minerAddresses) <= 0 && len(submitter.normalMinerAddresses) > 0 {
 		minerAddresses = append(minerAddresses, submitter.normalMinerAddresses[0])
 	}
 	return minerAddresses
 }
 
+// ignoreMinersGasPrice excludes txs of miners from the gas price evaluator, their prices are chosen by it
+func (submitter *RingSubmitter) ignoreMinersGasPrice() {
+	addresses := []common.Address{}
+	for _, minerAddress := range submitter.normalMinerAddresses {
+		addresses = append(addresses, minerAddress.Address)
+	}
+	for _, minerAddress := range submitter.percentMinerAddresses {
+		addresses = append(addresses, minerAddress.Address)
+	}
+	ethaccessor.IgnoreGasPriceSenders(addresses...)
+}
+
+// lrcRewardPayer is the fee recipient of ring, the contract pays the lrc reward of margin split from it
+func (submitter *RingSubmitter) lrcRewardPayer() common.Address {
+	if submitter.feeReceipt == (common.Address{}) {
+		return submitter.minerAccountForSign.Address
+	}
+	return submitter.feeReceipt
+}
+
 func (submitter *RingSubmitter) computeReceivedAndSelectMiner(ringSubmitInfo *types.RingSubmitInfo) error {
 	ringState := ringSubmitInfo.RawRing
-	ringState.LegalFee = new(big.Rat).SetInt(big.NewInt(int64(0)))
-	ethPrice, _ := submitter.marketCapProvider.GetEthCap()
-	ethPrice = ethPrice.Quo(ethPrice, new(big.Rat).SetInt(util.AllTokens["WETH"].Decimals))
+	ethCap, err := submitter.marketCapProvider.GetEthCap()
+	if nil != err {
+		return fmt.Errorf("Miner submitter,get eth cap err:%s", err.Error())
+	}
+	ethPrice := new(big.Rat).Quo(ethCap, new(big.Rat).SetInt(util.AllTokens["WETH"].Decimals))
 	lrcAddress := ethaccessor.ProtocolAddresses()[ringState.Orders[0].OrderState.RawOrder.Protocol].LrcTokenAddress
-	useSplit := false
-	//for _,splitMiner := range submitter.splitMinerAddresses {
-	//	//todo:optimize it
-	//	if lrcFee > splitMiner.StartFee || splitFee > splitMiner.StartFee || len(submitter.normalMinerAddresses) <= 0  {
-	//		useSplit = true
-	//		ringState.Miner = splitMiner.Address
-	//		minerLrcBalance, _ := submitter.matcher.GetAccountAvailableAmount(splitMiner.Address, lrcAddress)
-	//		//the lrcreward should be send to order.owner when miner selects MarginSplit as the selection of fee
-	//		//be careful！！！ miner will received nothing, if miner set FeeSelection=1 and he doesn't have enough lrc
-	//
-	//
-	//		if ringState.LrcLegalFee.Cmp(ringState.SplitLegalFee) < 0 && minerLrcBalance.Cmp(filledOrder.LrcFee) > 0 {
-	//			filledOrder.FeeSelection = 1
-	//			splitPer := new(big.Rat).SetInt64(int64(filledOrder.OrderState.RawOrder.MarginSplitPercentage))
-	//			legalAmountOfSaving.Mul(legalAmountOfSaving, splitPer)
-	//			filledOrder.LrcReward = legalAmountOfLrc
-	//			legalAmountOfSaving.Sub(legalAmountOfSaving, legalAmountOfLrc)
-	//			filledOrder.LegalFee = legalAmountOfSaving
-	//
-	//			minerLrcBalance.Sub(minerLrcBalance, filledOrder.LrcFee)
-	//			//log.Debugf("Miner,lrcReward:%s  legalFee:%s", lrcReward.FloatString(10), filledOrder.LegalFee.FloatString(10))
-	//		} else {
-	//			filledOrder.FeeSelection = 0
-	//			filledOrder.LegalFee = legalAmountOfLrc
-	//		}
-	//
-	//		ringState.LegalFee.Add(ringState.LegalFee, filledOrder.LegalFee)
-	//	}
-	//}
-	minerAddresses := submitter.availabeMinerAddress()
-	if !useSplit {
-		for _, normalMinerAddress := range minerAddresses {
-			minerLrcBalance, _ := submitter.matcher.GetAccountAvailableAmount(normalMinerAddress.Address, lrcAddress)
-
-			legalFee := new(big.Rat).SetInt(big.NewInt(int64(0)))
-			feeSelections := []uint8{}
-			legalFees := []*big.Rat{}
-			lrcRewards := []*big.Rat{}
-			for _, filledOrder := range ringState.Orders {
-				lrcFee := new(big.Rat).SetInt(big.NewInt(int64(2)))
-				lrcFee.Mul(lrcFee, filledOrder.LegalLrcFee)
-				if lrcFee.Cmp(filledOrder.LegalFeeS) < 0 && minerLrcBalance.Cmp(filledOrder.LrcFee) > 0 {
-					feeSelections = append(feeSelections, 1)
-					fee := new(big.Rat).Set(filledOrder.LegalFeeS)
-					fee.Sub(fee, filledOrder.LegalLrcFee)
-					legalFees = append(legalFees, fee)
-					lrcRewards = append(lrcRewards, filledOrder.LegalLrcFee)
-					legalFee.Add(legalFee, fee)
-
-					minerLrcBalance.Sub(minerLrcBalance, filledOrder.LrcFee)
-					//log.Debugf("Miner,lrcReward:%s  legalFee:%s", lrcReward.FloatString(10), filledOrder.LegalFee.FloatString(10))
-				} else {
-					feeSelections = append(feeSelections, 0)
-					legalFees = append(legalFees, filledOrder.LegalLrcFee)
-					lrcRewards = append(lrcRewards, new(big.Rat).SetInt(big.NewInt(int64(0))))
-					legalFee.Add(legalFee, filledOrder.LegalLrcFee)
-				}
-			}
 
-			if ringState.LegalFee.Sign() == 0 || ringState.LegalFee.Cmp(legalFee) < 0 {
-				ringState.LegalFee = legalFee
-				ringSubmitInfo.Miner = normalMinerAddress.Address
-				for idx, filledOrder := range ringState.Orders {
-					filledOrder.FeeSelection = feeSelections[idx]
-					filledOrder.LegalFee = legalFees[idx]
-					filledOrder.LrcReward = lrcRewards[idx]
-				}
+	//be careful！！！ miner will received nothing, if miner set FeeSelection=1 and fee recipient doesn't have enough lrc
+	lrcBalance, err := submitter.matcher.GetAccountAvailableAmount(submitter.lrcRewardPayer(), lrcAddress)
+	if nil != err {
+		log.Errorf("Miner submitter,get lrc balance of fee recipient:%s err:%s", submitter.lrcRewardPayer().Hex(), err.Error())
+		lrcBalance = new(big.Rat)
+	}
+	ringFee := ComputeRingFee(ringState.Orders, lrcBalance)
+	ringFee.apply(ringState)
 
-				if nil == ringSubmitInfo.ProtocolGasPrice || ringSubmitInfo.ProtocolGasPrice.Cmp(normalMinerAddress.GasPriceLimit) > 0 {
-					ringSubmitInfo.ProtocolGasPrice = normalMinerAddress.GasPriceLimit
-				}
-			}
-		}
+	gas := new(big.Int).Set(ringSubmitInfo.ProtocolGas)
+	if submitter.ifRegistryRingHash {
+		gas.Add(gas, ringSubmitInfo.RegistryGas)
+	}
+
+	if err := submitter.selectMiner(ringSubmitInfo, ethPrice, gas); nil != err {
+		return err
 	}
 
 	registryCost := big.NewInt(int64(0))
@@ -631,6 +870,61 @@ func (submitter *RingSubmitter) computeReceivedAndSelectMiner(ringSubmitInfo *ty
 	return nil
 }
 
+// selectMiner chooses the miner of ring and its gas price
+func (submitter *RingSubmitter) selectMiner(ringSubmitInfo *types.RingSubmitInfo, ethPrice *big.Rat, gas *big.Int) error {
+	ringState := ringSubmitInfo.RawRing
+
+	//percent miner is used if the fee reaches its StartFee, the gas price is FeePercent of the fee to be confirmed quickly
+	legalFee, _ := ringState.LegalFee.Float64()
+	var splitMiner *SplitMinerAddress
+	for _, minerAddress := range submitter.percentMinerAddresses {
+		if legalFee < minerAddress.StartFee && len(submitter.normalMinerAddresses) > 0 {
+			continue
+		}
+		if nil == splitMiner || minerAddress.FeePercent < splitMiner.FeePercent {
+			splitMiner = minerAddress
+		}
+	}
+
+	if nil != splitMiner {
+		ringSubmitInfo.Miner = splitMiner.Address
+		estimated := ringSubmitInfo.ProtocolGasPrice
+		ringSubmitInfo.ProtocolGasPrice = SplitMinerGasPrice(ringState.LegalFee, splitMiner.FeePercent, ethPrice, gas)
+		// 手续费太少时gasPrice为0，使用估算的gasPrice，并与普通miner一样限制上限
+		if ringSubmitInfo.ProtocolGasPrice.Sign() <= 0 {
+			ringSubmitInfo.ProtocolGasPrice = estimated
+			if limit := submitter.maxGasPriceLimit(); nil != limit && (nil == estimated || estimated.Cmp(limit) > 0) {
+				ringSubmitInfo.ProtocolGasPrice = limit
+			}
+		}
+	} else if minerAddresses := submitter.availabeMinerAddress(); len(minerAddresses) > 0 {
+		normalMinerAddress := minerAddresses[0]
+		ringSubmitInfo.Miner = normalMinerAddress.Address
+		if gasPrice := SelectGasPrice(ringState.LegalFee, gas, ethPrice, ethaccessor.EstimateGasPriceLevels()); nil != gasPrice && gasPrice.Sign() > 0 {
+			ringSubmitInfo.ProtocolGasPrice = gasPrice
+		}
+		if nil == ringSubmitInfo.ProtocolGasPrice || ringSubmitInfo.ProtocolGasPrice.Cmp(normalMinerAddress.GasPriceLimit) > 0 {
+			ringSubmitInfo.ProtocolGasPrice = normalMinerAddress.GasPriceLimit
+		}
+	}
+
+	if nil == ringSubmitInfo.ProtocolGasPrice || ringSubmitInfo.ProtocolGasPrice.Sign() <= 0 {
+		return fmt.Errorf("Miner submitter,no gas price for miner:%s", ringSubmitInfo.Miner.Hex())
+	}
+	return nil
+}
+
+// maxGasPriceLimit returns the highest GasPriceLimit of normal miners, nil if there isn't any
+func (submitter *RingSubmitter) maxGasPriceLimit() *big.Int {
+	var limit *big.Int
+	for _, minerAddress := range submitter.normalMinerAddresses {
+		if nil != minerAddress.GasPriceLimit && (nil == limit || minerAddress.GasPriceLimit.Cmp(limit) > 0) {
+			limit = minerAddress.GasPriceLimit
+		}
+	}
+	return limit
+}
+
 func (submitter *RingSubmitter) SetMatcher(matcher Matcher) {
 	submitter.matcher = matcher
 }
@@ -0,0 +1,255 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func init() {
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+}
+
+// submitterRds keeps rings and orders in memory, other methods of RdsService aren't used by recoverRings
+type submitterRds struct {
+	dao.RdsService
+	rings        []*types.RingSubmitInfo
+	filledOrders map[common.Hash][]dao.FilledOrder
+	orders       map[common.Hash]*dao.Order
+	status       map[common.Hash]types.RingSubmitStatus
+}
+
+func (r *submitterRds) GetUnfinishedRingSubmitInfos() ([]dao.RingSubmitInfo, error) {
+	list := []dao.RingSubmitInfo{}
+	for _, info := range r.rings {
+		model := dao.RingSubmitInfo{}
+		model.ConvertDown(info)
+		model.ProtocolTxHash = info.SubmitTxHash.Hex()
+		model.RegistryTxHash = info.RegistryTxHash.Hex()
+		list = append(list, model)
+	}
+	return list, nil
+}
+
+func (r *submitterRds) GetFilledOrdersByRinghash(ringhash common.Hash) ([]dao.FilledOrder, error) {
+	return r.filledOrders[ringhash], nil
+}
+
+func (r *submitterRds) GetOrderByHash(orderhash common.Hash) (*dao.Order, error) {
+	if o, ok := r.orders[orderhash]; ok {
+		return o, nil
+	}
+	return nil, errors.New("order not found")
+}
+
+func (r *submitterRds) UpdateRingSubmitInfoStatus(ringhashs []common.Hash, status types.RingSubmitStatus, txHash string, errMsg string) error {
+	for _, h := range ringhashs {
+		r.status[h] = status
+	}
+	return nil
+}
+
+func (r *submitterRds) UpdateRingSubmitInfoFailed(ringhashs []common.Hash, err string) error {
+	return nil
+}
+
+// addRing saves a ring with orders of status, the txHash is sent by miner
+func (r *submitterRds) addRing(t *testing.T, hash int64, status types.RingSubmitStatus, createTime int64, miner common.Address, txHash common.Hash, orderStatus types.OrderStatus) common.Hash {
+	info := &types.RingSubmitInfo{}
+	info.Ringhash = common.BigToHash(big.NewInt(hash))
+	info.OrdersCount = big.NewInt(2)
+	info.Miner = miner
+	info.Status = status
+	info.CreateTime = createTime
+	info.SubmitTxHash = txHash
+	r.rings = append(r.rings, info)
+	r.status[info.Ringhash] = status
+
+	for i := int64(0); i < 2; i++ {
+		state := &types.OrderState{}
+		state.RawOrder.Hash = common.BigToHash(big.NewInt(hash*10 + i))
+		state.RawOrder.AmountS = big.NewInt(100)
+		state.RawOrder.AmountB = big.NewInt(100)
+		state.RawOrder.Price = big.NewRat(1, 1)
+		state.RawOrder.Timestamp = big.NewInt(time.Now().Unix())
+		state.RawOrder.Ttl = big.NewInt(3600)
+		state.RawOrder.Salt = big.NewInt(1)
+		state.RawOrder.LrcFee = big.NewInt(1)
+		state.DealtAmountS = big.NewInt(0)
+		state.DealtAmountB = big.NewInt(0)
+		state.SplitAmountS = big.NewInt(0)
+		state.SplitAmountB = big.NewInt(0)
+		state.CancelledAmountS = big.NewInt(0)
+		state.CancelledAmountB = big.NewInt(0)
+		state.UpdatedBlock = big.NewInt(1)
+		state.Status = orderStatus
+		model := &dao.Order{}
+		if err := model.ConvertDown(state); nil != err {
+			t.Fatal(err)
+		}
+		r.orders[state.RawOrder.Hash] = model
+		r.filledOrders[info.Ringhash] = append(r.filledOrders[info.Ringhash], dao.FilledOrder{RingHash: info.Ringhash.Hex(), OrderHash: state.RawOrder.Hash.Hex()})
+	}
+	return info.Ringhash
+}
+
+func TestRingSubmitterRecoverRings(t *testing.T) {
+	splitMiner := common.HexToAddress("0x0b")
+	trackedTx := common.HexToHash("0x01")
+	knownTx := common.HexToHash("0x02")
+	lostTx := common.HexToHash("0x03")
+	now := time.Now().Unix()
+
+	rds := &submitterRds{
+		filledOrders: make(map[common.Hash][]dao.FilledOrder),
+		orders:       make(map[common.Hash]*dao.Order),
+		status:       make(map[common.Hash]types.RingSubmitStatus),
+	}
+	cases := []struct {
+		name     string
+		ringhash common.Hash
+		expected types.RingSubmitStatus
+	}{
+		{"matched ring expired", rds.addRing(t, 1, types.RING_SUBMIT_MATCHED, now-1000, nonceTestMiner, common.Hash{}, types.ORDER_NEW), types.RING_SUBMIT_EXPIRED},
+		{"matched ring with cancelled orders", rds.addRing(t, 2, types.RING_SUBMIT_MATCHED, now, nonceTestMiner, common.Hash{}, types.ORDER_CANCEL), types.RING_SUBMIT_FAILED},
+		{"matched ring with finished orders", rds.addRing(t, 3, types.RING_SUBMIT_MATCHED, now, nonceTestMiner, common.Hash{}, types.ORDER_FINISHED), types.RING_SUBMIT_FAILED},
+		{"tx tracked by nonce manager", rds.addRing(t, 4, types.RING_SUBMIT_SENT, now, nonceTestMiner, trackedTx, types.ORDER_NEW), types.RING_SUBMIT_SENT},
+		{"tx known by nodes", rds.addRing(t, 5, types.RING_SUBMIT_SENT, now, nonceTestMiner, knownTx, types.ORDER_NEW), types.RING_SUBMIT_SENT},
+		{"tx lost", rds.addRing(t, 6, types.RING_SUBMIT_SENT, now, nonceTestMiner, lostTx, types.ORDER_NEW), types.RING_SUBMIT_EXPIRED},
+		{"replaced tx lost", rds.addRing(t, 7, types.RING_SUBMIT_REPLACED, now, nonceTestMiner, lostTx, types.ORDER_NEW), types.RING_SUBMIT_EXPIRED},
+		{"tx of split miner known by nodes", rds.addRing(t, 8, types.RING_SUBMIT_SENT, now, splitMiner, knownTx, types.ORDER_NEW), types.RING_SUBMIT_SENT},
+		{"tx of split miner lost", rds.addRing(t, 9, types.RING_SUBMIT_SENT, now, splitMiner, trackedTx, types.ORDER_NEW), types.RING_SUBMIT_EXPIRED},
+	}
+
+	submitter := &RingSubmitter{dbService: rds, ringExpireTime: 100}
+	submitter.nonceManager = NewNonceManager(rds, []*NormalMinerAddress{{Address: nonceTestMiner}})
+	submitter.nonceManager.miners[nonceTestMiner].pending[1] = &types.MinerTransaction{Miner: nonceTestMiner, Nonce: 1, TxHash: trackedTx}
+	submitter.getTransactionByHash = func(result types.CheckNull, txHash string, blockParameter string) error {
+		if txHash == knownTx.Hex() {
+			return nil
+		}
+		return errors.New("no transaction with hash:" + txHash)
+	}
+	submitter.recoverRings()
+
+	for _, c := range cases {
+		if status := rds.status[c.ringhash]; status != c.expected {
+			t.Errorf("%s: status should be %d, but got %d", c.name, c.expected, status)
+		}
+	}
+}
+
+func TestRingSubmitterHandleChainFork(t *testing.T) {
+	trackedTx := common.HexToHash("0x01")
+	lostTx := common.HexToHash("0x03")
+	now := time.Now().Unix()
+
+	rds := &submitterRds{
+		filledOrders: make(map[common.Hash][]dao.FilledOrder),
+		orders:       make(map[common.Hash]*dao.Order),
+		status:       make(map[common.Hash]types.RingSubmitStatus),
+	}
+	tracked := rds.addRing(t, 1, types.RING_SUBMIT_SENT, now, nonceTestMiner, trackedTx, types.ORDER_NEW)
+	lost := rds.addRing(t, 2, types.RING_SUBMIT_SENT, now, nonceTestMiner, lostTx, types.ORDER_NEW)
+
+	// the tx mined in forked blocks is pending again on the new chain
+	minerRds := &nonceRds{txs: make(map[uint64]*types.MinerTransaction)}
+	minerRds.SaveMinerTransaction(&types.MinerTransaction{Miner: nonceTestMiner, Nonce: 5, TxHash: trackedTx, Status: types.MINER_TX_MINED, SubmitBlock: big.NewInt(1)})
+
+	submitter := &RingSubmitter{dbService: rds, ringExpireTime: 100}
+	submitter.nonceManager = newTestNonceManager(minerRds, &nonceChain{latest: 5, pending: 5})
+	submitter.getTransactionByHash = func(result types.CheckNull, txHash string, blockParameter string) error {
+		return errors.New("no transaction with hash:" + txHash)
+	}
+	if err := submitter.handleChainFork(&types.ForkedEvent{ForkBlock: big.NewInt(10), DetectedBlock: big.NewInt(12)}); nil != err {
+		t.Fatal(err)
+	}
+
+	if !submitter.nonceManager.IsTracked(nonceTestMiner, trackedTx) || minerRds.txs[5].Status != types.MINER_TX_PENDING {
+		t.Fatalf("tx rolled back by fork should be tracked again")
+	}
+	if submitter.nonceManager.miners[nonceTestMiner].nonce != 6 {
+		t.Fatalf("next nonce should be 6, but got %d", submitter.nonceManager.miners[nonceTestMiner].nonce)
+	}
+	if rds.status[tracked] != types.RING_SUBMIT_SENT || rds.status[lost] != types.RING_SUBMIT_EXPIRED {
+		t.Fatalf("ring of tracked tx should be sent and ring of lost tx expired, but got %d and %d", rds.status[tracked], rds.status[lost])
+	}
+}
+
+func TestRingSubmitterSelectSplitMinerGasPrice(t *testing.T) {
+	splitMiner := &SplitMinerAddress{Address: common.HexToAddress("0x0b"), FeePercent: 10}
+	ethPrice := big.NewRat(1, 1000000000)
+	cases := []struct {
+		name      string
+		legalFee  *big.Rat
+		estimated *big.Int
+		limit     *big.Int
+		expected  *big.Int
+	}{
+		{"percent of fee", big.NewRat(20, 1), big.NewInt(5), nil, big.NewInt(10000)},
+		{"tiny fee uses estimated price", big.NewRat(1, 1000000), big.NewInt(5), nil, big.NewInt(5)},
+		{"estimated price capped by normal miner", big.NewRat(1, 1000000), big.NewInt(5), big.NewInt(3), big.NewInt(3)},
+		{"tiny fee without estimated price", big.NewRat(1, 1000000), nil, nil, nil},
+	}
+
+	for _, c := range cases {
+		submitter := &RingSubmitter{percentMinerAddresses: []*SplitMinerAddress{splitMiner}}
+		if nil != c.limit {
+			submitter.normalMinerAddresses = []*NormalMinerAddress{{Address: nonceTestMiner, GasPriceLimit: c.limit}}
+		}
+		info := &types.RingSubmitInfo{RawRing: &types.Ring{LegalFee: c.legalFee}, ProtocolGasPrice: c.estimated}
+		err := submitter.selectMiner(info, ethPrice, big.NewInt(200000))
+		if nil == c.expected {
+			if nil == err {
+				t.Errorf("%s: error should be returned if there is no gas price, but got %v", c.name, info.ProtocolGasPrice)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("%s: %s", c.name, err.Error())
+		} else if info.Miner != splitMiner.Address || info.ProtocolGasPrice.Cmp(c.expected) != 0 {
+			t.Errorf("%s: gas price of split miner should be %s, but got %v of miner %s", c.name, c.expected.String(), info.ProtocolGasPrice, info.Miner.Hex())
+		}
+	}
+}
+
+// ethCapFailed fails to get the price of eth
+type ethCapFailed struct {
+	marketcap.MarketCapProvider
+}
+
+func (p *ethCapFailed) GetEthCap() (*big.Rat, error) {
+	return nil, errors.New("eth cap isn't loaded")
+}
+
+func TestRingSubmitterComputeReceivedWithoutEthCap(t *testing.T) {
+	submitter := &RingSubmitter{marketCapProvider: &ethCapFailed{}}
+	if err := submitter.computeReceivedAndSelectMiner(&types.RingSubmitInfo{RawRing: &types.Ring{}}); nil == err {
+		t.Fatalf("error should be returned if eth cap isn't got")
+	}
+}
@@ -0,0 +1,492 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"math"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	marketLib "github.com/Loopring/relay/market"
+	marketUtilLib "github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/Loopring/relay/usermanager"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+收到新订单后立即与内存中的订单簿撮合，不需要等待TimingMatcher的定时轮次。
+成交、取消、cutoff、软取消和过期事件到达时更新订单簿，环路发出前再从ordermanager确认订单状态，
+订单簿每隔RefreshDuration个区块从ordermanager中重新加载；
+最近MaxCacheRoundsLength个区块内已撮合但未上链的环路，其成交量会在撮合前扣除
+*/
+
+const eventMatcherChanSize = 1000
+
+// the events that change the orders in books
+var orderChangedTopics = []string{
+	eventemitter.OrderManagerExtractorFill,
+	eventemitter.OrderManagerExtractorCancel,
+	eventemitter.OrderManagerExtractorCutoff,
+	eventemitter.OrderManagerSoftCancel,
+	eventemitter.OrderManagerExpire,
+}
+
+type bookKey struct {
+	protocol common.Address
+	tokenS   common.Address
+	tokenB   common.Address
+}
+
+type EventMatcher struct {
+	rounds         *RoundStates
+	books          map[bookKey]map[common.Hash]*types.OrderState
+	submitter      *miner.RingSubmitter
+	evaluator      *miner.Evaluator
+	om             ordermanager.OrderManager
+	um             usermanager.UserManager
+	accountManager *marketLib.AccountManager
+
+	bookOrdersCount  int
+	refreshDuration  int64
+	lastBlockNumber  *big.Int
+	lastRefreshBlock *big.Int
+
+	newOrderChan chan *types.OrderState
+	newBlockChan chan *types.BlockEvent
+	forkChan     chan *types.ForkedEvent
+	removeChan   chan common.Hash
+	changedChan  chan eventemitter.EventData
+	stopChan     chan bool
+	stopFuncs    []func()
+}
+
+func NewEventMatcher(matcherOptions *config.EventMatcher, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, um usermanager.UserManager, accountManager *marketLib.AccountManager) *EventMatcher {
+	matcher := &EventMatcher{}
+	matcher.submitter = submitter
+	matcher.evaluator = evaluator
+	matcher.om = om
+	matcher.um = um
+	matcher.accountManager = accountManager
+	matcher.bookOrdersCount = matcherOptions.BookOrdersCount
+	matcher.refreshDuration = matcherOptions.RefreshDuration
+	matcher.rounds = NewRoundStates(matcherOptions.MaxCacheRoundsLength)
+	matcher.rounds.appendNewRoundState(big.NewInt(0))
+	matcher.books = make(map[bookKey]map[common.Hash]*types.OrderState)
+	matcher.lastBlockNumber = big.NewInt(0)
+	matcher.lastRefreshBlock = big.NewInt(0)
+	return matcher
+}
+
+func (matcher *EventMatcher) Start() {
+	matcher.newOrderChan = make(chan *types.OrderState, eventMatcherChanSize)
+	matcher.newBlockChan = make(chan *types.BlockEvent, eventMatcherChanSize)
+	matcher.forkChan = make(chan *types.ForkedEvent)
+	matcher.removeChan = make(chan common.Hash, eventMatcherChanSize)
+	matcher.changedChan = make(chan eventemitter.EventData, eventMatcherChanSize)
+	matcher.stopChan = make(chan bool)
+	matcher.stopFuncs = []func(){}
+
+	matcher.refreshBooks()
+
+	// 所有事件都在同一个goroutine中处理，books和rounds不需要加锁
+	go func(newOrderChan chan *types.OrderState, newBlockChan chan *types.BlockEvent, forkChan chan *types.ForkedEvent, removeChan chan common.Hash, changedChan chan eventemitter.EventData, stopChan chan bool) {
+		for {
+			select {
+			case <-stopChan:
+				return
+			case blockEvent := <-newBlockChan:
+				matcher.handleNewBlock(blockEvent)
+			case forkEvent := <-forkChan:
+				matcher.handleFork(forkEvent)
+			case ringhash := <-removeChan:
+				log.Debugf("event matcher,received mined event, ring will be removed from rounds, ringhash:%s", ringhash.Hex())
+				matcher.rounds.removeMinedRing(ringhash)
+			case eventData := <-changedChan:
+				matcher.handleOrderChanged(eventData)
+			case state := <-newOrderChan:
+				matcher.handleNewOrder(state)
+			}
+		}
+	}(matcher.newOrderChan, matcher.newBlockChan, matcher.forkChan, matcher.removeChan, matcher.changedChan, matcher.stopChan)
+
+	newOrderWatcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			matcher.newOrderChan <- eventData.(*types.OrderState)
+			return nil
+		},
+	}
+	newBlockWatcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			matcher.newBlockChan <- eventData.(*types.BlockEvent)
+			return nil
+		},
+	}
+	forkWatcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			select {
+			case matcher.forkChan <- eventData.(*types.ForkedEvent):
+			case <-matcher.stopChan:
+			}
+			return nil
+		},
+	}
+	minedWatcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			matcher.removeChan <- eventData.(*types.RingMinedEvent).Ringhash
+			return nil
+		},
+	}
+	orderChangedWatcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			matcher.changedChan <- eventData
+			return nil
+		},
+	}
+	submitFailedWatcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			matcher.removeChan <- eventData.(*types.RingSubmitFailedEvent).RingHash
+			return nil
+		},
+	}
+
+	eventemitter.On(eventemitter.OrderManagerGatewayNewOrder, newOrderWatcher)
+	eventemitter.On(eventemitter.Block_New, newBlockWatcher)
+	eventemitter.On(eventemitter.ChainForkComplete, forkWatcher)
+	eventemitter.On(eventemitter.OrderManagerExtractorRingMined, minedWatcher)
+	eventemitter.On(eventemitter.Miner_RingSubmitFailed, submitFailedWatcher)
+	for _, topic := range orderChangedTopics {
+		eventemitter.On(topic, orderChangedWatcher)
+	}
+	matcher.stopFuncs = append(matcher.stopFuncs, func() {
+		eventemitter.Un(eventemitter.OrderManagerGatewayNewOrder, newOrderWatcher)
+		eventemitter.Un(eventemitter.Block_New, newBlockWatcher)
+		eventemitter.Un(eventemitter.ChainForkComplete, forkWatcher)
+		eventemitter.Un(eventemitter.OrderManagerExtractorRingMined, minedWatcher)
+		eventemitter.Un(eventemitter.Miner_RingSubmitFailed, submitFailedWatcher)
+		for _, topic := range orderChangedTopics {
+			eventemitter.Un(topic, orderChangedWatcher)
+		}
+		close(matcher.stopChan)
+	})
+}
+
+func (matcher *EventMatcher) Stop() {
+	for _, stop := range matcher.stopFuncs {
+		stop()
+	}
+	matcher.stopFuncs = []func(){}
+}
+
+func (matcher *EventMatcher) GetAccountAvailableAmount(address common.Address, tokenAddress common.Address) (*big.Rat, error) {
+	return accountAvailableAmount(matcher.accountManager, matcher.rounds, address, tokenAddress)
+}
+
+// every block is a round of RoundStates, so rings matched in the last MaxCacheRoundsLength blocks are in-flight
+func (matcher *EventMatcher) handleNewBlock(blockEvent *types.BlockEvent) {
+	if nil == blockEvent || matcher.lastBlockNumber.Cmp(blockEvent.BlockNumber) >= 0 {
+		return
+	}
+	matcher.lastBlockNumber = new(big.Int).Set(blockEvent.BlockNumber)
+	matcher.rounds.appendNewRoundState(matcher.lastBlockNumber)
+
+	nextRefreshBlock := new(big.Int).Add(matcher.lastRefreshBlock, big.NewInt(matcher.refreshDuration))
+	if nextRefreshBlock.Cmp(matcher.lastBlockNumber) <= 0 {
+		matcher.refreshBooks()
+	}
+}
+
+// handleFork reverts rounds to the fork block, and reloads books from ordermanager which has rolled back the orders
+func (matcher *EventMatcher) handleFork(forkEvent *types.ForkedEvent) {
+	if nil == forkEvent || matcher.lastBlockNumber.Cmp(forkEvent.ForkBlock) <= 0 {
+		return
+	}
+	log.Infof("event matcher,revert rounds to fork block:%s", forkEvent.ForkBlock.String())
+	matcher.lastBlockNumber = new(big.Int).Set(forkEvent.ForkBlock)
+	matcher.rounds.revert(forkEvent.ForkBlock)
+	matcher.refreshBooks()
+}
+
+// refreshBooks reloads the orders of all token pairs from ordermanager
+func (matcher *EventMatcher) refreshBooks() {
+	books := make(map[bookKey]map[common.Hash]*types.OrderState)
+	for _, pair := range marketUtilLib.AllTokenPairs {
+		for _, protocolAddress := range ethaccessor.ProtocolAddresses() {
+			// both sides of the market are loaded
+			keys := []bookKey{
+				{protocol: protocolAddress.ContractAddress, tokenS: pair.TokenS, tokenB: pair.TokenB},
+				{protocol: protocolAddress.ContractAddress, tokenS: pair.TokenB, tokenB: pair.TokenS},
+			}
+			for _, key := range keys {
+				if _, exists := books[key]; exists {
+					continue
+				}
+				books[key] = make(map[common.Hash]*types.OrderState)
+				for _, order := range matcher.om.MinerOrders(key.protocol, key.tokenS, key.tokenB, matcher.bookOrdersCount, int64(0), math.MaxInt64) {
+					books[key][order.RawOrder.Hash] = order
+				}
+			}
+		}
+	}
+	matcher.books = books
+	matcher.lastRefreshBlock = new(big.Int).Set(matcher.lastBlockNumber)
+	log.Debugf("event matcher,books refreshed at block:%s", matcher.lastBlockNumber.String())
+}
+
+func (matcher *EventMatcher) handleNewOrder(state *types.OrderState) {
+	if nil == state {
+		return
+	}
+	order := copyOrderState(state)
+	key := bookKey{protocol: order.RawOrder.Protocol, tokenS: order.RawOrder.TokenS, tokenB: order.RawOrder.TokenB}
+	book, exists := matcher.books[key]
+	if !exists {
+		log.Debugf("event matcher,order:%s isn't in the markets of miner", order.RawOrder.Hash.Hex())
+		return
+	}
+	if _, exists := book[order.RawOrder.Hash]; exists {
+		return
+	}
+	if nil != matcher.um && !matcher.um.InWhiteList(order.RawOrder.Owner) {
+		log.Debugf("event matcher,owner:%s not in white list", order.RawOrder.Owner.Hex())
+		return
+	}
+	book[order.RawOrder.Hash] = order
+
+	if ringSubmitInfos := matcher.validRings(matcher.match(order)); len(ringSubmitInfos) > 0 {
+		matcher.submitter.RecordDryRun(miner.DryRunChosen, matcher.lastBlockNumber, ringSubmitInfos...)
+		eventemitter.Emit(eventemitter.Miner_NewRing, ringSubmitInfos)
+	}
+}
+
+// handleOrderChanged applies the fill, cancel, cutoff, soft cancel and expire events to the books in the same way
+// as ordermanager, the orders finished or closed are removed
+func (matcher *EventMatcher) handleOrderChanged(eventData eventemitter.EventData) {
+	switch event := eventData.(type) {
+	case *types.OrderFilledEvent:
+		if order := matcher.bookOrder(event.OrderHash); nil != order {
+			order.DealtAmountS.Add(order.DealtAmountS, event.AmountS)
+			order.DealtAmountB.Add(order.DealtAmountB, event.AmountB)
+			order.SplitAmountS.Add(order.SplitAmountS, event.SplitS)
+			order.SplitAmountB.Add(order.SplitAmountB, event.SplitB)
+			if matcher.om.IsOrderFullFinished(order) {
+				matcher.removeOrder(event.OrderHash)
+			}
+		}
+	case *types.OrderCancelledEvent:
+		if order := matcher.bookOrder(event.OrderHash); nil != order {
+			if order.RawOrder.BuyNoMoreThanAmountB {
+				order.CancelledAmountB.Add(order.CancelledAmountB, event.AmountCancelled)
+			} else {
+				order.CancelledAmountS.Add(order.CancelledAmountS, event.AmountCancelled)
+			}
+			if matcher.om.IsOrderFullFinished(order) {
+				matcher.removeOrder(event.OrderHash)
+			}
+		}
+	case *types.CutoffEvent:
+		for key, book := range matcher.books {
+			if key.protocol != event.ContractAddress {
+				continue
+			}
+			for hash, order := range book {
+				if order.RawOrder.Owner == event.Owner && order.RawOrder.Timestamp.Cmp(event.Cutoff) < 0 {
+					delete(book, hash)
+				}
+			}
+		}
+	case *types.OrderState:
+		matcher.removeOrder(event.RawOrder.Hash)
+	}
+}
+
+func (matcher *EventMatcher) bookOrder(hash common.Hash) *types.OrderState {
+	for _, book := range matcher.books {
+		if order, exists := book[hash]; exists {
+			return order
+		}
+	}
+	return nil
+}
+
+func (matcher *EventMatcher) removeOrder(hash common.Hash) {
+	for _, book := range matcher.books {
+		delete(book, hash)
+	}
+}
+
+// validRings checks the orders of rings with ordermanager again before they are emitted, because the events
+// of orders may have not been handled by matcher. the order not saved yet is the new order from gateway
+func (matcher *EventMatcher) validRings(ringSubmitInfos []*types.RingSubmitInfo) []*types.RingSubmitInfo {
+	valids := []*types.RingSubmitInfo{}
+	for _, ringSubmitInfo := range ringSubmitInfos {
+		valid := true
+		for _, filledOrder := range ringSubmitInfo.RawRing.Orders {
+			rawOrder := filledOrder.OrderState.RawOrder
+			state, err := matcher.om.GetOrderByHash(rawOrder.Hash)
+			if (nil == err && state.Status != types.ORDER_NEW && state.Status != types.ORDER_PARTIAL) ||
+				matcher.om.IsOrderCutoff(rawOrder.Protocol, rawOrder.Owner, rawOrder.Timestamp) {
+				log.Debugf("event matcher,order:%s of ring:%s has been closed", rawOrder.Hash.Hex(), ringSubmitInfo.Ringhash.Hex())
+				matcher.removeOrder(rawOrder.Hash)
+				valid = false
+			}
+		}
+		if valid {
+			valids = append(valids, ringSubmitInfo)
+		} else {
+			matcher.rounds.removeMinedRing(ringSubmitInfo.RawRing.Hash)
+		}
+	}
+	return valids
+}
+
+// match finds the rings of the new order and the orders on the other side of the book
+func (matcher *EventMatcher) match(order *types.OrderState) []*types.RingSubmitInfo {
+	ringSubmitInfos := []*types.RingSubmitInfo{}
+	protocolAddress, exists := ethaccessor.ProtocolAddresses()[order.RawOrder.Protocol]
+	if !exists {
+		return ringSubmitInfos
+	}
+	lrcAddress := protocolAddress.LrcTokenAddress
+
+	// 撮合使用订单的副本，扣除尚未上链的环路中的成交量
+	now := time.Now().Unix()
+	orders := make(map[common.Hash]*types.OrderState)
+	newOrder := matcher.orderForMatching(order, now)
+	if nil == newOrder {
+		return ringSubmitInfos
+	}
+	orders[order.RawOrder.Hash] = newOrder
+
+	//step 1: evaluate received
+	candidateRingList := CandidateRingList{}
+	otherSide := matcher.books[bookKey{protocol: order.RawOrder.Protocol, tokenS: order.RawOrder.TokenB, tokenB: order.RawOrder.TokenS}]
+	for hash, bookOrder := range otherSide {
+		other := matcher.orderForMatching(bookOrder, now)
+		if nil == other {
+			if !isOrderValidAt(bookOrder, now) {
+				delete(otherSide, hash)
+			}
+			continue
+		}
+		if !miner.PriceValid(newOrder, other) {
+			continue
+		}
+		ringForSubmit, err := generateRingSubmitInfo(matcher, matcher.om, matcher.evaluator, matcher.submitter, lrcAddress, newOrder, other)
+		if nil != err {
+			log.Debugf("event matcher,generate RingSubmitInfo err:%s", err.Error())
+			continue
+		}
+		orders[hash] = other
+		candidateRing := CandidateRing{cost: ringForSubmit.LegalCost, received: ringForSubmit.Received, filledOrders: make(map[common.Hash]*big.Rat)}
+		for _, filledOrder := range ringForSubmit.RawRing.Orders {
+			hash := filledOrder.OrderState.RawOrder.Hash
+			candidateRing.filledOrders[hash] = filledOrder.FillAmountS
+			candidateRing.orderHashes = append(candidateRing.orderHashes, hash)
+		}
+		candidateRingList = append(candidateRingList, candidateRing)
+		matcher.submitter.RecordDryRun(miner.DryRunCandidate, matcher.lastBlockNumber, ringForSubmit)
+	}
+	log.Debugf("event matcher,order:%s, candidateRingList.length:%d", order.RawOrder.Hash.Hex(), len(candidateRingList))
+
+	//step 2: the ring that can get max received, same as market.match
+	list := candidateRingList
+	for len(list) > 0 {
+		sort.Sort(list)
+		candidateRing := list[0]
+		list = list[1:]
+
+		ringOrders := []*types.OrderState{}
+		for _, hash := range candidateRing.orderHashes {
+			ringOrders = append(ringOrders, orders[hash])
+		}
+		ringForSubmit, err := generateRingSubmitInfo(matcher, matcher.om, matcher.evaluator, matcher.submitter, lrcAddress, ringOrders...)
+		if nil != err {
+			log.Debugf("event matcher,generate RingSubmitInfo err:%s", err.Error())
+			continue
+		}
+		for _, filledOrder := range ringForSubmit.RawRing.Orders {
+			orderState := orders[filledOrder.OrderState.RawOrder.Hash]
+			orderState.DealtAmountB.Add(orderState.DealtAmountB, ratToInt(filledOrder.FillAmountB))
+			orderState.DealtAmountS.Add(orderState.DealtAmountS, ratToInt(filledOrder.FillAmountS))
+			isFullFilled := matcher.om.IsOrderFullFinished(orderState)
+			matcher.rounds.appendFilledOrderToCurrent(filledOrder, ringForSubmit.RawRing.Hash)
+
+			list = reduceReceivedOfCandidateRing(list, filledOrder, isFullFilled)
+		}
+		ringSubmitInfos = append(ringSubmitInfos, ringForSubmit)
+	}
+
+	return ringSubmitInfos
+}
+
+// orderForMatching returns the copy of order whose amounts of in-flight rings are reduced,
+// nil if the order is invalid now or has been full filled
+func (matcher *EventMatcher) orderForMatching(order *types.OrderState, now int64) *types.OrderState {
+	if !isOrderValidAt(order, now) {
+		return nil
+	}
+	state := copyOrderState(order)
+	amountS, amountB := matcher.rounds.dealtAmount(state.RawOrder.Hash)
+	state.DealtAmountS.Add(state.DealtAmountS, ratToInt(amountS))
+	state.DealtAmountB.Add(state.DealtAmountB, ratToInt(amountB))
+	if matcher.om.IsOrderFullFinished(state) {
+		return nil
+	}
+	return state
+}
+
+func isOrderValidAt(order *types.OrderState, now int64) bool {
+	if nil == order.RawOrder.Timestamp || nil == order.RawOrder.Ttl {
+		return true
+	}
+	validTime := order.RawOrder.Timestamp.Int64()
+	return validTime <= now && validTime+order.RawOrder.Ttl.Int64() > now
+}
+
+func copyOrderState(state *types.OrderState) *types.OrderState {
+	orderState := *state
+	orderState.DealtAmountS = copyIntOrZero(state.DealtAmountS)
+	orderState.DealtAmountB = copyIntOrZero(state.DealtAmountB)
+	orderState.SplitAmountS = copyIntOrZero(state.SplitAmountS)
+	orderState.SplitAmountB = copyIntOrZero(state.SplitAmountB)
+	orderState.CancelledAmountS = copyIntOrZero(state.CancelledAmountS)
+	orderState.CancelledAmountB = copyIntOrZero(state.CancelledAmountB)
+	return &orderState
+}
+
+func copyIntOrZero(i *big.Int) *big.Int {
+	if nil == i {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(i)
+}
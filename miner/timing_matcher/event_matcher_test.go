@@ -0,0 +1,203 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+var (
+	matcherProtocol = common.HexToAddress("0x01")
+	matcherTokenA   = common.HexToAddress("0x02")
+	matcherTokenB   = common.HexToAddress("0x03")
+	matcherOwnerA   = common.HexToAddress("0x0a")
+	matcherOwnerB   = common.HexToAddress("0x0b")
+)
+
+// matcherOm keeps the saved orders in memory, other methods of OrderManager aren't used
+type matcherOm struct {
+	ordermanager.OrderManager
+	orders  map[common.Hash]*types.OrderState
+	cutoffs map[common.Address]int64
+}
+
+func (om *matcherOm) GetOrderByHash(hash common.Hash) (*types.OrderState, error) {
+	if state, ok := om.orders[hash]; ok {
+		return state, nil
+	}
+	return nil, errors.New("order not found")
+}
+
+func (om *matcherOm) IsOrderCutoff(protocol, owner common.Address, createTime *big.Int) bool {
+	cutoff, ok := om.cutoffs[owner]
+	return ok && createTime.Int64() < cutoff
+}
+
+func (om *matcherOm) IsOrderFullFinished(state *types.OrderState) bool {
+	remained := new(big.Int).Sub(state.RawOrder.AmountS, state.DealtAmountS)
+	remained.Sub(remained, state.CancelledAmountS)
+	return remained.Sign() <= 0
+}
+
+func matcherOrder(hash int64, owner common.Address, tokenS, tokenB common.Address, timestamp int64) *types.OrderState {
+	state := &types.OrderState{}
+	state.RawOrder.Hash = common.BigToHash(big.NewInt(hash))
+	state.RawOrder.Protocol = matcherProtocol
+	state.RawOrder.Owner = owner
+	state.RawOrder.TokenS = tokenS
+	state.RawOrder.TokenB = tokenB
+	state.RawOrder.AmountS = big.NewInt(100)
+	state.RawOrder.AmountB = big.NewInt(100)
+	state.RawOrder.Timestamp = big.NewInt(timestamp)
+	state.RawOrder.Ttl = big.NewInt(10000)
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.SplitAmountS = big.NewInt(0)
+	state.SplitAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	state.Status = types.ORDER_NEW
+	return state
+}
+
+// newTestEventMatcher returns a matcher whose books have order 1,2 of ownerA selling tokenA and order 3 of ownerB selling tokenB
+func newTestEventMatcher() (*EventMatcher, *matcherOm) {
+	om := &matcherOm{orders: make(map[common.Hash]*types.OrderState), cutoffs: make(map[common.Address]int64)}
+	matcher := &EventMatcher{om: om, rounds: NewRoundStates(10)}
+	matcher.rounds.appendNewRoundState(big.NewInt(1))
+	matcher.books = map[bookKey]map[common.Hash]*types.OrderState{
+		{protocol: matcherProtocol, tokenS: matcherTokenA, tokenB: matcherTokenB}: {},
+		{protocol: matcherProtocol, tokenS: matcherTokenB, tokenB: matcherTokenA}: {},
+	}
+	for _, order := range []*types.OrderState{
+		matcherOrder(1, matcherOwnerA, matcherTokenA, matcherTokenB, 100),
+		matcherOrder(2, matcherOwnerA, matcherTokenA, matcherTokenB, 200),
+		matcherOrder(3, matcherOwnerB, matcherTokenB, matcherTokenA, 100),
+	} {
+		matcher.books[bookKey{protocol: matcherProtocol, tokenS: order.RawOrder.TokenS, tokenB: order.RawOrder.TokenB}][order.RawOrder.Hash] = order
+		om.orders[order.RawOrder.Hash] = copyOrderState(order)
+	}
+	return matcher, om
+}
+
+func bookOrderHashes(matcher *EventMatcher) []int64 {
+	hashes := []int64{}
+	for _, book := range matcher.books {
+		for hash := range book {
+			hashes = append(hashes, hash.Big().Int64())
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return hashes
+}
+
+func TestEventMatcherOrderChanged(t *testing.T) {
+	hash := func(h int64) common.Hash { return common.BigToHash(big.NewInt(h)) }
+	cases := []struct {
+		name   string
+		events []eventemitter.EventData
+		orders []int64
+	}{
+		{"partial fill", []eventemitter.EventData{&types.OrderFilledEvent{OrderHash: hash(1), AmountS: big.NewInt(50), AmountB: big.NewInt(50), SplitS: big.NewInt(0), SplitB: big.NewInt(0)}}, []int64{1, 2, 3}},
+		{"full fill", []eventemitter.EventData{
+			&types.OrderFilledEvent{OrderHash: hash(1), AmountS: big.NewInt(50), AmountB: big.NewInt(50), SplitS: big.NewInt(0), SplitB: big.NewInt(0)},
+			&types.OrderFilledEvent{OrderHash: hash(1), AmountS: big.NewInt(50), AmountB: big.NewInt(50), SplitS: big.NewInt(0), SplitB: big.NewInt(0)},
+		}, []int64{2, 3}},
+		{"partial cancel", []eventemitter.EventData{&types.OrderCancelledEvent{OrderHash: hash(3), AmountCancelled: big.NewInt(10)}}, []int64{1, 2, 3}},
+		{"fill and cancel", []eventemitter.EventData{
+			&types.OrderFilledEvent{OrderHash: hash(3), AmountS: big.NewInt(50), AmountB: big.NewInt(50), SplitS: big.NewInt(0), SplitB: big.NewInt(0)},
+			&types.OrderCancelledEvent{OrderHash: hash(3), AmountCancelled: big.NewInt(50)},
+		}, []int64{1, 2}},
+		{"cutoff orders before", []eventemitter.EventData{&types.CutoffEvent{ContractAddress: matcherProtocol, Owner: matcherOwnerA, Cutoff: big.NewInt(150)}}, []int64{2, 3}},
+		{"cutoff all orders of owner", []eventemitter.EventData{&types.CutoffEvent{ContractAddress: matcherProtocol, Owner: matcherOwnerA, Cutoff: big.NewInt(300)}}, []int64{3}},
+		{"cutoff of other protocol", []eventemitter.EventData{&types.CutoffEvent{ContractAddress: common.HexToAddress("0x09"), Owner: matcherOwnerA, Cutoff: big.NewInt(300)}}, []int64{1, 2, 3}},
+		{"soft cancelled", []eventemitter.EventData{matcherOrder(2, matcherOwnerA, matcherTokenA, matcherTokenB, 200)}, []int64{1, 3}},
+		{"order not in books", []eventemitter.EventData{&types.OrderFilledEvent{OrderHash: hash(9), AmountS: big.NewInt(100), AmountB: big.NewInt(100), SplitS: big.NewInt(0), SplitB: big.NewInt(0)}}, []int64{1, 2, 3}},
+	}
+
+	for _, c := range cases {
+		matcher, _ := newTestEventMatcher()
+		for _, event := range c.events {
+			matcher.handleOrderChanged(event)
+		}
+		if orders := bookOrderHashes(matcher); !reflect.DeepEqual(orders, c.orders) {
+			t.Errorf("%s: orders in books should be %v, but got %v", c.name, c.orders, orders)
+		}
+	}
+}
+
+func TestEventMatcherValidRings(t *testing.T) {
+	ring := func(hash int64, orders ...*types.OrderState) *types.RingSubmitInfo {
+		r := &types.Ring{Hash: common.BigToHash(big.NewInt(hash))}
+		for _, order := range orders {
+			r.Orders = append(r.Orders, &types.FilledOrder{OrderState: *order, FillAmountS: big.NewRat(10, 1), FillAmountB: big.NewRat(10, 1)})
+		}
+		return &types.RingSubmitInfo{Ringhash: r.Hash, RawRing: r}
+	}
+	newOrder := matcherOrder(4, matcherOwnerB, matcherTokenB, matcherTokenA, 100)
+
+	cases := []struct {
+		name   string
+		closed func(om *matcherOm)
+		rings  int
+		orders []int64
+	}{
+		{"new order not saved yet", func(om *matcherOm) {}, 1, []int64{1, 2, 3}},
+		{"order cancelled", func(om *matcherOm) { om.orders[common.BigToHash(big.NewInt(1))].Status = types.ORDER_CANCEL }, 0, []int64{2, 3}},
+		{"order finished", func(om *matcherOm) { om.orders[common.BigToHash(big.NewInt(1))].Status = types.ORDER_FINISHED }, 0, []int64{2, 3}},
+		{"owner cutoff", func(om *matcherOm) { om.cutoffs[matcherOwnerA] = 150 }, 0, []int64{2, 3}},
+	}
+
+	for _, c := range cases {
+		matcher, om := newTestEventMatcher()
+		c.closed(om)
+		info := ring(10, matcher.bookOrder(common.BigToHash(big.NewInt(1))), newOrder)
+		for _, filledOrder := range info.RawRing.Orders {
+			matcher.rounds.appendFilledOrderToCurrent(filledOrder, info.RawRing.Hash)
+		}
+
+		if rings := matcher.validRings([]*types.RingSubmitInfo{info}); len(rings) != c.rings {
+			t.Errorf("%s: %d rings should be valid, but got %d", c.name, c.rings, len(rings))
+		}
+		if orders := bookOrderHashes(matcher); !reflect.DeepEqual(orders, c.orders) {
+			t.Errorf("%s: orders in books should be %v, but got %v", c.name, c.orders, orders)
+		}
+		// the amounts of invalid ring aren't in-flight any more
+		amountS, _ := matcher.rounds.dealtAmount(common.BigToHash(big.NewInt(1)))
+		if expected := int64(10 * c.rings); amountS.Cmp(big.NewRat(expected, 1)) != 0 {
+			t.Errorf("%s: in-flight amountS should be %d, but got %s", c.name, expected, amountS.FloatString(0))
+		}
+	}
+}
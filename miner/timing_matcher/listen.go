@@ -29,10 +29,18 @@ import (
 
 func (matcher *TimingMatcher) listenNewBlock() {
 	newBlockChan := make(chan *types.BlockEvent)
+	forkChan := make(chan *types.ForkedEvent)
 
 	go func() {
 		for {
 			select {
+			case forkEvent := <-forkChan:
+				// the blocks after fork block will be extracted again, next round starts by them
+				if nil != forkEvent && matcher.lastBlockNumber.Cmp(forkEvent.ForkBlock) > 0 {
+					log.Infof("miner,revert rounds to fork block:%s", forkEvent.ForkBlock.String())
+					matcher.lastBlockNumber = new(big.Int).Set(forkEvent.ForkBlock)
+					matcher.rounds.revert(forkEvent.ForkBlock)
+				}
 			case blockEvent := <-newBlockChan:
 				if nil != blockEvent {
 					nextBlockNumber := new(big.Int).Add(matcher.duration, matcher.lastBlockNumber)
@@ -52,6 +60,7 @@ func (matcher *TimingMatcher) listenNewBlock() {
 							}(market)
 						}
 						wg.Wait()
+						matcher.matchMultiHop()
 					}
 				}
 			}
@@ -66,10 +75,20 @@ func (matcher *TimingMatcher) listenNewBlock() {
 			return nil
 		},
 	}
+	forkWatcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			forkChan <- eventData.(*types.ForkedEvent)
+			return nil
+		},
+	}
 	eventemitter.On(eventemitter.Block_New, watcher)
+	eventemitter.On(eventemitter.ChainForkComplete, forkWatcher)
 	matcher.stopFuncs = append(matcher.stopFuncs, func() {
 		close(newBlockChan)
+		close(forkChan)
 		eventemitter.Un(eventemitter.Block_New, watcher)
+		eventemitter.Un(eventemitter.ChainForkComplete, forkWatcher)
 	})
 
 }
@@ -19,7 +19,6 @@
 package timing_matcher
 
 import (
-	"fmt"
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/miner"
@@ -27,7 +26,6 @@ import (
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
-	"sort"
 )
 
 type Market struct {
@@ -50,6 +48,7 @@ func (market *Market) match() {
 	matchedOrderHashes := make(map[common.Hash]bool) //true:fullfilled, false:partfilled
 	ringSubmitInfos := []*types.RingSubmitInfo{}
 	candidateRingList := CandidateRingList{}
+	capacities := make(map[common.Hash]*big.Rat)
 
 	//step 1: evaluate received
 	for _, a2BOrder := range market.AtoBOrders {
@@ -66,8 +65,10 @@ func (market *Market) match() {
 					for _, filledOrder := range ringForSubmit.RawRing.Orders {
 						log.Debugf("match, filledOrder.FilledAmountS:%s", filledOrder.FillAmountS.FloatString(3))
 						candidateRing.filledOrders[filledOrder.OrderState.RawOrder.Hash] = filledOrder.FillAmountS
+						addCapacity(capacities, filledOrder)
 					}
 					candidateRingList = append(candidateRingList, candidateRing)
+					market.matcher.submitter.RecordDryRun(miner.DryRunCandidate, market.matcher.lastBlockNumber, ringForSubmit)
 					//} else {
 					//	log.Debugf("timing_matchher, market ringForSubmit received not enough, received:%s, gas:%s, gasPrice:%s ", ringForSubmit.Received.FloatString(0), ringForSubmit.ProtocolGas.String(), ringForSubmit.ProtocolGasPrice.String())
 					//}
@@ -79,14 +80,14 @@ func (market *Market) match() {
 	log.Debugf("match round:%s, market: %s -> %s , candidateRingList.length:%d", market.matcher.lastBlockNumber, market.TokenA.Hex(), market.TokenB.Hex(), len(candidateRingList))
 	//the ring that can get max received
 	list := candidateRingList
+	market.matcher.selectCandidateRings(list, capacities)
 	for {
 		if len(list) <= 0 {
 			break
 		}
 
-		sort.Sort(list)
-		candidateRing := list[0]
-		list = list[1:]
+		var candidateRing CandidateRing
+		candidateRing, list = popCandidateRing(list)
 		orders := []*types.OrderState{}
 		for hash, _ := range candidateRing.filledOrders {
 			if o, exists := market.AtoBOrders[hash]; exists {
@@ -107,7 +108,7 @@ func (market *Market) match() {
 				matchedOrderHashes[filledOrder.OrderState.RawOrder.Hash] = isFullFilled
 				market.matcher.rounds.appendFilledOrderToCurrent(filledOrder, ringForSubmit.RawRing.Hash)
 
-				list = market.reduceReceivedOfCandidateRing(list, filledOrder, isFullFilled)
+				list = reduceReceivedOfCandidateRing(list, filledOrder, isFullFilled)
 			}
 			ringSubmitInfos = append(ringSubmitInfos, ringForSubmit)
 			//} else {
@@ -128,11 +129,12 @@ func (market *Market) match() {
 		}
 	}
 	if len(ringSubmitInfos) > 0 {
+		market.matcher.submitter.RecordDryRun(miner.DryRunChosen, market.matcher.lastBlockNumber, ringSubmitInfos...)
 		eventemitter.Emit(eventemitter.Miner_NewRing, ringSubmitInfos)
 	}
 }
 
-func (market *Market) reduceReceivedOfCandidateRing(list CandidateRingList, filledOrder *types.FilledOrder, isFullFilled bool) CandidateRingList {
+func reduceReceivedOfCandidateRing(list CandidateRingList, filledOrder *types.FilledOrder, isFullFilled bool) CandidateRingList {
 	resList := CandidateRingList{}
 	hash := filledOrder.OrderState.RawOrder.Hash
 	for _, ring := range list {
@@ -154,6 +156,7 @@ func (market *Market) reduceReceivedOfCandidateRing(list CandidateRingList, fill
 				rate.Quo(remainedAmountS, amountS)
 				remainedReceived := new(big.Rat).Add(ring.received, ring.cost)
 				remainedReceived.Mul(remainedReceived, rate).Sub(remainedReceived, ring.cost)
+				ring.received = remainedReceived
 				//todo:for test, release this limit
 				//if remainedReceived.Sign() <= 0 {
 				//	continue
@@ -253,33 +256,7 @@ func (market *Market) reduceAmountAfterFilled(filledOrder *types.FilledOrder) *t
 }
 
 func (market *Market) generateRingSubmitInfo(orders ...*types.OrderState) (*types.RingSubmitInfo, error) {
-	filledOrders := []*types.FilledOrder{}
-	//miner will received nothing, if miner set FeeSelection=1 and he doesn't have enough lrc
-	for _, order := range orders {
-		lrcTokenBalance, err := market.matcher.GetAccountAvailableAmount(order.RawOrder.Owner, market.lrcAddress)
-		if nil != err {
-			return nil, err
-		}
-		tokenSBalance, err := market.matcher.GetAccountAvailableAmount(order.RawOrder.Owner, order.RawOrder.TokenS)
-		if nil != err {
-			return nil, err
-		}
-		if tokenSBalance.Sign() <= 0 {
-			return nil, fmt.Errorf("owner:%s token:%s balance or allowance is zero", order.RawOrder.Owner.Hex(), order.RawOrder.TokenS.Hex())
-		}
-		//todo:
-		if market.om.IsValueDusted(order.RawOrder.TokenS, tokenSBalance) {
-			return nil, fmt.Errorf("owner:%s token:%s balance or allowance is not enough", order.RawOrder.Owner.Hex(), order.RawOrder.TokenS.Hex())
-		}
-		filledOrders = append(filledOrders, types.ConvertOrderStateToFilledOrder(*order, lrcTokenBalance, tokenSBalance))
-	}
-
-	ringTmp := miner.NewRing(filledOrders)
-	if err := market.matcher.evaluator.ComputeRing(ringTmp); nil != err {
-		return nil, err
-	} else {
-		return market.matcher.submitter.GenerateRingSubmitInfo(ringTmp)
-	}
+	return market.matcher.generateRingSubmitInfo(market.lrcAddress, orders...)
 }
 
 func ratToInt(rat *big.Rat) *big.Int {
@@ -19,13 +19,17 @@
 package timing_matcher
 
 import (
+	"fmt"
 	"github.com/Loopring/relay/miner"
 	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
+	"time"
 
 	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
 	marketLib "github.com/Loopring/relay/market"
 	marketUtilLib "github.com/Loopring/relay/market/util"
 )
@@ -42,25 +46,31 @@ type TimingMatcher struct {
 	lastBlockNumber *big.Int
 	duration        *big.Int
 	roundOrderCount int
+	ringMaxLength   int
+	om              ordermanager.OrderManager
 
 	maxCacheRoundsLength int
 	delayedNumber        int64
 	accountManager       *marketLib.AccountManager
+	selector             *miner.RingSelector
 
 	stopFuncs []func()
 }
 
-func NewTimingMatcher(matcherOptions *config.TimingMatcher, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) *TimingMatcher {
+func NewTimingMatcher(matcherOptions *config.TimingMatcher, ringMaxLength int, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) *TimingMatcher {
 	matcher := &TimingMatcher{}
 	matcher.submitter = submitter
 	matcher.evaluator = evaluator
 	matcher.accountManager = accountManager
 	matcher.roundOrderCount = matcherOptions.RoundOrdersCount
+	matcher.ringMaxLength = ringMaxLength
+	matcher.om = om
 	matcher.rounds = NewRoundStates(matcherOptions.MaxCacheRoundsLength)
 
 	matcher.markets = []*Market{}
 	matcher.duration = big.NewInt(matcherOptions.Duration)
 	matcher.delayedNumber = matcherOptions.DelayedNumber
+	matcher.selector = &miner.RingSelector{TimeBudget: time.Duration(matcherOptions.SelectTimeBudget) * time.Millisecond}
 
 	matcher.lastBlockNumber = big.NewInt(0)
 	matcher.stopFuncs = []func(){}
@@ -105,7 +115,33 @@ func (matcher *TimingMatcher) Stop() {
 }
 
 func (matcher *TimingMatcher) GetAccountAvailableAmount(address common.Address, tokenAddress common.Address) (*big.Rat, error) {
-	if balance, allowance, err := matcher.accountManager.GetBalanceByTokenAddress(address, tokenAddress); nil != err {
+	return accountAvailableAmount(matcher.accountManager, matcher.rounds, address, tokenAddress)
+}
+
+// selectCandidateRings marks the rings chosen by RingSelector, they will be submitted before the others.
+// the rings are chosen greedily one by one as before if the time budget isn't set
+func (matcher *TimingMatcher) selectCandidateRings(list CandidateRingList, capacities map[common.Hash]*big.Rat) {
+	if matcher.selector.TimeBudget <= 0 || len(list) <= 1 {
+		return
+	}
+	candidates := make([]miner.RingCandidate, len(list))
+	for i, ring := range list {
+		candidates[i] = miner.RingCandidate{Received: ring.received, Cost: ring.cost, Fills: ring.filledOrders}
+	}
+	chosen, optimal := matcher.selector.Select(candidates, capacities)
+	for rank, idx := range chosen {
+		list[idx].selectedRank = rank + 1
+	}
+	log.Debugf("timing matcher,round:%s, %d of %d rings are chosen, optimal:%t, total received:%s", matcher.lastBlockNumber.String(), len(chosen), len(list), optimal, miner.TotalReceived(candidates, capacities, chosen).FloatString(2))
+}
+
+func (matcher *TimingMatcher) generateRingSubmitInfo(lrcAddress common.Address, orders ...*types.OrderState) (*types.RingSubmitInfo, error) {
+	return generateRingSubmitInfo(matcher, matcher.om, matcher.evaluator, matcher.submitter, lrcAddress, orders...)
+}
+
+// accountAvailableAmount is min(balance, allowance) subtracted by the amount matched in cached rounds
+func accountAvailableAmount(accountManager *marketLib.AccountManager, rounds *RoundStates, address common.Address, tokenAddress common.Address) (*big.Rat, error) {
+	if balance, allowance, err := accountManager.GetBalanceByTokenAddress(address, tokenAddress); nil != err {
 		return nil, err
 	} else {
 		availableAmount := new(big.Rat).SetInt(balance)
@@ -114,9 +150,39 @@ func (matcher *TimingMatcher) GetAccountAvailableAmount(address common.Address,
 			availableAmount = allowanceAmount
 		}
 
-		matchedAmountS := matcher.rounds.filledAmountS(address, tokenAddress)
+		matchedAmountS := rounds.filledAmountS(address, tokenAddress)
 		availableAmount.Sub(availableAmount, matchedAmountS)
 
 		return availableAmount, nil
 	}
 }
+
+func generateRingSubmitInfo(matcher miner.Matcher, om ordermanager.OrderManager, evaluator *miner.Evaluator, submitter *miner.RingSubmitter, lrcAddress common.Address, orders ...*types.OrderState) (*types.RingSubmitInfo, error) {
+	filledOrders := []*types.FilledOrder{}
+	//miner will received nothing, if miner set FeeSelection=1 and he doesn't have enough lrc
+	for _, order := range orders {
+		lrcTokenBalance, err := matcher.GetAccountAvailableAmount(order.RawOrder.Owner, lrcAddress)
+		if nil != err {
+			return nil, err
+		}
+		tokenSBalance, err := matcher.GetAccountAvailableAmount(order.RawOrder.Owner, order.RawOrder.TokenS)
+		if nil != err {
+			return nil, err
+		}
+		if tokenSBalance.Sign() <= 0 {
+			return nil, fmt.Errorf("owner:%s token:%s balance or allowance is zero", order.RawOrder.Owner.Hex(), order.RawOrder.TokenS.Hex())
+		}
+		//todo:
+		if om.IsValueDusted(order.RawOrder.TokenS, tokenSBalance) {
+			return nil, fmt.Errorf("owner:%s token:%s balance or allowance is not enough", order.RawOrder.Owner.Hex(), order.RawOrder.TokenS.Hex())
+		}
+		filledOrders = append(filledOrders, types.ConvertOrderStateToFilledOrder(*order, lrcTokenBalance, tokenSBalance))
+	}
+
+	ringTmp := miner.NewRing(filledOrders)
+	if err := evaluator.ComputeRing(ringTmp); nil != err {
+		return nil, err
+	} else {
+		return submitter.GenerateRingSubmitInfo(ringTmp)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+)
+
+const (
+	multiHopMinLength     = 3
+	multiHopOrdersPerEdge = 5
+	multiHopMaxCandidates = 500
+)
+
+// 市场内撮合之后，用所有市场剩余的订单构建token图，寻找跨市场的3个及以上订单的环路，如 LRC->WETH->EOS->LRC
+func (matcher *TimingMatcher) matchMultiHop() {
+	if matcher.ringMaxLength < multiHopMinLength {
+		return
+	}
+
+	protocolMarkets := make(map[common.Address][]*Market)
+	for _, market := range matcher.markets {
+		protocolMarkets[market.protocolAddress] = append(protocolMarkets[market.protocolAddress], market)
+	}
+
+	finder := &miner.RingFinder{
+		MinLength:        multiHopMinLength,
+		MaxLength:        matcher.ringMaxLength,
+		MaxOrdersPerEdge: multiHopOrdersPerEdge,
+		MaxCandidates:    multiHopMaxCandidates,
+	}
+	ringSubmitInfos := []*types.RingSubmitInfo{}
+	for protocolAddress, markets := range protocolMarkets {
+		ringSubmitInfos = append(ringSubmitInfos, matcher.matchMultiHopOfProtocol(finder, protocolAddress, markets)...)
+	}
+
+	if len(ringSubmitInfos) > 0 {
+		matcher.submitter.RecordDryRun(miner.DryRunChosen, matcher.lastBlockNumber, ringSubmitInfos...)
+		eventemitter.Emit(eventemitter.Miner_NewRing, ringSubmitInfos)
+	}
+}
+
+func (matcher *TimingMatcher) matchMultiHopOfProtocol(finder *miner.RingFinder, protocolAddress common.Address, markets []*Market) []*types.RingSubmitInfo {
+	ringSubmitInfos := []*types.RingSubmitInfo{}
+	if len(markets) <= 0 {
+		return ringSubmitInfos
+	}
+	lrcAddress := markets[0].lrcAddress
+
+	orders := make(map[common.Hash]*types.OrderState)
+	for _, market := range markets {
+		for hash, order := range market.AtoBOrders {
+			if !matcher.om.IsOrderFullFinished(order) {
+				orders[hash] = order
+			}
+		}
+		for hash, order := range market.BtoAOrders {
+			if !matcher.om.IsOrderFullFinished(order) {
+				orders[hash] = order
+			}
+		}
+	}
+	orderList := []*types.OrderState{}
+	for _, order := range orders {
+		orderList = append(orderList, order)
+	}
+
+	//step 1: evaluate the rings found in token graph
+	candidateRingList := CandidateRingList{}
+	capacities := make(map[common.Hash]*big.Rat)
+	for _, ringOrders := range finder.Find(orderList) {
+		ringForSubmit, err := matcher.generateRingSubmitInfo(lrcAddress, ringOrders...)
+		if nil != err {
+			log.Debugf("multi-hop match, generate RingSubmitInfo err:%s", err.Error())
+			continue
+		}
+		candidateRing := CandidateRing{cost: ringForSubmit.LegalCost, received: ringForSubmit.Received, filledOrders: make(map[common.Hash]*big.Rat)}
+		for _, filledOrder := range ringForSubmit.RawRing.Orders {
+			hash := filledOrder.OrderState.RawOrder.Hash
+			candidateRing.filledOrders[hash] = filledOrder.FillAmountS
+			candidateRing.orderHashes = append(candidateRing.orderHashes, hash)
+			addCapacity(capacities, filledOrder)
+		}
+		candidateRingList = append(candidateRingList, candidateRing)
+		matcher.submitter.RecordDryRun(miner.DryRunCandidate, matcher.lastBlockNumber, ringForSubmit)
+	}
+	log.Debugf("multi-hop match round:%s, protocol:%s, orders:%d, candidateRingList.length:%d", matcher.lastBlockNumber, protocolAddress.Hex(), len(orderList), len(candidateRingList))
+
+	//step 2: the ring that can get max received, same as market.match
+	matchedOrderHashes := make(map[common.Hash]bool)
+	list := candidateRingList
+	matcher.selectCandidateRings(list, capacities)
+	for len(list) > 0 {
+		var candidateRing CandidateRing
+		candidateRing, list = popCandidateRing(list)
+
+		ringOrders := []*types.OrderState{}
+		for _, hash := range candidateRing.orderHashes {
+			ringOrders = append(ringOrders, orders[hash])
+		}
+		ringForSubmit, err := matcher.generateRingSubmitInfo(lrcAddress, ringOrders...)
+		if nil != err {
+			log.Debugf("multi-hop match, generate RingSubmitInfo err:%s", err.Error())
+			continue
+		}
+		for _, filledOrder := range ringForSubmit.RawRing.Orders {
+			orderState := orders[filledOrder.OrderState.RawOrder.Hash]
+			orderState.DealtAmountB.Add(orderState.DealtAmountB, ratToInt(filledOrder.FillAmountB))
+			orderState.DealtAmountS.Add(orderState.DealtAmountS, ratToInt(filledOrder.FillAmountS))
+			isFullFilled := matcher.om.IsOrderFullFinished(orderState)
+			matchedOrderHashes[orderState.RawOrder.Hash] = isFullFilled
+			matcher.rounds.appendFilledOrderToCurrent(filledOrder, ringForSubmit.RawRing.Hash)
+
+			list = reduceReceivedOfCandidateRing(list, filledOrder, isFullFilled)
+		}
+		ringSubmitInfos = append(ringSubmitInfos, ringForSubmit)
+	}
+
+	//matched orders will be delayed to next rounds, same as market.match
+	for _, market := range markets {
+		for orderHash := range market.AtoBOrders {
+			if _, exists := matchedOrderHashes[orderHash]; exists {
+				market.AtoBOrderHashesExcludeNextRound = append(market.AtoBOrderHashesExcludeNextRound, orderHash)
+			}
+		}
+		for orderHash := range market.BtoAOrders {
+			if _, exists := matchedOrderHashes[orderHash]; exists {
+				market.BtoAOrderHashesExcludeNextRound = append(market.BtoAOrderHashesExcludeNextRound, orderHash)
+			}
+		}
+	}
+
+	return ringSubmitInfos
+}
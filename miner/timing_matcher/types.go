@@ -23,6 +23,7 @@ import (
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
+	"sort"
 	"sync"
 )
 
@@ -87,6 +88,11 @@ func (rs *RoundState) removeMinedOrder(orderhash common.Hash) {
 	rs.mtx.Lock()
 	defer rs.mtx.Unlock()
 
+	rs.removeOrderWithoutRings(orderhash)
+}
+
+// removeOrderWithoutRings must be called with rs.mtx locked
+func (rs *RoundState) removeOrderWithoutRings(orderhash common.Hash) {
 	if len(rs.orderStates[orderhash].rings) <= 0 {
 		delete(rs.orderStates, orderhash)
 		balancesMap := make(map[common.Address][]common.Hash)
@@ -94,7 +100,7 @@ func (rs *RoundState) removeMinedOrder(orderhash common.Hash) {
 			hashes1 := []common.Hash{}
 			for _, orderhash1 := range hashes {
 				if orderhash != orderhash1 {
-					hashes1 = append(hashes1, orderhash)
+					hashes1 = append(hashes1, orderhash1)
 				}
 			}
 			if len(hashes1) > 0 {
@@ -111,14 +117,14 @@ func (rs *RoundState) removeMinedRing(ringhash common.Hash) {
 
 	orderhashes := []common.Hash{}
 	for orderhash, orderState := range rs.orderStates {
-		if _, exists := orderState.rings[ringhash]; !exists {
+		if _, exists := orderState.rings[ringhash]; exists {
 			orderhashes = append(orderhashes, orderhash)
 		}
 	}
 	for _, hash := range orderhashes {
 		delete(rs.orderStates[hash].rings, ringhash)
 		if len(rs.orderStates[hash].rings) <= 0 {
-			rs.removeMinedOrder(hash)
+			rs.removeOrderWithoutRings(hash)
 		}
 	}
 }
@@ -220,10 +226,27 @@ func (r *RoundStates) removeMinedRing(ringhash common.Hash) {
 	}
 }
 
+// revert renumbers the rounds of forked blocks to the fork block, rings matched in them are still in-flight,
+// since their transactions may be packed again in the new chain
+func (r *RoundStates) revert(forkBlock *big.Int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for _, state := range r.states {
+		state.mtx.Lock()
+		if state.round.Cmp(forkBlock) > 0 {
+			state.round = new(big.Int).Set(forkBlock)
+		}
+		state.mtx.Unlock()
+	}
+}
+
 type CandidateRing struct {
 	filledOrders map[common.Hash]*big.Rat
+	orderHashes  []common.Hash //orders of ring in sequence, used by rings of more than 2 orders
 	received     *big.Rat
 	cost         *big.Rat
+	selectedRank int //rank in the rings chosen by RingSelector, 0 means not chosen
 }
 
 type CandidateRingList []CandidateRing
@@ -237,3 +260,29 @@ func (ringList CandidateRingList) Swap(i, j int) {
 func (ringList CandidateRingList) Less(i, j int) bool {
 	return ringList[i].received.Cmp(ringList[j].received) > 0
 }
+
+// popCandidateRing takes the chosen ring of min rank first, then the ring that can get max received
+func popCandidateRing(list CandidateRingList) (CandidateRing, CandidateRingList) {
+	idx := -1
+	for i, ring := range list {
+		if ring.selectedRank > 0 && (idx < 0 || ring.selectedRank < list[idx].selectedRank) {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		sort.Sort(list)
+		idx = 0
+	}
+	ring := list[idx]
+	rest := append(CandidateRingList{}, list[:idx]...)
+	rest = append(rest, list[idx+1:]...)
+	return ring, rest
+}
+
+// addCapacity records the available amountS of order, it is the same in all rings of a round
+func addCapacity(capacities map[common.Hash]*big.Rat, filledOrder *types.FilledOrder) {
+	hash := filledOrder.OrderState.RawOrder.Hash
+	if _, exists := capacities[hash]; !exists && nil != filledOrder.AvailableAmountS {
+		capacities[hash] = new(big.Rat).Set(filledOrder.AvailableAmountS)
+	}
+}
@@ -19,7 +19,6 @@
 package node
 
 import (
-	"strconv"
 	"sync"
 
 	"github.com/Loopring/relay/cache"
@@ -41,7 +40,6 @@ import (
 	"github.com/Loopring/relay/usermanager"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"go.uber.org/zap"
-	"math/big"
 )
 
 const (
@@ -68,7 +66,7 @@ type Node struct {
 
 type RelayNode struct {
 	trendManager   market.TrendManager
-	jsonRpcService gateway.JsonrpcServiceImpl
+	jsonRpcService *gateway.JsonrpcServiceImpl
 }
 
 func (n *RelayNode) Start() {
@@ -77,7 +75,7 @@ func (n *RelayNode) Start() {
 }
 
 func (n *RelayNode) Stop() {
-	//
+	n.jsonRpcService.Stop()
 }
 
 type MineNode struct {
@@ -97,6 +95,7 @@ func NewNode(logger *zap.Logger, globalConfig *config.GlobalConfig) *Node {
 	n.globalConfig = globalConfig
 
 	// register
+	n.registerEventBus()
 	n.registerMysql()
 	cache.NewCache(n.globalConfig.Redis)
 
@@ -107,9 +106,9 @@ func NewNode(logger *zap.Logger, globalConfig *config.GlobalConfig) *Node {
 	n.registerIPFSSubService()
 	n.registerOrderManager()
 	n.registerExtractor()
+	n.registerAccountManager()
 	n.registerGateway()
 	n.registerCrypto(nil)
-	n.registerAccountManager()
 
 	if "relay" == globalConfig.Mode {
 		n.registerRelayNode()
@@ -143,9 +142,6 @@ func (n *Node) Start() {
 
 	extractorSyncWatcher := &eventemitter.Watcher{Concurrent: false, Handle: n.startAfterExtractorSync}
 	eventemitter.On(eventemitter.SyncChainComplete, extractorSyncWatcher)
-
-	chainForkWatcher := &eventemitter.Watcher{Concurrent: false, Handle: n.startAfterChainFork}
-	eventemitter.On(eventemitter.ChainForkDetected, chainForkWatcher)
 }
 
 func (n *Node) startAfterExtractorSync(input eventemitter.EventData) error {
@@ -164,39 +160,6 @@ func (n *Node) startAfterExtractorSync(input eventemitter.EventData) error {
 	return nil
 }
 
-func (n *Node) startAfterChainFork(input eventemitter.EventData) error {
-	// stop extractor
-	if n.globalConfig.Mode == MODEL_MINER {
-		n.mineNode.Stop()
-	} else if n.globalConfig.Mode == MODEL_RELAY {
-		n.relayNode.Stop()
-	} else {
-		n.relayNode.Stop()
-		n.mineNode.Stop()
-	}
-	n.extractorService.Stop()
-
-	// emit fork event,waiting for ordermanager and accountmanager finished procedure of process chain fork
-	forkEvent := input.(*types.ForkedEvent)
-	eventemitter.Emit(eventemitter.ChainForkProcess, forkEvent)
-
-	// reset new block number and start extractor
-	nextBlockNumber := new(big.Int).Add(forkEvent.ForkBlock, big.NewInt(1))
-	n.extractorService.Fork(nextBlockNumber)
-	n.extractorService.Start()
-
-	if n.globalConfig.Mode == MODEL_MINER {
-		n.mineNode.Start()
-	} else if n.globalConfig.Mode == MODEL_RELAY {
-		n.relayNode.Start()
-	} else {
-		n.relayNode.Start()
-		n.mineNode.Start()
-	}
-
-	return nil
-}
-
 func (n *Node) Wait() {
 	n.lock.RLock()
 
@@ -227,6 +190,20 @@ func (n *Node) registerCrypto(ks *keystore.KeyStore) {
 	crypto.Initialize(c)
 }
 
+func (n *Node) registerEventBus() {
+	eventemitter.RegisterEventType(eventemitter.OrderManagerGatewayNewOrder, &types.OrderState{})
+	eventemitter.RegisterEventType(eventemitter.OrderManagerExtractorRingMined, &types.RingMinedEvent{})
+	eventemitter.RegisterEventType(eventemitter.OrderManagerExtractorFill, &types.OrderFilledEvent{})
+	eventemitter.RegisterEventType(eventemitter.OrderManagerExtractorCancel, &types.OrderCancelledEvent{})
+	eventemitter.RegisterEventType(eventemitter.OrderManagerExtractorCutoff, &types.CutoffEvent{})
+	eventemitter.RegisterEventType(eventemitter.OrderManagerSoftCancel, &types.OrderState{})
+	eventemitter.RegisterEventType(eventemitter.OrderManagerExpire, &types.OrderState{})
+
+	if err := eventemitter.Initialize(n.globalConfig.EventBus); nil != err {
+		log.Fatalf("err:%s", err.Error())
+	}
+}
+
 func (n *Node) registerMysql() {
 	n.rdsService = dao.NewRdsService(n.globalConfig.Mysql)
 	n.rdsService.Prepare()
@@ -261,19 +238,33 @@ func (n *Node) registerAccountManager() {
 
 func (n *Node) registerJsonRpcService() {
 	ethForwarder := gateway.EthForwarder{}
-	n.relayNode.jsonRpcService = *gateway.NewJsonrpcService(strconv.Itoa(n.globalConfig.Jsonrpc.Port), n.relayNode.trendManager, n.orderManager, n.accountManager, &ethForwarder, n.marketCapProvider)
+	n.relayNode.jsonRpcService = gateway.NewJsonrpcService(n.globalConfig.Jsonrpc, n.relayNode.trendManager, n.orderManager, n.accountManager, n.userManager, &ethForwarder, n.marketCapProvider)
 }
 
 func (n *Node) registerMiner() {
 	submitter := miner.NewSubmitter(n.globalConfig.Miner, n.rdsService, n.marketCapProvider)
-	evaluator := miner.NewEvaluator(n.marketCapProvider, n.globalConfig.Miner.RateRatioCVSThreshold)
-	matcher := timing_matcher.NewTimingMatcher(n.globalConfig.Miner.TimingMatcher, submitter, evaluator, n.orderManager, &n.accountManager)
+	evaluator := miner.NewEvaluator(n.marketCapProvider, n.globalConfig.Miner.RateRatioCVSThreshold, n.globalConfig.Miner.RatePrecision)
+	var matcher miner.Matcher
+	switch n.globalConfig.Miner.Matcher {
+	case "event":
+		matcher = timing_matcher.NewEventMatcher(n.globalConfig.Miner.EventMatcher, submitter, evaluator, n.orderManager, n.userManager, &n.accountManager)
+	case "", "timing":
+		matcher = timing_matcher.NewTimingMatcher(n.globalConfig.Miner.TimingMatcher, n.globalConfig.Miner.RingMaxLength, submitter, evaluator, n.orderManager, &n.accountManager)
+	default:
+		log.Fatalf("miner,unsupported matcher:%s", n.globalConfig.Miner.Matcher)
+	}
 	submitter.SetMatcher(matcher)
 	n.mineNode.miner = miner.NewMiner(submitter, matcher, evaluator, n.marketCapProvider)
 }
 
 func (n *Node) registerGateway() {
-	gateway.Initialize(&n.globalConfig.GatewayFilters, &n.globalConfig.Gateway, &n.globalConfig.Ipfs, n.orderManager)
+	deps := &gateway.FilterDependencies{
+		OrderManager:   n.orderManager,
+		MarketCap:      n.marketCapProvider,
+		AccountManager: &n.accountManager,
+		UserManager:    n.userManager,
+	}
+	gateway.Initialize(&n.globalConfig.GatewayFilters, &n.globalConfig.Gateway, &n.globalConfig.Ipfs, deps)
 }
 
 func (n *Node) registerUserManager() {
@@ -69,6 +69,8 @@ func newOrderEntity(state *types.OrderState, mc marketcap.MarketCapProvider, blo
 
 // 写入订单状态
 func settleOrderStatus(state *types.OrderState, mc marketcap.MarketCapProvider) {
+	origin := state.Status
+
 	zero := big.NewInt(0)
 	finishAmountS := big.NewInt(0).Add(state.CancelledAmountS, state.DealtAmountS)
 	totalAmountS := big.NewInt(0).Add(finishAmountS, state.SplitAmountS)
@@ -81,6 +83,11 @@ func settleOrderStatus(state *types.OrderState, mc marketcap.MarketCapProvider)
 		finished := isOrderFullFinished(state, mc)
 		state.SettleFinishedStatus(finished)
 	}
+
+	// 链下取消和已过期的订单在链上成交后仍然保持原状态，除非已经完全成交
+	if (origin == types.ORDER_SOFT_CANCEL || origin == types.ORDER_EXPIRE) && state.Status != types.ORDER_FINISHED {
+		state.Status = origin
+	}
 }
 
 // 读取时根据订单相关参数，解释订单重叠状态
@@ -0,0 +1,137 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+)
+
+const expireOrdersBatchSize = 500
+
+// expirySweeper sets the open orders to ORDER_EXPIRE with the timestamp of new blocks instead of
+// local time, the block number is saved as expired_block so that fork can roll it back
+type expirySweeper struct {
+	rds     dao.RdsService
+	book    *orderBook
+	blocks  chan *types.BlockEvent
+	stop    chan struct{}
+	watcher *eventemitter.Watcher
+}
+
+func newExpirySweeper(rds dao.RdsService, book *orderBook) *expirySweeper {
+	s := &expirySweeper{}
+	s.rds = rds
+	s.book = book
+	return s
+}
+
+func (s *expirySweeper) start() {
+	s.blocks = make(chan *types.BlockEvent, 1)
+	s.stop = make(chan struct{})
+	s.watcher = &eventemitter.Watcher{Concurrent: false, Handle: s.handleNewBlock}
+	eventemitter.On(eventemitter.Block_New, s.watcher)
+	go s.loop(s.blocks, s.stop)
+}
+
+func (s *expirySweeper) quit() {
+	if nil == s.stop {
+		return
+	}
+	eventemitter.Un(eventemitter.Block_New, s.watcher)
+	close(s.stop)
+	s.stop = nil
+}
+
+// handleNewBlock only keeps the latest block if the sweeper is busy
+func (s *expirySweeper) handleNewBlock(input eventemitter.EventData) error {
+	block := input.(*types.BlockEvent)
+	for {
+		select {
+		case s.blocks <- block:
+			return nil
+		default:
+			select {
+			case <-s.blocks:
+			default:
+			}
+		}
+	}
+}
+
+func (s *expirySweeper) loop(blocks chan *types.BlockEvent, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case block := <-blocks:
+			s.sweep(block)
+		}
+	}
+}
+
+func (s *expirySweeper) sweep(block *types.BlockEvent) {
+	if block.BlockTime <= 0 || nil == block.BlockNumber {
+		return
+	}
+
+	for {
+		models, err := s.rds.GetOrdersToExpire(block.BlockTime, expireOrdersBatchSize)
+		if err != nil {
+			log.Errorf("order manager,get orders to expire error:%s", err.Error())
+			return
+		}
+		if len(models) == 0 {
+			return
+		}
+
+		orderhashs := []string{}
+		states := []*types.OrderState{}
+		for _, model := range models {
+			state := &types.OrderState{}
+			if err := model.ConvertUp(state); err != nil {
+				log.Errorf("order manager,expire order %s,convert error:%s", model.OrderHash, err.Error())
+				continue
+			}
+			orderhashs = append(orderhashs, model.OrderHash)
+			states = append(states, state)
+		}
+		if len(orderhashs) == 0 {
+			return
+		}
+
+		if err := s.rds.ExpireOrders(orderhashs, block.BlockNumber.Int64()); err != nil {
+			log.Errorf("order manager,expire %d orders error:%s", len(orderhashs), err.Error())
+			return
+		}
+		log.Debugf("order manager,%d orders expired at block %s", len(orderhashs), block.BlockNumber.String())
+
+		for _, state := range states {
+			state.Status = types.ORDER_EXPIRE
+			s.book.Remove(state.RawOrder.Hash)
+			eventemitter.Emit(eventemitter.OrderManagerExpire, state)
+		}
+
+		if len(models) < expireOrdersBatchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+}
+
+// expiryRds keeps orders in memory, the methods not used by sweeper and fork panic
+type expiryRds struct {
+	dao.RdsService
+	orders map[string]*dao.Order
+}
+
+func (r *expiryRds) GetOrdersToExpire(blockTime int64, limit int) ([]dao.Order, error) {
+	list := []dao.Order{}
+	for _, o := range r.orders {
+		status := types.OrderStatus(o.Status)
+		if (status == types.ORDER_NEW || status == types.ORDER_PARTIAL) && o.ValidTime+o.Ttl <= blockTime {
+			list = append(list, *o)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (r *expiryRds) ExpireOrders(orderhashs []string, blockNumber int64) error {
+	for _, hash := range orderhashs {
+		if o, ok := r.orders[hash]; ok {
+			o.Status = uint8(types.ORDER_EXPIRE)
+			o.ExpiredBlock = blockNumber
+		}
+	}
+	return nil
+}
+
+func (r *expiryRds) GetExpiredOrdersWithBlockNumberRange(from, to int64) ([]dao.Order, error) {
+	list := []dao.Order{}
+	for _, o := range r.orders {
+		if o.Status == uint8(types.ORDER_EXPIRE) && o.ExpiredBlock > from && o.ExpiredBlock <= to {
+			list = append(list, *o)
+		}
+	}
+	return list, nil
+}
+
+func (r *expiryRds) GetOrdersWithBlockNumberRange(from, to int64) ([]dao.Order, error) {
+	list := []dao.Order{}
+	for _, o := range r.orders {
+		if o.UpdatedBlock > from && o.UpdatedBlock <= to {
+			list = append(list, *o)
+		}
+	}
+	return list, nil
+}
+
+func (r *expiryRds) UpdateOrderStatusByHash(hash common.Hash, status types.OrderStatus, fromStatusSet []types.OrderStatus) (int64, error) {
+	o, ok := r.orders[hash.Hex()]
+	if !ok {
+		return 0, nil
+	}
+	for _, from := range fromStatusSet {
+		if o.Status == uint8(from) {
+			o.Status = uint8(status)
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (r *expiryRds) RollBackRingMined(from, to int64) error { return nil }
+func (r *expiryRds) RollBackFill(from, to int64) error      { return nil }
+func (r *expiryRds) RollBackCancel(from, to int64) error    { return nil }
+func (r *expiryRds) RollBackCutoff(from, to int64) error    { return nil }
+
+// add saves an order valid since validTime for ttl seconds, updated at updatedBlock
+func (r *expiryRds) add(t *testing.T, id int, validTime, ttl, updatedBlock int64, status types.OrderStatus) common.Hash {
+	state := &types.OrderState{}
+	state.RawOrder.Protocol = common.HexToAddress("0x01")
+	state.RawOrder.TokenS = common.HexToAddress("0x02")
+	state.RawOrder.TokenB = common.HexToAddress("0x03")
+	state.RawOrder.AmountS = big.NewInt(100)
+	state.RawOrder.AmountB = big.NewInt(10)
+	state.RawOrder.Price = big.NewRat(10, 1)
+	state.RawOrder.Timestamp = big.NewInt(validTime)
+	state.RawOrder.Ttl = big.NewInt(ttl)
+	state.RawOrder.Salt = big.NewInt(int64(id))
+	state.RawOrder.LrcFee = big.NewInt(1)
+	state.RawOrder.Hash = state.RawOrder.GenerateHash()
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.SplitAmountS = big.NewInt(0)
+	state.SplitAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	state.UpdatedBlock = big.NewInt(updatedBlock)
+	state.Status = status
+
+	model := &dao.Order{}
+	if err := model.ConvertDown(state); err != nil {
+		t.Fatal(err)
+	}
+	model.ID = id
+	r.orders[model.OrderHash] = model
+	return state.RawOrder.Hash
+}
+
+func TestExpirySweeper(t *testing.T) {
+	cases := []struct {
+		name         string
+		validTime    int64
+		ttl          int64
+		status       types.OrderStatus
+		blockTime    int64
+		expectStatus types.OrderStatus
+	}{
+		{"new order expires", 100, 100, types.ORDER_NEW, 200, types.ORDER_EXPIRE},
+		{"partial order expires", 100, 100, types.ORDER_PARTIAL, 250, types.ORDER_EXPIRE},
+		{"order not expired before block time", 100, 100, types.ORDER_NEW, 199, types.ORDER_NEW},
+		{"finished order is kept", 100, 100, types.ORDER_FINISHED, 200, types.ORDER_FINISHED},
+		{"cancelled order is kept", 100, 100, types.ORDER_CANCEL, 200, types.ORDER_CANCEL},
+	}
+
+	for _, c := range cases {
+		rds := &expiryRds{orders: make(map[string]*dao.Order)}
+		hash := rds.add(t, 1, c.validTime, c.ttl, 5, c.status)
+		book := newOrderBook()
+		sweeper := newExpirySweeper(rds, book)
+		sweeper.sweep(&types.BlockEvent{BlockNumber: big.NewInt(10), BlockTime: c.blockTime})
+
+		o := rds.orders[hash.Hex()]
+		if types.OrderStatus(o.Status) != c.expectStatus {
+			t.Errorf("%s: status should be %d, but got %d", c.name, c.expectStatus, o.Status)
+		}
+		if o.UpdatedBlock != 5 {
+			t.Errorf("%s: updated block shouldn't be changed, but got %d", c.name, o.UpdatedBlock)
+		}
+		if c.expectStatus == types.ORDER_EXPIRE && o.ExpiredBlock != 10 {
+			t.Errorf("%s: expired block should be 10, but got %d", c.name, o.ExpiredBlock)
+		}
+	}
+}
+
+func TestExpirySweeperBatches(t *testing.T) {
+	rds := &expiryRds{orders: make(map[string]*dao.Order)}
+	for i := 1; i <= expireOrdersBatchSize+10; i++ {
+		rds.add(t, i, 100, 100, 5, types.ORDER_NEW)
+	}
+	sweeper := newExpirySweeper(rds, newOrderBook())
+	sweeper.sweep(&types.BlockEvent{BlockNumber: big.NewInt(10), BlockTime: 300})
+
+	for _, o := range rds.orders {
+		if types.OrderStatus(o.Status) != types.ORDER_EXPIRE {
+			t.Fatalf("all orders should be expired, order %d is %d", o.ID, o.Status)
+		}
+	}
+}
+
+func TestExpiryForkRollBack(t *testing.T) {
+	rds := &expiryRds{orders: make(map[string]*dao.Order)}
+	// fills of the orders are in blocks before the fork
+	before := rds.add(t, 1, 100, 100, 5, types.ORDER_NEW)
+	inFork := rds.add(t, 2, 100, 200, 5, types.ORDER_NEW)
+	sweeper := newExpirySweeper(rds, newOrderBook())
+	sweeper.sweep(&types.BlockEvent{BlockNumber: big.NewInt(10), BlockTime: 200})
+	sweeper.sweep(&types.BlockEvent{BlockNumber: big.NewInt(20), BlockTime: 300})
+
+	processor := newForkProcess(rds, nil)
+	if err := processor.fork(&types.ForkedEvent{ForkBlock: big.NewInt(15), DetectedBlock: big.NewInt(25)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if o := rds.orders[before.Hex()]; types.OrderStatus(o.Status) != types.ORDER_EXPIRE || o.ExpiredBlock != 10 {
+		t.Errorf("order expired before fork should be kept, but got status:%d, expired block:%d", o.Status, o.ExpiredBlock)
+	}
+	if o := rds.orders[inFork.Hex()]; types.OrderStatus(o.Status) != types.ORDER_NEW {
+		t.Errorf("order expired in forked blocks should be rolled back, but got status:%d", o.Status)
+	}
+
+	// it expires again with the block time of new chain
+	sweeper.sweep(&types.BlockEvent{BlockNumber: big.NewInt(16), BlockTime: 300})
+	if o := rds.orders[inFork.Hex()]; types.OrderStatus(o.Status) != types.ORDER_EXPIRE || o.ExpiredBlock != 16 {
+		t.Errorf("order should be expired at block 16, but got status:%d, expired block:%d", o.Status, o.ExpiredBlock)
+	}
+}
@@ -57,6 +57,9 @@ func (p *forkProcessor) fork(event *types.ForkedEvent) error {
 	if err := p.dao.RollBackCutoff(from, to); err != nil {
 		log.Errorf("order manager fork error:%s", err.Error())
 	}
+	if err := p.rollBackExpiredOrders(from, to); err != nil {
+		log.Errorf("order manager fork error:%s", err.Error())
+	}
 
 	orderList, err := p.dao.GetOrdersWithBlockNumberRange(from, to)
 	if err != nil {
@@ -78,6 +81,7 @@ func (p *forkProcessor) fork(event *types.ForkedEvent) error {
 		}
 
 		model.ID = v.ID
+		model.ExpiredBlock = v.ExpiredBlock
 		if err := p.dao.Save(model); err != nil {
 			log.Debugf("order manager fork error:%s", err.Error())
 			continue
@@ -86,3 +90,28 @@ func (p *forkProcessor) fork(event *types.ForkedEvent) error {
 
 	return nil
 }
+
+// 分叉区块内过期的订单恢复为new或partial，由新链上的区块时间重新判断是否过期
+func (p *forkProcessor) rollBackExpiredOrders(from, to int64) error {
+	orderList, err := p.dao.GetExpiredOrdersWithBlockNumberRange(from, to)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range orderList {
+		state := &types.OrderState{}
+		if err := v.ConvertUp(state); err != nil {
+			log.Errorf("order manager fork error:%s", err.Error())
+			continue
+		}
+
+		state.Status = types.ORDER_NEW
+		settleOrderStatus(state, p.mc)
+		if _, err := p.dao.UpdateOrderStatusByHash(state.RawOrder.Hash, state.Status, []types.OrderStatus{types.ORDER_EXPIRE}); err != nil {
+			log.Errorf("order manager fork error:%s", err.Error())
+			continue
+		}
+	}
+
+	return nil
+}
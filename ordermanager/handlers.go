@@ -0,0 +1,99 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"fmt"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+)
+
+// 以下方法由OrderManagerImpl和Reindexer共用，保存extractor事件
+
+// saveRingMined saves the ring mined event if it isn't saved yet
+func saveRingMined(rds dao.RdsService, event *types.RingMinedEvent) error {
+	if _, err := rds.FindRingMinedByRingIndex(event.RingIndex.String()); err == nil {
+		log.Debugf("order manager,handle ringmined event,ring %s has already exist", event.Ringhash.Hex())
+		return nil
+	}
+	model := &dao.RingMinedEvent{}
+	if err := model.ConvertDown(event); err != nil {
+		return err
+	}
+	if err := rds.Add(model); err != nil {
+		return fmt.Errorf("order manager,handle ringmined event,insert ring error:%s", err.Error())
+	}
+	return nil
+}
+
+// saveFill saves the fill event, false is returned if it has been saved
+func saveFill(rds dao.RdsService, event *types.OrderFilledEvent) (bool, error) {
+	if _, err := rds.FindFillEventByRinghashAndOrderhash(event.Ringhash, event.OrderHash); err == nil {
+		log.Debugf("order manager,handle order filled event,fill already exist ringIndex:%s orderHash:%s", event.RingIndex.String(), event.OrderHash.Hex())
+		return false, nil
+	}
+	model := &dao.FillEvent{}
+	if err := model.ConvertDown(event); err != nil {
+		log.Debugf("order manager,handle order filled event error:order %s convert down failed", event.OrderHash.Hex())
+		return false, err
+	}
+	if err := rds.Add(model); err != nil {
+		log.Debugf("order manager,handle order filled event error:order %s insert faild", event.OrderHash.Hex())
+		return false, err
+	}
+	return true, nil
+}
+
+// saveCancel saves the cancel event, false is returned if it has been saved
+func saveCancel(rds dao.RdsService, event *types.OrderCancelledEvent) (bool, error) {
+	if _, err := rds.FindCancelEvent(event.OrderHash, event.TxHash); err == nil {
+		log.Debugf("order manager,handle order cancelled event error:event %s have already exist", event.OrderHash.Hex())
+		return false, nil
+	}
+	model := &dao.CancelEvent{}
+	if err := model.ConvertDown(event); err != nil {
+		return false, err
+	}
+	if err := rds.Add(model); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// saveCutoff replaces the cutoff of owner if the event is later, and sets the open orders before it cutoff
+func saveCutoff(cutoffCache *CutoffCache, rds dao.RdsService, event *types.CutoffEvent) error {
+	lastCutoff, ok := cutoffCache.Get(event.ContractAddress, event.Owner)
+
+	var addErr, delErr error
+	if !ok {
+		addErr = cutoffCache.Add(event)
+	} else if lastCutoff.Cmp(event.Cutoff) >= 0 {
+		log.Debugf("order manager, handle cutoff event, protocol:%s - owner:%s lastCutofftime:%s > currentCutoffTime:%s", event.ContractAddress.Hex(), event.Owner.Hex(), lastCutoff.String(), event.Cutoff.String())
+	} else {
+		delErr = cutoffCache.Del(event.ContractAddress, event.Owner)
+		addErr = cutoffCache.Add(event)
+	}
+
+	if addErr != nil || delErr != nil {
+		return fmt.Errorf("order manager,handle cutoff error: cutoffCache add or del failed")
+	}
+	return rds.SetCutOff(event.Owner, event.Cutoff)
+}
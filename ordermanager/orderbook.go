@@ -0,0 +1,265 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// 价格精度与dao.Order.Price一致，从数据库重建和实时更新的订单落在同一价格档位
+const bookPricePrecision = 16
+
+// DepthLevel is the remained amount of the open orders at the same price
+type DepthLevel struct {
+	Price   *big.Rat // amountS/amountB in unit of token, same as Order.Price
+	AmountS *big.Rat // remained amountS in wei
+	AmountB *big.Rat // remained amountB in wei
+	Count   int
+}
+
+type bookKey struct {
+	protocol common.Address
+	tokenS   common.Address
+	tokenB   common.Address
+}
+
+type bookEntry struct {
+	key       bookKey
+	level     string
+	owner     common.Address
+	validTime int64
+	expireAt  int64
+	amountS   *big.Rat
+	amountB   *big.Rat
+}
+
+// bookSide keeps the price levels of orders that sell tokenS for tokenB, sorted by price desc
+type bookSide struct {
+	levels map[string]*DepthLevel
+	sorted []*DepthLevel
+}
+
+func newBookSide() *bookSide {
+	side := &bookSide{}
+	side.levels = make(map[string]*DepthLevel)
+	side.sorted = []*DepthLevel{}
+	return side
+}
+
+func (s *bookSide) add(levelKey string, price, amountS, amountB *big.Rat) {
+	level, ok := s.levels[levelKey]
+	if !ok {
+		level = &DepthLevel{Price: price, AmountS: new(big.Rat), AmountB: new(big.Rat)}
+		s.levels[levelKey] = level
+		idx := sort.Search(len(s.sorted), func(i int) bool { return s.sorted[i].Price.Cmp(price) < 0 })
+		s.sorted = append(s.sorted, nil)
+		copy(s.sorted[idx+1:], s.sorted[idx:])
+		s.sorted[idx] = level
+	}
+	level.AmountS.Add(level.AmountS, amountS)
+	level.AmountB.Add(level.AmountB, amountB)
+	level.Count++
+}
+
+func (s *bookSide) sub(levelKey string, amountS, amountB *big.Rat) {
+	level, ok := s.levels[levelKey]
+	if !ok {
+		return
+	}
+	level.AmountS.Sub(level.AmountS, amountS)
+	level.AmountB.Sub(level.AmountB, amountB)
+	level.Count--
+	if level.Count > 0 {
+		return
+	}
+
+	delete(s.levels, levelKey)
+	idx := sort.Search(len(s.sorted), func(i int) bool { return s.sorted[i].Price.Cmp(level.Price) <= 0 })
+	if idx < len(s.sorted) && s.sorted[idx] == level {
+		s.sorted = append(s.sorted[:idx], s.sorted[idx+1:]...)
+	}
+}
+
+// orderBook aggregates the remained amount of open orders by price level, it is updated
+// by the events handled by ordermanager instead of querying mysql for each depth request
+type orderBook struct {
+	mtx     sync.RWMutex
+	sides   map[bookKey]*bookSide
+	entries map[common.Hash]*bookEntry
+	pending map[common.Hash]*types.OrderState // orders whose valid time is later than now
+}
+
+func newOrderBook() *orderBook {
+	b := &orderBook{}
+	b.sides = make(map[bookKey]*bookSide)
+	b.entries = make(map[common.Hash]*bookEntry)
+	b.pending = make(map[common.Hash]*types.OrderState)
+	return b
+}
+
+// reset rebuilds the book with all open orders
+func (b *orderBook) reset(states []*types.OrderState, now int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.sides = make(map[bookKey]*bookSide)
+	b.entries = make(map[common.Hash]*bookEntry)
+	b.pending = make(map[common.Hash]*types.OrderState)
+	for _, state := range states {
+		b.update(state, now)
+	}
+}
+
+// Update adds, updates or removes the order according to its status and remained amount
+func (b *orderBook) Update(state *types.OrderState, now int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.update(state, now)
+}
+
+func (b *orderBook) update(state *types.OrderState, now int64) {
+	hash := state.RawOrder.Hash
+	b.remove(hash)
+
+	if state.Status != types.ORDER_NEW && state.Status != types.ORDER_PARTIAL {
+		return
+	}
+	if nil == state.RawOrder.Price || nil == state.RawOrder.Timestamp || nil == state.RawOrder.Ttl {
+		return
+	}
+	validTime := state.RawOrder.Timestamp.Int64()
+	expireAt := validTime + state.RawOrder.Ttl.Int64()
+	if expireAt <= now {
+		return
+	}
+	if validTime >= now {
+		b.pending[hash] = state
+		return
+	}
+
+	amountS, amountB := state.RemainedAmount()
+	if amountS.Sign() <= 0 || amountB.Sign() <= 0 {
+		return
+	}
+
+	entry := &bookEntry{}
+	entry.key = bookKey{protocol: state.RawOrder.Protocol, tokenS: state.RawOrder.TokenS, tokenB: state.RawOrder.TokenB}
+	entry.level = state.RawOrder.Price.FloatString(bookPricePrecision)
+	entry.owner = state.RawOrder.Owner
+	entry.validTime = validTime
+	entry.expireAt = expireAt
+	entry.amountS = amountS
+	entry.amountB = amountB
+
+	price, _ := new(big.Rat).SetString(entry.level)
+	side, ok := b.sides[entry.key]
+	if !ok {
+		side = newBookSide()
+		b.sides[entry.key] = side
+	}
+	side.add(entry.level, price, amountS, amountB)
+	b.entries[hash] = entry
+}
+
+func (b *orderBook) Remove(hash common.Hash) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.remove(hash)
+}
+
+func (b *orderBook) remove(hash common.Hash) {
+	delete(b.pending, hash)
+
+	entry, ok := b.entries[hash]
+	if !ok {
+		return
+	}
+	delete(b.entries, hash)
+
+	if side, ok := b.sides[entry.key]; ok {
+		side.sub(entry.level, entry.amountS, entry.amountB)
+		if len(side.levels) == 0 {
+			delete(b.sides, entry.key)
+		}
+	}
+}
+
+// Cutoff removes the orders of owner created before cutoff, same as dao.SetCutOff
+func (b *orderBook) Cutoff(owner common.Address, cutoff *big.Int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for hash, entry := range b.entries {
+		if entry.owner == owner && entry.validTime < cutoff.Int64() {
+			b.remove(hash)
+		}
+	}
+	for hash, state := range b.pending {
+		if state.RawOrder.Owner == owner && state.RawOrder.Timestamp.Int64() < cutoff.Int64() {
+			b.remove(hash)
+		}
+	}
+}
+
+// Refresh removes the expired orders and adds the pending orders that become valid
+func (b *orderBook) Refresh(now int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for hash, entry := range b.entries {
+		if entry.expireAt <= now {
+			b.remove(hash)
+		}
+	}
+	for _, state := range b.pending {
+		if state.RawOrder.Timestamp.Int64() < now {
+			b.update(state, now)
+		}
+	}
+}
+
+// Depth returns at most length price levels of orders selling tokenS for tokenB with the
+// highest price, length <= 0 means all levels
+func (b *orderBook) Depth(protocol, tokenS, tokenB common.Address, length int) []DepthLevel {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	levels := []DepthLevel{}
+	side, ok := b.sides[bookKey{protocol: protocol, tokenS: tokenS, tokenB: tokenB}]
+	if !ok {
+		return levels
+	}
+	for _, level := range side.sorted {
+		if length > 0 && len(levels) >= length {
+			break
+		}
+		levels = append(levels, DepthLevel{
+			Price:   new(big.Rat).Set(level.Price),
+			AmountS: new(big.Rat).Set(level.AmountS),
+			AmountB: new(big.Rat).Set(level.AmountB),
+			Count:   level.Count,
+		})
+	}
+	return levels
+}
@@ -0,0 +1,213 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	bookProtocol = common.HexToAddress("0x01")
+	bookTokenS   = common.HexToAddress("0x02")
+	bookTokenB   = common.HexToAddress("0x03")
+	bookOwnerA   = common.HexToAddress("0x0a")
+	bookOwnerB   = common.HexToAddress("0x0b")
+)
+
+type bookOrder struct {
+	hash      int64
+	owner     common.Address
+	amountS   int64
+	amountB   int64
+	dealtS    int64
+	validTime int64
+	ttl       int64
+	status    types.OrderStatus
+}
+
+func (o bookOrder) state() *types.OrderState {
+	state := &types.OrderState{}
+	state.RawOrder.Hash = common.BigToHash(big.NewInt(o.hash))
+	state.RawOrder.Protocol = bookProtocol
+	state.RawOrder.TokenS = bookTokenS
+	state.RawOrder.TokenB = bookTokenB
+	state.RawOrder.Owner = o.owner
+	state.RawOrder.AmountS = big.NewInt(o.amountS)
+	state.RawOrder.AmountB = big.NewInt(o.amountB)
+	state.RawOrder.Price = new(big.Rat).SetFrac(state.RawOrder.AmountS, state.RawOrder.AmountB)
+	state.RawOrder.Timestamp = big.NewInt(o.validTime)
+	state.RawOrder.Ttl = big.NewInt(o.ttl)
+	state.DealtAmountS = big.NewInt(o.dealtS)
+	state.DealtAmountB = big.NewInt(0)
+	state.SplitAmountS = big.NewInt(0)
+	state.SplitAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	state.Status = o.status
+	return state
+}
+
+// openBookOrder returns an order valid since 0 and never expires in tests
+func openBookOrder(hash, amountS, amountB int64) bookOrder {
+	return bookOrder{hash: hash, owner: bookOwnerA, amountS: amountS, amountB: amountB, validTime: 0, ttl: 10000, status: types.ORDER_NEW}
+}
+
+// depthString formats levels as price:amountS:count
+func depthString(levels []DepthLevel) string {
+	s := ""
+	for _, level := range levels {
+		s += fmt.Sprintf("%s:%s:%d ", level.Price.FloatString(2), level.AmountS.FloatString(0), level.Count)
+	}
+	return s
+}
+
+func TestOrderBookLevels(t *testing.T) {
+	finished := openBookOrder(1, 100, 50)
+	finished.status = types.ORDER_FINISHED
+	partial := openBookOrder(1, 100, 50)
+	partial.dealtS = 40
+	partial.status = types.ORDER_PARTIAL
+	cancelled := openBookOrder(2, 200, 100)
+	cancelled.status = types.ORDER_CANCEL
+
+	cases := []struct {
+		name    string
+		updates []bookOrder
+		removes []int64
+		length  int
+		depth   string
+	}{
+		{"merge orders of same price", []bookOrder{openBookOrder(1, 100, 50), openBookOrder(2, 200, 100)}, nil, 0, "2.00:300:2 "},
+		{"sorted by price desc", []bookOrder{openBookOrder(1, 100, 100), openBookOrder(2, 300, 100), openBookOrder(3, 200, 100)}, nil, 0, "3.00:300:1 2.00:200:1 1.00:100:1 "},
+		{"length limits levels", []bookOrder{openBookOrder(1, 100, 100), openBookOrder(2, 300, 100), openBookOrder(3, 200, 100)}, nil, 2, "3.00:300:1 2.00:200:1 "},
+		{"partial filled order reduces level", []bookOrder{openBookOrder(1, 100, 50), openBookOrder(2, 200, 100), partial}, nil, 0, "2.00:260:2 "},
+		{"finished order leaves level", []bookOrder{openBookOrder(1, 100, 50), openBookOrder(2, 200, 100), finished}, nil, 0, "2.00:200:1 "},
+		{"cancelled last order removes level", []bookOrder{openBookOrder(1, 100, 100), openBookOrder(2, 200, 100), cancelled}, nil, 0, "1.00:100:1 "},
+		{"removed order leaves level", []bookOrder{openBookOrder(1, 100, 50), openBookOrder(2, 200, 100)}, []int64{1}, 0, "2.00:200:1 "},
+		{"removed last order removes level", []bookOrder{openBookOrder(1, 100, 100), openBookOrder(2, 200, 100)}, []int64{2, 3}, 0, "1.00:100:1 "},
+		{"all removed", []bookOrder{openBookOrder(1, 100, 100)}, []int64{1}, 0, ""},
+		{"updated twice counts once", []bookOrder{openBookOrder(1, 100, 100), openBookOrder(1, 100, 100)}, nil, 0, "1.00:100:1 "},
+	}
+
+	for _, c := range cases {
+		book := newOrderBook()
+		for _, o := range c.updates {
+			book.Update(o.state(), 100)
+		}
+		for _, hash := range c.removes {
+			book.Remove(common.BigToHash(big.NewInt(hash)))
+		}
+		if depth := depthString(book.Depth(bookProtocol, bookTokenS, bookTokenB, c.length)); depth != c.depth {
+			t.Errorf("%s: depth should be %q, but got %q", c.name, c.depth, depth)
+		}
+	}
+}
+
+func TestOrderBookPending(t *testing.T) {
+	pending := openBookOrder(1, 100, 100)
+	pending.validTime = 200
+	pending.ttl = 100
+
+	cases := []struct {
+		name  string
+		now   int64
+		depth string
+	}{
+		{"before valid time", 150, ""},
+		{"at valid time", 200, ""},
+		{"after valid time", 201, "1.00:100:1 "},
+		{"expired", 300, ""},
+	}
+
+	for _, c := range cases {
+		book := newOrderBook()
+		book.Update(pending.state(), 100)
+		if depth := depthString(book.Depth(bookProtocol, bookTokenS, bookTokenB, 0)); depth != "" {
+			t.Fatalf("pending order shouldn't be in depth, but got %q", depth)
+		}
+		book.Refresh(c.now)
+		if depth := depthString(book.Depth(bookProtocol, bookTokenS, bookTokenB, 0)); depth != c.depth {
+			t.Errorf("%s: depth should be %q, but got %q", c.name, c.depth, depth)
+		}
+	}
+
+	// the order is removed after it's valid and then expires
+	book := newOrderBook()
+	book.Update(pending.state(), 100)
+	book.Refresh(250)
+	book.Refresh(300)
+	if depth := depthString(book.Depth(bookProtocol, bookTokenS, bookTokenB, 0)); depth != "" {
+		t.Errorf("expired order should be removed, but got %q", depth)
+	}
+}
+
+func TestOrderBookCutoff(t *testing.T) {
+	oldA := openBookOrder(1, 100, 100)
+	oldA.validTime = 50
+	newA := openBookOrder(2, 200, 100)
+	newA.validTime = 80
+	oldB := openBookOrder(3, 300, 100)
+	oldB.owner = bookOwnerB
+	oldB.validTime = 50
+	pendingA := openBookOrder(4, 400, 100)
+	pendingA.validTime = 120
+
+	cases := []struct {
+		name   string
+		owner  common.Address
+		cutoff int64
+		depth  string
+		refill string // depth after pendingA becomes valid
+	}{
+		{"cutoff before all orders", bookOwnerA, 50, "3.00:300:1 2.00:200:1 1.00:100:1 ", "4.00:400:1 3.00:300:1 2.00:200:1 1.00:100:1 "},
+		{"cutoff some orders of owner", bookOwnerA, 60, "3.00:300:1 2.00:200:1 ", "4.00:400:1 3.00:300:1 2.00:200:1 "},
+		{"cutoff valid orders of owner", bookOwnerA, 100, "3.00:300:1 ", "4.00:400:1 3.00:300:1 "},
+		{"cutoff pending orders of owner", bookOwnerA, 130, "3.00:300:1 ", "3.00:300:1 "},
+		{"cutoff other owner", bookOwnerB, 130, "2.00:200:1 1.00:100:1 ", "4.00:400:1 2.00:200:1 1.00:100:1 "},
+	}
+
+	for _, c := range cases {
+		book := newOrderBook()
+		for _, o := range []bookOrder{oldA, newA, oldB, pendingA} {
+			book.Update(o.state(), 100)
+		}
+		book.Cutoff(c.owner, big.NewInt(c.cutoff))
+		if depth := depthString(book.Depth(bookProtocol, bookTokenS, bookTokenB, 0)); depth != c.depth {
+			t.Errorf("%s: depth should be %q, but got %q", c.name, c.depth, depth)
+		}
+		book.Refresh(150)
+		if depth := depthString(book.Depth(bookProtocol, bookTokenS, bookTokenB, 0)); depth != c.refill {
+			t.Errorf("%s: depth after refresh should be %q, but got %q", c.name, c.refill, depth)
+		}
+	}
+}
+
+func TestOrderBookReset(t *testing.T) {
+	book := newOrderBook()
+	book.Update(openBookOrder(1, 100, 100).state(), 100)
+	book.reset([]*types.OrderState{openBookOrder(2, 200, 100).state(), openBookOrder(3, 200, 100).state()}, 100)
+	if depth := depthString(book.Depth(bookProtocol, bookTokenS, bookTokenB, 0)); depth != "2.00:400:2 " {
+		t.Errorf("depth should be rebuilt by reset, but got %q", depth)
+	}
+}
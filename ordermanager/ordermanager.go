@@ -19,7 +19,7 @@
 package ordermanager
 
 import (
-	"fmt"
+	"bytes"
 	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/dao"
 	"github.com/Loopring/relay/eventemiter"
@@ -29,6 +29,14 @@ import (
 	"github.com/Loopring/relay/usermanager"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
+	"time"
+)
+
+const (
+	orderBookRefreshInterval = 10 * time.Second
+	orderBookLoadBatchSize   = 1000
+	// 默认重试10次，每次间隔1秒，无法处理的事件在此之前已存入死信队列
+	forkDrainTimeout = 60 * time.Second
 )
 
 type OrderManager interface {
@@ -36,31 +44,39 @@ type OrderManager interface {
 	Stop()
 	MinerOrders(protocol, tokenS, tokenB common.Address, length int, startBlockNumber, endBlockNumber int64, filterOrderHashLists ...*types.OrderDelayList) []*types.OrderState
 	GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]types.OrderState, error)
+	GetDepth(protocol, tokenS, tokenB common.Address, length int) []DepthLevel
 	GetOrders(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error)
 	GetOrderByHash(hash common.Hash) (*types.OrderState, error)
+	InsertOrders(states []*types.OrderState) error
 	UpdateBroadcastTimeByHash(hash common.Hash, bt int) error
+	SoftCancelOrder(hash common.Hash) (bool, error)
 	FillsPageQuery(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error)
 	RingMinedPageQuery(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error)
+	GetRingSubmitInfo(ringhash common.Hash) (*dao.RingSubmitInfo, []dao.RingSubmitTransition, error)
 	IsOrderCutoff(protocol, owner common.Address, createTime *big.Int) bool
 	IsOrderFullFinished(state *types.OrderState) bool
 	IsValueDusted(tokenAddress common.Address, value *big.Rat) bool
 	GetFrozenAmount(owner common.Address, token common.Address, statusSet []types.OrderStatus) (*big.Int, error)
 	GetFrozenLRCFee(owner common.Address, statusSet []types.OrderStatus) (*big.Int, error)
+	GetOrderCount(owner common.Address, statusSet []types.OrderStatus) (int, error)
 }
 
 type OrderManagerImpl struct {
-	options            *config.OrderManagerOptions
-	rds                dao.RdsService
-	processor          *forkProcessor
-	um                 usermanager.UserManager
-	mc                 marketcap.MarketCapProvider
-	cutoffCache        *CutoffCache
-	newOrderWatcher    *eventemitter.Watcher
-	ringMinedWatcher   *eventemitter.Watcher
-	fillOrderWatcher   *eventemitter.Watcher
-	cancelOrderWatcher *eventemitter.Watcher
-	cutoffOrderWatcher *eventemitter.Watcher
-	forkWatcher        *eventemitter.Watcher
+	options     *config.OrderManagerOptions
+	rds         dao.RdsService
+	processor   *forkProcessor
+	um          usermanager.UserManager
+	mc          marketcap.MarketCapProvider
+	cutoffCache *CutoffCache
+	forkWatcher *eventemitter.Watcher
+	stopFuncs   []func()
+	topics      []string
+	book        *orderBook
+	bookStop    chan struct{}
+	sweeper     *expirySweeper
+
+	reloadMark    []byte
+	getReloadMark func() []byte
 }
 
 func NewOrderManager(
@@ -76,6 +92,9 @@ func NewOrderManager(
 	om.um = userManager
 	om.mc = market
 	om.cutoffCache = NewCutoffCache(rds, options.CutoffCacheExpireTime, options.CutoffCacheCleanTime)
+	om.book = newOrderBook()
+	om.sweeper = newExpirySweeper(rds, om.book)
+	om.getReloadMark = orderBookReloadMark
 
 	dustOrderValue = om.options.DustOrderValue
 
@@ -84,207 +103,244 @@ func NewOrderManager(
 
 // Start start orderbook as a service
 func (om *OrderManagerImpl) Start() {
-	om.newOrderWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleGatewayOrder}
-	om.ringMinedWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleRingMined}
-	om.fillOrderWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleOrderFilled}
-	om.cancelOrderWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleOrderCancelled}
-	om.cutoffOrderWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleOrderCutoff}
-	om.forkWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleFork}
+	om.reloadMark = om.getReloadMark()
+	if err := om.loadOrderBook(); err != nil {
+		log.Fatalf("order manager,load order book error:%s", err.Error())
+	}
+	om.bookStop = make(chan struct{})
+	go om.refreshOrderBook(om.bookStop)
+
+	handlers := map[string]func(eventemitter.EventData) error{
+		eventemitter.OrderManagerGatewayNewOrder:    om.handleGatewayOrder,
+		eventemitter.OrderManagerExtractorRingMined: om.handleRingMined,
+		eventemitter.OrderManagerExtractorFill:      om.handleOrderFilled,
+		eventemitter.OrderManagerExtractorCancel:    om.handleOrderCancelled,
+		eventemitter.OrderManagerExtractorCutoff:    om.handleOrderCutoff,
+	}
+	// events of durable topics not handled before restart will be delivered again
+	for topic, handle := range handlers {
+		stop, err := eventemitter.Subscribe(topic, "ordermanager", handle)
+		if err != nil {
+			log.Fatalf("order manager,subscribe topic:%s error:%s", topic, err.Error())
+		}
+		om.stopFuncs = append(om.stopFuncs, stop)
+		om.topics = append(om.topics, topic)
+	}
 
-	eventemitter.On(eventemitter.OrderManagerGatewayNewOrder, om.newOrderWatcher)
-	eventemitter.On(eventemitter.OrderManagerExtractorRingMined, om.ringMinedWatcher)
-	eventemitter.On(eventemitter.OrderManagerExtractorFill, om.fillOrderWatcher)
-	eventemitter.On(eventemitter.OrderManagerExtractorCancel, om.cancelOrderWatcher)
-	eventemitter.On(eventemitter.OrderManagerExtractorCutoff, om.cutoffOrderWatcher)
+	om.forkWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleFork}
 	eventemitter.On(eventemitter.ChainForkProcess, om.forkWatcher)
+
+	om.sweeper.start()
 }
 
 func (om *OrderManagerImpl) Stop() {
-	eventemitter.Un(eventemitter.OrderManagerGatewayNewOrder, om.newOrderWatcher)
-	eventemitter.Un(eventemitter.OrderManagerExtractorRingMined, om.ringMinedWatcher)
-	eventemitter.Un(eventemitter.OrderManagerExtractorFill, om.fillOrderWatcher)
-	eventemitter.Un(eventemitter.OrderManagerExtractorCancel, om.cancelOrderWatcher)
-	eventemitter.Un(eventemitter.OrderManagerExtractorCutoff, om.cutoffOrderWatcher)
+	for _, stop := range om.stopFuncs {
+		stop()
+	}
+	om.stopFuncs = nil
+	om.topics = nil
 	eventemitter.Un(eventemitter.ChainForkProcess, om.forkWatcher)
+	if nil != om.bookStop {
+		close(om.bookStop)
+		om.bookStop = nil
+	}
+	om.sweeper.quit()
 }
 
 func (om *OrderManagerImpl) handleFork(input eventemitter.EventData) error {
+	// events emitted before the fork are handled first, otherwise they would be saved after rolled back
+	for _, topic := range om.topics {
+		if err := eventemitter.Drain(topic, "ordermanager", forkDrainTimeout); err != nil {
+			log.Errorf("order manager,drain topic:%s before fork error:%s, the unhandled events of forked blocks may be saved after rollback", topic, err.Error())
+		}
+	}
 	if err := om.processor.fork(input.(*types.ForkedEvent)); err != nil {
 		log.Errorf("order manager,handle fork error:%s", err.Error())
 	}
+	// orders have been rolled back in mysql directly
+	if err := om.loadOrderBook(); err != nil {
+		log.Errorf("order manager,reload order book after fork error:%s", err.Error())
+	}
 	return nil
 }
 
-// 所有来自gateway的订单都是新订单
-func (om *OrderManagerImpl) handleGatewayOrder(input eventemitter.EventData) error {
-	state := input.(*types.OrderState)
-	log.Debugf("order manager,handle gateway order,order.hash:%s amountS:%s", state.RawOrder.Hash.Hex(), state.RawOrder.AmountS.String())
-
-	model, err := newOrderEntity(state, om.mc, nil)
-	if err != nil {
-		return err
+// loadOrderBook rebuilds the order book with all open orders in mysql
+func (om *OrderManagerImpl) loadOrderBook() error {
+	states := []*types.OrderState{}
+	fromId := 0
+	for {
+		models, err := om.rds.GetOpenOrders(fromId, orderBookLoadBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, model := range models {
+			state := &types.OrderState{}
+			if err := model.ConvertUp(state); err != nil {
+				log.Errorf("order manager,load order book,convert order %s error:%s", model.OrderHash, err.Error())
+				continue
+			}
+			states = append(states, state)
+		}
+		if len(models) < orderBookLoadBatchSize {
+			break
+		}
+		fromId = models[len(models)-1].ID
 	}
 
-	return om.rds.Add(model)
+	om.book.reset(states, time.Now().Unix())
+	log.Infof("order manager,order book loaded %d orders", len(states))
+	return nil
 }
 
-func (om *OrderManagerImpl) handleRingMined(input eventemitter.EventData) error {
-	event := input.(*types.RingMinedEvent)
-
-	var (
-		model = &dao.RingMinedEvent{}
-		err   error
-	)
-
-	model, err = om.rds.FindRingMinedByRingIndex(event.RingIndex.String())
-	if err == nil {
-		return fmt.Errorf("order manager,handle ringmined event,ring %s has already exist", event.Ringhash.Hex())
-	}
-	if err = model.ConvertDown(event); err != nil {
-		return err
+func (om *OrderManagerImpl) refreshOrderBook(stop chan struct{}) {
+	ticker := time.NewTicker(orderBookRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			om.reloadIfReindexed()
+			om.book.Refresh(now.Unix())
+		}
 	}
+}
 
-	if err = om.rds.Add(model); err != nil {
-		return fmt.Errorf("order manager,handle ringmined event,insert ring error:%s", err.Error())
+// reloadIfReindexed reloads the order book after the orders in mysql are recomputed by reindex
+func (om *OrderManagerImpl) reloadIfReindexed() {
+	mark := om.getReloadMark()
+	if bytes.Equal(mark, om.reloadMark) {
+		return
 	}
-
-	return nil
+	log.Infof("order manager,orders reindexed, reload order book")
+	if err := om.loadOrderBook(); err != nil {
+		log.Errorf("order manager,reload order book after reindex error:%s", err.Error())
+		return
+	}
+	om.reloadMark = mark
 }
 
-func (om *OrderManagerImpl) handleOrderFilled(input eventemitter.EventData) error {
-	event := input.(*types.OrderFilledEvent)
+// 所有来自gateway的订单都是新订单
+func (om *OrderManagerImpl) handleGatewayOrder(input eventemitter.EventData) error {
+	state := input.(*types.OrderState)
+	log.Debugf("order manager,handle gateway order,order.hash:%s amountS:%s", state.RawOrder.Hash.Hex(), state.RawOrder.AmountS.String())
 
-	// save event
-	_, err := om.rds.FindFillEventByRinghashAndOrderhash(event.Ringhash, event.OrderHash)
-	if err == nil {
-		log.Debugf("order manager,handle order filled event,fill already exist ringIndex:%s orderHash:%s", event.RingIndex.String(), event.OrderHash.Hex())
+	if _, err := om.rds.GetOrderByHash(state.RawOrder.Hash); err == nil {
+		log.Debugf("order manager,handle gateway order,order %s already exist", state.RawOrder.Hash.Hex())
 		return nil
 	}
 
-	newFillModel := &dao.FillEvent{}
-	if err := newFillModel.ConvertDown(event); err != nil {
-		log.Debugf("order manager,handle order filled event error:order %s convert down failed", event.OrderHash.Hex())
-		return err
-	}
-	if err := om.rds.Add(newFillModel); err != nil {
-		log.Debugf("order manager,handle order filled event error:order %s insert faild", event.OrderHash.Hex())
-		return err
-	}
-
-	// get rds.Order and types.OrderState
-	state := &types.OrderState{UpdatedBlock: event.Blocknumber}
-	model, err := om.rds.GetOrderByHash(event.OrderHash)
+	model, err := newOrderEntity(state, om.mc, nil)
 	if err != nil {
 		return err
 	}
-	if err := model.ConvertUp(state); err != nil {
+
+	if err := om.rds.Add(model); err != nil {
 		return err
 	}
+	om.book.Update(state, time.Now().Unix())
+	return nil
+}
 
-	// judge order status
-	if state.Status == types.ORDER_CUTOFF || state.Status == types.ORDER_FINISHED || state.Status == types.ORDER_UNKNOWN {
-		log.Debugf("order manager,handle order filled event,order %s status is %d ", state.RawOrder.Hash.Hex(), state.Status)
-		return nil
-	}
+func (om *OrderManagerImpl) handleRingMined(input eventemitter.EventData) error {
+	return saveRingMined(om.rds, input.(*types.RingMinedEvent))
+}
 
-	// calculate dealt amount
-	state.UpdatedBlock = event.Blocknumber
-	state.DealtAmountS = new(big.Int).Add(state.DealtAmountS, event.AmountS)
-	state.DealtAmountB = new(big.Int).Add(state.DealtAmountB, event.AmountB)
-	state.SplitAmountS = new(big.Int).Add(state.SplitAmountS, event.SplitS)
-	state.SplitAmountB = new(big.Int).Add(state.SplitAmountB, event.SplitB)
+// the fill is saved with the order locked, reindex recomputes the order either before or after both of them
+func (om *OrderManagerImpl) handleOrderFilled(input eventemitter.EventData) error {
+	event := input.(*types.OrderFilledEvent)
 
-	log.Debugf("order manager,handle order filled event orderhash:%s,dealAmountS:%s,dealtAmountB:%s", state.RawOrder.Hash.Hex(), state.DealtAmountS.String(), state.DealtAmountB.String())
+	return om.rds.LockOrder(event.OrderHash, func(rds dao.RdsService, model *dao.Order) error {
+		// save event
+		if saved, err := saveFill(rds, event); err != nil || !saved {
+			return err
+		}
+		if nil == model {
+			log.Debugf("order manager,handle order filled event,order %s not found", event.OrderHash.Hex())
+			return nil
+		}
 
-	// update order status
-	settleOrderStatus(state, om.mc)
+		// get rds.Order and types.OrderState
+		state := &types.OrderState{UpdatedBlock: event.Blocknumber}
+		if err := model.ConvertUp(state); err != nil {
+			return err
+		}
 
-	// update rds.Order
-	if err := model.ConvertDown(state); err != nil {
-		log.Errorf(err.Error())
-		return err
-	}
-	if err := om.rds.UpdateOrderWhileFill(state.RawOrder.Hash, state.Status, state.DealtAmountS, state.DealtAmountB, state.SplitAmountS, state.SplitAmountB, state.UpdatedBlock); err != nil {
-		return err
-	}
+		// judge order status
+		if state.Status == types.ORDER_CUTOFF || state.Status == types.ORDER_FINISHED || state.Status == types.ORDER_UNKNOWN {
+			log.Debugf("order manager,handle order filled event,order %s status is %d ", state.RawOrder.Hash.Hex(), state.Status)
+			return nil
+		}
 
-	return nil
+		// calculate dealt amount
+		state.UpdatedBlock = event.Blocknumber
+		state.DealtAmountS = new(big.Int).Add(state.DealtAmountS, event.AmountS)
+		state.DealtAmountB = new(big.Int).Add(state.DealtAmountB, event.AmountB)
+		state.SplitAmountS = new(big.Int).Add(state.SplitAmountS, event.SplitS)
+		state.SplitAmountB = new(big.Int).Add(state.SplitAmountB, event.SplitB)
+
+		log.Debugf("order manager,handle order filled event orderhash:%s,dealAmountS:%s,dealtAmountB:%s", state.RawOrder.Hash.Hex(), state.DealtAmountS.String(), state.DealtAmountB.String())
+
+		// update order status
+		settleOrderStatus(state, om.mc)
+
+		// update rds.Order
+		if err := rds.UpdateOrderWhileFill(state.RawOrder.Hash, state.Status, state.DealtAmountS, state.DealtAmountB, state.SplitAmountS, state.SplitAmountB, state.UpdatedBlock); err != nil {
+			return err
+		}
+		// 在订单锁内更新订单簿，与数据库的更新顺序一致
+		om.book.Update(state, time.Now().Unix())
+		return nil
+	})
 }
 
 func (om *OrderManagerImpl) handleOrderCancelled(input eventemitter.EventData) error {
 	event := input.(*types.OrderCancelledEvent)
 
-	// save event
-	_, err := om.rds.FindCancelEvent(event.OrderHash, event.TxHash)
-	if err == nil {
-		log.Debugf("order manager,handle order cancelled event error:event %s have already exist", event.OrderHash.Hex())
-		return nil
-	}
-	newCancelEventModel := &dao.CancelEvent{}
-	if err := newCancelEventModel.ConvertDown(event); err != nil {
-		return err
-	}
-	if err := om.rds.Add(newCancelEventModel); err != nil {
-		return err
-	}
-
-	// get rds.Order and types.OrderState
-	state := &types.OrderState{}
-	model, err := om.rds.GetOrderByHash(event.OrderHash)
-	if err != nil {
-		return err
-	}
-	if err := model.ConvertUp(state); err != nil {
-		return err
-	}
+	return om.rds.LockOrder(event.OrderHash, func(rds dao.RdsService, model *dao.Order) error {
+		// save event
+		if saved, err := saveCancel(rds, event); err != nil || !saved {
+			return err
+		}
+		if nil == model {
+			log.Debugf("order manager,handle order cancelled event,order %s not found", event.OrderHash.Hex())
+			return nil
+		}
 
-	// calculate remainAmount and cancelled amount should be saved whether order is finished or not
-	if state.RawOrder.BuyNoMoreThanAmountB {
-		state.CancelledAmountB = new(big.Int).Add(state.CancelledAmountB, event.AmountCancelled)
-		log.Debugf("order manager,handle order cancelled event,order:%s cancelled amountb:%s", state.RawOrder.Hash.Hex(), state.CancelledAmountB.String())
-	} else {
-		state.CancelledAmountS = new(big.Int).Add(state.CancelledAmountS, event.AmountCancelled)
-		log.Debugf("order manager,handle order cancelled event,order:%s cancelled amounts:%s", state.RawOrder.Hash.Hex(), state.CancelledAmountS.String())
-	}
+		// get rds.Order and types.OrderState
+		state := &types.OrderState{}
+		if err := model.ConvertUp(state); err != nil {
+			return err
+		}
 
-	// update order status
-	settleOrderStatus(state, om.mc)
-	state.UpdatedBlock = event.Blocknumber
+		// calculate remainAmount and cancelled amount should be saved whether order is finished or not
+		if state.RawOrder.BuyNoMoreThanAmountB {
+			state.CancelledAmountB = new(big.Int).Add(state.CancelledAmountB, event.AmountCancelled)
+			log.Debugf("order manager,handle order cancelled event,order:%s cancelled amountb:%s", state.RawOrder.Hash.Hex(), state.CancelledAmountB.String())
+		} else {
+			state.CancelledAmountS = new(big.Int).Add(state.CancelledAmountS, event.AmountCancelled)
+			log.Debugf("order manager,handle order cancelled event,order:%s cancelled amounts:%s", state.RawOrder.Hash.Hex(), state.CancelledAmountS.String())
+		}
 
-	// update rds.Order
-	if err := model.ConvertDown(state); err != nil {
-		return err
-	}
-	if err := om.rds.UpdateOrderWhileCancel(state.RawOrder.Hash, state.Status, state.CancelledAmountS, state.CancelledAmountB, state.UpdatedBlock); err != nil {
-		return err
-	}
+		// update order status
+		settleOrderStatus(state, om.mc)
+		state.UpdatedBlock = event.Blocknumber
 
-	return nil
+		// update rds.Order
+		if err := rds.UpdateOrderWhileCancel(state.RawOrder.Hash, state.Status, state.CancelledAmountS, state.CancelledAmountB, state.UpdatedBlock); err != nil {
+			return err
+		}
+		om.book.Update(state, time.Now().Unix())
+		return nil
+	})
 }
 
 func (om *OrderManagerImpl) handleOrderCutoff(input eventemitter.EventData) error {
 	event := input.(*types.CutoffEvent)
-
-	protocol := event.ContractAddress
-	owner := event.Owner
-	currentCutoff := event.Cutoff
-	lastCutoff, ok := om.cutoffCache.Get(event.ContractAddress, event.Owner)
-
-	var addErr, delErr error
-	if !ok {
-		addErr = om.cutoffCache.Add(event)
-	} else if ok && lastCutoff.Cmp(event.Cutoff) >= 0 {
-		log.Debugf("order manager, handle cutoff event, protocol:%s - owner:%s lastCutofftime:%s > currentCutoffTime:%s", protocol.Hex(), owner.Hex(), lastCutoff.String(), currentCutoff.String())
-	} else {
-		delErr = om.cutoffCache.Del(event.ContractAddress, event.Owner)
-		addErr = om.cutoffCache.Add(event)
-	}
-
-	if addErr != nil || delErr != nil {
-		return fmt.Errorf("order manager,handle cutoff error: cutoffCache add or del failed")
+	if err := saveCutoff(om.cutoffCache, om.rds, event); err != nil {
+		return err
 	}
-
-	om.rds.SetCutOff(owner, currentCutoff)
+	om.book.Cutoff(event.Owner, event.Cutoff)
 	log.Debugf("order manager,handle cutoff event, owner:%s, cutoffTimestamp:%s", event.Owner.Hex(), event.Cutoff.String())
 	return nil
 }
@@ -306,7 +362,7 @@ func (om *OrderManagerImpl) MinerOrders(protocol, tokenS, tokenB common.Address,
 		list         []*types.OrderState
 		modelList    []*dao.Order
 		err          error
-		filterStatus = []types.OrderStatus{types.ORDER_FINISHED, types.ORDER_CUTOFF, types.ORDER_CANCEL}
+		filterStatus = []types.OrderStatus{types.ORDER_FINISHED, types.ORDER_CUTOFF, types.ORDER_CANCEL, types.ORDER_SOFT_CANCEL, types.ORDER_EXPIRE}
 	)
 
 	for _, orderDelay := range filterOrderHashLists {
@@ -357,6 +413,11 @@ func (om *OrderManagerImpl) GetOrderBook(protocol, tokenS, tokenB common.Address
 	return list, nil
 }
 
+// GetDepth returns the price levels of open orders in the order book, sorted by price desc
+func (om *OrderManagerImpl) GetDepth(protocol, tokenS, tokenB common.Address, length int) []DepthLevel {
+	return om.book.Depth(protocol, tokenS, tokenB, length)
+}
+
 func (om *OrderManagerImpl) GetOrders(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error) {
 	var (
 		pageRes dao.PageResult
@@ -396,6 +457,43 @@ func (om *OrderManagerImpl) GetOrderByHash(hash common.Hash) (orderState *types.
 	return &result, nil
 }
 
+// InsertOrders saves the orders submitted by gateway in one transaction
+func (om *OrderManagerImpl) InsertOrders(states []*types.OrderState) error {
+	models := []*dao.Order{}
+	for _, state := range states {
+		model, err := newOrderEntity(state, om.mc, nil)
+		if err != nil {
+			return err
+		}
+		models = append(models, model)
+	}
+	if err := om.rds.AddOrders(models); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, state := range states {
+		om.book.Update(state, now)
+	}
+	return nil
+}
+
+// SoftCancelOrder marks the open order as soft cancelled, it returns false if the order isn't open
+func (om *OrderManagerImpl) SoftCancelOrder(hash common.Hash) (bool, error) {
+	affected, err := om.rds.UpdateOrderStatusByHash(hash, types.ORDER_SOFT_CANCEL, []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL})
+	if err != nil || affected == 0 {
+		return false, err
+	}
+	om.book.Remove(hash)
+
+	state, err := om.GetOrderByHash(hash)
+	if err != nil {
+		return true, err
+	}
+	eventemitter.Emit(eventemitter.OrderManagerSoftCancel, state)
+	return true, nil
+}
+
 func (om *OrderManagerImpl) UpdateBroadcastTimeByHash(hash common.Hash, bt int) error {
 	return om.rds.UpdateBroadcastTimeByHash(hash.Hex(), bt)
 }
@@ -408,6 +506,19 @@ func (om *OrderManagerImpl) RingMinedPageQuery(query map[string]interface{}, pag
 	return om.rds.RingMinedPageQuery(query, pageIndex, pageSize)
 }
 
+// GetRingSubmitInfo returns the ring submitted by miner and the transitions of its status
+func (om *OrderManagerImpl) GetRingSubmitInfo(ringhash common.Hash) (*dao.RingSubmitInfo, []dao.RingSubmitTransition, error) {
+	info, err := om.rds.GetRingForSubmitByHash(ringhash)
+	if err != nil {
+		return nil, nil, err
+	}
+	transitions, err := om.rds.GetRingSubmitTransitions(ringhash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &info, transitions, nil
+}
+
 func (om *OrderManagerImpl) IsOrderCutoff(protocol, owner common.Address, createTime *big.Int) bool {
 	return om.cutoffCache.IsOrderCutoff(protocol, owner, createTime)
 }
@@ -455,3 +566,7 @@ func (om *OrderManagerImpl) GetFrozenLRCFee(owner common.Address, statusSet []ty
 
 	return totalAmount, nil
 }
+
+func (om *OrderManagerImpl) GetOrderCount(owner common.Address, statusSet []types.OrderStatus) (int, error) {
+	return om.rds.GetOrderCountByOwner(owner, statusSet)
+}
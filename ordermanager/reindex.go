@@ -0,0 +1,314 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/Loopring/relay/cache"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// reindex changes the mark in redis after orders recomputed, the live node reloads its order book once it's changed
+	orderBookReloadKey = "ordermanager_orderbook_reload"
+	orderBookReloadTtl = 7 * 24 * 3600
+)
+
+// Reindexer rebuilds the events of a block range in mysql, it runs in a process apart from the live node.
+// the rolled back events are saved again by the extractor events emitted locally with the handlers of
+// ordermanager, then the amounts and status of affected orders are recomputed from all of their fills and
+// cancels with the orders locked. the live node is asked to reload its order book by the mark in redis
+type Reindexer struct {
+	rds         dao.RdsService
+	mc          marketcap.MarketCapProvider
+	cutoffCache *CutoffCache
+	orders      map[common.Hash]bool
+	owners      map[common.Address]bool
+	watchers    map[string]*eventemitter.Watcher
+
+	requestReload func() error
+}
+
+func NewReindexer(rds dao.RdsService, mc marketcap.MarketCapProvider) *Reindexer {
+	r := &Reindexer{}
+	r.rds = rds
+	r.mc = mc
+	r.cutoffCache = NewCutoffCache(rds, 0, 0)
+	r.requestReload = requestOrderBookReload
+	r.orders = make(map[common.Hash]bool)
+	r.owners = make(map[common.Address]bool)
+	return r
+}
+
+func (r *Reindexer) Start() {
+	handlers := map[string]func(eventemitter.EventData) error{
+		eventemitter.OrderManagerExtractorRingMined: r.handleRingMined,
+		eventemitter.OrderManagerExtractorFill:      r.handleOrderFilled,
+		eventemitter.OrderManagerExtractorCancel:    r.handleOrderCancelled,
+		eventemitter.OrderManagerExtractorCutoff:    r.handleOrderCutoff,
+	}
+	r.watchers = make(map[string]*eventemitter.Watcher)
+	for topic, handle := range handlers {
+		watcher := &eventemitter.Watcher{Concurrent: false, Handle: handle}
+		eventemitter.On(topic, watcher)
+		r.watchers[topic] = watcher
+	}
+}
+
+func (r *Reindexer) Stop() {
+	for topic, watcher := range r.watchers {
+		eventemitter.Un(topic, watcher)
+	}
+	r.watchers = nil
+}
+
+// RollBack deletes ring mined, fills, cancels and cutoffs of blocks in (from, to],
+// the orders and owners of them are recomputed after the blocks extracted again
+func (r *Reindexer) RollBack(from, to int64) error {
+	fills, err := r.rds.GetFillsWithBlockNumberRange(from, to)
+	if err != nil {
+		return err
+	}
+	for _, v := range fills {
+		r.orders[common.HexToHash(v.OrderHash)] = true
+	}
+	cancels, err := r.rds.GetCancelsWithBlockNumberRange(from, to)
+	if err != nil {
+		return err
+	}
+	for _, v := range cancels {
+		r.orders[common.HexToHash(v.OrderHash)] = true
+	}
+	cutoffs, err := r.rds.GetCutoffsWithBlockNumberRange(from, to)
+	if err != nil {
+		return err
+	}
+	for _, v := range cutoffs {
+		r.owners[common.HexToAddress(v.Owner)] = true
+	}
+
+	if err := r.rds.RollBackRingMined(from, to); err != nil {
+		return err
+	}
+	if err := r.rds.RollBackFill(from, to); err != nil {
+		return err
+	}
+	if err := r.rds.RollBackCancel(from, to); err != nil {
+		return err
+	}
+	if err := r.rds.RollBackCutoff(from, to); err != nil {
+		return err
+	}
+	// 缓存中可能是已删除的cutoff，不清除的话重新提取的cutoff不会被保存
+	for _, v := range cutoffs {
+		r.cutoffCache.del(common.HexToAddress(v.Protocol), common.HexToAddress(v.Owner))
+	}
+	return nil
+}
+
+// Recompute settles the orders and owners affected since last recompute, and asks the live node to reload
+// its order book
+func (r *Reindexer) Recompute() error {
+	if len(r.orders) == 0 && len(r.owners) == 0 {
+		return nil
+	}
+	for hash := range r.orders {
+		if err := r.recomputeOrder(hash); err != nil {
+			return err
+		}
+	}
+	for owner := range r.owners {
+		if err := r.recomputeCutoff(owner); err != nil {
+			return err
+		}
+	}
+	r.orders = make(map[common.Hash]bool)
+	r.owners = make(map[common.Address]bool)
+	return r.requestReload()
+}
+
+// recomputeOrder locks the order as the live handlers do, the fills and cancels saved by them are either
+// all included, or applied to the recomputed amounts after the lock released
+func (r *Reindexer) recomputeOrder(hash common.Hash) error {
+	return r.rds.LockOrder(hash, func(rds dao.RdsService, model *dao.Order) error {
+		if nil == model {
+			log.Debugf("order manager,reindex order:%s not found", hash.Hex())
+			return nil
+		}
+		return r.recomputeLockedOrder(rds, hash, model)
+	})
+}
+
+func (r *Reindexer) recomputeLockedOrder(rds dao.RdsService, hash common.Hash, model *dao.Order) error {
+	state := &types.OrderState{}
+	if err := model.ConvertUp(state); err != nil {
+		return err
+	}
+	if state.Status == types.ORDER_UNKNOWN {
+		return nil
+	}
+
+	fills, err := rds.GetFillsByOrderHash(hash)
+	if err != nil {
+		return err
+	}
+	cancels, err := rds.GetCancelsByOrderHash(hash)
+	if err != nil {
+		return err
+	}
+
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.SplitAmountS = big.NewInt(0)
+	state.SplitAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	for _, v := range fills {
+		state.DealtAmountS.Add(state.DealtAmountS, parseAmount(v.AmountS))
+		state.DealtAmountB.Add(state.DealtAmountB, parseAmount(v.AmountB))
+		state.SplitAmountS.Add(state.SplitAmountS, parseAmount(v.SplitS))
+		state.SplitAmountB.Add(state.SplitAmountB, parseAmount(v.SplitB))
+		updateBlock(state, v.BlockNumber)
+	}
+	for _, v := range cancels {
+		if state.RawOrder.BuyNoMoreThanAmountB {
+			state.CancelledAmountB.Add(state.CancelledAmountB, parseAmount(v.AmountCancelled))
+		} else {
+			state.CancelledAmountS.Add(state.CancelledAmountS, parseAmount(v.AmountCancelled))
+		}
+		updateBlock(state, v.BlockNumber)
+	}
+
+	// 截止时间内的订单保持cutoff状态，其他状态由成交和取消数量重新判断
+	if state.Status != types.ORDER_CUTOFF || !isOrderCutoff(rds, state) {
+		if state.Status == types.ORDER_CUTOFF {
+			state.Status = types.ORDER_NEW
+		}
+		settleOrderStatus(state, r.mc)
+	}
+
+	if err := rds.UpdateOrderWhileFill(hash, state.Status, state.DealtAmountS, state.DealtAmountB, state.SplitAmountS, state.SplitAmountB, state.UpdatedBlock); err != nil {
+		return err
+	}
+	return rds.UpdateOrderWhileCancel(hash, state.Status, state.CancelledAmountS, state.CancelledAmountB, state.UpdatedBlock)
+}
+
+// recomputeCutoff restores the cutoff orders of owner which aren't cut off by the current cutoff
+func (r *Reindexer) recomputeCutoff(owner common.Address) error {
+	list, err := r.rds.GetOrdersByOwnerAndStatus(owner, []types.OrderStatus{types.ORDER_CUTOFF})
+	if err != nil {
+		return err
+	}
+	for _, v := range list {
+		state := &types.OrderState{}
+		if err := v.ConvertUp(state); err != nil {
+			log.Errorf("order manager,reindex cutoff error:%s", err.Error())
+			continue
+		}
+		if isOrderCutoff(r.rds, state) {
+			continue
+		}
+		// the amounts may be changed by live node after listed, status is settled with the locked order
+		err := r.rds.LockOrder(state.RawOrder.Hash, func(rds dao.RdsService, model *dao.Order) error {
+			if nil == model || types.OrderStatus(model.Status) != types.ORDER_CUTOFF {
+				return nil
+			}
+			locked := &types.OrderState{}
+			if err := model.ConvertUp(locked); err != nil {
+				return err
+			}
+			locked.Status = types.ORDER_NEW
+			settleOrderStatus(locked, r.mc)
+			_, err := rds.UpdateOrderStatusByHash(locked.RawOrder.Hash, locked.Status, []types.OrderStatus{types.ORDER_CUTOFF})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOrderCutoff judges as SetCutOff does
+func isOrderCutoff(rds dao.RdsService, state *types.OrderState) bool {
+	entity, err := rds.GetCutoffEvent(state.RawOrder.Protocol, state.RawOrder.Owner)
+	if err != nil {
+		return false
+	}
+	return state.RawOrder.Timestamp.Int64() < entity.Cutoff
+}
+
+func (r *Reindexer) handleRingMined(input eventemitter.EventData) error {
+	return saveRingMined(r.rds, input.(*types.RingMinedEvent))
+}
+
+func (r *Reindexer) handleOrderFilled(input eventemitter.EventData) error {
+	event := input.(*types.OrderFilledEvent)
+	r.orders[event.OrderHash] = true
+	_, err := saveFill(r.rds, event)
+	return err
+}
+
+func (r *Reindexer) handleOrderCancelled(input eventemitter.EventData) error {
+	event := input.(*types.OrderCancelledEvent)
+	r.orders[event.OrderHash] = true
+	_, err := saveCancel(r.rds, event)
+	return err
+}
+
+func (r *Reindexer) handleOrderCutoff(input eventemitter.EventData) error {
+	event := input.(*types.CutoffEvent)
+	r.owners[event.Owner] = true
+	return saveCutoff(r.cutoffCache, r.rds, event)
+}
+
+// requestOrderBookReload changes the reload mark in redis
+func requestOrderBookReload() error {
+	return cache.Set(orderBookReloadKey, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), orderBookReloadTtl)
+}
+
+// orderBookReloadMark returns the reload mark in redis, it's empty if reindex never ran
+func orderBookReloadMark() []byte {
+	mark, err := cache.Get(orderBookReloadKey)
+	if err != nil {
+		return []byte{}
+	}
+	return mark
+}
+
+func parseAmount(amount string) *big.Int {
+	if value, ok := new(big.Int).SetString(amount, 10); ok {
+		return value
+	}
+	return big.NewInt(0)
+}
+
+func updateBlock(state *types.OrderState, blockNumber int64) {
+	if nil == state.UpdatedBlock || state.UpdatedBlock.Int64() < blockNumber {
+		state.UpdatedBlock = big.NewInt(blockNumber)
+	}
+}
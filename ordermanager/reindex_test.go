@@ -0,0 +1,420 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// reindexRds keeps an order and its fills in memory, LockOrder holds the lock as select for update does
+type reindexRds struct {
+	dao.RdsService
+	mtx         sync.Mutex
+	orders      map[common.Hash]*dao.Order
+	fills       []dao.FillEvent
+	cancels     []dao.CancelEvent
+	cutoffs     []dao.CutOffEvent
+	openQueried int
+	unlocked    func() // called after the lock is released
+}
+
+func (r *reindexRds) LockOrder(orderhash common.Hash, fn func(rds dao.RdsService, order *dao.Order) error) error {
+	r.mtx.Lock()
+	err := fn(r, r.orders[orderhash])
+	r.mtx.Unlock()
+	if nil != r.unlocked {
+		r.unlocked()
+	}
+	return err
+}
+
+func (r *reindexRds) FindFillEventByRinghashAndOrderhash(ringhash, orderhash common.Hash) (*dao.FillEvent, error) {
+	for _, fill := range r.fills {
+		if fill.RingHash == ringhash.Hex() && fill.OrderHash == orderhash.Hex() {
+			return &fill, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *reindexRds) FindCancelEvent(orderhash, txhash common.Hash) (*dao.CancelEvent, error) {
+	return nil, errors.New("record not found")
+}
+
+func (r *reindexRds) Add(item interface{}) error {
+	switch item := item.(type) {
+	case *dao.FillEvent:
+		r.fills = append(r.fills, *item)
+	case *dao.CancelEvent:
+		r.cancels = append(r.cancels, *item)
+	case *dao.CutOffEvent:
+		r.cutoffs = append(r.cutoffs, *item)
+	}
+	return nil
+}
+
+func (r *reindexRds) GetFillsByOrderHash(orderhash common.Hash) ([]dao.FillEvent, error) {
+	list := []dao.FillEvent{}
+	for _, fill := range r.fills {
+		if fill.OrderHash == orderhash.Hex() {
+			list = append(list, fill)
+		}
+	}
+	return list, nil
+}
+
+func (r *reindexRds) GetCancelsByOrderHash(orderhash common.Hash) ([]dao.CancelEvent, error) {
+	return []dao.CancelEvent{}, nil
+}
+
+func (r *reindexRds) GetCutoffEvent(protocol, owner common.Address) (*dao.CutOffEvent, error) {
+	for _, cutoff := range r.cutoffs {
+		if cutoff.Protocol == protocol.Hex() && cutoff.Owner == owner.Hex() {
+			return &cutoff, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *reindexRds) DelCutoffEvent(protocol, owner common.Address) error {
+	kept := []dao.CutOffEvent{}
+	for _, cutoff := range r.cutoffs {
+		if cutoff.Protocol != protocol.Hex() || cutoff.Owner != owner.Hex() {
+			kept = append(kept, cutoff)
+		}
+	}
+	r.cutoffs = kept
+	return nil
+}
+
+func (r *reindexRds) GetFillsWithBlockNumberRange(from, to int64) ([]dao.FillEvent, error) {
+	return []dao.FillEvent{}, nil
+}
+
+func (r *reindexRds) GetCancelsWithBlockNumberRange(from, to int64) ([]dao.CancelEvent, error) {
+	return []dao.CancelEvent{}, nil
+}
+
+func (r *reindexRds) GetCutoffsWithBlockNumberRange(from, to int64) ([]dao.CutOffEvent, error) {
+	list := []dao.CutOffEvent{}
+	for _, cutoff := range r.cutoffs {
+		if cutoff.BlockNumber > from && cutoff.BlockNumber <= to {
+			list = append(list, cutoff)
+		}
+	}
+	return list, nil
+}
+
+func (r *reindexRds) RollBackRingMined(from, to int64) error { return nil }
+func (r *reindexRds) RollBackFill(from, to int64) error      { return nil }
+func (r *reindexRds) RollBackCancel(from, to int64) error    { return nil }
+
+func (r *reindexRds) RollBackCutoff(from, to int64) error {
+	kept := []dao.CutOffEvent{}
+	for _, cutoff := range r.cutoffs {
+		if cutoff.BlockNumber <= from || cutoff.BlockNumber > to {
+			kept = append(kept, cutoff)
+		}
+	}
+	r.cutoffs = kept
+	return nil
+}
+
+func (r *reindexRds) SetCutOff(owner common.Address, cutoffTime *big.Int) error {
+	for _, o := range r.orders {
+		if o.Owner == owner.Hex() && o.ValidTime < cutoffTime.Int64() && (types.OrderStatus(o.Status) == types.ORDER_NEW || types.OrderStatus(o.Status) == types.ORDER_PARTIAL) {
+			o.Status = uint8(types.ORDER_CUTOFF)
+		}
+	}
+	return nil
+}
+
+func (r *reindexRds) GetOrdersByOwnerAndStatus(owner common.Address, status []types.OrderStatus) ([]dao.Order, error) {
+	list := []dao.Order{}
+	for _, o := range r.orders {
+		for _, s := range status {
+			if o.Owner == owner.Hex() && types.OrderStatus(o.Status) == s {
+				list = append(list, *o)
+			}
+		}
+	}
+	return list, nil
+}
+
+func (r *reindexRds) UpdateOrderStatusByHash(orderhash common.Hash, status types.OrderStatus, statusList []types.OrderStatus) (int64, error) {
+	o := r.orders[orderhash]
+	for _, s := range statusList {
+		if types.OrderStatus(o.Status) == s {
+			o.Status = uint8(status)
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (r *reindexRds) UpdateOrderWhileFill(hash common.Hash, status types.OrderStatus, dealtAmountS, dealtAmountB, splitAmountS, splitAmountB, blockNumber *big.Int) error {
+	o := r.orders[hash]
+	o.Status = uint8(status)
+	o.DealtAmountS = dealtAmountS.String()
+	o.DealtAmountB = dealtAmountB.String()
+	o.SplitAmountS = splitAmountS.String()
+	o.SplitAmountB = splitAmountB.String()
+	o.UpdatedBlock = blockNumber.Int64()
+	return nil
+}
+
+func (r *reindexRds) UpdateOrderWhileCancel(hash common.Hash, status types.OrderStatus, cancelledAmountS, cancelledAmountB, blockNumber *big.Int) error {
+	o := r.orders[hash]
+	o.Status = uint8(status)
+	o.CancelledAmountS = cancelledAmountS.String()
+	o.CancelledAmountB = cancelledAmountB.String()
+	o.UpdatedBlock = blockNumber.Int64()
+	return nil
+}
+
+func (r *reindexRds) GetOpenOrders(fromId, limit int) ([]dao.Order, error) {
+	r.openQueried++
+	return []dao.Order{}, nil
+}
+
+// reindexMc values tokens as their amounts
+type reindexMc struct {
+	marketcap.MarketCapProvider
+}
+
+func (mc *reindexMc) LegalCurrencyValue(tokenAddress common.Address, amount *big.Rat) (*big.Rat, error) {
+	return amount, nil
+}
+
+func newReindexOrder(t *testing.T, validTime int64) *dao.Order {
+	state := &types.OrderState{}
+	state.RawOrder.Protocol = common.HexToAddress("0x01")
+	state.RawOrder.TokenS = common.HexToAddress("0x02")
+	state.RawOrder.TokenB = common.HexToAddress("0x03")
+	state.RawOrder.AmountS = big.NewInt(10000)
+	state.RawOrder.AmountB = big.NewInt(10000)
+	state.RawOrder.Price = big.NewRat(1, 1)
+	state.RawOrder.Timestamp = big.NewInt(validTime)
+	state.RawOrder.Ttl = big.NewInt(100)
+	state.RawOrder.Salt = big.NewInt(1)
+	state.RawOrder.LrcFee = big.NewInt(1)
+	state.RawOrder.Hash = state.RawOrder.GenerateHash()
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.SplitAmountS = big.NewInt(0)
+	state.SplitAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	state.UpdatedBlock = big.NewInt(1)
+	state.Status = types.ORDER_NEW
+	model := &dao.Order{}
+	if err := model.ConvertDown(state); err != nil {
+		t.Fatal(err)
+	}
+	return model
+}
+
+func newReindexFill(orderhash common.Hash, ring int64) *types.OrderFilledEvent {
+	event := &types.OrderFilledEvent{}
+	event.Ringhash = common.BigToHash(big.NewInt(ring))
+	event.OrderHash = orderhash
+	event.RingIndex = big.NewInt(ring)
+	event.Time = big.NewInt(0)
+	event.Blocknumber = big.NewInt(ring)
+	event.AmountS = big.NewInt(10)
+	event.AmountB = big.NewInt(10)
+	event.LrcReward = big.NewInt(0)
+	event.LrcFee = big.NewInt(0)
+	event.SplitS = big.NewInt(0)
+	event.SplitB = big.NewInt(0)
+	event.FillIndex = big.NewInt(0)
+	return event
+}
+
+// TestReindexRecomputeWithLiveFills checks that the fills saved by live node while reindex recomputes aren't lost
+func TestReindexRecomputeWithLiveFills(t *testing.T) {
+	model := newReindexOrder(t, 100)
+	hash := common.HexToHash(model.OrderHash)
+	rds := &reindexRds{orders: map[common.Hash]*dao.Order{hash: model}}
+	mc := &reindexMc{}
+	om := &OrderManagerImpl{rds: rds, mc: mc, book: newOrderBook()}
+	reindexer := NewReindexer(rds, mc)
+	reindexer.requestReload = func() error { return nil }
+
+	// the fill reindexed
+	if err := reindexer.handleOrderFilled(newReindexFill(hash, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	const liveFills = 20
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := int64(0); i < liveFills; i++ {
+			if err := om.handleOrderFilled(newReindexFill(hash, 100+i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < liveFills; i++ {
+			reindexer.orders[hash] = true
+			if err := reindexer.Recompute(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if expected := big.NewInt(10 * (liveFills + 1)).String(); model.DealtAmountS != expected {
+		t.Fatalf("dealt amountS should be %s, but got %s", expected, model.DealtAmountS)
+	}
+	if model.UpdatedBlock != 100+liveFills-1 {
+		t.Fatalf("updated block should be %d, but got %d", 100+liveFills-1, model.UpdatedBlock)
+	}
+}
+
+func TestReloadIfReindexed(t *testing.T) {
+	rds := &reindexRds{orders: make(map[common.Hash]*dao.Order)}
+	mark := []byte{}
+	om := &OrderManagerImpl{rds: rds, book: newOrderBook()}
+	om.getReloadMark = func() []byte { return mark }
+
+	reindexer := NewReindexer(rds, &reindexMc{})
+	reindexer.requestReload = func() error {
+		mark = []byte("1")
+		return nil
+	}
+
+	om.reloadIfReindexed()
+	if rds.openQueried != 0 {
+		t.Fatalf("order book shouldn't be reloaded before reindex")
+	}
+	// nothing is recomputed
+	reindexer.Recompute()
+	om.reloadIfReindexed()
+	if rds.openQueried != 0 {
+		t.Fatalf("order book shouldn't be reloaded if no order recomputed")
+	}
+
+	reindexer.orders[common.HexToHash("0x01")] = true
+	if err := reindexer.Recompute(); err != nil {
+		t.Fatal(err)
+	}
+	om.reloadIfReindexed()
+	om.reloadIfReindexed()
+	if rds.openQueried != 1 {
+		t.Fatalf("order book should be reloaded once after reindex, but got %d", rds.openQueried)
+	}
+}
+
+func newReindexCutoff(blockNumber, cutoff int64) *types.CutoffEvent {
+	event := &types.CutoffEvent{}
+	event.ContractAddress = common.HexToAddress("0x01")
+	event.TxHash = common.BigToHash(big.NewInt(blockNumber))
+	event.Time = big.NewInt(0)
+	event.Blocknumber = big.NewInt(blockNumber)
+	event.Cutoff = big.NewInt(cutoff)
+	return event
+}
+
+// TestReindexCutoffInChunks reindexes blocks 101-300 in 2 chunks, the cutoff at block 250 cached in the
+// first chunk is rolled back in the second one, it should be saved again
+func TestReindexCutoffInChunks(t *testing.T) {
+	model := newReindexOrder(t, 1500)
+	model.Status = uint8(types.ORDER_CUTOFF)
+	hash := common.HexToHash(model.OrderHash)
+	rds := &reindexRds{orders: map[common.Hash]*dao.Order{hash: model}}
+	latest := &dao.CutOffEvent{}
+	latest.ConvertDown(newReindexCutoff(250, 2000))
+	rds.cutoffs = []dao.CutOffEvent{*latest}
+
+	reindexer := NewReindexer(rds, &reindexMc{})
+	reindexer.requestReload = func() error { return nil }
+	chunks := []struct {
+		from, to int64
+		cutoffs  []*types.CutoffEvent
+	}{
+		{100, 200, []*types.CutoffEvent{newReindexCutoff(150, 1000)}},
+		{200, 300, []*types.CutoffEvent{newReindexCutoff(250, 2000)}},
+	}
+	for _, chunk := range chunks {
+		if err := reindexer.RollBack(chunk.from, chunk.to); err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range chunk.cutoffs {
+			if err := reindexer.handleOrderCutoff(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := reindexer.Recompute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(rds.cutoffs) != 1 || rds.cutoffs[0].Cutoff != 2000 {
+		t.Fatalf("cutoff 2000 should be saved, but got %v", rds.cutoffs)
+	}
+	if types.OrderStatus(model.Status) != types.ORDER_CUTOFF {
+		t.Fatalf("order should be still cut off, but got status %d", model.Status)
+	}
+}
+
+// TestOrderBookUpdatedInCommitOrder cancels the order after the fill committed but before the fill returns,
+// the book should keep the state of the cancel which is committed later
+func TestOrderBookUpdatedInCommitOrder(t *testing.T) {
+	model := newReindexOrder(t, time.Now().Unix()-10)
+	hash := common.HexToHash(model.OrderHash)
+	rds := &reindexRds{orders: map[common.Hash]*dao.Order{hash: model}}
+	om := &OrderManagerImpl{rds: rds, mc: &reindexMc{}, book: newOrderBook()}
+
+	cancel := &types.OrderCancelledEvent{}
+	cancel.OrderHash = hash
+	cancel.Time = big.NewInt(0)
+	cancel.Blocknumber = big.NewInt(2)
+	cancel.AmountCancelled = big.NewInt(10000)
+	rds.unlocked = func() {
+		rds.unlocked = nil
+		if err := om.handleOrderCancelled(cancel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := om.handleOrderFilled(newReindexFill(hash, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the remained amount is cancelled
+	if types.OrderStatus(model.Status) != types.ORDER_FINISHED {
+		t.Fatalf("order should be finished, but got status %d", model.Status)
+	}
+	if _, ok := om.book.entries[hash]; ok {
+		t.Fatalf("finished order shouldn't be kept in order book")
+	}
+}
@@ -231,4 +231,5 @@ type ForkedEvent struct {
 type BlockEvent struct {
 	BlockNumber *big.Int
 	BlockHash   common.Hash
+	BlockTime   int64
 }
@@ -36,6 +36,8 @@ const (
 	ORDER_CANCEL   OrderStatus = 4
 	ORDER_CUTOFF   OrderStatus = 5
 	ORDER_EXPIRE   OrderStatus = 6
+	// 链下取消，只在relay内生效，订单仍然可以在链上成交
+	ORDER_SOFT_CANCEL OrderStatus = 7
 )
 
 //订单原始信息
@@ -168,6 +170,39 @@ func (o *Order) SignerAddress() (common.Address, error) {
 	}
 }
 
+// 链下取消订单的请求，owner对orderHash和timestamp签名
+type OrderSoftCancel struct {
+	OrderHash common.Hash    `json:"orderHash"`
+	Owner     common.Address `json:"owner"`
+	Timestamp int64          `json:"timestamp"`
+	V         uint8          `json:"v"`
+	R         Bytes32        `json:"r"`
+	S         Bytes32        `json:"s"`
+}
+
+func (c *OrderSoftCancel) GenerateHash() common.Hash {
+	h := &common.Hash{}
+	hashBytes := crypto.GenerateHash(
+		c.OrderHash.Bytes(),
+		common.LeftPadBytes(big.NewInt(c.Timestamp).Bytes(), 32),
+	)
+	h.SetBytes(hashBytes)
+	return *h
+}
+
+func (c *OrderSoftCancel) SignerAddress() (common.Address, error) {
+	address := &common.Address{}
+	sig, _ := crypto.VRSToSig(c.V, c.R.Bytes(), c.S.Bytes())
+
+	if addressBytes, err := crypto.SigToAddress(c.GenerateHash().Bytes(), sig); nil != err {
+		log.Errorf("type,soft cancel signer address error:%s", err.Error())
+		return *address, err
+	} else {
+		address.SetBytes(addressBytes)
+		return *address, nil
+	}
+}
+
 func (o *Order) GeneratePrice() {
 	o.Price = new(big.Rat).SetFrac(o.AmountS, o.AmountB)
 }
@@ -19,9 +19,13 @@
 package types_test
 
 import (
+	"github.com/Loopring/relay/crypto"
 	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
 	"math/big"
 	"testing"
+	"time"
 )
 
 func TestOrder_GeneratePrice(t *testing.T) {
@@ -32,3 +36,37 @@ func TestOrder_GeneratePrice(t *testing.T) {
 
 	t.Log(ord.Price.String())
 }
+
+func TestOrderSoftCancel_SignerAddress(t *testing.T) {
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+
+	key, err := ethCrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := ethCrypto.PubkeyToAddress(key.PublicKey)
+
+	cancel := &types.OrderSoftCancel{}
+	cancel.OrderHash = common.HexToHash("0x1")
+	cancel.Owner = owner
+	cancel.Timestamp = time.Now().Unix()
+
+	hash := cancel.GenerateHash()
+	sig, err := ethCrypto.Sign(ethCrypto.Keccak256(append([]byte("\x19Ethereum Signed Message:\n32"), hash.Bytes()...)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, r, s := crypto.SigToVRS(sig)
+	cancel.V, cancel.R, cancel.S = v, types.BytesToBytes32(r), types.BytesToBytes32(s)
+
+	if signer, err := cancel.SignerAddress(); err != nil {
+		t.Fatal(err)
+	} else if signer != owner {
+		t.Fatalf("signer %s should be owner %s", signer.Hex(), owner.Hex())
+	}
+
+	cancel.Timestamp++
+	if signer, _ := cancel.SignerAddress(); signer == owner {
+		t.Fatalf("signature should not match after timestamp changed")
+	}
+}
@@ -162,6 +162,62 @@ type RingSubmitInfo struct {
 	RegistryTxHash common.Hash
 	Received       *big.Rat
 	LegalCost      *big.Rat
+
+	Status     RingSubmitStatus
+	CreateTime int64
+	Err        string //reason of failure, such as the revert reason of simulation
+}
+
+// RingSubmitStatus is the lifecycle of ring submitted by miner:
+// matched -> registry sent -> registry mined -> submit sent -> mined/failed/expired,
+// it becomes replaced if the tx is replaced by another one with higher gasPrice
+type RingSubmitStatus uint8
+
+const (
+	RING_SUBMIT_UNKNOWN        RingSubmitStatus = 0
+	RING_SUBMIT_MATCHED        RingSubmitStatus = 1
+	RING_SUBMIT_REGISTRY_SENT  RingSubmitStatus = 2
+	RING_SUBMIT_REGISTRY_MINED RingSubmitStatus = 3
+	RING_SUBMIT_SENT           RingSubmitStatus = 4
+	RING_SUBMIT_MINED          RingSubmitStatus = 5
+	RING_SUBMIT_FAILED         RingSubmitStatus = 6
+	RING_SUBMIT_REPLACED       RingSubmitStatus = 7
+	RING_SUBMIT_EXPIRED        RingSubmitStatus = 8
+)
+
+func (s RingSubmitStatus) IsFinished() bool {
+	return s == RING_SUBMIT_MINED || s == RING_SUBMIT_FAILED || s == RING_SUBMIT_EXPIRED
+}
+
+type MinerTxType uint8
+
+const (
+	MINER_TX_SUBMIT_RING MinerTxType = 0 // submitRing of protocol
+	MINER_TX_REGISTRY    MinerTxType = 1 // submitRinghash or batchSubmitRinghash of ringhash registry
+)
+
+type MinerTxStatus uint8
+
+const (
+	MINER_TX_PENDING MinerTxStatus = 0
+	MINER_TX_MINED   MinerTxStatus = 1
+)
+
+// MinerTransaction is a tx sent by miner address with nonce assigned locally,
+// it is replaced with the same nonce and higher gasPrice if still pending after MaxPendingTtl blocks
+type MinerTransaction struct {
+	Miner       common.Address
+	Nonce       uint64
+	TxHash      common.Hash
+	To          common.Address
+	Gas         *big.Int
+	GasPrice    *big.Int
+	Value       *big.Int
+	Data        []byte
+	TxType      MinerTxType
+	RingHashes  []common.Hash
+	SubmitBlock *big.Int
+	Status      MinerTxStatus
 }
 
 type RingSubmitInputs struct {
@@ -9,3 +9,8 @@ govendor add +external
 # copy go-ethrenum c libs
 rm -rf $GOPATH/src/github.com/Loopring/relay/vendor/github.com/ethereum/go-ethereum/crypto/secp256k1
 cp -r $GOPATH/src/github.com/ethereum/go-ethereum/crypto/secp256k1 $GOPATH/src/github.com/Loopring/relay/vendor/github.com/ethereum/go-ethereum/crypto/
+
+# apply patches of vendored libraries, they are lost after vendor init
+for p in $GOPATH/src/github.com/Loopring/relay/patches/*.patch; do
+    git -C $GOPATH/src/github.com/Loopring/relay apply $p || exit 1
+done